@@ -0,0 +1,1113 @@
+package main
+
+import (
+  "github.com/pantaroid/test/api"
+  "gopkg.in/gin-gonic/gin.v1"
+  "net/http"
+  "bytes"
+  "encoding/json"
+  "io"
+  "io/ioutil"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+func statusText(status int) string {
+  switch status {
+    case 0:
+      return "stopped"
+    case 1:
+      return "active"
+    case 2:
+      return "synchronizing"
+    case 8:
+      return "warning"
+    case 9:
+      return "danger"
+  }
+  return "unknown"
+}
+
+// normalizePort accepts "12345" as well as ":12345".
+func normalizePort(port string) string {
+  if strings.HasPrefix(port, ":") {
+    return port
+  }
+  return ":" + port
+}
+
+func newServerResource(server *ServiceServer) api.ServerResource {
+  resource := api.ServerResource {
+    IP: server.Node.IP,
+    Port: server.Port,
+    Name: server.Name,
+    Status: server.Status,
+    StatusText: statusText(server.Status),
+    Module: server.Module,
+    History: append([]string{}, server.History...),
+    LastModifiedAt: server.LastModifiedAt,
+    Draining: server.Draining,
+    Maintenance: server.Maintenance,
+    Assignments: make([]api.AssignmentResource, 0),
+  }
+  if !server.SessionsAt.IsZero() {
+    sessions := server.Sessions
+    resource.Sessions = &sessions
+  }
+  for _, assign := range server.AssignPriorities {
+    resource.Assignments = append(resource.Assignments, newAssignmentResource(assign))
+  }
+  return resource
+}
+
+func newNodeResource(node *Node) api.NodeResource {
+  resource := api.NodeResource {
+    IP: node.IP,
+    Status: node.Status,
+    StatusText: statusText(node.Status),
+    LastModifiedAt: node.LastModifiedAt,
+    Draining: node.Draining,
+    Maintenance: node.Maintenance,
+    Servers: make([]api.ServerResource, 0),
+  }
+  for _, server := range node.ServiceServers {
+    resource.Servers = append(resource.Servers, newServerResource(server))
+  }
+  sort.Slice(resource.Servers, func(i, j int) bool {
+    return resource.Servers[i].Port < resource.Servers[j].Port
+  })
+  return resource
+}
+
+func newAssignmentResource(assign *AssignPriority) api.AssignmentResource {
+  return api.AssignmentResource {
+    Domain: assign.Domain.Key,
+    IP: assign.ServiceServer.Node.IP,
+    Port: assign.ServiceServer.Port,
+    Priority: assign.Priority,
+  }
+}
+
+func newDomainResource(domain *Domain) api.DomainResource {
+  resource := api.DomainResource {
+    Key: domain.Key,
+    Assignments: make([]api.AssignmentResource, 0),
+  }
+  for _, assign := range domain.AssignPriorities {
+    resource.Assignments = append(resource.Assignments, newAssignmentResource(assign))
+  }
+  return resource
+}
+
+func newModuleResource(file UploadedFile) api.ModuleResource {
+  return api.ModuleResource {
+    Name: file.Name,
+    Description: file.Description,
+    Size: file.Size,
+    ModifiedAt: file.ModTime,
+    Signed: file.Signed,
+    Version: file.Meta.Version,
+    Uploader: file.Meta.Uploader,
+    UploadedAt: file.Meta.UploadedAt,
+    Changelog: file.Meta.Changelog,
+    Tags: labelList(file.Meta.Tags),
+    NodeLabels: labelList(file.Meta.NodeLabels),
+    SHA256: file.Meta.SHA256,
+  }
+}
+
+// labelList answers [] instead of null.
+func labelList(labels []string) []string {
+  if nil == labels {
+    return []string{}
+  }
+  return labels
+}
+
+func newRolloutTargets(targets []*RolloutTarget) []api.RolloutTarget {
+  resources := make([]api.RolloutTarget, 0, len(targets))
+  for _, target := range targets {
+    resources = append(resources, api.RolloutTarget(*target))
+  }
+  return resources
+}
+
+func newRolloutResource(rollout *Rollout) api.RolloutResource {
+  return api.RolloutResource {
+    ID: rollout.ID,
+    Domain: rollout.Domain,
+    Module: rollout.Module,
+    BatchSize: rollout.BatchSize,
+    TimeoutSeconds: int(rollout.Timeout.Seconds()),
+    OnFailure: rollout.OnFailure,
+    Status: rollout.Status,
+    Message: rollout.Message,
+    Batch: rollout.Batch,
+    Batches: rollout.Batches(),
+    Progress: rollout.Progress(),
+    StartedAt: rollout.StartedAt,
+    Targets: newRolloutTargets(rollout.Targets),
+  }
+}
+
+func newCanaryResource(canary *Canary) api.CanaryResource {
+  return api.CanaryResource {
+    ID: canary.ID,
+    Domain: canary.Domain,
+    Module: canary.Module,
+    Weight: canary.Weight,
+    WindowSeconds: int(canary.Window.Seconds()),
+    MaxErrors: canary.MaxErrors,
+    TimeoutSeconds: int(canary.Timeout.Seconds()),
+    Status: canary.Status,
+    Message: canary.Message,
+    Errors: canary.Errors,
+    Resolutions: canary.Resolutions(),
+    RemainingSeconds: canary.Remaining(),
+    StartedAt: canary.StartedAt,
+    Targets: newRolloutTargets(canary.Targets),
+    RolloutID: canary.RolloutID,
+  }
+}
+
+func apiError(c *gin.Context, err error) {
+  status := http.StatusInternalServerError
+  response := api.ErrorResponse { Error: err.Error() }
+  if hubError, ok := err.(*HubError); ok {
+    status = hubError.Status
+    response.Fields = hubError.Fields
+  }
+  auditError(c, err)
+  c.JSON(status, response)
+}
+
+// decodeBody strictly decodes the JSON body. an empty body is accepted when optional.
+func decodeBody(c *gin.Context, v interface{}, optional bool) error {
+  decoder := json.NewDecoder(c.Request.Body)
+  decoder.DisallowUnknownFields()
+  err := decoder.Decode(v)
+  if err == io.EOF && optional {
+    return nil
+  }
+  if err != nil {
+    return &HubError { Status: http.StatusBadRequest, Message: "invalid request body: " + err.Error() }
+  }
+  return nil
+}
+
+// maxAPIBody limits the JSON bodies of the API, they are read before the state is locked.
+const maxAPIBody = 64 * 1024
+
+// bufferedWriter keeps the response of a handler running under the state lock, it is
+// written to the client once the lock is released.
+type bufferedWriter struct {
+  gin.ResponseWriter
+  status int
+  body bytes.Buffer
+}
+
+func (writer *bufferedWriter) WriteHeader(code int) {
+  if 0 < code {
+    writer.status = code
+  }
+}
+
+func (writer *bufferedWriter) WriteHeaderNow() {
+}
+
+func (writer *bufferedWriter) Write(data []byte) (int, error) {
+  return writer.body.Write(data)
+}
+
+func (writer *bufferedWriter) WriteString(s string) (int, error) {
+  return writer.body.WriteString(s)
+}
+
+func (writer *bufferedWriter) Status() int {
+  return writer.status
+}
+
+func (writer *bufferedWriter) Size() int {
+  return writer.body.Len()
+}
+
+func (writer *bufferedWriter) Written() bool {
+  return 0 < writer.body.Len()
+}
+
+// flush writes the kept response to the client.
+func (writer *bufferedWriter) flush() {
+  writer.ResponseWriter.WriteHeader(writer.status)
+  if 0 < writer.body.Len() {
+    writer.ResponseWriter.Write(writer.body.Bytes())
+  }
+}
+
+// readBody reads the request body into memory, so that decoding it does not wait on the client.
+func readBody(c *gin.Context) error {
+  body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxAPIBody))
+  if err != nil {
+    return &HubError { Status: http.StatusRequestEntityTooLarge, Message: "request body too large" }
+  }
+  c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+  return nil
+}
+
+func registerAPI(router *gin.Engine, state *StateStore) {
+  // GET handlers share the state, the others change it. the body is read before and
+  // the response written after the lock, a slow client does not hold it.
+  handle := func(fn func(*gin.Context, *HubInfo)) gin.HandlerFunc {
+    return func(c *gin.Context) {
+      writer := &bufferedWriter { ResponseWriter: c.Writer, status: http.StatusOK }
+      c.Writer = writer
+      defer func() {
+        c.Writer = writer.ResponseWriter
+        writer.flush()
+      }()
+      if "GET" == c.Request.Method {
+        state.View(func(info *HubInfo) {
+          fn(c, info)
+        })
+        return
+      }
+      if err := readBody(c); err != nil {
+        apiError(c, err)
+        return
+      }
+      state.Update(func(info *HubInfo) {
+        before := Backup(info)
+        fn(c, info)
+        // failed requests leave the state as it was, it is not written again.
+        if writer.Status() < http.StatusBadRequest {
+          auditState(c, before, Backup(info))
+        }
+      })
+    }
+  }
+  viewer := requireRole(roleViewer)
+  operator := requireRole(roleOperator)
+  admin := requireRole(roleAdmin)
+  group := router.Group("/api")
+  group.GET("/nodes", viewer, handle(apiListNodes))
+  group.GET("/nodes/:ip", viewer, handle(apiGetNode))
+  group.PATCH("/nodes/:ip", operator, handle(apiPatchNode))
+  group.POST("/nodes/:ip/stop", operator, handle(apiStopNode))
+  group.POST("/nodes/:ip/drain", operator, handle(apiDrainNode))
+  group.GET("/nodes/:ip/servers", viewer, handle(apiListServers))
+  group.POST("/nodes/:ip/servers", operator, handle(apiAddServer))
+  group.GET("/nodes/:ip/servers/:port", viewer, handle(apiGetServer))
+  group.PATCH("/nodes/:ip/servers/:port", operator, handle(apiPatchServer))
+  group.POST("/nodes/:ip/servers/:port/sync", operator, handle(apiSyncServer))
+  group.POST("/nodes/:ip/servers/:port/rollback", operator, handle(apiRollbackServer))
+  group.POST("/nodes/:ip/servers/:port/drain", operator, handle(apiDrainServer))
+  group.GET("/domains", viewer, handle(apiListDomains))
+  group.GET("/domains/:domain", viewer, handle(apiGetDomain))
+  group.PUT("/domains/:domain", admin, handle(apiPutDomain))
+  group.DELETE("/domains/:domain", admin, handle(apiDeleteDomain))
+  group.POST("/domains/:domain/rollback", operator, handle(apiRollbackDomain))
+  group.GET("/assignments", viewer, handle(apiListAssignments))
+  group.PUT("/assignments/:domain/:ip/:port", operator, handle(apiPutAssignment))
+  group.DELETE("/assignments/:domain/:ip/:port", operator, handle(apiDeleteAssignment))
+  group.GET("/modules", viewer, handle(apiListModules))
+  group.GET("/modules/:name", viewer, handle(apiGetModule))
+  group.PUT("/modules/:name", operator, func(c *gin.Context) {
+    apiPutModule(c, state)
+  })
+  group.PATCH("/modules/:name", operator, handle(apiPatchModule))
+  group.DELETE("/modules/:name", admin, handle(apiDeleteModule))
+  group.GET("/modules/:name/content", viewer, func(c *gin.Context) {
+    apiModuleContent(c, state)
+  })
+  group.POST("/modules/:name/rollback", operator, handle(apiRollbackModule))
+  group.GET("/retention", viewer, handle(apiGetRetention))
+  group.PUT("/retention", admin, handle(apiPutRetention))
+  group.GET("/retention/plan", viewer, func(c *gin.Context) {
+    apiRetentionPlan(c, state)
+  })
+  group.POST("/retention/run", admin, func(c *gin.Context) {
+    apiRunRetention(c, state)
+  })
+  group.GET("/uploads", operator, apiListUploads)
+  group.POST("/uploads", operator, apiCreateUpload)
+  group.GET("/uploads/:id", operator, apiGetUpload)
+  group.PUT("/uploads/:id", operator, apiUploadChunk)
+  group.POST("/uploads/:id/finish", operator, func(c *gin.Context) {
+    apiFinishUpload(c, state)
+  })
+  group.DELETE("/uploads/:id", operator, apiAbortUpload)
+  group.GET("/rollouts", viewer, handle(apiListRollouts))
+  group.POST("/rollouts", operator, handle(apiStartRollout))
+  group.GET("/rollouts/:id", viewer, handle(apiGetRollout))
+  group.POST("/rollouts/:id/:action", operator, handle(apiRolloutAction))
+  group.GET("/canaries", viewer, handle(apiListCanaries))
+  group.POST("/canaries", operator, handle(apiStartCanary))
+  group.GET("/canaries/:id", viewer, handle(apiGetCanary))
+  group.POST("/canaries/:id/:action", operator, handle(apiCanaryAction))
+  group.GET("/history", viewer, handle(apiListHistory))
+  // server-sent events, also used by the page.
+  group.GET("/events", viewer, func(c *gin.Context) {
+    streamEvents(c, state)
+  })
+  group.GET("/template", viewer, handle(apiGetTemplate))
+  group.POST("/template/plan", operator, func(c *gin.Context) {
+    apiPlanTemplate(c, state)
+  })
+  group.PUT("/template", admin, func(c *gin.Context) {
+    apiPutTemplate(c, state)
+  })
+  group.GET("/me", viewer, apiMe)
+  group.GET("/tokens", viewer, apiListTokens)
+  group.POST("/tokens", viewer, apiCreateToken)
+  group.DELETE("/tokens/:id", viewer, apiDeleteToken)
+  group.GET("/users", admin, apiListUsers)
+  group.PUT("/users/:name", admin, apiPutUser)
+  group.DELETE("/users/:name", admin, apiDeleteUser)
+  group.GET("/audit", admin, apiListAudit)
+  group.GET("/udp", viewer, apiUDPStats)
+  group.POST("/config/reload", admin, func(c *gin.Context) {
+    apiReloadConfig(c, state)
+  })
+  router.StaticFile("/api/openapi.json", "./resources/openapi.json")
+}
+
+// nodes
+
+func apiListNodes(c *gin.Context, info *HubInfo) {
+  nodes := make([]api.NodeResource, 0, len(info.Nodes))
+  for _, node := range info.Nodes {
+    nodes = append(nodes, newNodeResource(node))
+  }
+  sort.Slice(nodes, func(i, j int) bool {
+    return nodes[i].IP < nodes[j].IP
+  })
+  c.JSON(http.StatusOK, nodes)
+}
+
+func apiGetNode(c *gin.Context, info *HubInfo) {
+  node, err := findNode(info, c.Param("ip"))
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  c.JSON(http.StatusOK, newNodeResource(node))
+}
+
+func apiPatchNode(c *gin.Context, info *HubInfo) {
+  var patch api.NodePatch
+  if err := decodeBody(c, &patch, false); err != nil {
+    apiError(c, err)
+    return
+  }
+  node, err := findNode(info, c.Param("ip"))
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  if nil != patch.Maintenance {
+    node.Maintenance = *patch.Maintenance
+  }
+  c.JSON(http.StatusOK, newNodeResource(node))
+}
+
+func apiStopNode(c *gin.Context, info *HubInfo) {
+  if err := stopNode(info, c.Param("ip")); err != nil {
+    apiError(c, err)
+    return
+  }
+  c.JSON(http.StatusAccepted, newNodeResource(info.Nodes[c.Param("ip")]))
+}
+
+func apiDrainNode(c *gin.Context, info *HubInfo) {
+  var request api.DrainRequest
+  if err := decodeBody(c, &request, true); err != nil {
+    apiError(c, err)
+    return
+  }
+  node, err := findNode(info, c.Param("ip"))
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  drainNode(node, time.Duration(request.Seconds) * time.Second)
+  c.JSON(http.StatusAccepted, newNodeResource(node))
+}
+
+// servers
+
+func apiListServers(c *gin.Context, info *HubInfo) {
+  node, err := findNode(info, c.Param("ip"))
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  c.JSON(http.StatusOK, newNodeResource(node).Servers)
+}
+
+func apiAddServer(c *gin.Context, info *HubInfo) {
+  if err := addServer(info, c.Param("ip")); err != nil {
+    apiError(c, err)
+    return
+  }
+  c.Status(http.StatusAccepted)
+}
+
+func apiGetServer(c *gin.Context, info *HubInfo) {
+  server, err := findServer(info, c.Param("ip"), normalizePort(c.Param("port")))
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  c.JSON(http.StatusOK, newServerResource(server))
+}
+
+// apiPatchServer applies the given fields. every field is idempotent.
+func apiPatchServer(c *gin.Context, info *HubInfo) {
+  var patch api.ServerPatch
+  if err := decodeBody(c, &patch, false); err != nil {
+    apiError(c, err)
+    return
+  }
+  ip := c.Param("ip")
+  port := normalizePort(c.Param("port"))
+  server, err := findServer(info, ip, port)
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  // every field is checked before any is applied, a rejected patch changes nothing.
+  if nil != patch.State && "running" != *patch.State && "stopped" != *patch.State {
+    apiError(c, invalid("state", "state must be running or stopped"))
+    return
+  }
+  moduleChanged := nil != patch.Module && *patch.Module != server.Module
+  if moduleChanged {
+    err = checkSetModule(info, server, *patch.Module)
+  }
+  if err == nil && nil != patch.State {
+    switch {
+    case moduleChanged && "running" == *patch.State:
+      // the module is only changed on a running server.
+    case moduleChanged:
+      err = conflict("server %s cannot change its module and stop at once", server.Target())
+    case "running" == *patch.State:
+      err = checkStart(server)
+    default:
+      err = checkStop(server)
+    }
+  }
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+
+  status := http.StatusOK
+  before := server.Status
+  if nil != patch.Name {
+    server.Name = *patch.Name
+  }
+  if nil != patch.Maintenance {
+    server.Maintenance = *patch.Maintenance
+  }
+  if moduleChanged {
+    err = setModule(info, ip, port, *patch.Module)
+    status = http.StatusAccepted
+  } else if nil != patch.State && "running" == *patch.State {
+    err = startServer(info, ip, port)
+  } else if nil != patch.State {
+    err = stopServer(info, ip, port)
+  }
+  if err != nil {
+    // checked above.
+    apiError(c, err)
+    return
+  }
+  if before != server.Status {
+    status = http.StatusAccepted
+  }
+  c.JSON(status, newServerResource(server))
+}
+
+func apiSyncServer(c *gin.Context, info *HubInfo) {
+  ip := c.Param("ip")
+  port := normalizePort(c.Param("port"))
+  if err := syncServer(info, ip, port); err != nil {
+    apiError(c, err)
+    return
+  }
+  c.JSON(http.StatusAccepted, newServerResource(info.Server(ip, port)))
+}
+
+func apiRollbackServer(c *gin.Context, info *HubInfo) {
+  server, err := findServer(info, c.Param("ip"), normalizePort(c.Param("port")))
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  if !rollbackServer(info, server) {
+    apiError(c, noRollback(server))
+    return
+  }
+  c.JSON(http.StatusAccepted, newServerResource(server))
+}
+
+func apiDrainServer(c *gin.Context, info *HubInfo) {
+  var request api.DrainRequest
+  if err := decodeBody(c, &request, true); err != nil {
+    apiError(c, err)
+    return
+  }
+  server, err := findServer(info, c.Param("ip"), normalizePort(c.Param("port")))
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  drainServer(server, time.Duration(request.Seconds) * time.Second)
+  c.JSON(http.StatusAccepted, newServerResource(server))
+}
+
+// domains
+
+func apiListDomains(c *gin.Context, info *HubInfo) {
+  domains := make([]api.DomainResource, 0, len(info.Domains))
+  for _, domain := range info.Domains {
+    domains = append(domains, newDomainResource(domain))
+  }
+  sort.Slice(domains, func(i, j int) bool {
+    return domains[i].Key < domains[j].Key
+  })
+  c.JSON(http.StatusOK, domains)
+}
+
+func apiGetDomain(c *gin.Context, info *HubInfo) {
+  domain, err := findDomain(info, c.Param("domain"))
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  c.JSON(http.StatusOK, newDomainResource(domain))
+}
+
+func apiPutDomain(c *gin.Context, info *HubInfo) {
+  created, err := addDomain(info, c.Param("domain"))
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  status := http.StatusOK
+  if created {
+    status = http.StatusCreated
+  }
+  c.JSON(status, newDomainResource(info.Domains[c.Param("domain")]))
+}
+
+func apiDeleteDomain(c *gin.Context, info *HubInfo) {
+  if err := deleteDomain(info, c.Param("domain")); err != nil {
+    apiError(c, err)
+    return
+  }
+  c.Status(http.StatusNoContent)
+}
+
+func apiRollbackDomain(c *gin.Context, info *HubInfo) {
+  domain, err := findDomain(info, c.Param("domain"))
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  c.JSON(http.StatusAccepted, api.RollbackResponse { RolledBack: rollbackDomain(info, domain) })
+}
+
+// assignments
+
+func apiListAssignments(c *gin.Context, info *HubInfo) {
+  domainKey := c.Query("domain")
+  ip := c.Query("ip")
+  assignments := make([]api.AssignmentResource, 0)
+  for _, domain := range info.Domains {
+    if "" != domainKey && domainKey != domain.Key {
+      continue
+    }
+    for _, assign := range domain.AssignPriorities {
+      if "" == ip || ip == assign.ServiceServer.Node.IP {
+        assignments = append(assignments, newAssignmentResource(assign))
+      }
+    }
+  }
+  sort.Slice(assignments, func(i, j int) bool {
+    a, b := assignments[i], assignments[j]
+    if a.Domain != b.Domain {
+      return a.Domain < b.Domain
+    }
+    return a.IP + a.Port < b.IP + b.Port
+  })
+  c.JSON(http.StatusOK, assignments)
+}
+
+func apiPutAssignment(c *gin.Context, info *HubInfo) {
+  var request api.AssignmentRequest
+  if err := decodeBody(c, &request, false); err != nil {
+    apiError(c, err)
+    return
+  }
+  domainKey := c.Param("domain")
+  ip := c.Param("ip")
+  port := normalizePort(c.Param("port"))
+  created, err := assignServer(info, ip, port, domainKey, request.Priority)
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  status := http.StatusOK
+  if created {
+    status = http.StatusCreated
+  }
+  c.JSON(status, api.AssignmentResource { Domain: domainKey, IP: ip, Port: port, Priority: request.Priority })
+}
+
+func apiDeleteAssignment(c *gin.Context, info *HubInfo) {
+  if _, err := findDomain(info, c.Param("domain")); err != nil {
+    apiError(c, err)
+    return
+  }
+  if !excludeServer(info, c.Param("ip"), normalizePort(c.Param("port")), c.Param("domain")) {
+    apiError(c, notFound("assignment not found"))
+    return
+  }
+  c.Status(http.StatusNoContent)
+}
+
+// modules
+
+func findModule(info *HubInfo, name string) (UploadedFile, error) {
+  for _, file := range listModules(info) {
+    if name == file.Name {
+      return file, nil
+    }
+  }
+  return UploadedFile{}, notFound("module %s not found", name)
+}
+
+// apiListModules filters with the query parameters q, tag, label and uploader.
+func apiListModules(c *gin.Context, info *HubInfo) {
+  query := ModuleQuery {
+    Text: c.Query("q"),
+    Tag: c.Query("tag"),
+    NodeLabel: c.Query("label"),
+    Uploader: c.Query("uploader"),
+  }
+  modules := make([]api.ModuleResource, 0)
+  for _, file := range listModules(info) {
+    if query.Match(file.Name, file.Meta) {
+      modules = append(modules, newModuleResource(file))
+    }
+  }
+  c.JSON(http.StatusOK, modules)
+}
+
+func apiGetModule(c *gin.Context, info *HubInfo) {
+  file, err := findModule(info, c.Param("name"))
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  c.JSON(http.StatusOK, newModuleResource(file))
+}
+
+// apiPutModule stores the request body as the module. the signature is taken from
+// the X-Module-Signature header, the description and backup flag from the query.
+// the body is stored before the hub state is locked.
+func apiPutModule(c *gin.Context, state *StateStore) {
+  var signature []byte
+  if text := c.Request.Header.Get("X-Module-Signature"); "" != text {
+    var err error
+    signature, err = decodeSignature([]byte(text))
+    if err != nil {
+      apiError(c, invalid("signature", err.Error()))
+      return
+    }
+  }
+  name := c.Param("name")
+  description := c.Query("description")
+  version := c.Query("version")
+  changelog := c.Query("changelog")
+  edit := ModuleEdit {
+    Description: &description,
+    Version: &version,
+    Changelog: &changelog,
+    Tags: splitLabels(c.Query("tags")),
+    NodeLabels: splitLabels(c.Query("nodeLabels")),
+  }
+  created, err := storeModule(state, name, c.Request.Body, signature, edit, currentUser(c).Name, "true" == c.Query("backup"))
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  var file UploadedFile
+  state.View(func(info *HubInfo) {
+    file, err = findModule(info, name)
+  })
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  status := http.StatusOK
+  if created {
+    status = http.StatusCreated
+  }
+  c.JSON(status, newModuleResource(file))
+}
+
+func apiPatchModule(c *gin.Context, info *HubInfo) {
+  var patch api.ModulePatch
+  if err := decodeBody(c, &patch, false); err != nil {
+    apiError(c, err)
+    return
+  }
+  name := c.Param("name")
+  edit := ModuleEdit {
+    Description: patch.Description,
+    Version: patch.Version,
+    Changelog: patch.Changelog,
+    Tags: patch.Tags,
+    NodeLabels: patch.NodeLabels,
+  }
+  if err := editModule(info, name, edit); err != nil {
+    apiError(c, err)
+    return
+  }
+  file, err := findModule(info, name)
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  c.JSON(http.StatusOK, newModuleResource(file))
+}
+
+func apiDeleteModule(c *gin.Context, info *HubInfo) {
+  if err := removeModule(info, c.Param("name")); err != nil {
+    apiError(c, err)
+    return
+  }
+  c.Status(http.StatusNoContent)
+}
+
+func apiModuleContent(c *gin.Context, state *StateStore) {
+  content, object, sum, err := openModule(state, c.Param("name"))
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  defer content.Close()
+  serveObject(c, content, object, sum)
+}
+
+func apiRollbackModule(c *gin.Context, info *HubInfo) {
+  if _, err := findModule(info, c.Param("name")); err != nil {
+    apiError(c, err)
+    return
+  }
+  c.JSON(http.StatusAccepted, api.RollbackResponse { RolledBack: rollbackModule(info, c.Param("name")) })
+}
+
+// deployments
+
+func apiListRollouts(c *gin.Context, info *HubInfo) {
+  rollouts := make([]api.RolloutResource, 0, len(info.Rollouts))
+  for _, rollout := range info.Rollouts {
+    rollouts = append(rollouts, newRolloutResource(rollout))
+  }
+  c.JSON(http.StatusOK, rollouts)
+}
+
+func apiGetRollout(c *gin.Context, info *HubInfo) {
+  rollout := findRollout(info, c.Param("id"))
+  if nil == rollout {
+    apiError(c, notFound("rollout %s not found", c.Param("id")))
+    return
+  }
+  c.JSON(http.StatusOK, newRolloutResource(rollout))
+}
+
+func apiStartRollout(c *gin.Context, info *HubInfo) {
+  var request api.RolloutRequest
+  if err := decodeBody(c, &request, false); err != nil {
+    apiError(c, err)
+    return
+  }
+  if "" != request.OnFailure && "pause" != request.OnFailure && "abort" != request.OnFailure {
+    apiError(c, invalid("onFailure", "onFailure must be pause or abort"))
+    return
+  }
+  rollout, err := startRollout(info, request.Domain, request.Module, request.BatchSize, time.Duration(request.TimeoutSeconds) * time.Second, request.OnFailure)
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  c.JSON(http.StatusCreated, newRolloutResource(rollout))
+}
+
+func apiRolloutAction(c *gin.Context, info *HubInfo) {
+  rollout := findRollout(info, c.Param("id"))
+  if nil == rollout {
+    apiError(c, notFound("rollout %s not found", c.Param("id")))
+    return
+  }
+  switch c.Param("action") {
+    case "pause":
+      pauseRollout(rollout)
+    case "resume":
+      resumeRollout(rollout)
+    case "abort":
+      abortRollout(info, rollout, "aborted by operator")
+    default:
+      apiError(c, notFound("unknown action %s", c.Param("action")))
+      return
+  }
+  c.JSON(http.StatusOK, newRolloutResource(rollout))
+}
+
+func apiListCanaries(c *gin.Context, info *HubInfo) {
+  canaries := make([]api.CanaryResource, 0, len(info.Canaries))
+  for _, canary := range info.Canaries {
+    canaries = append(canaries, newCanaryResource(canary))
+  }
+  c.JSON(http.StatusOK, canaries)
+}
+
+func apiGetCanary(c *gin.Context, info *HubInfo) {
+  canary := findCanary(info, c.Param("id"))
+  if nil == canary {
+    apiError(c, notFound("canary %s not found", c.Param("id")))
+    return
+  }
+  c.JSON(http.StatusOK, newCanaryResource(canary))
+}
+
+func apiStartCanary(c *gin.Context, info *HubInfo) {
+  var request api.CanaryRequest
+  if err := decodeBody(c, &request, false); err != nil {
+    apiError(c, err)
+    return
+  }
+  servers := make([]string, 0, len(request.Servers))
+  for _, server := range request.Servers {
+    servers = append(servers, server.IP + "@" + normalizePort(server.Port))
+  }
+  canary, err := startCanary(info, request.Domain, request.Module, servers, request.Weight, time.Duration(request.WindowSeconds) * time.Second, request.MaxErrors, time.Duration(request.TimeoutSeconds) * time.Second)
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  c.JSON(http.StatusCreated, newCanaryResource(canary))
+}
+
+func apiCanaryAction(c *gin.Context, info *HubInfo) {
+  canary := findCanary(info, c.Param("id"))
+  if nil == canary {
+    apiError(c, notFound("canary %s not found", c.Param("id")))
+    return
+  }
+  switch c.Param("action") {
+    case "promote":
+      if err := promoteCanary(info, canary); err != nil {
+        apiError(c, err)
+        return
+      }
+    case "abort":
+      abortCanary(info, canary, "aborted by operator")
+    default:
+      apiError(c, notFound("unknown action %s", c.Param("action")))
+      return
+  }
+  c.JSON(http.StatusOK, newCanaryResource(canary))
+}
+
+func apiListHistory(c *gin.Context, info *HubInfo) {
+  entries := make([]api.HistoryEntry, 0)
+  for _, entry := range recentHistory(info) {
+    entries = append(entries, api.HistoryEntry(*entry))
+  }
+  c.JSON(http.StatusOK, entries)
+}
+
+// templates
+
+func templateName(c *gin.Context) string {
+  if name := c.Query("name"); "" != name {
+    return name
+  }
+  return "xht_" + time.Now().Format(dateTimeTemplateLayout) + ".txt"
+}
+
+func apiGetTemplate(c *gin.Context, info *HubInfo) {
+  c.Data(http.StatusOK, "text/plain; charset=utf-8", Backup(info))
+}
+
+// apiPlanTemplate reports what applying the request body as template would change.
+// it is a dry run: the template is parsed and compared to a snapshot, nothing is locked,
+// changed or audited.
+func apiPlanTemplate(c *gin.Context, state *StateStore) {
+  auditSkip(c)
+  newInfo, err := restoreTemplate(templateName(c), c.Request.Body)
+  if err != nil {
+    apiError(c, invalid("template", err.Error()))
+    return
+  }
+  added, removed := planTemplate(state.Snapshot(), newInfo)
+  c.JSON(http.StatusOK, api.TemplatePlan { Name: newInfo.Template, Added: added, Removed: removed })
+}
+
+func apiPutTemplate(c *gin.Context, state *StateStore) {
+  before, after, err := replaceTemplate(state, templateName(c), c.Request.Body)
+  if err != nil {
+    apiError(c, invalid("template", err.Error()))
+    return
+  }
+  auditState(c, before, after)
+  c.Status(http.StatusNoContent)
+}
+
+// users and tokens
+
+func newUserResource(user *User) api.UserResource {
+  return api.UserResource { Name: user.Name, Role: user.Role, External: user.External }
+}
+
+func newTokenResource(token *APIToken) api.TokenResource {
+  return api.TokenResource {
+    ID: token.ID,
+    Name: token.Name,
+    CreatedAt: token.CreatedAt,
+    LastUsedAt: token.LastUsedAt,
+  }
+}
+
+func apiMe(c *gin.Context) {
+  c.JSON(http.StatusOK, newUserResource(currentUser(c)))
+}
+
+func apiListTokens(c *gin.Context) {
+  user := currentUser(c)
+  accounts.Lock()
+  tokens := make([]api.TokenResource, 0, len(user.Tokens))
+  for _, token := range user.Tokens {
+    tokens = append(tokens, newTokenResource(token))
+  }
+  accounts.Unlock()
+  c.JSON(http.StatusOK, tokens)
+}
+
+// apiCreateToken returns the token of the current user. it is not shown again.
+func apiCreateToken(c *gin.Context) {
+  var request api.TokenRequest
+  if err := decodeBody(c, &request, true); err != nil {
+    apiError(c, err)
+    return
+  }
+  token, secret, err := createToken(currentUser(c), request.Name)
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  c.JSON(http.StatusCreated, api.CreatedToken { TokenResource: newTokenResource(token), Token: secret })
+}
+
+func apiDeleteToken(c *gin.Context) {
+  if err := deleteToken(currentUser(c), c.Param("id")); err != nil {
+    apiError(c, err)
+    return
+  }
+  c.Status(http.StatusNoContent)
+}
+
+func apiListUsers(c *gin.Context) {
+  accounts.Lock()
+  users := make([]api.UserResource, 0, len(accounts.Users))
+  for _, user := range accounts.Users {
+    users = append(users, newUserResource(user))
+  }
+  accounts.Unlock()
+  sort.Slice(users, func(i, j int) bool {
+    return users[i].Name < users[j].Name
+  })
+  c.JSON(http.StatusOK, users)
+}
+
+// apiPutUser creates the user or changes role and password.
+func apiPutUser(c *gin.Context) {
+  var request api.UserRequest
+  if err := decodeBody(c, &request, false); err != nil {
+    apiError(c, err)
+    return
+  }
+  created, err := addUser(c.Param("name"), request.Role, request.Password)
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  status := http.StatusOK
+  if created {
+    status = http.StatusCreated
+  }
+  c.JSON(status, api.UserResource { Name: c.Param("name"), Role: request.Role })
+}
+
+func apiDeleteUser(c *gin.Context) {
+  if err := deleteUser(c.Param("name")); err != nil {
+    apiError(c, err)
+    return
+  }
+  c.Status(http.StatusNoContent)
+}
+
+// audit
+
+// apiListAudit returns the audit log, newest first. with format=csv or format=json
+// it is sent as a download.
+func apiListAudit(c *gin.Context) {
+  filter := AuditFilter {
+    User: c.Query("user"),
+    Action: c.Query("action"),
+    FailedOnly: "true" == c.Query("failed"),
+    Limit: 100,
+  }
+  if text := c.Query("since"); "" != text {
+    since, err := time.Parse(time.RFC3339, text)
+    if err != nil {
+      apiError(c, invalid("since", "since must be an RFC 3339 time"))
+      return
+    }
+    filter.Since = since
+  }
+  if text := c.Query("limit"); "" != text {
+    limit, err := strconv.Atoi(text)
+    if err != nil || limit < 0 {
+      apiError(c, invalid("limit", "limit must be a non-negative number"))
+      return
+    }
+    filter.Limit = limit
+  }
+  entries, err := readAudit(filter)
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  fileName := "xhub_audit_" + time.Now().Format(dateTimeTemplateLayout)
+  switch c.Query("format") {
+    case "csv":
+      c.Header("Content-Disposition", "attachment; filename=" + fileName + ".csv")
+      c.Header("Content-Type", "text/csv; charset=utf-8")
+      c.Status(http.StatusOK)
+      writeAuditCSV(c, entries)
+      return
+    case "json":
+      c.Header("Content-Disposition", "attachment; filename=" + fileName + ".json")
+  }
+  resources := make([]api.AuditEntry, 0, len(entries))
+  for _, entry := range entries {
+    resources = append(resources, api.AuditEntry(*entry))
+  }
+  c.JSON(http.StatusOK, resources)
+}
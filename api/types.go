@@ -0,0 +1,338 @@
+// Package api holds the request and response types of the hub JSON API.
+// they are shared by the hub handlers and the client package.
+package api
+
+import (
+  "encoding/json"
+  "time"
+)
+
+type NodeResource struct {
+  IP string `json:"ip"`
+  Status int `json:"status"`
+  StatusText string `json:"statusText"`
+  LastModifiedAt time.Time `json:"lastModifiedAt"`
+  Draining bool `json:"draining"`
+  Maintenance bool `json:"maintenance"`
+  Servers []ServerResource `json:"servers"`
+}
+
+type ServerResource struct {
+  IP string `json:"ip"`
+  Port string `json:"port"`
+  Name string `json:"name"`
+  Status int `json:"status"`
+  StatusText string `json:"statusText"`
+  Module string `json:"module"`
+  History []string `json:"history"`
+  LastModifiedAt time.Time `json:"lastModifiedAt"`
+  Sessions *int `json:"sessions,omitempty"`
+  Draining bool `json:"draining"`
+  Maintenance bool `json:"maintenance"`
+  Assignments []AssignmentResource `json:"assignments"`
+}
+
+type DomainResource struct {
+  Key string `json:"key"`
+  Assignments []AssignmentResource `json:"assignments"`
+}
+
+type AssignmentResource struct {
+  Domain string `json:"domain"`
+  IP string `json:"ip"`
+  Port string `json:"port"`
+  Priority int `json:"priority"`
+}
+
+type ModuleResource struct {
+  Name string `json:"name"`
+  Description string `json:"description"`
+  Size int64 `json:"size"`
+  ModifiedAt time.Time `json:"modifiedAt"`
+  Signed bool `json:"signed"`
+  Version string `json:"version"`
+  Uploader string `json:"uploader"`
+  // zero for modules stored before metadata was recorded.
+  UploadedAt time.Time `json:"uploadedAt"`
+  Changelog string `json:"changelog"`
+  Tags []string `json:"tags"`
+  // labels of the nodes the module is meant for.
+  NodeLabels []string `json:"nodeLabels"`
+  // hex encoded, empty when not recorded.
+  SHA256 string `json:"sha256,omitempty"`
+}
+
+// ModulePatch changes the metadata of a module. omitted fields are kept,
+// an empty list clears the tags or labels.
+type ModulePatch struct {
+  Description *string `json:"description,omitempty"`
+  Version *string `json:"version,omitempty"`
+  Changelog *string `json:"changelog,omitempty"`
+  Tags []string `json:"tags"`
+  NodeLabels []string `json:"nodeLabels"`
+}
+
+// UploadRequest starts a resumable upload. chunks are sent with PUT /uploads/{id}?offset=N
+// and the upload is finished with the sha256 of the whole module.
+type UploadRequest struct {
+  Name string `json:"name"`
+  Size int64 `json:"size"`
+  Description string `json:"description,omitempty"`
+  Version string `json:"version,omitempty"`
+  Changelog string `json:"changelog,omitempty"`
+  Tags []string `json:"tags,omitempty"`
+  NodeLabels []string `json:"nodeLabels,omitempty"`
+  // keep the replaced module under a timestamp-prefixed name.
+  Backup bool `json:"backup,omitempty"`
+  // base64 or hex encoded ed25519 signature, required when the hub has trusted keys.
+  Signature string `json:"signature,omitempty"`
+}
+
+type UploadResource struct {
+  ID string `json:"id"`
+  Name string `json:"name"`
+  Size int64 `json:"size"`
+  // bytes received so far, the offset of the next chunk.
+  Offset int64 `json:"offset"`
+  User string `json:"user"`
+  CreatedAt time.Time `json:"createdAt"`
+  // the upload is removed when no chunk arrives until then.
+  ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type FinishUploadRequest struct {
+  // hex encoded sha256 of the whole module.
+  SHA256 string `json:"sha256"`
+}
+
+// RetentionPolicy removes old backups of modules. zero values disable a rule.
+type RetentionPolicy struct {
+  // versions kept per module, the current one included.
+  KeepVersions int `json:"keepVersions"`
+  MaxAgeDays int `json:"maxAgeDays"`
+  // hours between scheduled runs, 0 runs only on request.
+  IntervalHours int `json:"intervalHours"`
+  // set by the hub.
+  LastRunAt time.Time `json:"lastRunAt"`
+  // zero without interval.
+  NextRunAt time.Time `json:"nextRunAt"`
+}
+
+type RetentionItem struct {
+  Name string `json:"name"`
+  Module string `json:"module"`
+  // the rule that removes the backup, or the reference that keeps it.
+  Reason string `json:"reason"`
+  Error string `json:"error,omitempty"`
+}
+
+// RetentionPlan lists the backups a run removes, and those the rules would remove
+// but that are still referenced.
+type RetentionPlan struct {
+  Delete []RetentionItem `json:"delete"`
+  Keep []RetentionItem `json:"keep"`
+}
+
+type ErrorResponse struct {
+  Error string `json:"error"`
+  Fields map[string]string `json:"fields,omitempty"`
+}
+
+type NodePatch struct {
+  Maintenance *bool `json:"maintenance"`
+}
+
+type ServerPatch struct {
+  Name *string `json:"name"`
+  Module *string `json:"module"`
+  // running or stopped
+  State *string `json:"state"`
+  Maintenance *bool `json:"maintenance"`
+}
+
+type DrainRequest struct {
+  Seconds int `json:"seconds"`
+}
+
+type AssignmentRequest struct {
+  Priority int `json:"priority"`
+}
+
+type RolloutRequest struct {
+  Domain string `json:"domain"`
+  Module string `json:"module"`
+  BatchSize int `json:"batchSize"`
+  TimeoutSeconds int `json:"timeoutSeconds"`
+  OnFailure string `json:"onFailure"`
+}
+
+type CanaryRequest struct {
+  Domain string `json:"domain"`
+  Module string `json:"module"`
+  Servers []AssignmentResource `json:"servers"`
+  Weight int `json:"weight"`
+  WindowSeconds int `json:"windowSeconds"`
+  MaxErrors int `json:"maxErrors"`
+  // for the canary servers to become active and for the batches of the promotion.
+  TimeoutSeconds int `json:"timeoutSeconds"`
+}
+
+type RolloutTarget struct {
+  IP string `json:"ip"`
+  Port string `json:"port"`
+  Previous string `json:"previous"`
+  Batch int `json:"batch"`
+  // pending, updating, done, failed or reverted
+  State string `json:"state"`
+}
+
+type RolloutResource struct {
+  ID string `json:"id"`
+  Domain string `json:"domain"`
+  Module string `json:"module"`
+  BatchSize int `json:"batchSize"`
+  TimeoutSeconds int `json:"timeoutSeconds"`
+  OnFailure string `json:"onFailure"`
+  // running, paused, completed or aborted
+  Status string `json:"status"`
+  Message string `json:"message"`
+  // zero-based index of the current batch.
+  Batch int `json:"batch"`
+  Batches int `json:"batches"`
+  Progress int `json:"progress"`
+  StartedAt time.Time `json:"startedAt"`
+  Targets []RolloutTarget `json:"targets"`
+}
+
+type CanaryResource struct {
+  ID string `json:"id"`
+  Domain string `json:"domain"`
+  Module string `json:"module"`
+  Weight int `json:"weight"`
+  WindowSeconds int `json:"windowSeconds"`
+  MaxErrors int `json:"maxErrors"`
+  TimeoutSeconds int `json:"timeoutSeconds"`
+  // deploying, observing, promoted or aborted
+  Status string `json:"status"`
+  Message string `json:"message"`
+  Errors int `json:"errors"`
+  Resolutions int `json:"resolutions"`
+  RemainingSeconds int `json:"remainingSeconds"`
+  StartedAt time.Time `json:"startedAt"`
+  Targets []RolloutTarget `json:"targets"`
+  RolloutID string `json:"rolloutId,omitempty"`
+}
+
+type HistoryEntry struct {
+  Time time.Time `json:"time"`
+  Action string `json:"action"`
+  Target string `json:"target"`
+  Module string `json:"module"`
+  Previous string `json:"previous"`
+}
+
+type RollbackResponse struct {
+  RolledBack int `json:"rolledBack"`
+}
+
+// TemplatePlan lists the template records a template would add and remove.
+type TemplatePlan struct {
+  Name string `json:"name"`
+  Added []string `json:"added"`
+  Removed []string `json:"removed"`
+}
+
+
+type UserResource struct {
+  Name string `json:"name"`
+  // viewer, operator or admin
+  Role string `json:"role"`
+  // signed in through OIDC.
+  External bool `json:"external,omitempty"`
+}
+
+type UserRequest struct {
+  Role string `json:"role"`
+  // required for new users. empty keeps the password of existing ones.
+  Password string `json:"password,omitempty"`
+}
+
+type TokenResource struct {
+  ID string `json:"id"`
+  Name string `json:"name"`
+  CreatedAt time.Time `json:"createdAt"`
+  LastUsedAt time.Time `json:"lastUsedAt"`
+}
+
+type TokenRequest struct {
+  Name string `json:"name"`
+}
+
+// CreatedToken carries the bearer token. it is returned only on creation.
+type CreatedToken struct {
+  TokenResource
+  Token string `json:"token"`
+}
+
+type AuditEntry struct {
+  Time time.Time `json:"time"`
+  User string `json:"user"`
+  Role string `json:"role,omitempty"`
+  IP string `json:"ip"`
+  // ui, api or signal
+  Source string `json:"source"`
+  Action string `json:"action"`
+  Params map[string]string `json:"params,omitempty"`
+  Status int `json:"status"`
+  // ok or the error message
+  Result string `json:"result"`
+  // configuration records removed and added by the action.
+  Before []string `json:"before,omitempty"`
+  After []string `json:"after,omitempty"`
+}
+
+// Event is one event of GET /events. Data holds a NodeResource, DomainResource,
+// RolloutResource or CanaryResource as named by Type, or a RemovedEvent.
+// the stream starts with every resource followed by a ready event.
+type Event struct {
+  Type string `json:"type"`
+  Data json.RawMessage `json:"data"`
+}
+
+type RemovedEvent struct {
+  Type string `json:"type"`
+  Key string `json:"key"`
+}
+
+// UDPQueue is a queue of the UDP pipeline, resolutions or messages.
+type UDPQueue struct {
+  Name string `json:"name"`
+  Depth int `json:"depth"`
+  Capacity int `json:"capacity"`
+  Handled uint64 `json:"handled"`
+  // messages not queued because the queue was full.
+  Dropped uint64 `json:"dropped"`
+}
+
+// UDPStats tells how the hub keeps up with the messages of the nodes.
+type UDPStats struct {
+  Workers int `json:"workers"`
+  Received uint64 `json:"received"`
+  Queues []UDPQueue `json:"queues"`
+}
+
+// ConfigChange is a setting changed by a reload, named by its path in the config file.
+// reloaded files of users, OIDC, trusted keys and the retention policy come without values.
+type ConfigChange struct {
+  Setting string `json:"setting"`
+  From string `json:"from,omitempty"`
+  To string `json:"to,omitempty"`
+}
+
+// ReloadResult tells what a reload changed. Restart lists the changes of listen
+// addresses, TLS and paths, which apply after a restart: a reload does not bind the
+// HTTP and UDP listeners again and keeps serving the certificate it started with.
+type ReloadResult struct {
+  Changes []ConfigChange `json:"changes"`
+  Restart []ConfigChange `json:"restart"`
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+  "gopkg.in/gin-gonic/gin.v1"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "strings"
+  "testing"
+)
+
+// newTestServer returns a hub with the running server 127.0.0.1:9000 on a.zip and the
+// modules a.zip and b.zip.
+func newTestServer(t *testing.T) (*HubInfo, *ServiceServer) {
+  useHistoryFile(t)
+  store, _ := newTestStore(t)
+  previous := modules
+  modules = store
+  t.Cleanup(func() {
+    modules = previous
+  })
+  for _, name := range []string { "a.zip", "b.zip" } {
+    temp, _, _, err := store.Stage(strings.NewReader(name))
+    if err == nil {
+      err = store.Commit(temp, name)
+    }
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+  node := &Node { IP: "127.0.0.1", Status: 1, ServiceServers: map[string]*ServiceServer{} }
+  server := &ServiceServer { Port: ":9000", Status: 1, Module: "a.zip", Name: "web", Node: node }
+  node.ServiceServers[server.Port] = server
+  info := &HubInfo {
+    Nodes: map[string]*Node { node.IP: node },
+    Domains: map[string]*Domain{},
+    Metadata: map[string]*ModuleMeta{},
+    History: make([]*HistoryEntry, 0),
+  }
+  return info, server
+}
+
+func patchServer(info *HubInfo, body string) int {
+  gin.SetMode(gin.TestMode)
+  router := gin.New()
+  router.PATCH("/api/nodes/:ip/servers/:port", func(c *gin.Context) {
+    apiPatchServer(c, info)
+  })
+  recorder := httptest.NewRecorder()
+  req, _ := http.NewRequest("PATCH", "/api/nodes/127.0.0.1/servers/9000", strings.NewReader(body))
+  router.ServeHTTP(recorder, req)
+  return recorder.Code
+}
+
+func TestPatchServerRejectsAll(t *testing.T) {
+  tests := []struct {
+    body string
+    status int
+  }{
+    { `{"name":"api","state":"paused"}`, http.StatusUnprocessableEntity },
+    { `{"name":"api","maintenance":true,"module":"missing.zip"}`, http.StatusUnprocessableEntity },
+    { `{"name":"api","module":"b.zip","state":"stopped"}`, http.StatusConflict },
+  }
+  for _, test := range tests {
+    info, server := newTestServer(t)
+    if status := patchServer(info, test.body); test.status != status {
+      t.Errorf("%s: status %d, want %d", test.body, status, test.status)
+    }
+    if "web" != server.Name || server.Maintenance || "a.zip" != server.Module || 1 != server.Status {
+      t.Errorf("%s: server changed to %+v", test.body, server)
+    }
+  }
+
+  // synchronizing servers are neither started nor renamed.
+  info, server := newTestServer(t)
+  server.Status = 2
+  if status := patchServer(info, `{"name":"api","state":"running"}`); http.StatusConflict != status || "web" != server.Name {
+    t.Errorf("status %d, name %s", status, server.Name)
+  }
+}
+
+func TestPatchServerAppliesAll(t *testing.T) {
+  info, server := newTestServer(t)
+  if status := patchServer(info, `{"name":"api","maintenance":true,"module":"b.zip","state":"running"}`); http.StatusAccepted != status {
+    t.Fatalf("status %d", status)
+  }
+  if "api" != server.Name || !server.Maintenance || "b.zip" != server.Module || 2 != server.Status {
+    t.Errorf("server %+v", server)
+  }
+
+  info, server = newTestServer(t)
+  if status := patchServer(info, `{"name":"api","state":"stopped"}`); http.StatusAccepted != status {
+    t.Fatalf("status %d", status)
+  }
+  if "api" != server.Name || 2 != server.Status {
+    t.Errorf("server %+v", server)
+  }
+}
+
+// lockedRecorder notes whether the state was locked while the response was written.
+type lockedRecorder struct {
+  *httptest.ResponseRecorder
+  state *StateStore
+  locked bool
+}
+
+func (recorder *lockedRecorder) Write(data []byte) (int, error) {
+  if recorder.state.lock.TryLock() {
+    recorder.state.lock.Unlock()
+  } else {
+    recorder.locked = true
+  }
+  return recorder.ResponseRecorder.Write(data)
+}
+
+func TestHandleOutsideLock(t *testing.T) {
+  info, server := newTestServer(t)
+  state := newStateStore(info, newPersister(os.DevNull))
+  gin.SetMode(gin.TestMode)
+  router := gin.New()
+  router.Use(func(c *gin.Context) {
+    c.Set("user", &User { Name: "alice", Role: roleAdmin })
+  })
+  registerAPI(router, state)
+  tests := []struct {
+    method string
+    body string
+    status int
+  }{
+    { "GET", "", http.StatusOK },
+    { "PATCH", `{"name":"api"}`, http.StatusOK },
+    { "PATCH", `{"name":"` + strings.Repeat("x", maxAPIBody) + `"}`, http.StatusRequestEntityTooLarge },
+  }
+  for _, test := range tests {
+    req, _ := http.NewRequest(test.method, "/api/nodes/127.0.0.1/servers/9000", strings.NewReader(test.body))
+    recorder := &lockedRecorder { ResponseRecorder: httptest.NewRecorder(), state: state }
+    router.ServeHTTP(recorder, req)
+    if test.status != recorder.Code {
+      t.Errorf("%s: status %d, want %d", test.method, recorder.Code, test.status)
+    }
+    if recorder.locked || 0 == recorder.Body.Len() {
+      t.Errorf("%s: written with the state locked or empty", test.method)
+    }
+  }
+  if "api" != server.Name {
+    t.Errorf("name %s", server.Name)
+  }
+}
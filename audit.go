@@ -0,0 +1,401 @@
+package main
+
+import (
+  "gopkg.in/gin-gonic/gin.v1"
+  "bytes"
+  "encoding/csv"
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  // entries shown on the audit tab.
+  auditPageSize = 200
+  // request bodies larger than this are not recorded.
+  maxAuditBody = 64 * 1024
+  // rotated logs kept next to the current one, as .1 (newest) and up.
+  auditBackups = 3
+  // the log is read backwards in blocks of this size.
+  auditBlockSize = 64 * 1024
+)
+
+// the log is rotated before it grows larger than this.
+var maxAuditSize int64 = 64 * 1024 * 1024
+
+// AuditEntry is one line of the audit log.
+type AuditEntry struct {
+  Time time.Time `json:"time"`
+  User string `json:"user"`
+  Role string `json:"role,omitempty"`
+  IP string `json:"ip"`
+  // ui, api or signal
+  Source string `json:"source"`
+  Action string `json:"action"`
+  Params map[string]string `json:"params,omitempty"`
+  Status int `json:"status"`
+  // ok or the error message
+  Result string `json:"result"`
+  // configuration records removed and added by the action.
+  Before []string `json:"before,omitempty"`
+  After []string `json:"after,omitempty"`
+}
+
+func (entry AuditEntry) TimeText() string {
+  return entry.Time.Format(dateTimeLayout)
+}
+
+// ParamsText joins the parameters for display.
+func (entry AuditEntry) ParamsText() string {
+  keys := make([]string, 0, len(entry.Params))
+  for key := range entry.Params {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  parts := make([]string, 0, len(keys))
+  for _, key := range keys {
+    parts = append(parts, key + "=" + entry.Params[key])
+  }
+  return strings.Join(parts, " ")
+}
+
+func (entry AuditEntry) Failed() bool {
+  return "ok" != entry.Result
+}
+
+// parameters that are never written to the log.
+var auditRedacted = map[string]bool {
+  "password": true,
+  "clientSecret": true,
+  "token": true,
+  csrfField: true,
+}
+
+var auditMutex sync.Mutex
+
+// auditFile returns the path of the current log for 0, and of the rotated ones after.
+func auditFile(path string, index int) string {
+  if 0 == index {
+    return path
+  }
+  return path + "." + strconv.Itoa(index)
+}
+
+// rotateAudit moves the logs one up, the oldest is removed.
+func rotateAudit(path string) error {
+  os.Remove(auditFile(path, auditBackups))
+  for i := auditBackups - 1; 0 <= i; i-- {
+    if err := os.Rename(auditFile(path, i), auditFile(path, i + 1)); err != nil && !os.IsNotExist(err) {
+      return err
+    }
+  }
+  return nil
+}
+
+func appendAudit(entry *AuditEntry) {
+  blob, err := json.Marshal(entry)
+  if err != nil {
+    fmt.Printf("Error: %s\n", err)
+    return
+  }
+  blob = append(blob, '\n')
+  auditMutex.Lock()
+  defer auditMutex.Unlock()
+  path := currentConfig().Paths.Audit
+  if stat, err := os.Stat(path); err == nil && 0 < stat.Size() && maxAuditSize < stat.Size() + int64(len(blob)) {
+    if err = rotateAudit(path); err != nil {
+      fmt.Printf("Error: %s\n", err)
+    }
+  }
+  file, err := os.OpenFile(path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600)
+  if err != nil {
+    fmt.Printf("Error: %s\n", err)
+    return
+  }
+  defer file.Close()
+  file.Write(blob)
+}
+
+// AuditFilter selects entries. empty fields match everything.
+type AuditFilter struct {
+  User string
+  // substring of the action.
+  Action string
+  Since time.Time
+  FailedOnly bool
+  // 0 for all.
+  Limit int
+}
+
+func (filter *AuditFilter) Match(entry *AuditEntry) bool {
+  return ("" == filter.User || filter.User == entry.User) &&
+    ("" == filter.Action || strings.Contains(entry.Action, filter.Action)) &&
+    (filter.Since.IsZero() || !entry.Time.Before(filter.Since)) &&
+    (!filter.FailedOnly || entry.Failed())
+}
+
+// readAudit returns the matching entries, newest first. the logs are read from their
+// end and only as far as the limit and since need, the rotated ones after the current.
+func readAudit(filter AuditFilter) ([]*AuditEntry, error) {
+  auditMutex.Lock()
+  defer auditMutex.Unlock()
+  entries := make([]*AuditEntry, 0)
+  path := currentConfig().Paths.Audit
+  for i := 0; i <= auditBackups; i++ {
+    file, err := os.Open(auditFile(path, i))
+    if os.IsNotExist(err) {
+      continue
+    } else if err != nil {
+      return nil, err
+    }
+    done := false
+    err = readLinesBackward(file, func(line []byte) bool {
+      var entry AuditEntry
+      if json.Unmarshal(line, &entry) != nil {
+        return true
+      }
+      if !filter.Since.IsZero() && entry.Time.Before(filter.Since) {
+        // every entry before it is older.
+        done = true
+        return false
+      }
+      if filter.Match(&entry) {
+        entries = append(entries, &entry)
+      }
+      done = 0 < filter.Limit && filter.Limit <= len(entries)
+      return !done
+    })
+    file.Close()
+    if err != nil || done {
+      return entries, err
+    }
+  }
+  return entries, nil
+}
+
+// readLinesBackward calls fn with the lines of the file, the last first, until it
+// returns false.
+func readLinesBackward(file *os.File, fn func([]byte) bool) error {
+  stat, err := file.Stat()
+  if err != nil {
+    return err
+  }
+  // the start of a line whose end was read already.
+  var rest []byte
+  for offset := stat.Size(); 0 < offset; {
+    size := int64(auditBlockSize)
+    if offset < size {
+      size = offset
+    }
+    offset -= size
+    block := make([]byte, size, size + int64(len(rest)))
+    if _, err = file.ReadAt(block, offset); err != nil {
+      return err
+    }
+    block = append(block, rest...)
+    for {
+      i := bytes.LastIndexByte(block, '\n')
+      if i < 0 {
+        break
+      }
+      if line := block[i + 1:]; 0 < len(line) && !fn(line) {
+        return nil
+      }
+      block = block[:i]
+    }
+    rest = block
+  }
+  if 0 < len(rest) {
+    fn(rest)
+  }
+  return nil
+}
+
+// auditState keeps the configuration before and after the action for the audit entry.
+func auditState(c *gin.Context, before []byte, after []byte) {
+  c.Set("auditBefore", before)
+  c.Set("auditAfter", after)
+}
+
+// auditAction names the action of the request when the default does not fit.
+func auditAction(c *gin.Context, action string) {
+  c.Set("auditAction", action)
+}
+
+// auditSkip leaves the request out of the audit log, such as the chunks of an upload,
+// whose creation and end are recorded.
+func auditSkip(c *gin.Context) {
+  c.Set("auditSkip", true)
+}
+
+// auditError records the failure of the action.
+func auditError(c *gin.Context, err error) {
+  c.Set("auditError", err.Error())
+}
+
+// requestParams collects query, form and JSON body parameters without consuming the body.
+func requestParams(c *gin.Context) map[string]string {
+  params := map[string]string{}
+  for key, values := range c.Request.URL.Query() {
+    params[key] = strings.Join(values, ",")
+  }
+  contentType := c.Request.Header.Get("Content-Type")
+  switch {
+    case strings.HasPrefix(contentType, "multipart/form-data"):
+      if c.Request.ParseMultipartForm(32 << 20) == nil {
+        for key, values := range c.Request.MultipartForm.Value {
+          params[key] = strings.Join(values, ",")
+        }
+        for key, headers := range c.Request.MultipartForm.File {
+          for _, header := range headers {
+            params[key] = header.Filename
+            if file, err := header.Open(); err == nil {
+              if size, err := file.Seek(0, 2); err == nil {
+                params[key + ".size"] = strconv.FormatInt(size, 10)
+              }
+              file.Close()
+            }
+          }
+        }
+      }
+    case 0 < c.Request.ContentLength && c.Request.ContentLength <= maxAuditBody && !strings.HasPrefix(contentType, "application/octet-stream"):
+      // the UI posts JSON as form data, so the body is tried as JSON first.
+      blob, err := ioutil.ReadAll(c.Request.Body)
+      c.Request.Body = ioutil.NopCloser(bytes.NewReader(blob))
+      if err != nil {
+        break
+      }
+      var body map[string]interface{}
+      if json.Unmarshal(blob, &body) == nil {
+        for key, value := range body {
+          if text, ok := value.(string); ok {
+            params[key] = text
+          } else {
+            encoded, _ := json.Marshal(value)
+            params[key] = string(encoded)
+          }
+        }
+      } else if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+        if values, err := url.ParseQuery(string(blob)); err == nil {
+          for key, value := range values {
+            params[key] = strings.Join(value, ",")
+          }
+        }
+      } else if strings.HasPrefix(contentType, "text/") {
+        params["body"] = string(blob)
+      }
+    case 0 < c.Request.ContentLength:
+      params["body.size"] = strconv.FormatInt(c.Request.ContentLength, 10)
+  }
+  for key := range params {
+    if auditRedacted[key] {
+      params[key] = "***"
+    }
+  }
+  return params
+}
+
+// auditRequest records every changing request (anything but GET and HEAD) in the audit log,
+// unless the handler skips it.
+// "key" names the action of UI requests, as /execute uses it.
+func auditRequest(c *gin.Context) {
+  if "GET" == c.Request.Method || "HEAD" == c.Request.Method {
+    c.Next()
+    return
+  }
+  params := requestParams(c)
+  c.Next()
+  if _, has := c.Get("auditSkip"); has {
+    return
+  }
+
+  entry := &AuditEntry {
+    Time: time.Now(),
+    IP: c.ClientIP(),
+    Source: "ui",
+    Action: c.Request.Method + " " + c.Request.URL.Path,
+    Params: params,
+    Status: c.Writer.Status(),
+    Result: "ok",
+  }
+  if isAPIRequest(c) {
+    entry.Source = "api"
+  } else if key, has := params["key"]; has {
+    entry.Action = key
+    delete(params, "key")
+  }
+  if value, has := c.Get("auditAction"); has {
+    entry.Action = value.(string)
+  }
+  if user := currentUser(c); nil != user {
+    entry.User = user.Name
+    entry.Role = user.Role
+  } else if name, has := params["user"]; has {
+    // failed sign-in
+    entry.User = name
+  }
+  if value, has := c.Get("auditError"); has {
+    entry.Result = value.(string)
+  } else if 400 <= entry.Status {
+    entry.Result = http.StatusText(entry.Status)
+  }
+  before, hasBefore := c.Get("auditBefore")
+  after, hasAfter := c.Get("auditAfter")
+  if hasBefore && hasAfter {
+    added, removed := diffLines(before.([]byte), after.([]byte))
+    if 0 < len(added) {
+      entry.After = added
+    }
+    if 0 < len(removed) {
+      entry.Before = removed
+    }
+  }
+  appendAudit(entry)
+}
+
+// recordAudit records an action that arrives as GET request, such as the OIDC sign-in.
+func recordAudit(c *gin.Context, action string, result string) {
+  entry := &AuditEntry {
+    Time: time.Now(),
+    IP: c.ClientIP(),
+    Source: "ui",
+    Action: action,
+    Status: http.StatusFound,
+    Result: result,
+  }
+  if user := currentUser(c); nil != user {
+    entry.User = user.Name
+    entry.Role = user.Role
+  }
+  appendAudit(entry)
+}
+
+// writeAuditCSV writes the entries with one column per field.
+func writeAuditCSV(c *gin.Context, entries []*AuditEntry) {
+  writer := csv.NewWriter(c.Writer)
+  writer.Write([]string { "time", "user", "role", "ip", "source", "action", "params", "status", "result", "before", "after" })
+  for _, entry := range entries {
+    writer.Write([]string {
+      entry.Time.Format(time.RFC3339),
+      entry.User,
+      entry.Role,
+      entry.IP,
+      entry.Source,
+      entry.Action,
+      entry.ParamsText(),
+      strconv.Itoa(entry.Status),
+      entry.Result,
+      strings.Join(entry.Before, "\n"),
+      strings.Join(entry.After, "\n"),
+    })
+  }
+  writer.Flush()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "testing"
+  "time"
+)
+
+// useAuditFile points the config to an audit log in a temporary directory, rotated at size.
+func useAuditFile(t *testing.T, size int64) string {
+  path := filepath.Join(t.TempDir(), "audit.log")
+  reloadable.Lock()
+  previous := hubConfig
+  config := *hubConfig
+  config.Paths.Audit = path
+  hubConfig = &config
+  reloadable.Unlock()
+  previousSize := maxAuditSize
+  maxAuditSize = size
+  t.Cleanup(func() {
+    reloadable.Lock()
+    hubConfig = previous
+    reloadable.Unlock()
+    maxAuditSize = previousSize
+  })
+  return path
+}
+
+func TestAuditRotateAndRead(t *testing.T) {
+  path := useAuditFile(t, 100 * 1024)
+  start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+  for i := 0; i < 1000; i++ {
+    user := "alice"
+    if 0 == i % 2 {
+      user = "bob"
+    }
+    appendAudit(&AuditEntry {
+      Time: start.Add(time.Duration(i) * time.Minute),
+      User: user,
+      Action: "action" + strconv.Itoa(i),
+      // entries span the blocks read backwards.
+      Params: map[string]string { "note": strings.Repeat("x", i % 500) },
+      Result: "ok",
+    })
+  }
+  for i := 1; i <= auditBackups; i++ {
+    if _, err := os.Stat(auditFile(path, i)); err != nil {
+      t.Fatalf("rotated log %d: %s", i, err)
+    }
+  }
+  if _, err := os.Stat(auditFile(path, auditBackups + 1)); !os.IsNotExist(err) {
+    t.Errorf("more than %d rotated logs", auditBackups)
+  }
+  if stat, _ := os.Stat(path); maxAuditSize < stat.Size() {
+    t.Errorf("log of %d bytes", stat.Size())
+  }
+
+  entries, err := readAudit(AuditFilter { Limit: 5 })
+  if err != nil || 5 != len(entries) || "action999" != entries[0].Action || "action995" != entries[4].Action {
+    t.Fatalf("newest: %v, %v", entries, err)
+  }
+  entries, err = readAudit(AuditFilter { User: "alice", Since: start.Add(900 * time.Minute) })
+  if err != nil || 50 != len(entries) || "action999" != entries[0].Action || "action901" != entries[49].Action {
+    t.Fatalf("since: %d entries, %v", len(entries), err)
+  }
+  // the whole kept history, newest first across the rotated logs.
+  entries, err = readAudit(AuditFilter{})
+  if err != nil {
+    t.Fatal(err)
+  }
+  for i := 1; i < len(entries); i++ {
+    if !entries[i].Time.Before(entries[i - 1].Time) {
+      t.Fatalf("entry %d %s is not older than %s", i, entries[i].Action, entries[i - 1].Action)
+    }
+  }
+  if len(entries) < 300 || "action999" != entries[0].Action {
+    t.Errorf("%d entries", len(entries))
+  }
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+  "gopkg.in/gin-gonic/gin.v1"
+  "golang.org/x/crypto/bcrypt"
+  "net/http"
+  "net/url"
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "net"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  sessionCookie = "xhub_session"
+  sessionLifetime = 12 * time.Hour
+  tokenPrefix = "xhub_"
+  // the page sends the CSRF token of the session in this header or in the csrf form field.
+  csrfHeader = "X-CSRF-Token"
+  csrfField = "csrf"
+  // basic credentials are checked with bcrypt once in this time. the CLI sends them
+  // with every request.
+  basicAuthLifetime = time.Minute
+  // the last use of a token is written once in this time, not on every request.
+  lastUsedInterval = time.Minute
+
+  roleViewer = "viewer"
+  roleOperator = "operator"
+  roleAdmin = "admin"
+)
+
+// roleLevels orders the roles. a role includes every lower one.
+var roleLevels = map[string]int {
+  roleViewer: 1,
+  roleOperator: 2,
+  roleAdmin: 3,
+}
+
+func validRole(role string) bool {
+  _, has := roleLevels[role]
+  return has
+}
+
+// APIToken is a bearer token. only the SHA-256 of the token is kept.
+type APIToken struct {
+  ID string `json:"id"`
+  Name string `json:"name"`
+  Hash string `json:"hash"`
+  CreatedAt time.Time `json:"createdAt"`
+  LastUsedAt time.Time `json:"lastUsedAt"`
+}
+
+type User struct {
+  Name string `json:"name"`
+  Role string `json:"role"`
+  PasswordHash string `json:"passwordHash,omitempty"`
+  Tokens []*APIToken `json:"tokens"`
+  // signed in through OIDC. such users are not stored.
+  External bool `json:"-"`
+}
+
+func (user *User) Can(role string) bool {
+  return nil != user && roleLevels[role] <= roleLevels[user.Role]
+}
+
+type Session struct {
+  User *User
+  Expires time.Time
+  CSRFToken string
+}
+
+// Accounts holds the local users and the active sessions. File is set at startup, it is
+// not taken from the config under the lock, which reloads hold while taking this one.
+type Accounts struct {
+  sync.Mutex
+  File string
+  Users map[string]*User
+  Sessions map[string]*Session
+}
+
+var accounts = &Accounts {
+  Users: map[string]*User{},
+  Sessions: map[string]*Session{},
+}
+
+func randomHex(size int) string {
+  blob := make([]byte, size)
+  if _, err := rand.Read(blob); err != nil {
+    panic(err)
+  }
+  return hex.EncodeToString(blob)
+}
+
+func hashToken(token string) string {
+  sum := sha256.Sum256([]byte(token))
+  return hex.EncodeToString(sum[:])
+}
+
+// compared against for unknown users so that they take as long as known ones.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+func hashPassword(password string) (string, error) {
+  hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+  return string(hash), err
+}
+
+// readUsers reads the users file. a missing file has no users.
+func readUsers(usersFile string) (map[string]*User, error) {
+  users := map[string]*User{}
+  blob, err := ioutil.ReadFile(usersFile)
+  if os.IsNotExist(err) {
+    return users, nil
+  } else if err != nil {
+    return nil, err
+  }
+  list := make([]*User, 0)
+  if err = json.Unmarshal(blob, &list); err != nil {
+    return nil, fmt.Errorf("%s: %s", usersFile, err)
+  }
+  for _, user := range list {
+    if !validRole(user.Role) {
+      return nil, fmt.Errorf("%s: user %s has unknown role %s", usersFile, user.Name, user.Role)
+    }
+    if nil == user.Tokens {
+      user.Tokens = make([]*APIToken, 0)
+    }
+    users[user.Name] = user
+  }
+  return users, nil
+}
+
+// loadUsers reads the users. without any user an admin with a random password is created
+// and the password is printed once.
+func loadUsers() error {
+  accounts.Lock()
+  defer accounts.Unlock()
+  users, err := readUsers(accounts.File)
+  if err != nil {
+    return err
+  }
+  accounts.Users = users
+  if 0 == len(accounts.Users) {
+    password := randomHex(8)
+    hash, err := hashPassword(password)
+    if err != nil {
+      return err
+    }
+    accounts.Users["admin"] = &User { Name: "admin", Role: roleAdmin, PasswordHash: hash, Tokens: make([]*APIToken, 0) }
+    fmt.Printf("Created user admin with password %s\n", password)
+    return saveUsers()
+  }
+  return nil
+}
+
+// saveUsers writes the users. the caller holds the accounts lock.
+func saveUsers() error {
+  list := make([]*User, 0, len(accounts.Users))
+  for _, user := range accounts.Users {
+    list = append(list, user)
+  }
+  sort.Slice(list, func(i, j int) bool {
+    return list[i].Name < list[j].Name
+  })
+  blob, err := json.MarshalIndent(list, "", "  ")
+  if err != nil {
+    return err
+  }
+  return ioutil.WriteFile(accounts.File, blob, 0600)
+}
+
+func checkPassword(name string, password string) *User {
+  accounts.Lock()
+  user, has := accounts.Users[name]
+  accounts.Unlock()
+  if !has || "" == user.PasswordHash {
+    // same cost as a real comparison.
+    bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+    return nil
+  }
+  // without the lock, bcrypt takes long.
+  if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+    return nil
+  }
+  return user
+}
+
+// verifiedCredentials are basic credentials that passed bcrypt, valid while the password
+// hash of the user is the same.
+type verifiedCredentials struct {
+  PasswordHash string
+  Expires time.Time
+}
+
+// by HMAC of the credentials with a key of this process. guarded by accounts.
+var (
+  credentialsKey = []byte(randomHex(32))
+  verified = map[string]*verifiedCredentials{}
+)
+
+// checkBasicAuth is checkPassword for basic credentials, which are cached for a while.
+func checkBasicAuth(name string, password string) *User {
+  mac := hmac.New(sha256.New, credentialsKey)
+  mac.Write([]byte(name + "\x00" + password))
+  key := hex.EncodeToString(mac.Sum(nil))
+  now := time.Now()
+  accounts.Lock()
+  if credentials, has := verified[key]; has {
+    user, has := accounts.Users[name]
+    if has && now.Before(credentials.Expires) && user.PasswordHash == credentials.PasswordHash {
+      accounts.Unlock()
+      return user
+    }
+    delete(verified, key)
+  }
+  accounts.Unlock()
+  user := checkPassword(name, password)
+  if nil != user {
+    accounts.Lock()
+    verified[key] = &verifiedCredentials { PasswordHash: user.PasswordHash, Expires: now.Add(basicAuthLifetime) }
+    accounts.Unlock()
+  }
+  return user
+}
+
+// tokenUser returns the user of the token and records its use. the last use is written
+// to the users file, at most once per lastUsedInterval for each token.
+func tokenUser(token string) *User {
+  hash := hashToken(token)
+  now := time.Now()
+  accounts.Lock()
+  defer accounts.Unlock()
+  for name, user := range accounts.Users {
+    for i, apiToken := range user.Tokens {
+      if hash != apiToken.Hash {
+        continue
+      }
+      if now.Sub(apiToken.LastUsedAt) < lastUsedInterval {
+        return user
+      }
+      // requests may be reading the user and its tokens, both are replaced.
+      user, _ = replaceUser(name)
+      used := *apiToken
+      used.LastUsedAt = now
+      user.Tokens[i] = &used
+      if err := saveUsers(); err != nil {
+        fmt.Printf("Error: %s\n", err)
+      }
+      return user
+    }
+  }
+  return nil
+}
+
+func startSession(c *gin.Context, user *User) {
+  id := randomHex(32)
+  accounts.Lock()
+  accounts.Sessions[id] = &Session { User: user, Expires: time.Now().Add(sessionLifetime), CSRFToken: randomHex(32) }
+  accounts.Unlock()
+  setCookie(c, sessionCookie, id, int(sessionLifetime.Seconds()), "/")
+}
+
+func endSession(c *gin.Context) {
+  if id, err := c.Cookie(sessionCookie); err == nil {
+    accounts.Lock()
+    delete(accounts.Sessions, id)
+    accounts.Unlock()
+  }
+  setCookie(c, sessionCookie, "", -1, "/")
+}
+
+// setCookie sets an HTTP only cookie, secure over TLS. SameSite=Lax keeps it from
+// cross-site requests other than links, such as the redirect back from the provider.
+func setCookie(c *gin.Context, name string, value string, maxAge int, path string) {
+  http.SetCookie(c.Writer, &http.Cookie {
+    Name: name,
+    Value: url.QueryEscape(value),
+    MaxAge: maxAge,
+    Path: path,
+    Secure: nil != c.Request.TLS,
+    HttpOnly: true,
+    SameSite: http.SameSiteLaxMode,
+  })
+}
+
+// expireSessions removes expired sessions and verified basic credentials. it is called
+// by the scheduler, sessions that are not used again would stay otherwise.
+func expireSessions(now time.Time) {
+  accounts.Lock()
+  defer accounts.Unlock()
+  for id, session := range accounts.Sessions {
+    if now.After(session.Expires) {
+      delete(accounts.Sessions, id)
+    }
+  }
+  for key, credentials := range verified {
+    if now.After(credentials.Expires) {
+      delete(verified, key)
+    }
+  }
+}
+
+// sessionUser returns the user and the CSRF token of the session.
+func sessionUser(id string) (*User, string) {
+  accounts.Lock()
+  defer accounts.Unlock()
+  session, has := accounts.Sessions[id]
+  if !has {
+    return nil, ""
+  }
+  if time.Now().After(session.Expires) {
+    delete(accounts.Sessions, id)
+    return nil, ""
+  }
+  if session.User.External {
+    return session.User, session.CSRFToken
+  }
+  // pick up role changes and deletions.
+  user, has := accounts.Users[session.User.Name]
+  if !has {
+    delete(accounts.Sessions, id)
+    return nil, ""
+  }
+  return user, session.CSRFToken
+}
+
+// authenticate identifies the user by bearer token, basic credentials (for creating
+// the first token from the command line) or session cookie. it never rejects. basic
+// credentials are taken by the API only: browsers send remembered ones on their own,
+// and the pages would need a CSRF token for them.
+func authenticate(c *gin.Context) {
+  var user *User
+  name, password, basic := c.Request.BasicAuth()
+  if header := c.Request.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+    user = tokenUser(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+  } else if basic && isAPIRequest(c) {
+    user = checkBasicAuth(name, password)
+  } else if id, err := c.Cookie(sessionCookie); err == nil {
+    var token string
+    if user, token = sessionUser(id); nil != user {
+      c.Set("csrf", token)
+    }
+  }
+  if nil != user {
+    c.Set("user", user)
+  }
+  c.Next()
+}
+
+// csrfToken returns the CSRF token of the session. it is empty without a session.
+func csrfToken(c *gin.Context) string {
+  if value, has := c.Get("csrf"); has {
+    return value.(string)
+  }
+  return ""
+}
+
+// checkCSRF rejects changing requests of a session that do not carry its token.
+// bearer tokens are never sent by browsers on their own and need no token, basic
+// credentials only reach the API, whose bodies a cross-site form cannot send as JSON.
+// sign-in replaces the session and is not checked.
+func checkCSRF(c *gin.Context) {
+  token := csrfToken(c)
+  method := c.Request.Method
+  if "" == token || "GET" == method || "HEAD" == method || "OPTIONS" == method || "/login" == c.Request.URL.Path {
+    c.Next()
+    return
+  }
+  sent := c.Request.Header.Get(csrfHeader)
+  contentType := c.Request.Header.Get("Content-Type")
+  if "" == sent && (strings.HasPrefix(contentType, "multipart/form-data") || strings.HasPrefix(contentType, "application/x-www-form-urlencoded")) {
+    sent = c.Request.FormValue(csrfField)
+  }
+  if 1 != subtle.ConstantTimeCompare([]byte(token), []byte(sent)) {
+    err := &HubError { Status: http.StatusForbidden, Message: "invalid CSRF token, reload the page" }
+    fmt.Printf("Error: %s for %s %s from %s\n", err, method, c.Request.URL.Path, c.ClientIP())
+    if isAPIRequest(c) {
+      apiError(c, err)
+    } else {
+      auditError(c, err)
+      c.String(http.StatusForbidden, err.Error())
+    }
+    c.Abort()
+    return
+  }
+  c.Next()
+}
+
+func currentUser(c *gin.Context) *User {
+  if value, has := c.Get("user"); has {
+    return value.(*User)
+  }
+  return nil
+}
+
+// isAPIRequest is true for the JSON API and for the metrics, which are read by machines.
+func isAPIRequest(c *gin.Context) bool {
+  return strings.HasPrefix(c.Request.URL.Path, "/api/") || "/metrics" == c.Request.URL.Path
+}
+
+// requireRole rejects requests of anonymous users and users below the role.
+// pages redirect to the login form, the API answers 401 or 403.
+func requireRole(role string) gin.HandlerFunc {
+  return func(c *gin.Context) {
+    user := currentUser(c)
+    if nil == user {
+      if isAPIRequest(c) {
+        c.Header("WWW-Authenticate", "Bearer")
+        apiError(c, &HubError { Status: http.StatusUnauthorized, Message: "authentication required" })
+      } else if "GET" == c.Request.Method {
+        c.Redirect(http.StatusFound, "/login")
+      } else {
+        c.Status(http.StatusUnauthorized)
+      }
+      c.Abort()
+      return
+    }
+    if err := authorize(user, role); err != nil {
+      if isAPIRequest(c) {
+        apiError(c, err)
+      } else {
+        c.String(http.StatusForbidden, err.Error())
+      }
+      c.Abort()
+      return
+    }
+    c.Next()
+  }
+}
+
+// requireViewerOrNode lets the nodes download modules and their signatures without
+// credentials, which they have no way to send: a node fetches the module pushed with
+// S> from /download. a node is known by the address of the connection, never by
+// forwarded headers, and reaches modules only, not the template or the metadata.
+// everyone else needs the viewer role.
+func requireViewerOrNode(state *StateStore) gin.HandlerFunc {
+  viewer := requireRole(roleViewer)
+  return func(c *gin.Context) {
+    if nil == currentUser(c) && nil == validModuleName(c.Param("file")) && isNodeAddress(state, c.Request.RemoteAddr) {
+      c.Next()
+      return
+    }
+    viewer(c)
+  }
+}
+
+// isNodeAddress reports whether the host:port is of a node that sent a heartbeat.
+func isNodeAddress(state *StateStore, address string) bool {
+  host, _, err := net.SplitHostPort(address)
+  if err != nil {
+    return false
+  }
+  known := false
+  state.View(func(info *HubInfo) {
+    _, known = info.Nodes[host]
+  })
+  return known
+}
+
+func authorize(user *User, role string) error {
+  if !user.Can(role) {
+    return &HubError { Status: http.StatusForbidden, Message: "permission denied: " + role + " role required" }
+  }
+  return nil
+}
+
+// executeRoles lists the /execute actions that need more than the operator role.
+var executeRoles = map[string]string {
+  "removeFile": roleAdmin,
+  "addDomain": roleAdmin,
+  "delDomain": roleAdmin,
+}
+
+func executeRole(key string) string {
+  if role, has := executeRoles[key]; has {
+    return role
+  }
+  return roleOperator
+}
+
+// pages
+
+func loginPage(c *gin.Context) {
+  message, _ := c.Cookie("alert")
+  if "" != message {
+    setCookie(c, "alert", "", -1, "/")
+  }
+  c.HTML(http.StatusOK, "login.tmpl", gin.H {
+    "alert": message,
+    "oidc": oidcEnabled(),
+  })
+}
+
+func login(c *gin.Context) {
+  auditAction(c, "login")
+  user := checkPassword(c.PostForm("user"), c.PostForm("password"))
+  if nil == user {
+    fmt.Printf("Error: login failed for %s from %s\n", c.PostForm("user"), c.ClientIP())
+    auditError(c, errors.New("invalid user or password"))
+    setAlert(c, "invalid user or password")
+    c.Redirect(http.StatusFound, "/login")
+    return
+  }
+  c.Set("user", user)
+  startSession(c, user)
+  c.Redirect(http.StatusFound, "/")
+}
+
+func logout(c *gin.Context) {
+  auditAction(c, "logout")
+  endSession(c)
+  c.Redirect(http.StatusFound, "/login")
+}
+
+// users and tokens
+
+// addUser creates the user or updates role and password. an empty password keeps the current one.
+// the user is replaced, not changed: requests that authenticated it read it without the lock.
+func addUser(name string, role string, password string) (bool, error) {
+  if "" == name || strings.ContainsAny(name, " \t/") {
+    return false, invalid("name", "invalid user name")
+  }
+  if !validRole(role) {
+    return false, invalid("role", "role must be viewer, operator or admin")
+  }
+  // bcrypt is slow on purpose, the accounts are not locked for it.
+  hash := ""
+  if "" != password {
+    var err error
+    if hash, err = hashPassword(password); err != nil {
+      return false, err
+    }
+  }
+  accounts.Lock()
+  defer accounts.Unlock()
+  current, has := accounts.Users[name]
+  if !has && "" == hash {
+    return false, invalid("password", "password is required")
+  }
+  if has && roleAdmin == current.Role && roleAdmin != role && 1 == countAdmins() {
+    return false, conflict("the last admin cannot be demoted")
+  }
+  user := &User { Name: name, Tokens: make([]*APIToken, 0) }
+  if has {
+    user, _ = replaceUser(name)
+  }
+  if "" != hash {
+    user.PasswordHash = hash
+  }
+  user.Role = role
+  accounts.Users[name] = user
+  return !has, saveUsers()
+}
+
+// countAdmins is called with the accounts lock held.
+func countAdmins() int {
+  count := 0
+  for _, user := range accounts.Users {
+    if roleAdmin == user.Role {
+      count++
+    }
+  }
+  return count
+}
+
+func deleteUser(name string) error {
+  accounts.Lock()
+  defer accounts.Unlock()
+  user, has := accounts.Users[name]
+  if !has {
+    return notFound("user %s not found", name)
+  }
+  if roleAdmin == user.Role && 1 == countAdmins() {
+    return conflict("the last admin cannot be deleted")
+  }
+  delete(accounts.Users, name)
+  return saveUsers()
+}
+
+// createToken returns the new token. it is shown only once.
+func createToken(user *User, name string) (*APIToken, string, error) {
+  if user.External {
+    return nil, "", conflict("tokens are only available to local users")
+  }
+  token := tokenPrefix + randomHex(24)
+  apiToken := &APIToken {
+    ID: randomHex(4),
+    Name: name,
+    Hash: hashToken(token),
+    CreatedAt: time.Now(),
+  }
+  accounts.Lock()
+  defer accounts.Unlock()
+  current, err := replaceUser(user.Name)
+  if err != nil {
+    return nil, "", err
+  }
+  current.Tokens = append(current.Tokens, apiToken)
+  return apiToken, token, saveUsers()
+}
+
+func deleteToken(user *User, id string) error {
+  accounts.Lock()
+  defer accounts.Unlock()
+  current, err := replaceUser(user.Name)
+  if err != nil {
+    return err
+  }
+  tokens := make([]*APIToken, 0, len(current.Tokens))
+  for _, apiToken := range current.Tokens {
+    if id != apiToken.ID {
+      tokens = append(tokens, apiToken)
+    }
+  }
+  if len(tokens) == len(current.Tokens) {
+    return notFound("token %s not found", id)
+  }
+  current.Tokens = tokens
+  return saveUsers()
+}
+
+// replaceUser puts a copy of the user in place of the running one and returns it for
+// the change. it is called with the accounts lock held.
+func replaceUser(name string) (*User, error) {
+  current, has := accounts.Users[name]
+  if !has {
+    return nil, notFound("user %s not found", name)
+  }
+  user := *current
+  user.Tokens = append(make([]*APIToken, 0, len(current.Tokens) + 1), current.Tokens...)
+  accounts.Users[name] = &user
+  return &user, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+  "gopkg.in/gin-gonic/gin.v1"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func TestNodeDownload(t *testing.T) {
+  info := &HubInfo { Nodes: map[string]*Node { "10.0.0.1": { IP: "10.0.0.1" } }, Domains: map[string]*Domain{}, Metadata: map[string]*ModuleMeta{} }
+  state := newStateStore(info, newPersister(os.DevNull))
+  gin.SetMode(gin.TestMode)
+  router := gin.New()
+  router.GET("/download/:file", requireViewerOrNode(state), func(c *gin.Context) {
+    c.Status(http.StatusOK)
+  })
+  tests := []struct {
+    remote string
+    file string
+    status int
+  }{
+    { "10.0.0.1:40000", "app.zip", http.StatusOK },
+    { "10.0.0.2:40000", "app.zip", http.StatusFound },
+    // the state and the metadata are for users only.
+    { "10.0.0.1:40000", "template", http.StatusFound },
+    { "10.0.0.1:40000", metadataFile, http.StatusFound },
+  }
+  for _, test := range tests {
+    req, _ := http.NewRequest("GET", "/download/" + test.file, nil)
+    req.RemoteAddr = test.remote
+    // forwarded addresses are not trusted.
+    req.Header.Set("X-Forwarded-For", "10.0.0.1")
+    recorder := httptest.NewRecorder()
+    router.ServeHTTP(recorder, req)
+    if test.status != recorder.Code {
+      t.Errorf("%s %s: status %d, want %d", test.remote, test.file, recorder.Code, test.status)
+    }
+  }
+}
+
+// useAccounts gives the test its own users, written to a temporary file.
+func useAccounts(t *testing.T, users ...*User) {
+  accounts.Lock()
+  previousFile, previousUsers := accounts.File, accounts.Users
+  accounts.File = filepath.Join(t.TempDir(), "users.json")
+  accounts.Users = map[string]*User{}
+  for _, user := range users {
+    accounts.Users[user.Name] = user
+  }
+  accounts.Unlock()
+  t.Cleanup(func() {
+    accounts.Lock()
+    accounts.File, accounts.Users = previousFile, previousUsers
+    accounts.Unlock()
+  })
+}
+
+func TestAddUserReplaces(t *testing.T) {
+  alice := &User { Name: "alice", Role: roleOperator, PasswordHash: "x", Tokens: make([]*APIToken, 0) }
+  useAccounts(t, &User { Name: "admin", Role: roleAdmin }, alice)
+  // requests that authenticated alice keep reading her.
+  if _, err := addUser("alice", roleViewer, ""); err != nil {
+    t.Fatal(err)
+  }
+  if roleOperator != alice.Role {
+    t.Errorf("running user changed to %s", alice.Role)
+  }
+  // a token created through the previous user goes to the current one.
+  if _, _, err := createToken(alice, "ci"); err != nil {
+    t.Fatal(err)
+  }
+  current := accounts.Users["alice"]
+  if roleViewer != current.Role || "x" != current.PasswordHash || 1 != len(current.Tokens) || 0 != len(alice.Tokens) {
+    t.Errorf("user %+v", current)
+  }
+  if _, err := addUser("admin", roleViewer, ""); nil == err {
+    t.Error("last admin demoted")
+  }
+  if _, err := addUser("bob", roleViewer, ""); nil == err {
+    t.Error("user created without password")
+  }
+}
+
+func TestTokenLastUsed(t *testing.T) {
+  useAccounts(t, &User { Name: "alice", Role: roleOperator, Tokens: make([]*APIToken, 0) })
+  token, secret, err := createToken(accounts.Users["alice"], "ci")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if user := tokenUser(secret); nil == user || "alice" != user.Name {
+    t.Fatalf("token user %v", user)
+  }
+  users, err := readUsers(accounts.File)
+  if err != nil {
+    t.Fatal(err)
+  }
+  used := users["alice"].Tokens[0].LastUsedAt
+  if used.IsZero() || !token.LastUsedAt.IsZero() {
+    t.Errorf("last use %s written, token changed to %s", used, token.LastUsedAt)
+  }
+  // not written again within the interval.
+  tokenUser(secret)
+  if !accounts.Users["alice"].Tokens[0].LastUsedAt.Equal(used) {
+    t.Error("last use written again")
+  }
+}
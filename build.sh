@@ -1,4 +1,6 @@
-GOOS=linux GOARCH=386 go build -o xengine_hub_linux32.exe xengine_hub.go
-GOOS=linux GOARCH=amd64 go build -o xengine_hub_linux64.exe xengine_hub.go
-GOOS=windows GOARCH=386 go build -o xengine_hub_windows32.exe xengine_hub.go
-GOOS=windows GOARCH=amd64 go build -o xengine_hub_windows64.exe xengine_hub.go
+GOOS=linux GOARCH=386 go build -o xengine_hub_linux32.exe .
+GOOS=linux GOARCH=amd64 go build -o xengine_hub_linux64.exe .
+GOOS=windows GOARCH=386 go build -o xengine_hub_windows32.exe .
+GOOS=windows GOARCH=amd64 go build -o xengine_hub_windows64.exe .
+GOOS=linux GOARCH=amd64 go build -o xhub_linux64.exe ./cmd/xhub
+GOOS=windows GOARCH=amd64 go build -o xhub_windows64.exe ./cmd/xhub
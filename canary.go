@@ -0,0 +1,333 @@
+package main
+
+import (
+  "fmt"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  maxFinishedCanaries = 20
+  defaultCanaryWindow = 600 * time.Second
+)
+
+type Canary struct {
+  ID string `json:"id"`
+  Domain string `json:"domain"`
+  Module string `json:"module"`
+  // share of D resolutions in percent.
+  Weight int `json:"weight"`
+  Window time.Duration `json:"window"`
+  // error reports tolerated during the window.
+  MaxErrors int `json:"maxErrors"`
+  // time the canary servers have to become active, and the batches of the promotion.
+  Timeout time.Duration `json:"timeout"`
+  Status string `json:"status"`
+  // deploying
+  // observing
+  // promoted
+  // aborted
+  Message string `json:"message"`
+
+  Errors int `json:"errors"`
+  Deadline time.Time `json:"deadline"`
+  StartedAt time.Time `json:"startedAt"`
+  ObservedAt time.Time `json:"observedAt"`
+  Targets []*RolloutTarget `json:"targets"`
+  // rollout started on promotion.
+  RolloutID string `json:"rolloutId"`
+}
+
+func (canary *Canary) Active() bool {
+  return "deploying" == canary.Status || "observing" == canary.Status
+}
+
+// Resolutions is the number of D queries answered with a canary server.
+func (canary *Canary) Resolutions() int {
+  return canaryResolutions.Get(canary.ID)
+}
+
+func (canary *Canary) StartedText() string {
+  return canary.StartedAt.Format(dateTimeLayout)
+}
+
+// Remaining observation time in seconds.
+func (canary *Canary) Remaining() int {
+  if "observing" != canary.Status {
+    return 0
+  }
+  remaining := canary.Window - time.Since(canary.ObservedAt)
+  if remaining < 0 {
+    return 0
+  }
+  return int(remaining.Seconds())
+}
+
+func (canary *Canary) Includes(server *ServiceServer) bool {
+  for _, target := range canary.Targets {
+    if server.Node.IP == target.IP && server.Port == target.Port {
+      return true
+    }
+  }
+  return false
+}
+
+func findCanary(info *HubInfo, id string) *Canary {
+  for _, canary := range info.Canaries {
+    if id == canary.ID {
+      return canary
+    }
+  }
+  return nil
+}
+
+// domainCanary returns the active canary release of the domain.
+func domainCanary(info *HubInfo, domainKey string) *Canary {
+  for _, canary := range info.Canaries {
+    if domainKey == canary.Domain && canary.Active() {
+      return canary
+    }
+  }
+  return nil
+}
+
+// startCanary pushes the module to the chosen servers ("ip@port") of the domain
+// and routes weight percent of its resolutions to them once they are active.
+func startCanary(info *HubInfo, domainKey string, module string, servers []string, weight int, window time.Duration, maxErrors int, timeout time.Duration) (*Canary, error) {
+  domain, has := info.Domains[domainKey]
+  if !has {
+    return nil, notFound("domain %s not found", domainKey)
+  }
+  if !moduleAvailable(info, module) {
+    return nil, invalid("module", "module is not available: " + module)
+  }
+  if weight < 1 || 100 < weight {
+    return nil, invalid("weight", "weight must be between 1 and 100")
+  }
+  if window <= 0 {
+    window = defaultCanaryWindow
+  }
+  if maxErrors < 0 {
+    maxErrors = 0
+  }
+  if timeout <= 0 {
+    timeout = defaultRolloutTimeout
+  }
+  if nil != domainCanary(info, domainKey) {
+    return nil, conflict("canary release already in progress on %s", domainKey)
+  }
+  for _, rollout := range info.Rollouts {
+    if domainKey == rollout.Domain && rollout.Active() {
+      return nil, conflict("rollout already in progress: %s", rollout.ID)
+    }
+  }
+  assigned := domainServers(domain)
+  canary := &Canary {
+    ID: "c" + time.Now().Format(dateTimeSimple) + strconv.Itoa(len(info.Canaries)),
+    Domain: domainKey,
+    Module: module,
+    Weight: weight,
+    Window: window,
+    MaxErrors: maxErrors,
+    Timeout: timeout,
+    Status: "deploying",
+    StartedAt: time.Now(),
+    Deadline: time.Now().Add(timeout),
+    Targets: make([]*RolloutTarget, 0),
+  }
+  for _, key := range servers {
+    ipport := strings.SplitN(key, "@", 2)
+    if 2 != len(ipport) {
+      return nil, invalid("servers", "invalid server: " + key)
+    }
+    server := info.Server(ipport[0], ipport[1])
+    if nil == server {
+      return nil, invalid("servers", "unknown server: " + key)
+    }
+    if canary.Includes(server) {
+      continue
+    }
+    member := false
+    for _, candidate := range assigned {
+      member = member || candidate == server
+    }
+    if !member {
+      return nil, invalid("servers", server.Target() + " is not assigned to " + domainKey)
+    }
+    canary.Targets = append(canary.Targets, &RolloutTarget {
+      IP: server.Node.IP,
+      Port: server.Port,
+      State: "pending",
+    })
+  }
+  if 0 == len(canary.Targets) {
+    return nil, invalid("servers", "no canary servers selected")
+  }
+  if len(assigned) <= len(canary.Targets) {
+    return nil, invalid("servers", "canary servers must be a subset of the domain")
+  }
+
+  for _, target := range canary.Targets {
+    server := info.Server(target.IP, target.Port)
+    target.Previous = server.Module
+    target.State = "updating"
+    if module != server.Module {
+      changeModule(server, module)
+      recordHistory(info, "canary", server.Target(), module, target.Previous)
+    } else {
+      pushModule(server)
+    }
+  }
+  info.Canaries = append(info.Canaries, canary)
+  trimCanaries(info)
+  return canary, nil
+}
+
+// ResolutionCounts counts the D queries answered with canary servers, by canary. the
+// queries hold the state locked for reading only, so the counts have a lock of their own
+// and are not state changes to publish.
+type ResolutionCounts struct {
+  lock sync.Mutex
+  counts map[string]int
+}
+
+var canaryResolutions = &ResolutionCounts { counts: map[string]int{} }
+
+func (r *ResolutionCounts) Add(id string) {
+  r.lock.Lock()
+  defer r.lock.Unlock()
+  r.counts[id]++
+}
+
+func (r *ResolutionCounts) Get(id string) int {
+  r.lock.Lock()
+  defer r.lock.Unlock()
+  return r.counts[id]
+}
+
+func (r *ResolutionCounts) Forget(id string) {
+  r.lock.Lock()
+  defer r.lock.Unlock()
+  delete(r.counts, id)
+}
+
+func trimCanaries(info *HubInfo) {
+  finished := 0
+  canaries := make([]*Canary, 0, len(info.Canaries))
+  for i := len(info.Canaries) - 1; 0 <= i; i-- {
+    canary := info.Canaries[i]
+    if !canary.Active() {
+      finished++
+      if maxFinishedCanaries < finished {
+        canaryResolutions.Forget(canary.ID)
+        continue
+      }
+    }
+    canaries = append([]*Canary{canary}, canaries...)
+  }
+  info.Canaries = canaries
+}
+
+// recordCanaryError counts an error report (E@) from the node against its canary releases.
+// reports only carry the node address, so every canary server on that node is suspect.
+func recordCanaryError(info *HubInfo, ip string) {
+  for _, canary := range info.Canaries {
+    if "observing" != canary.Status {
+      continue
+    }
+    for _, target := range canary.Targets {
+      if ip == target.IP {
+        canary.Errors++
+        break
+      }
+    }
+  }
+}
+
+// promoteCanary ends the observation and rolls the module out to the whole domain.
+// when the rollout cannot start the canary stays active.
+func promoteCanary(info *HubInfo, canary *Canary) error {
+  if !canary.Active() {
+    return conflict("canary %s is %s", canary.ID, canary.Status)
+  }
+  // the rollout refuses to start beside an active canary.
+  status := canary.Status
+  canary.Status = "promoted"
+  rollout, err := startRollout(info, canary.Domain, canary.Module, len(canary.Targets), canary.Timeout, "abort")
+  if err != nil {
+    canary.Status = status
+    canary.Message = "promotion failed: " + err.Error()
+    return err
+  }
+  canary.Message = ""
+  canary.RolloutID = rollout.ID
+  recordHistory(info, "promoteCanary", canary.Domain, canary.Module, "")
+  return nil
+}
+
+// abortCanary reverts the canary servers to their previous modules.
+func abortCanary(info *HubInfo, canary *Canary, message string) {
+  if !canary.Active() {
+    return
+  }
+  for _, target := range canary.Targets {
+    if "" == target.Previous || canary.Module == target.Previous {
+      continue
+    }
+    server := info.Server(target.IP, target.Port)
+    if nil != server && canary.Module == server.Module && target.Previous == server.PreviousModule() {
+      if revertModule(info, server, "abortCanary") {
+        target.State = "reverted"
+      }
+    }
+  }
+  canary.Status = "aborted"
+  canary.Message = message
+  fmt.Printf("Canary %s: %s\n", canary.ID, message)
+}
+
+// stepCanaries watches the canary releases. it is called periodically under lock.
+func stepCanaries(info *HubInfo) {
+  for _, canary := range info.Canaries {
+    if canary.Active() {
+      stepCanary(info, canary)
+    }
+  }
+}
+
+func stepCanary(info *HubInfo, canary *Canary) {
+  healthy := true
+  for _, target := range canary.Targets {
+    server := info.Server(target.IP, target.Port)
+    if nil != server && canary.Module == server.Module && server.Healthy() {
+      target.State = "done"
+    } else {
+      healthy = false
+      if "done" == target.State {
+        target.State = "failed"
+      }
+    }
+  }
+
+  if "deploying" == canary.Status {
+    if healthy {
+      canary.Status = "observing"
+      canary.ObservedAt = time.Now()
+      canary.Errors = 0
+    } else if time.Now().After(canary.Deadline) {
+      abortCanary(info, canary, "canary servers did not become active")
+    }
+    return
+  }
+
+  if !healthy {
+    abortCanary(info, canary, "canary server became unhealthy")
+  } else if canary.MaxErrors < canary.Errors {
+    abortCanary(info, canary, fmt.Sprintf("%d error reports exceeded the limit of %d", canary.Errors, canary.MaxErrors))
+  } else if canary.Window <= time.Since(canary.ObservedAt) {
+    // tried again on the next step, the message tells why.
+    promoteCanary(info, canary)
+  }
+}
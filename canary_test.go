@@ -0,0 +1,66 @@
+package main
+
+import (
+  "testing"
+  "time"
+)
+
+func TestCanary(t *testing.T) {
+  tests := []struct {
+    name string
+    run func(info *HubInfo, canary *Canary, servers []*ServiceServer)
+    status string
+    module string
+  }{
+    { "promote after the window", func(info *HubInfo, canary *Canary, servers []*ServiceServer) {
+      activate(servers...)
+      stepCanaries(info)
+      if "observing" != canary.Status {
+        t.Errorf("promote after the window: %s while the servers are active", canary.Status)
+      }
+      canary.ObservedAt = time.Now().Add(-canary.Window)
+      stepCanaries(info)
+      rollout := findRollout(info, canary.RolloutID)
+      if nil == rollout || 2 * time.Minute != rollout.Timeout {
+        t.Errorf("promote after the window: rollout %+v", rollout)
+      }
+    }, "promoted", "b.zip" },
+    { "deploy timeout", func(info *HubInfo, canary *Canary, servers []*ServiceServer) {
+      stepCanaries(info)
+      canary.Deadline = time.Now().Add(-time.Second)
+      stepCanaries(info)
+    }, "aborted", "a.zip" },
+    { "errors", func(info *HubInfo, canary *Canary, servers []*ServiceServer) {
+      activate(servers...)
+      stepCanaries(info)
+      recordCanaryError(info, "127.0.0.1")
+      recordCanaryError(info, "127.0.0.1")
+      stepCanaries(info)
+    }, "aborted", "a.zip" },
+    { "failed promotion", func(info *HubInfo, canary *Canary, servers []*ServiceServer) {
+      activate(servers...)
+      stepCanaries(info)
+      modules.Remove("b.zip")
+      if err := promoteCanary(info, canary); nil == err || "" == canary.Message {
+        t.Errorf("failed promotion: %v, message %s", err, canary.Message)
+      }
+    }, "observing", "b.zip" },
+  }
+  for _, test := range tests {
+    info, servers := newTestDomain(t)
+    canary, err := startCanary(info, "example.com", "b.zip", []string { "127.0.0.1@:9000" }, 50, time.Minute, 1, 2 * time.Minute)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if deadline := canary.StartedAt.Add(2 * time.Minute); 2 * time.Minute != canary.Timeout || canary.Deadline.Before(deadline.Add(-time.Second)) {
+      t.Errorf("%s: timeout %v, deadline %s", test.name, canary.Timeout, canary.Deadline)
+    }
+    test.run(info, canary, servers)
+    if test.status != canary.Status {
+      t.Errorf("%s: status %s, want %s (%s)", test.name, canary.Status, test.status, canary.Message)
+    }
+    if test.module != servers[0].Module || "a.zip" != servers[1].Module {
+      t.Errorf("%s: modules %s %s", test.name, servers[0].Module, servers[1].Module)
+    }
+  }
+}
@@ -0,0 +1,898 @@
+// Package client is a Go client of the hub JSON API.
+// see resources/openapi.json for the specification.
+package client
+
+import (
+  "github.com/pantaroid/test/api"
+  "bufio"
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// Error is returned for every non-2xx response.
+type Error struct {
+  StatusCode int
+  api.ErrorResponse
+}
+
+func (err *Error) Error() string {
+  fields := make([]string, 0, len(err.Fields))
+  for field, message := range err.Fields {
+    if message != err.ErrorResponse.Error {
+      fields = append(fields, field + ": " + message)
+    }
+  }
+  if 0 == len(fields) {
+    return fmt.Sprintf("%d: %s", err.StatusCode, err.ErrorResponse.Error)
+  }
+  return fmt.Sprintf("%d: %s (%s)", err.StatusCode, err.ErrorResponse.Error, strings.Join(fields, ", "))
+}
+
+// IsNotFound reports whether err is a 404 response.
+func IsNotFound(err error) bool {
+  apiErr, ok := err.(*Error)
+  return ok && http.StatusNotFound == apiErr.StatusCode
+}
+
+type Client struct {
+  // hub address, e.g. http://127.0.0.1:8080
+  BaseURL string
+  // API token sent as bearer token.
+  Token string
+  // basic credentials, used when Token is empty.
+  User string
+  Password string
+  HTTPClient *http.Client
+}
+
+func New(baseURL string) *Client {
+  return &Client {
+    BaseURL: strings.TrimRight(baseURL, "/"),
+    HTTPClient: http.DefaultClient,
+  }
+}
+
+func escape(segment string) string {
+  return url.PathEscape(segment)
+}
+
+// port accepts "12345" as well as ":12345"; the hub normalizes both.
+func port(port string) string {
+  return escape(strings.TrimPrefix(port, ":"))
+}
+
+func (client *Client) request(method string, path string, header http.Header, body io.Reader) (*http.Response, error) {
+  req, err := http.NewRequest(method, client.BaseURL + "/api" + path, body)
+  if err != nil {
+    return nil, err
+  }
+  for key, values := range header {
+    req.Header[key] = values
+  }
+  if "" != client.Token {
+    req.Header.Set("Authorization", "Bearer " + client.Token)
+  } else if "" != client.User {
+    req.SetBasicAuth(client.User, client.Password)
+  }
+  resp, err := client.HTTPClient.Do(req)
+  if err != nil {
+    return nil, err
+  }
+  if resp.StatusCode < 200 || 299 < resp.StatusCode {
+    defer resp.Body.Close()
+    apiErr := &Error { StatusCode: resp.StatusCode }
+    blob, _ := ioutil.ReadAll(resp.Body)
+    if json.Unmarshal(blob, &apiErr.ErrorResponse) != nil || "" == apiErr.ErrorResponse.Error {
+      apiErr.ErrorResponse.Error = strings.TrimSpace(string(blob))
+      if "" == apiErr.ErrorResponse.Error {
+        apiErr.ErrorResponse.Error = http.StatusText(resp.StatusCode)
+      }
+    }
+    return nil, apiErr
+  }
+  return resp, nil
+}
+
+// do sends in as JSON body (when not nil) and decodes the response into out (when not nil).
+func (client *Client) do(method string, path string, in interface{}, out interface{}) error {
+  var body io.Reader
+  header := http.Header{}
+  if nil != in {
+    blob, err := json.Marshal(in)
+    if err != nil {
+      return err
+    }
+    body = bytes.NewReader(blob)
+    header.Set("Content-Type", "application/json")
+  }
+  resp, err := client.request(method, path, header, body)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+  if nil == out || http.StatusNoContent == resp.StatusCode {
+    io.Copy(ioutil.Discard, resp.Body)
+    return nil
+  }
+  return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// nodes
+
+func (client *Client) ListNodes() ([]api.NodeResource, error) {
+  var nodes []api.NodeResource
+  err := client.do("GET", "/nodes", nil, &nodes)
+  return nodes, err
+}
+
+func (client *Client) GetNode(ip string) (*api.NodeResource, error) {
+  var node api.NodeResource
+  if err := client.do("GET", "/nodes/" + escape(ip), nil, &node); err != nil {
+    return nil, err
+  }
+  return &node, nil
+}
+
+func (client *Client) PatchNode(ip string, patch api.NodePatch) (*api.NodeResource, error) {
+  var node api.NodeResource
+  if err := client.do("PATCH", "/nodes/" + escape(ip), patch, &node); err != nil {
+    return nil, err
+  }
+  return &node, nil
+}
+
+func (client *Client) StopNode(ip string) error {
+  return client.do("POST", "/nodes/" + escape(ip) + "/stop", nil, nil)
+}
+
+func (client *Client) DrainNode(ip string, seconds int) (*api.NodeResource, error) {
+  var node api.NodeResource
+  if err := client.do("POST", "/nodes/" + escape(ip) + "/drain", api.DrainRequest { Seconds: seconds }, &node); err != nil {
+    return nil, err
+  }
+  return &node, nil
+}
+
+// servers
+
+func serverPath(ip string, serverPort string) string {
+  return "/nodes/" + escape(ip) + "/servers/" + port(serverPort)
+}
+
+func (client *Client) ListServers(ip string) ([]api.ServerResource, error) {
+  var servers []api.ServerResource
+  err := client.do("GET", "/nodes/" + escape(ip) + "/servers", nil, &servers)
+  return servers, err
+}
+
+// AddServer asks the node to create a server. it shows up with the next heartbeat.
+func (client *Client) AddServer(ip string) error {
+  return client.do("POST", "/nodes/" + escape(ip) + "/servers", nil, nil)
+}
+
+func (client *Client) GetServer(ip string, port string) (*api.ServerResource, error) {
+  var server api.ServerResource
+  if err := client.do("GET", serverPath(ip, port), nil, &server); err != nil {
+    return nil, err
+  }
+  return &server, nil
+}
+
+func (client *Client) PatchServer(ip string, port string, patch api.ServerPatch) (*api.ServerResource, error) {
+  var server api.ServerResource
+  if err := client.do("PATCH", serverPath(ip, port), patch, &server); err != nil {
+    return nil, err
+  }
+  return &server, nil
+}
+
+func (client *Client) StartServer(ip string, port string) (*api.ServerResource, error) {
+  state := "running"
+  return client.PatchServer(ip, port, api.ServerPatch { State: &state })
+}
+
+func (client *Client) StopServer(ip string, port string) (*api.ServerResource, error) {
+  state := "stopped"
+  return client.PatchServer(ip, port, api.ServerPatch { State: &state })
+}
+
+func (client *Client) SetModule(ip string, port string, module string) (*api.ServerResource, error) {
+  return client.PatchServer(ip, port, api.ServerPatch { Module: &module })
+}
+
+func (client *Client) SyncServer(ip string, port string) (*api.ServerResource, error) {
+  var server api.ServerResource
+  if err := client.do("POST", serverPath(ip, port) + "/sync", nil, &server); err != nil {
+    return nil, err
+  }
+  return &server, nil
+}
+
+func (client *Client) RollbackServer(ip string, port string) (*api.ServerResource, error) {
+  var server api.ServerResource
+  if err := client.do("POST", serverPath(ip, port) + "/rollback", nil, &server); err != nil {
+    return nil, err
+  }
+  return &server, nil
+}
+
+func (client *Client) DrainServer(ip string, port string, seconds int) (*api.ServerResource, error) {
+  var server api.ServerResource
+  if err := client.do("POST", serverPath(ip, port) + "/drain", api.DrainRequest { Seconds: seconds }, &server); err != nil {
+    return nil, err
+  }
+  return &server, nil
+}
+
+// domains
+
+func (client *Client) ListDomains() ([]api.DomainResource, error) {
+  var domains []api.DomainResource
+  err := client.do("GET", "/domains", nil, &domains)
+  return domains, err
+}
+
+func (client *Client) GetDomain(key string) (*api.DomainResource, error) {
+  var domain api.DomainResource
+  if err := client.do("GET", "/domains/" + escape(key), nil, &domain); err != nil {
+    return nil, err
+  }
+  return &domain, nil
+}
+
+// PutDomain creates the domain. it succeeds when the domain already exists.
+func (client *Client) PutDomain(key string) (*api.DomainResource, error) {
+  var domain api.DomainResource
+  if err := client.do("PUT", "/domains/" + escape(key), nil, &domain); err != nil {
+    return nil, err
+  }
+  return &domain, nil
+}
+
+func (client *Client) DeleteDomain(key string) error {
+  return client.do("DELETE", "/domains/" + escape(key), nil, nil)
+}
+
+func (client *Client) RollbackDomain(key string) (int, error) {
+  var response api.RollbackResponse
+  err := client.do("POST", "/domains/" + escape(key) + "/rollback", nil, &response)
+  return response.RolledBack, err
+}
+
+// assignments
+
+func assignmentPath(domain string, ip string, serverPort string) string {
+  return "/assignments/" + escape(domain) + "/" + escape(ip) + "/" + port(serverPort)
+}
+
+// ListAssignments filters by domain and node ip when they are not empty.
+func (client *Client) ListAssignments(domain string, ip string) ([]api.AssignmentResource, error) {
+  query := url.Values{}
+  if "" != domain {
+    query.Set("domain", domain)
+  }
+  if "" != ip {
+    query.Set("ip", ip)
+  }
+  path := "/assignments"
+  if 0 < len(query) {
+    path = path + "?" + query.Encode()
+  }
+  var assignments []api.AssignmentResource
+  err := client.do("GET", path, nil, &assignments)
+  return assignments, err
+}
+
+// Assign assigns the server to the domain with priority 1 (primary) or 2 (secondary).
+func (client *Client) Assign(domain string, ip string, port string, priority int) (*api.AssignmentResource, error) {
+  var assignment api.AssignmentResource
+  if err := client.do("PUT", assignmentPath(domain, ip, port), api.AssignmentRequest { Priority: priority }, &assignment); err != nil {
+    return nil, err
+  }
+  return &assignment, nil
+}
+
+func (client *Client) Exclude(domain string, ip string, port string) error {
+  return client.do("DELETE", assignmentPath(domain, ip, port), nil, nil)
+}
+
+// modules
+
+func (client *Client) ListModules() ([]api.ModuleResource, error) {
+  return client.SearchModules(ModuleQuery{})
+}
+
+// ModuleQuery filters modules. zero fields match everything.
+type ModuleQuery struct {
+  // case insensitive substring of name, description, version, changelog, uploader or tags.
+  Text string
+  Tag string
+  NodeLabel string
+  Uploader string
+}
+
+func (query ModuleQuery) path() string {
+  values := url.Values{}
+  if "" != query.Text {
+    values.Set("q", query.Text)
+  }
+  if "" != query.Tag {
+    values.Set("tag", query.Tag)
+  }
+  if "" != query.NodeLabel {
+    values.Set("label", query.NodeLabel)
+  }
+  if "" != query.Uploader {
+    values.Set("uploader", query.Uploader)
+  }
+  if 0 == len(values) {
+    return "/modules"
+  }
+  return "/modules?" + values.Encode()
+}
+
+func (client *Client) SearchModules(query ModuleQuery) ([]api.ModuleResource, error) {
+  var modules []api.ModuleResource
+  err := client.do("GET", query.path(), nil, &modules)
+  return modules, err
+}
+
+// PatchModule changes the metadata of the module.
+func (client *Client) PatchModule(name string, patch api.ModulePatch) (*api.ModuleResource, error) {
+  var module api.ModuleResource
+  if err := client.do("PATCH", "/modules/" + escape(name), patch, &module); err != nil {
+    return nil, err
+  }
+  return &module, nil
+}
+
+func (client *Client) GetModule(name string) (*api.ModuleResource, error) {
+  var module api.ModuleResource
+  if err := client.do("GET", "/modules/" + escape(name), nil, &module); err != nil {
+    return nil, err
+  }
+  return &module, nil
+}
+
+type UploadOptions struct {
+  Description string
+  Version string
+  Changelog string
+  Tags []string
+  NodeLabels []string
+  // keep the replaced module under a timestamp-prefixed name.
+  Backup bool
+  // base64 or hex encoded ed25519 signature, required when the hub has trusted keys.
+  Signature string
+}
+
+func (client *Client) UploadModule(name string, content io.Reader, options UploadOptions) (*api.ModuleResource, error) {
+  query := url.Values{}
+  if "" != options.Description {
+    query.Set("description", options.Description)
+  }
+  if "" != options.Version {
+    query.Set("version", options.Version)
+  }
+  if "" != options.Changelog {
+    query.Set("changelog", options.Changelog)
+  }
+  if 0 < len(options.Tags) {
+    query.Set("tags", strings.Join(options.Tags, ","))
+  }
+  if 0 < len(options.NodeLabels) {
+    query.Set("nodeLabels", strings.Join(options.NodeLabels, ","))
+  }
+  if options.Backup {
+    query.Set("backup", "true")
+  }
+  path := "/modules/" + escape(name)
+  if 0 < len(query) {
+    path = path + "?" + query.Encode()
+  }
+  header := http.Header{}
+  header.Set("Content-Type", "application/octet-stream")
+  if "" != options.Signature {
+    header.Set("X-Module-Signature", options.Signature)
+  }
+  resp, err := client.request("PUT", path, header, content)
+  if err != nil {
+    return nil, err
+  }
+  defer resp.Body.Close()
+  var module api.ModuleResource
+  if err = json.NewDecoder(resp.Body).Decode(&module); err != nil {
+    return nil, err
+  }
+  return &module, nil
+}
+
+// DownloadModule returns the module content. the caller closes it.
+func (client *Client) DownloadModule(name string) (io.ReadCloser, error) {
+  resp, err := client.request("GET", "/modules/" + escape(name) + "/content", nil, nil)
+  if err != nil {
+    return nil, err
+  }
+  return resp.Body, nil
+}
+
+// retention
+
+func (client *Client) GetRetention() (*api.RetentionPolicy, error) {
+  var policy api.RetentionPolicy
+  if err := client.do("GET", "/retention", nil, &policy); err != nil {
+    return nil, err
+  }
+  return &policy, nil
+}
+
+func (client *Client) PutRetention(policy api.RetentionPolicy) (*api.RetentionPolicy, error) {
+  var updated api.RetentionPolicy
+  if err := client.do("PUT", "/retention", policy, &updated); err != nil {
+    return nil, err
+  }
+  return &updated, nil
+}
+
+// PlanRetention previews what RunRetention removes.
+func (client *Client) PlanRetention() (*api.RetentionPlan, error) {
+  var plan api.RetentionPlan
+  if err := client.do("GET", "/retention/plan", nil, &plan); err != nil {
+    return nil, err
+  }
+  return &plan, nil
+}
+
+func (client *Client) RunRetention() (*api.RetentionPlan, error) {
+  var plan api.RetentionPlan
+  if err := client.do("POST", "/retention/run", nil, &plan); err != nil {
+    return nil, err
+  }
+  return &plan, nil
+}
+
+// config
+
+// ReloadConfig makes the hub read its config files again.
+func (client *Client) ReloadConfig() (*api.ReloadResult, error) {
+  var result api.ReloadResult
+  if err := client.do("POST", "/config/reload", nil, &result); err != nil {
+    return nil, err
+  }
+  return &result, nil
+}
+
+// resumable uploads
+
+func (client *Client) ListUploads() ([]api.UploadResource, error) {
+  var uploads []api.UploadResource
+  err := client.do("GET", "/uploads", nil, &uploads)
+  return uploads, err
+}
+
+func (client *Client) CreateUpload(request api.UploadRequest) (*api.UploadResource, error) {
+  var upload api.UploadResource
+  if err := client.do("POST", "/uploads", request, &upload); err != nil {
+    return nil, err
+  }
+  return &upload, nil
+}
+
+func (client *Client) GetUpload(id string) (*api.UploadResource, error) {
+  var upload api.UploadResource
+  if err := client.do("GET", "/uploads/" + escape(id), nil, &upload); err != nil {
+    return nil, err
+  }
+  return &upload, nil
+}
+
+// UploadChunk sends the chunk at offset, the bytes the hub received so far.
+func (client *Client) UploadChunk(id string, offset int64, chunk []byte) (*api.UploadResource, error) {
+  header := http.Header{}
+  header.Set("Content-Type", "application/octet-stream")
+  resp, err := client.request("PUT", "/uploads/" + escape(id) + "?offset=" + strconv.FormatInt(offset, 10), header, bytes.NewReader(chunk))
+  if err != nil {
+    return nil, err
+  }
+  defer resp.Body.Close()
+  var upload api.UploadResource
+  if err = json.NewDecoder(resp.Body).Decode(&upload); err != nil {
+    return nil, err
+  }
+  return &upload, nil
+}
+
+// FinishUpload stores the module when the hash matches the received content.
+func (client *Client) FinishUpload(id string, sha256 string) (*api.ModuleResource, error) {
+  var module api.ModuleResource
+  if err := client.do("POST", "/uploads/" + escape(id) + "/finish", api.FinishUploadRequest { SHA256: sha256 }, &module); err != nil {
+    return nil, err
+  }
+  return &module, nil
+}
+
+func (client *Client) AbortUpload(id string) error {
+  return client.do("DELETE", "/uploads/" + escape(id), nil, nil)
+}
+
+// ChunkedUpload sends a module in chunks. a failed chunk is retried, and an upload
+// that failed altogether is continued with ID.
+type ChunkedUpload struct {
+  Client *Client
+  // the upload to continue. empty starts a new one.
+  ID string
+  ChunkSize int
+  // attempts per chunk.
+  Retries int
+  // called after every chunk.
+  Progress func(upload *api.UploadResource)
+}
+
+// Upload sends content, which holds size bytes with the given hex sha256. ID is set
+// as soon as the upload exists, so that it can be continued after an error.
+func (upload *ChunkedUpload) Upload(request api.UploadRequest, content io.ReaderAt, sha256 string) (*api.ModuleResource, error) {
+  var state *api.UploadResource
+  var err error
+  if "" == upload.ID {
+    state, err = upload.Client.CreateUpload(request)
+    if err != nil {
+      return nil, err
+    }
+    upload.ID = state.ID
+  } else {
+    state, err = upload.Client.GetUpload(upload.ID)
+    if err != nil {
+      return nil, err
+    }
+    if state.Name != request.Name || state.Size != request.Size {
+      return nil, fmt.Errorf("upload %s is %s of %d bytes", upload.ID, state.Name, state.Size)
+    }
+  }
+  chunk := make([]byte, upload.ChunkSize)
+  failures := 0
+  for state.Offset < state.Size {
+    length := int64(len(chunk))
+    if state.Size - state.Offset < length {
+      length = state.Size - state.Offset
+    }
+    n, err := content.ReadAt(chunk[:length], state.Offset)
+    if int64(n) < length {
+      return nil, err
+    }
+    next, err := upload.Client.UploadChunk(upload.ID, state.Offset, chunk[:length])
+    if err != nil {
+      // rejected chunks are not cured by trying again, a wrong offset or a failing hub may be.
+      if apiErr, ok := err.(*Error); ok && http.StatusConflict != apiErr.StatusCode && apiErr.StatusCode < 500 {
+        return nil, err
+      }
+      failures++
+      if upload.Retries <= failures {
+        return nil, err
+      }
+      time.Sleep(time.Duration(failures) * time.Second)
+      // the chunk may have arrived after all, continue where the hub is.
+      if next, err = upload.Client.GetUpload(upload.ID); err != nil {
+        continue
+      }
+    } else {
+      failures = 0
+    }
+    state = next
+    if nil != upload.Progress {
+      upload.Progress(state)
+    }
+  }
+  return upload.Client.FinishUpload(upload.ID, sha256)
+}
+
+// Download is a module download. the caller closes Content.
+type Download struct {
+  Content io.ReadCloser
+  // where Content starts in the module, 0 unless the requested offset was granted.
+  Offset int64
+  // hex encoded sha256 of the whole module, taken from the ETag.
+  SHA256 string
+}
+
+// DownloadModuleFrom resumes a download at offset. the hub may send the whole module
+// instead, check Offset.
+func (client *Client) DownloadModuleFrom(name string, offset int64) (*Download, error) {
+  header := http.Header{}
+  if 0 < offset {
+    header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+  }
+  resp, err := client.request("GET", "/modules/" + escape(name) + "/content", header, nil)
+  if err != nil {
+    return nil, err
+  }
+  download := &Download { Content: resp.Body, SHA256: strings.Trim(resp.Header.Get("ETag"), "\"") }
+  if http.StatusPartialContent == resp.StatusCode {
+    download.Offset = offset
+  }
+  return download, nil
+}
+
+func (client *Client) DeleteModule(name string) error {
+  return client.do("DELETE", "/modules/" + escape(name), nil, nil)
+}
+
+func (client *Client) RollbackModule(name string) (int, error) {
+  var response api.RollbackResponse
+  err := client.do("POST", "/modules/" + escape(name) + "/rollback", nil, &response)
+  return response.RolledBack, err
+}
+
+// rollouts
+
+func (client *Client) ListRollouts() ([]api.RolloutResource, error) {
+  var rollouts []api.RolloutResource
+  err := client.do("GET", "/rollouts", nil, &rollouts)
+  return rollouts, err
+}
+
+func (client *Client) GetRollout(id string) (*api.RolloutResource, error) {
+  var rollout api.RolloutResource
+  if err := client.do("GET", "/rollouts/" + escape(id), nil, &rollout); err != nil {
+    return nil, err
+  }
+  return &rollout, nil
+}
+
+func (client *Client) StartRollout(request api.RolloutRequest) (*api.RolloutResource, error) {
+  var rollout api.RolloutResource
+  if err := client.do("POST", "/rollouts", request, &rollout); err != nil {
+    return nil, err
+  }
+  return &rollout, nil
+}
+
+// RolloutAction is one of pause, resume or abort.
+func (client *Client) RolloutAction(id string, action string) (*api.RolloutResource, error) {
+  var rollout api.RolloutResource
+  if err := client.do("POST", "/rollouts/" + escape(id) + "/" + escape(action), nil, &rollout); err != nil {
+    return nil, err
+  }
+  return &rollout, nil
+}
+
+// canaries
+
+func (client *Client) ListCanaries() ([]api.CanaryResource, error) {
+  var canaries []api.CanaryResource
+  err := client.do("GET", "/canaries", nil, &canaries)
+  return canaries, err
+}
+
+func (client *Client) GetCanary(id string) (*api.CanaryResource, error) {
+  var canary api.CanaryResource
+  if err := client.do("GET", "/canaries/" + escape(id), nil, &canary); err != nil {
+    return nil, err
+  }
+  return &canary, nil
+}
+
+func (client *Client) StartCanary(request api.CanaryRequest) (*api.CanaryResource, error) {
+  var canary api.CanaryResource
+  if err := client.do("POST", "/canaries", request, &canary); err != nil {
+    return nil, err
+  }
+  return &canary, nil
+}
+
+// CanaryAction is one of promote or abort.
+func (client *Client) CanaryAction(id string, action string) (*api.CanaryResource, error) {
+  var canary api.CanaryResource
+  if err := client.do("POST", "/canaries/" + escape(id) + "/" + escape(action), nil, &canary); err != nil {
+    return nil, err
+  }
+  return &canary, nil
+}
+
+// history
+
+func (client *Client) ListHistory() ([]api.HistoryEntry, error) {
+  var entries []api.HistoryEntry
+  err := client.do("GET", "/history", nil, &entries)
+  return entries, err
+}
+
+// templates
+
+func (client *Client) ExportTemplate() ([]byte, error) {
+  resp, err := client.request("GET", "/template", nil, nil)
+  if err != nil {
+    return nil, err
+  }
+  defer resp.Body.Close()
+  return ioutil.ReadAll(resp.Body)
+}
+
+func templatePath(path string, name string) string {
+  if "" == name {
+    return path
+  }
+  return path + "?" + url.Values { "name": { name } }.Encode()
+}
+
+// PlanTemplate reports the records applying the template would add and remove.
+func (client *Client) PlanTemplate(name string, content io.Reader) (*api.TemplatePlan, error) {
+  header := http.Header{}
+  header.Set("Content-Type", "text/plain")
+  resp, err := client.request("POST", templatePath("/template/plan", name), header, content)
+  if err != nil {
+    return nil, err
+  }
+  defer resp.Body.Close()
+  var plan api.TemplatePlan
+  if err = json.NewDecoder(resp.Body).Decode(&plan); err != nil {
+    return nil, err
+  }
+  return &plan, nil
+}
+
+// ApplyTemplate replaces the hub configuration with the template.
+func (client *Client) ApplyTemplate(name string, content io.Reader) error {
+  header := http.Header{}
+  header.Set("Content-Type", "text/plain")
+  resp, err := client.request("PUT", templatePath("/template", name), header, content)
+  if err != nil {
+    return err
+  }
+  resp.Body.Close()
+  return nil
+}
+
+// users and tokens
+
+// Me returns the authenticated user.
+func (client *Client) Me() (*api.UserResource, error) {
+  var user api.UserResource
+  if err := client.do("GET", "/me", nil, &user); err != nil {
+    return nil, err
+  }
+  return &user, nil
+}
+
+func (client *Client) ListTokens() ([]api.TokenResource, error) {
+  var tokens []api.TokenResource
+  err := client.do("GET", "/tokens", nil, &tokens)
+  return tokens, err
+}
+
+// CreateToken creates an API token of the authenticated user. the token is returned only once.
+func (client *Client) CreateToken(name string) (*api.CreatedToken, error) {
+  var token api.CreatedToken
+  if err := client.do("POST", "/tokens", api.TokenRequest { Name: name }, &token); err != nil {
+    return nil, err
+  }
+  return &token, nil
+}
+
+func (client *Client) DeleteToken(id string) error {
+  return client.do("DELETE", "/tokens/" + escape(id), nil, nil)
+}
+
+func (client *Client) ListUsers() ([]api.UserResource, error) {
+  var users []api.UserResource
+  err := client.do("GET", "/users", nil, &users)
+  return users, err
+}
+
+// PutUser creates the user or changes role and password. an empty password keeps the current one.
+func (client *Client) PutUser(name string, request api.UserRequest) (*api.UserResource, error) {
+  var user api.UserResource
+  if err := client.do("PUT", "/users/" + escape(name), request, &user); err != nil {
+    return nil, err
+  }
+  return &user, nil
+}
+
+func (client *Client) DeleteUser(name string) error {
+  return client.do("DELETE", "/users/" + escape(name), nil, nil)
+}
+
+// UDPStats returns the queues of the node messages.
+func (client *Client) UDPStats() (*api.UDPStats, error) {
+  var stats api.UDPStats
+  if err := client.do("GET", "/udp", nil, &stats); err != nil {
+    return nil, err
+  }
+  return &stats, nil
+}
+
+// audit
+
+// AuditQuery filters the audit log. zero fields match everything.
+type AuditQuery struct {
+  User string
+  // substring of the action.
+  Action string
+  Since time.Time
+  Failed bool
+  // 0 for all entries. the hub returns 100 entries when nil.
+  Limit *int
+}
+
+func (query AuditQuery) path(format string) string {
+  values := url.Values{}
+  if "" != query.User {
+    values.Set("user", query.User)
+  }
+  if "" != query.Action {
+    values.Set("action", query.Action)
+  }
+  if !query.Since.IsZero() {
+    values.Set("since", query.Since.Format(time.RFC3339))
+  }
+  if query.Failed {
+    values.Set("failed", "true")
+  }
+  if nil != query.Limit {
+    values.Set("limit", strconv.Itoa(*query.Limit))
+  }
+  if "" != format {
+    values.Set("format", format)
+  }
+  if 0 == len(values) {
+    return "/audit"
+  }
+  return "/audit?" + values.Encode()
+}
+
+// ListAudit returns the matching audit entries, newest first.
+func (client *Client) ListAudit(query AuditQuery) ([]api.AuditEntry, error) {
+  var entries []api.AuditEntry
+  err := client.do("GET", query.path(""), nil, &entries)
+  return entries, err
+}
+
+// ExportAudit returns the matching audit entries as csv or json file.
+func (client *Client) ExportAudit(format string, query AuditQuery) (io.ReadCloser, error) {
+  resp, err := client.request("GET", query.path(format), nil, nil)
+  if err != nil {
+    return nil, err
+  }
+  return resp.Body, nil
+}
+
+// events
+
+// Events calls fn for every event of the hub until fn returns an error or the stream ends.
+// the HTTP client must not have a timeout.
+func (client *Client) Events(fn func(api.Event) error) error {
+  header := http.Header{}
+  header.Set("Accept", "text/event-stream")
+  resp, err := client.request("GET", "/events", header, nil)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+  scanner := bufio.NewScanner(resp.Body)
+  scanner.Buffer(make([]byte, 64 * 1024), 16 * 1024 * 1024)
+  event := api.Event{}
+  for scanner.Scan() {
+    line := scanner.Text()
+    switch {
+      case "" == line:
+        if "" != event.Type {
+          if err = fn(event); err != nil {
+            return err
+          }
+        }
+        event = api.Event{}
+      case strings.HasPrefix(line, "event:"):
+        event.Type = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+      case strings.HasPrefix(line, "data:"):
+        event.Data = append(event.Data, strings.TrimSpace(strings.TrimPrefix(line, "data:"))...)
+    }
+  }
+  return scanner.Err()
+}
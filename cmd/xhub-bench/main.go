@@ -0,0 +1,233 @@
+// xhub-bench measures how many node heartbeats the hub handles per second, optionally
+// while readers poll the API.
+//
+//   xhub-bench [--udp HOST:PORT] [--nodes N] [--servers N] [--rounds N] [--window N]
+//              [--timeout DURATION] [--readers N] [--hub URL] [--token TOKEN | --user NAME]
+//
+// every node sends a window of heartbeats followed by a domain query and waits for the
+// answer. the hub answers queries before queued heartbeats, so the round trip is the
+// resolution latency under load. with a token, or --user with the password in
+// $XHUB_PASSWORD, the bench waits until the hub has handled every heartbeat and reports
+// the messages it dropped, as counted by GET /api/udp. readers need the same. nodes send
+// from the loopback addresses 127.0.0.2 and up, so the hub has to run on the same linux
+// host. datagrams dropped by a full socket buffer show up as timeouts.
+package main
+
+import (
+  "github.com/pantaroid/test/client"
+  "flag"
+  "fmt"
+  "net"
+  "os"
+  "sort"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// the hub answers E@NotAssignDomain.
+const queryDomain = "xhub-bench.invalid"
+
+type result struct {
+  heartbeats int
+  // round trips of the domain queries.
+  latencies []time.Duration
+  timeouts int
+  err error
+}
+
+// runNode sends the heartbeats of one node from 127.0.0.<index + 2>.
+func runNode(hub *net.UDPAddr, index int, servers int, rounds int, window int, timeout time.Duration) result {
+  var res result
+  local := &net.UDPAddr { IP: net.IPv4(127, 0, 0, byte(index + 2)) }
+  conn, err := net.DialUDP("udp", local, hub)
+  if err != nil {
+    res.err = err
+    return res
+  }
+  defer conn.Close()
+  buf := make([]byte, 1024)
+  pending := 0
+  query := func() {
+    start := time.Now()
+    conn.Write([]byte("D@" + queryDomain))
+    conn.SetReadDeadline(time.Now().Add(timeout))
+    if _, err := conn.Read(buf); err != nil {
+      res.timeouts++
+    } else {
+      res.latencies = append(res.latencies, time.Since(start))
+    }
+    pending = 0
+  }
+  for round := 0; round < rounds; round++ {
+    for server := 0; server < servers; server++ {
+      if _, err := conn.Write([]byte(fmt.Sprintf("N>:%d", 20000 + server))); err != nil {
+        res.err = err
+        return res
+      }
+      res.heartbeats++
+      pending++
+      if window <= pending {
+        query()
+      }
+    }
+  }
+  if 0 < pending {
+    query()
+  }
+  return res
+}
+
+// handledMessages counts the heartbeats the hub handled or dropped.
+func handledMessages(hub *client.Client) (uint64, error) {
+  stats, err := hub.UDPStats()
+  if err != nil {
+    return 0, err
+  }
+  var count uint64
+  for _, queue := range stats.Queues {
+    if "messages" == queue.Name {
+      count += queue.Handled + queue.Dropped
+    }
+  }
+  return count, nil
+}
+
+func droppedMessages(hub *client.Client) uint64 {
+  stats, err := hub.UDPStats()
+  if err != nil {
+    return 0
+  }
+  var count uint64
+  for _, queue := range stats.Queues {
+    count += queue.Dropped
+  }
+  return count
+}
+
+// percentile expects sorted latencies.
+func percentile(latencies []time.Duration, p int) time.Duration {
+  if 0 == len(latencies) {
+    return 0
+  }
+  return latencies[(len(latencies) - 1) * p / 100]
+}
+
+func main() {
+  udp := flag.String("udp", "127.0.0.1:51701", "UDP address of the hub")
+  nodes := flag.Int("nodes", 50, "simulated nodes, at most 250")
+  servers := flag.Int("servers", 4, "servers per node")
+  rounds := flag.Int("rounds", 100, "heartbeats per server")
+  window := flag.Int("window", 1, "heartbeats sent before waiting for the hub")
+  timeout := flag.Duration("timeout", time.Second, "wait for the answer of the hub")
+  readers := flag.Int("readers", 0, "clients listing the nodes through the API meanwhile")
+  hubURL := flag.String("hub", "http://127.0.0.1:51700", "hub address for the readers")
+  token := flag.String("token", os.Getenv("XHUB_TOKEN"), "API token for the readers")
+  user := flag.String("user", "", "user name for the readers, password from $XHUB_PASSWORD")
+  flag.Parse()
+  if *nodes < 1 || 250 < *nodes || *servers < 1 || *rounds < 1 || *window < 1 || *readers < 0 {
+    flag.Usage()
+    os.Exit(2)
+  }
+  hub, err := net.ResolveUDPAddr("udp", *udp)
+  if err != nil {
+    fmt.Printf("Error: %s\n", err)
+    os.Exit(1)
+  }
+
+  connect := func() *client.Client {
+    hub := client.New(*hubURL)
+    hub.Token = *token
+    if "" != *user {
+      hub.User = *user
+      hub.Password = os.Getenv("XHUB_PASSWORD")
+      hub.Token = ""
+    }
+    return hub
+  }
+  var monitor *client.Client
+  var before, dropped uint64
+  if "" != *token || "" != *user {
+    monitor = connect()
+    if before, err = handledMessages(monitor); err != nil {
+      fmt.Printf("Error: %s\n", err)
+      os.Exit(1)
+    }
+    dropped = droppedMessages(monitor)
+  }
+
+  // readers poll until the nodes are done.
+  done := make(chan struct{})
+  var reads, readErrors int64
+  var polling sync.WaitGroup
+  for i := 0; i < *readers; i++ {
+    reader := connect()
+    polling.Add(1)
+    go func() {
+      defer polling.Done()
+      for {
+        select {
+          case <- done:
+            return
+          default:
+        }
+        if _, err := reader.ListNodes(); err != nil {
+          if 1 == atomic.AddInt64(&readErrors, 1) {
+            fmt.Printf("Error: %s\n", err)
+          }
+        } else {
+          atomic.AddInt64(&reads, 1)
+        }
+      }
+    }()
+  }
+
+  start := time.Now()
+  results := make([]result, *nodes)
+  var senders sync.WaitGroup
+  for i := 0; i < *nodes; i++ {
+    senders.Add(1)
+    go func(i int) {
+      defer senders.Done()
+      results[i] = runNode(hub, i, *servers, *rounds, *window, *timeout)
+    }(i)
+  }
+  senders.Wait()
+  heartbeats := 0
+  for _, res := range results {
+    heartbeats += res.heartbeats
+  }
+  // the last heartbeats may still be queued.
+  for deadline := time.Now().Add(30 * time.Second); nil != monitor && time.Now().Before(deadline); {
+    handled, err := handledMessages(monitor)
+    if err != nil || uint64(heartbeats) <= handled - before {
+      break
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  elapsed := time.Since(start)
+  close(done)
+  polling.Wait()
+
+  timeouts := 0
+  latencies := make([]time.Duration, 0)
+  for i, res := range results {
+    if res.err != nil {
+      fmt.Printf("Error: node %d: %s\n", i, res.err)
+    }
+    timeouts += res.timeouts
+    latencies = append(latencies, res.latencies...)
+  }
+  sort.Slice(latencies, func(i, j int) bool {
+    return latencies[i] < latencies[j]
+  })
+  fmt.Printf("nodes %d, servers %d, heartbeats %d in %s\n", *nodes, *nodes * *servers, heartbeats, elapsed.Round(time.Millisecond))
+  fmt.Printf("heartbeats/s %.0f\n", float64(heartbeats) / elapsed.Seconds())
+  fmt.Printf("resolution round trip p50 %s, p99 %s, timeouts %d\n", percentile(latencies, 50), percentile(latencies, 99), timeouts)
+  if nil != monitor {
+    fmt.Printf("dropped by the hub %d\n", droppedMessages(monitor) - dropped)
+  }
+  if 0 < *readers {
+    fmt.Printf("readers %d, reads/s %.0f, errors %d\n", *readers, float64(reads) / elapsed.Seconds(), readErrors)
+  }
+}
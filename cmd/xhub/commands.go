@@ -0,0 +1,1297 @@
+package main
+
+import (
+  "github.com/pantaroid/test/api"
+  "github.com/pantaroid/test/client"
+  "bytes"
+  "crypto/sha256"
+  "encoding/hex"
+  "flag"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "time"
+)
+
+func init() {
+  register("nodes", "ls", "", "list nodes and their servers", nodesList)
+  register("node", "stop", "<ip>", "stop every server of the node", nodeStop)
+  register("node", "drain", "[--seconds N] <ip>", "drain the node", nodeDrain)
+  register("node", "maintenance", "<ip> on|off", "switch maintenance mode of the node", nodeMaintenance)
+
+  register("server", "ls", "<ip>", "list servers of the node", serverList)
+  register("server", "add", "<ip>", "ask the node to create a server", serverAdd)
+  register("server", "start", "<ip> <port>", "start the server", serverAction("start"))
+  register("server", "stop", "<ip> <port>", "stop the server", serverAction("stop"))
+  register("server", "sync", "<ip> <port>", "synchronize the module of the server", serverAction("sync"))
+  register("server", "rollback", "<ip> <port>", "roll the server back to its previous module", serverAction("rollback"))
+  register("server", "rename", "<ip> <port> <name>", "rename the server", serverRename)
+  register("server", "drain", "[--seconds N] <ip> <port>", "drain the server", serverDrain)
+  register("server", "maintenance", "<ip> <port> on|off", "switch maintenance mode of the server", serverMaintenance)
+
+  register("module", "ls", "[--search TEXT] [--tag TAG] [--label LABEL] [--uploader USER]", "list modules", moduleList)
+  register("module", "show", "<name>", "show the metadata of a module", moduleShow)
+  register("module", "edit", "[--description TEXT] [--version VERSION] [--changelog TEXT] [--tags TAGS] [--node-labels LABELS] <name>", "change the metadata of a module", moduleEdit)
+  register("module", "upload", "[--name NAME] [--description TEXT] [--version VERSION] [--changelog TEXT] [--tags TAGS] [--node-labels LABELS] [--backup] [--signature SIG|--signature-file FILE] [--chunked] [--chunk-size BYTES] [--resume ID] <file>", "upload a module, large ones in resumable chunks", moduleUpload)
+  register("module", "download", "[-o FILE] [--continue] <name>", "download a module", moduleDownload)
+  register("module", "rm", "<name>", "delete a module", moduleRemove)
+  register("module", "set", "<ip> <port> <module>", "set the module of the server", moduleSet)
+  register("module", "rollback", "<name>", "roll back every server running the module", moduleRollback)
+
+  register("domain", "ls", "", "list domains and their assignments", domainList)
+  register("domain", "add", "<domain>", "create the domain", domainAdd)
+  register("domain", "rm", "<domain>", "delete the domain", domainRemove)
+  register("domain", "assign", "[--priority 1|2] <domain> <ip> <port>", "assign the server to the domain", domainAssign)
+  register("domain", "exclude", "<domain> <ip> <port>", "exclude the server from the domain", domainExclude)
+  register("domain", "rollback", "<domain>", "roll back every server of the domain", domainRollback)
+
+  register("template", "export", "[-o FILE]", "export the configuration as template", templateExport)
+  register("template", "plan", "[--name NAME] <file>", "show what applying the template changes", templatePlan)
+  register("template", "apply", "[--name NAME] [--yes] <file>", "replace the configuration with the template", templateApply)
+
+  register("history", "ls", "[--limit N]", "list module changes, newest first", historyList)
+
+  register("user", "me", "", "show the authenticated user", userMe)
+  register("user", "ls", "", "list users", userList)
+  register("user", "add", "[--password PASSWORD] <name> viewer|operator|admin", "create a user or change the role (password from $XHUB_NEW_PASSWORD)", userAdd)
+  register("user", "rm", "<name>", "delete a user", userRemove)
+
+  register("retention", "show", "", "show the retention policy of module backups", retentionShow)
+  register("retention", "set", "[--keep N] [--max-age DAYS] [--interval HOURS]", "change the retention policy, 0 disables a rule", retentionSet)
+  register("retention", "plan", "", "list the backups a run would remove", retentionPlan)
+  register("retention", "run", "", "remove the backups the policy does not keep", retentionRun)
+  register("upload", "ls", "", "list unfinished resumable uploads", uploadList)
+  register("upload", "rm", "<id>", "abort a resumable upload", uploadRemove)
+  register("token", "ls", "", "list API tokens of the authenticated user", tokenList)
+  register("token", "create", "<name>", "create an API token (shown once)", tokenCreate)
+  register("token", "rm", "<id>", "delete an API token", tokenRemove)
+
+  register("udp", "stats", "", "show the queues of the node messages", udpStats)
+  register("config", "reload", "", "make the hub read its config files again", configReload)
+  register("events", "watch", "[--all]", "print state changes as they happen (--all starts with the whole state)", eventsWatch)
+
+  register("audit", "ls", "[--by NAME] [--action TEXT] [--since TIME] [--failed] [--limit N]", "list the audit log, newest first", auditList)
+  register("audit", "export", "[--format csv|json] [-o FILE] [--by NAME] [--action TEXT] [--since TIME] [--failed]", "export the whole audit log", auditExport)
+}
+
+func flagSet(name string) *flag.FlagSet {
+  flags := flag.NewFlagSet(name, flag.ContinueOnError)
+  flags.SetOutput(os.Stderr)
+  return flags
+}
+
+// arguments parses the flags and checks the number of positional arguments.
+func arguments(flags *flag.FlagSet, args []string, count int) ([]string, error) {
+  positional, err := parse(flags, args)
+  if err != nil {
+    return nil, usageError(err.Error())
+  }
+  if count != len(positional) {
+    return nil, usageError(fmt.Sprintf("%d argument(s) expected", count))
+  }
+  return positional, nil
+}
+
+func onOff(value string) (bool, error) {
+  switch value {
+    case "on":
+      return true, nil
+    case "off":
+      return false, nil
+  }
+  return false, usageError("on or off expected")
+}
+
+func yesNo(value bool) string {
+  if value {
+    return "yes"
+  }
+  return ""
+}
+
+// nodes
+
+func serverRow(server api.ServerResource) []string {
+  domains := make([]string, 0, len(server.Assignments))
+  for _, assign := range server.Assignments {
+    domains = append(domains, assign.Domain + "(" + strconv.Itoa(assign.Priority) + ")")
+  }
+  sessions := ""
+  if nil != server.Sessions {
+    sessions = strconv.Itoa(*server.Sessions)
+  }
+  state := server.StatusText
+  if server.Draining {
+    state = state + ",draining"
+  }
+  if server.Maintenance {
+    state = state + ",maintenance"
+  }
+  return []string { server.IP, server.Port, server.Name, state, server.Module, sessions, strings.Join(domains, " ") }
+}
+
+var serverHeader = []string { "NODE", "PORT", "NAME", "STATUS", "MODULE", "SESSIONS", "DOMAINS" }
+
+func nodesList(args []string) error {
+  if _, err := arguments(flagSet("nodes ls"), args, 0); err != nil {
+    return err
+  }
+  nodes, err := connect().ListNodes()
+  if err != nil {
+    return err
+  }
+  if jsonOutput {
+    return printJSON(nodes)
+  }
+  rows := make([][]string, 0)
+  for _, node := range nodes {
+    state := node.StatusText
+    if node.Draining {
+      state = state + ",draining"
+    }
+    if node.Maintenance {
+      state = state + ",maintenance"
+    }
+    rows = append(rows, []string { node.IP, "", "", state, "", "", "" })
+    for _, server := range node.Servers {
+      row := serverRow(server)
+      row[0] = ""
+      rows = append(rows, row)
+    }
+  }
+  printTable(serverHeader, rows)
+  return nil
+}
+
+func printNode(node *api.NodeResource) error {
+  if jsonOutput {
+    return printJSON(node)
+  }
+  fmt.Printf("%s %s\n", node.IP, node.StatusText)
+  return nil
+}
+
+func nodeStop(args []string) error {
+  positional, err := arguments(flagSet("node stop"), args, 1)
+  if err != nil {
+    return err
+  }
+  return connect().StopNode(positional[0])
+}
+
+func nodeDrain(args []string) error {
+  flags := flagSet("node drain")
+  seconds := flags.Int("seconds", 0, "drain period in seconds (hub default when 0)")
+  positional, err := arguments(flags, args, 1)
+  if err != nil {
+    return err
+  }
+  node, err := connect().DrainNode(positional[0], *seconds)
+  if err != nil {
+    return err
+  }
+  return printNode(node)
+}
+
+func nodeMaintenance(args []string) error {
+  positional, err := arguments(flagSet("node maintenance"), args, 2)
+  if err != nil {
+    return err
+  }
+  enabled, err := onOff(positional[1])
+  if err != nil {
+    return err
+  }
+  node, err := connect().PatchNode(positional[0], api.NodePatch { Maintenance: &enabled })
+  if err != nil {
+    return err
+  }
+  return printNode(node)
+}
+
+// servers
+
+func printServer(server *api.ServerResource) error {
+  if jsonOutput {
+    return printJSON(server)
+  }
+  printTable(serverHeader, [][]string { serverRow(*server) })
+  return nil
+}
+
+func serverList(args []string) error {
+  positional, err := arguments(flagSet("server ls"), args, 1)
+  if err != nil {
+    return err
+  }
+  servers, err := connect().ListServers(positional[0])
+  if err != nil {
+    return err
+  }
+  if jsonOutput {
+    return printJSON(servers)
+  }
+  rows := make([][]string, 0, len(servers))
+  for _, server := range servers {
+    rows = append(rows, serverRow(server))
+  }
+  printTable(serverHeader, rows)
+  return nil
+}
+
+func serverAdd(args []string) error {
+  positional, err := arguments(flagSet("server add"), args, 1)
+  if err != nil {
+    return err
+  }
+  return connect().AddServer(positional[0])
+}
+
+func serverAction(action string) func([]string) error {
+  return func(args []string) error {
+    positional, err := arguments(flagSet("server " + action), args, 2)
+    if err != nil {
+      return err
+    }
+    hub := connect()
+    var server *api.ServerResource
+    switch action {
+      case "start":
+        server, err = hub.StartServer(positional[0], positional[1])
+      case "stop":
+        server, err = hub.StopServer(positional[0], positional[1])
+      case "sync":
+        server, err = hub.SyncServer(positional[0], positional[1])
+      case "rollback":
+        server, err = hub.RollbackServer(positional[0], positional[1])
+    }
+    if err != nil {
+      return err
+    }
+    return printServer(server)
+  }
+}
+
+func serverRename(args []string) error {
+  positional, err := arguments(flagSet("server rename"), args, 3)
+  if err != nil {
+    return err
+  }
+  server, err := connect().PatchServer(positional[0], positional[1], api.ServerPatch { Name: &positional[2] })
+  if err != nil {
+    return err
+  }
+  return printServer(server)
+}
+
+func serverDrain(args []string) error {
+  flags := flagSet("server drain")
+  seconds := flags.Int("seconds", 0, "drain period in seconds (hub default when 0)")
+  positional, err := arguments(flags, args, 2)
+  if err != nil {
+    return err
+  }
+  server, err := connect().DrainServer(positional[0], positional[1], *seconds)
+  if err != nil {
+    return err
+  }
+  return printServer(server)
+}
+
+func serverMaintenance(args []string) error {
+  positional, err := arguments(flagSet("server maintenance"), args, 3)
+  if err != nil {
+    return err
+  }
+  enabled, err := onOff(positional[2])
+  if err != nil {
+    return err
+  }
+  server, err := connect().PatchServer(positional[0], positional[1], api.ServerPatch { Maintenance: &enabled })
+  if err != nil {
+    return err
+  }
+  return printServer(server)
+}
+
+// modules
+
+var moduleHeader = []string { "NAME", "VERSION", "SIZE", "MODIFIED", "SIGNED", "TAGS", "DESCRIPTION" }
+
+func moduleRow(module api.ModuleResource) []string {
+  return []string {
+    module.Name,
+    module.Version,
+    strconv.FormatInt(module.Size, 10),
+    module.ModifiedAt.Local().Format("2006-01-02 15:04:05"),
+    yesNo(module.Signed),
+    strings.Join(module.Tags, ","),
+    module.Description,
+  }
+}
+
+// commaList splits the value of a list flag. empty values are nil.
+func commaList(text string) []string {
+  if "" == text {
+    return nil
+  }
+  return strings.Split(text, ",")
+}
+
+func moduleList(args []string) error {
+  flags := flagSet("module ls")
+  search := flags.String("search", "", "substring of name, description, version, changelog, uploader or tags")
+  tag := flags.String("tag", "", "only modules with the tag")
+  label := flags.String("label", "", "only modules for nodes with the label")
+  uploader := flags.String("uploader", "", "only modules uploaded by the user")
+  if _, err := arguments(flags, args, 0); err != nil {
+    return err
+  }
+  modules, err := connect().SearchModules(client.ModuleQuery {
+    Text: *search,
+    Tag: *tag,
+    NodeLabel: *label,
+    Uploader: *uploader,
+  })
+  if err != nil {
+    return err
+  }
+  if jsonOutput {
+    return printJSON(modules)
+  }
+  rows := make([][]string, 0, len(modules))
+  for _, module := range modules {
+    rows = append(rows, moduleRow(module))
+  }
+  printTable(moduleHeader, rows)
+  return nil
+}
+
+func printModule(module *api.ModuleResource) error {
+  if jsonOutput {
+    return printJSON(module)
+  }
+  uploadedAt := "-"
+  if !module.UploadedAt.IsZero() {
+    uploadedAt = module.UploadedAt.Local().Format("2006-01-02 15:04:05")
+  }
+  printTable([]string { "FIELD", "VALUE" }, [][]string {
+    { "name", module.Name },
+    { "version", module.Version },
+    { "description", module.Description },
+    { "size", strconv.FormatInt(module.Size, 10) },
+    { "sha256", module.SHA256 },
+    { "signed", yesNo(module.Signed) },
+    { "modified", module.ModifiedAt.Local().Format("2006-01-02 15:04:05") },
+    { "uploaded", uploadedAt },
+    { "uploader", module.Uploader },
+    { "tags", strings.Join(module.Tags, ",") },
+    { "node labels", strings.Join(module.NodeLabels, ",") },
+  })
+  if "" != module.Changelog {
+    fmt.Printf("\n%s\n", module.Changelog)
+  }
+  return nil
+}
+
+func moduleShow(args []string) error {
+  positional, err := arguments(flagSet("module show"), args, 1)
+  if err != nil {
+    return err
+  }
+  module, err := connect().GetModule(positional[0])
+  if err != nil {
+    return err
+  }
+  return printModule(module)
+}
+
+// moduleEdit changes the given fields only. an empty --tags or --node-labels clears them.
+func moduleEdit(args []string) error {
+  flags := flagSet("module edit")
+  description := flags.String("description", "", "module description")
+  version := flags.String("version", "", "version label")
+  changelog := flags.String("changelog", "", "changes of this version")
+  tags := flags.String("tags", "", "comma separated tags")
+  labels := flags.String("node-labels", "", "comma separated labels of the nodes the module is meant for")
+  positional, err := arguments(flags, args, 1)
+  if err != nil {
+    return err
+  }
+  var patch api.ModulePatch
+  flags.Visit(func(f *flag.Flag) {
+    switch f.Name {
+      case "description":
+        patch.Description = description
+      case "version":
+        patch.Version = version
+      case "changelog":
+        patch.Changelog = changelog
+      case "tags":
+        patch.Tags = append([]string{}, commaList(*tags)...)
+      case "node-labels":
+        patch.NodeLabels = append([]string{}, commaList(*labels)...)
+    }
+  })
+  module, err := connect().PatchModule(positional[0], patch)
+  if err != nil {
+    return err
+  }
+  return printModule(module)
+}
+
+// moduleUpload uploads the file. a signature next to the file (<file>.sig) is sent along.
+func moduleUpload(args []string) error {
+  flags := flagSet("module upload")
+  name := flags.String("name", "", "module name (file name when empty)")
+  description := flags.String("description", "", "module description")
+  version := flags.String("version", "", "version label")
+  changelog := flags.String("changelog", "", "changes of this version")
+  tags := flags.String("tags", "", "comma separated tags")
+  labels := flags.String("node-labels", "", "comma separated labels of the nodes the module is meant for")
+  backup := flags.Bool("backup", false, "keep the replaced module")
+  signature := flags.String("signature", "", "base64 or hex ed25519 signature")
+  signatureFile := flags.String("signature-file", "", "file holding the signature")
+  chunked := flags.Bool("chunked", false, "upload in resumable chunks, the default above 64 MiB")
+  chunkSize := flags.Int("chunk-size", 8 * 1024 * 1024, "bytes per chunk")
+  resume := flags.String("resume", "", "continue the upload with this id")
+  positional, err := arguments(flags, args, 1)
+  if err != nil {
+    return err
+  }
+  path := positional[0]
+  if "" == *name {
+    *name = filepath.Base(path)
+  }
+  if "" == *signature {
+    sigPath := *signatureFile
+    if "" == sigPath {
+      if _, err := os.Stat(path + ".sig"); err == nil {
+        sigPath = path + ".sig"
+      }
+    }
+    if "" != sigPath {
+      blob, err := ioutil.ReadFile(sigPath)
+      if err != nil {
+        return err
+      }
+      *signature = strings.TrimSpace(string(blob))
+    }
+  }
+  var module *api.ModuleResource
+  if *chunked || "" != *resume || chunkedUploadSize < fileSize(path) {
+    module, err = uploadChunked(path, *resume, *chunkSize, api.UploadRequest {
+      Name: *name,
+      Description: *description,
+      Version: *version,
+      Changelog: *changelog,
+      Tags: commaList(*tags),
+      NodeLabels: commaList(*labels),
+      Backup: *backup,
+      Signature: *signature,
+    })
+  } else {
+    var file io.ReadCloser
+    file, err = open(path)
+    if err != nil {
+      return err
+    }
+    defer file.Close()
+    module, err = connect().UploadModule(*name, file, client.UploadOptions {
+      Description: *description,
+      Version: *version,
+      Changelog: *changelog,
+      Tags: commaList(*tags),
+      NodeLabels: commaList(*labels),
+      Backup: *backup,
+      Signature: *signature,
+    })
+  }
+  if err != nil {
+    return err
+  }
+  if jsonOutput {
+    return printJSON(module)
+  }
+  printTable(moduleHeader, [][]string { moduleRow(*module) })
+  return nil
+}
+
+// files larger than this are uploaded in chunks.
+const chunkedUploadSize = 64 * 1024 * 1024
+
+// fileSize is 0 for stdin and missing files.
+func fileSize(path string) int64 {
+  if "-" == path {
+    return 0
+  }
+  stat, err := os.Stat(path)
+  if err != nil {
+    return 0
+  }
+  return stat.Size()
+}
+
+// uploadChunked sends the file through a resumable upload. on failure the error
+// tells how to continue.
+func uploadChunked(path string, id string, chunkSize int, request api.UploadRequest) (*api.ModuleResource, error) {
+  if "-" == path {
+    return nil, usageError("chunked uploads need a file")
+  }
+  if chunkSize <= 0 {
+    return nil, usageError("--chunk-size must be positive")
+  }
+  file, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+  hash := sha256.New()
+  size, err := io.Copy(hash, file)
+  if err != nil {
+    return nil, err
+  }
+  request.Size = size
+  upload := &client.ChunkedUpload {
+    Client: connect(),
+    ID: id,
+    ChunkSize: chunkSize,
+    Retries: 5,
+    Progress: func(state *api.UploadResource) {
+      fmt.Fprintf(os.Stderr, "\r%s: %d / %d bytes", request.Name, state.Offset, state.Size)
+    },
+  }
+  module, err := upload.Upload(request, file, hex.EncodeToString(hash.Sum(nil)))
+  fmt.Fprintln(os.Stderr)
+  if apiErr, ok := err.(*client.Error); ok && http.StatusNotFound == apiErr.StatusCode {
+    return nil, err
+  }
+  if err != nil && "" != upload.ID {
+    return nil, fmt.Errorf("%s (continue with --resume %s)", err, upload.ID)
+  }
+  return module, err
+}
+
+func moduleDownload(args []string) error {
+  flags := flagSet("module download")
+  output := flags.String("o", "", "output file (module name when empty, - for stdout)")
+  resume := flags.Bool("continue", false, "resume a partial download of the output file")
+  positional, err := arguments(flags, args, 1)
+  if err != nil {
+    return err
+  }
+  path := *output
+  if "" == path {
+    path = filepath.Base(positional[0])
+  }
+  if *resume && "-" == path {
+    return usageError("--continue needs an output file")
+  }
+  var offset int64
+  if *resume {
+    // one byte back, so that a complete file still gets an answer with the hash.
+    if stat, err := os.Stat(path); err == nil && 1 < stat.Size() {
+      offset = stat.Size() - 1
+    }
+  }
+  download, err := connect().DownloadModuleFrom(positional[0], offset)
+  if err != nil {
+    return err
+  }
+  defer download.Content.Close()
+
+  hash := sha256.New()
+  var out io.Writer = os.Stdout
+  if "-" != path {
+    var file *os.File
+    if 0 < download.Offset {
+      file, err = os.OpenFile(path, os.O_RDWR, 0644)
+      if err == nil {
+        // the hash covers the part already downloaded.
+        if _, err = io.CopyN(hash, file, download.Offset); err == nil {
+          err = file.Truncate(download.Offset)
+        }
+      }
+    } else {
+      file, err = os.Create(path)
+    }
+    if err != nil {
+      return err
+    }
+    defer file.Close()
+    out = file
+  }
+  if _, err = io.Copy(io.MultiWriter(out, hash), download.Content); err != nil {
+    return err
+  }
+  if "" != download.SHA256 && hex.EncodeToString(hash.Sum(nil)) != download.SHA256 {
+    return fmt.Errorf("%s: sha256 mismatch, the module may have changed; download it again without --continue", path)
+  }
+  return nil
+}
+
+func moduleRemove(args []string) error {
+  positional, err := arguments(flagSet("module rm"), args, 1)
+  if err != nil {
+    return err
+  }
+  return connect().DeleteModule(positional[0])
+}
+
+func moduleSet(args []string) error {
+  positional, err := arguments(flagSet("module set"), args, 3)
+  if err != nil {
+    return err
+  }
+  server, err := connect().SetModule(positional[0], positional[1], positional[2])
+  if err != nil {
+    return err
+  }
+  return printServer(server)
+}
+
+func printRolledBack(count int) error {
+  if jsonOutput {
+    return printJSON(api.RollbackResponse { RolledBack: count })
+  }
+  fmt.Printf("%d server(s) rolled back\n", count)
+  return nil
+}
+
+func moduleRollback(args []string) error {
+  positional, err := arguments(flagSet("module rollback"), args, 1)
+  if err != nil {
+    return err
+  }
+  count, err := connect().RollbackModule(positional[0])
+  if err != nil {
+    return err
+  }
+  return printRolledBack(count)
+}
+
+// domains
+
+func domainList(args []string) error {
+  if _, err := arguments(flagSet("domain ls"), args, 0); err != nil {
+    return err
+  }
+  domains, err := connect().ListDomains()
+  if err != nil {
+    return err
+  }
+  if jsonOutput {
+    return printJSON(domains)
+  }
+  rows := make([][]string, 0)
+  for _, domain := range domains {
+    if 0 == len(domain.Assignments) {
+      rows = append(rows, []string { domain.Key, "", "", "" })
+    }
+    for _, assign := range domain.Assignments {
+      rows = append(rows, []string { domain.Key, assign.IP, assign.Port, strconv.Itoa(assign.Priority) })
+    }
+  }
+  printTable([]string { "DOMAIN", "NODE", "PORT", "PRIORITY" }, rows)
+  return nil
+}
+
+func domainAdd(args []string) error {
+  positional, err := arguments(flagSet("domain add"), args, 1)
+  if err != nil {
+    return err
+  }
+  domain, err := connect().PutDomain(positional[0])
+  if err != nil {
+    return err
+  }
+  if jsonOutput {
+    return printJSON(domain)
+  }
+  return nil
+}
+
+func domainRemove(args []string) error {
+  positional, err := arguments(flagSet("domain rm"), args, 1)
+  if err != nil {
+    return err
+  }
+  return connect().DeleteDomain(positional[0])
+}
+
+func domainAssign(args []string) error {
+  flags := flagSet("domain assign")
+  priority := flags.Int("priority", 1, "1 (primary) or 2 (secondary)")
+  positional, err := arguments(flags, args, 3)
+  if err != nil {
+    return err
+  }
+  assignment, err := connect().Assign(positional[0], positional[1], positional[2], *priority)
+  if err != nil {
+    return err
+  }
+  if jsonOutput {
+    return printJSON(assignment)
+  }
+  return nil
+}
+
+func domainExclude(args []string) error {
+  positional, err := arguments(flagSet("domain exclude"), args, 3)
+  if err != nil {
+    return err
+  }
+  return connect().Exclude(positional[0], positional[1], positional[2])
+}
+
+func domainRollback(args []string) error {
+  positional, err := arguments(flagSet("domain rollback"), args, 1)
+  if err != nil {
+    return err
+  }
+  count, err := connect().RollbackDomain(positional[0])
+  if err != nil {
+    return err
+  }
+  return printRolledBack(count)
+}
+
+// templates
+
+func templateExport(args []string) error {
+  flags := flagSet("template export")
+  output := flags.String("o", "-", "output file")
+  if _, err := arguments(flags, args, 0); err != nil {
+    return err
+  }
+  template, err := connect().ExportTemplate()
+  if err != nil {
+    return err
+  }
+  if "-" == *output {
+    _, err = os.Stdout.Write(template)
+    return err
+  }
+  return ioutil.WriteFile(*output, template, 0644)
+}
+
+func readTemplate(path string) ([]byte, error) {
+  file, err := open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+  return ioutil.ReadAll(file)
+}
+
+func printPlan(plan *api.TemplatePlan) error {
+  if jsonOutput {
+    return printJSON(plan)
+  }
+  for _, line := range plan.Removed {
+    fmt.Println("- " + line)
+  }
+  for _, line := range plan.Added {
+    fmt.Println("+ " + line)
+  }
+  fmt.Printf("%d to add, %d to remove\n", len(plan.Added), len(plan.Removed))
+  return nil
+}
+
+func templatePlan(args []string) error {
+  flags := flagSet("template plan")
+  name := flags.String("name", "", "template name (file name when empty)")
+  positional, err := arguments(flags, args, 1)
+  if err != nil {
+    return err
+  }
+  template, err := readTemplate(positional[0])
+  if err != nil {
+    return err
+  }
+  if "" == *name && "-" != positional[0] {
+    *name = filepath.Base(positional[0])
+  }
+  plan, err := connect().PlanTemplate(*name, bytes.NewReader(template))
+  if err != nil {
+    return err
+  }
+  return printPlan(plan)
+}
+
+// templateApply shows the plan and applies it. without --yes it asks first.
+func templateApply(args []string) error {
+  flags := flagSet("template apply")
+  name := flags.String("name", "", "template name (file name when empty)")
+  yes := flags.Bool("yes", false, "apply without confirmation")
+  positional, err := arguments(flags, args, 1)
+  if err != nil {
+    return err
+  }
+  template, err := readTemplate(positional[0])
+  if err != nil {
+    return err
+  }
+  if "" == *name && "-" != positional[0] {
+    *name = filepath.Base(positional[0])
+  }
+  hub := connect()
+  if !*yes {
+    if "-" == positional[0] {
+      return usageError("--yes is required when the template is read from stdin")
+    }
+    plan, err := hub.PlanTemplate(*name, bytes.NewReader(template))
+    if err != nil {
+      return err
+    }
+    printPlan(plan)
+    fmt.Print("apply? [y/N] ")
+    var answer string
+    fmt.Scanln(&answer)
+    if "y" != strings.ToLower(answer) && "yes" != strings.ToLower(answer) {
+      return fmt.Errorf("not applied")
+    }
+  }
+  return hub.ApplyTemplate(*name, bytes.NewReader(template))
+}
+
+// history
+
+func historyList(args []string) error {
+  flags := flagSet("history ls")
+  limit := flags.Int("limit", 20, "number of entries (0 for all)")
+  if _, err := arguments(flags, args, 0); err != nil {
+    return err
+  }
+  entries, err := connect().ListHistory()
+  if err != nil {
+    return err
+  }
+  if 0 < *limit && *limit < len(entries) {
+    entries = entries[:*limit]
+  }
+  if jsonOutput {
+    return printJSON(entries)
+  }
+  rows := make([][]string, 0, len(entries))
+  for _, entry := range entries {
+    rows = append(rows, []string { entry.Time.Local().Format("2006-01-02 15:04:05"), entry.Action, entry.Target, entry.Module, entry.Previous })
+  }
+  printTable([]string { "TIME", "ACTION", "TARGET", "MODULE", "PREVIOUS" }, rows)
+  return nil
+}
+
+// users and tokens
+
+func userMe(args []string) error {
+  if _, err := arguments(flagSet("user me"), args, 0); err != nil {
+    return err
+  }
+  user, err := connect().Me()
+  if err != nil {
+    return err
+  }
+  if jsonOutput {
+    return printJSON(user)
+  }
+  fmt.Printf("%s %s\n", user.Name, user.Role)
+  return nil
+}
+
+func userList(args []string) error {
+  if _, err := arguments(flagSet("user ls"), args, 0); err != nil {
+    return err
+  }
+  users, err := connect().ListUsers()
+  if err != nil {
+    return err
+  }
+  if jsonOutput {
+    return printJSON(users)
+  }
+  rows := make([][]string, 0, len(users))
+  for _, user := range users {
+    rows = append(rows, []string { user.Name, user.Role })
+  }
+  printTable([]string { "NAME", "ROLE" }, rows)
+  return nil
+}
+
+func userAdd(args []string) error {
+  flags := flagSet("user add")
+  password := flags.String("password", os.Getenv("XHUB_NEW_PASSWORD"), "password, required for new users")
+  positional, err := arguments(flags, args, 2)
+  if err != nil {
+    return err
+  }
+  user, err := connect().PutUser(positional[0], api.UserRequest { Role: positional[1], Password: *password })
+  if err != nil {
+    return err
+  }
+  if jsonOutput {
+    return printJSON(user)
+  }
+  return nil
+}
+
+func userRemove(args []string) error {
+  positional, err := arguments(flagSet("user rm"), args, 1)
+  if err != nil {
+    return err
+  }
+  return connect().DeleteUser(positional[0])
+}
+
+func printRetention(policy *api.RetentionPolicy) error {
+  if jsonOutput {
+    return printJSON(policy)
+  }
+  text := func(value int, unit string) string {
+    if 0 == value {
+      return "-"
+    }
+    return fmt.Sprintf("%d%s", value, unit)
+  }
+  at := func(value time.Time) string {
+    if value.IsZero() {
+      return "-"
+    }
+    return value.Local().Format("2006-01-02 15:04:05")
+  }
+  printTable([]string { "KEEP", "MAX AGE", "INTERVAL", "LAST RUN", "NEXT RUN" }, [][]string {
+    { text(policy.KeepVersions, ""), text(policy.MaxAgeDays, "d"), text(policy.IntervalHours, "h"), at(policy.LastRunAt), at(policy.NextRunAt) },
+  })
+  return nil
+}
+
+func retentionShow(args []string) error {
+  if _, err := arguments(flagSet("retention show"), args, 0); err != nil {
+    return err
+  }
+  policy, err := connect().GetRetention()
+  if err != nil {
+    return err
+  }
+  return printRetention(policy)
+}
+
+// retentionSet changes the given rules and keeps the others.
+func retentionSet(args []string) error {
+  flags := flagSet("retention set")
+  keep := flags.Int("keep", -1, "versions kept per module, the current one included")
+  maxAge := flags.Int("max-age", -1, "days after which backups are removed")
+  interval := flags.Int("interval", -1, "hours between scheduled runs")
+  if _, err := arguments(flags, args, 0); err != nil {
+    return err
+  }
+  hub := connect()
+  policy, err := hub.GetRetention()
+  if err != nil {
+    return err
+  }
+  if 0 <= *keep {
+    policy.KeepVersions = *keep
+  }
+  if 0 <= *maxAge {
+    policy.MaxAgeDays = *maxAge
+  }
+  if 0 <= *interval {
+    policy.IntervalHours = *interval
+  }
+  policy, err = hub.PutRetention(api.RetentionPolicy {
+    KeepVersions: policy.KeepVersions,
+    MaxAgeDays: policy.MaxAgeDays,
+    IntervalHours: policy.IntervalHours,
+  })
+  if err != nil {
+    return err
+  }
+  return printRetention(policy)
+}
+
+func printRetentionPlan(plan *api.RetentionPlan, action string) error {
+  if jsonOutput {
+    return printJSON(plan)
+  }
+  rows := make([][]string, 0, len(plan.Delete) + len(plan.Keep))
+  for _, item := range plan.Delete {
+    result := action
+    if "" != item.Error {
+      result = "failed: " + item.Error
+    }
+    rows = append(rows, []string { item.Name, item.Module, result, item.Reason })
+  }
+  for _, item := range plan.Keep {
+    rows = append(rows, []string { item.Name, item.Module, "keep", item.Reason })
+  }
+  printTable([]string { "BACKUP", "MODULE", "ACTION", "REASON" }, rows)
+  return nil
+}
+
+func retentionPlan(args []string) error {
+  if _, err := arguments(flagSet("retention plan"), args, 0); err != nil {
+    return err
+  }
+  plan, err := connect().PlanRetention()
+  if err != nil {
+    return err
+  }
+  return printRetentionPlan(plan, "delete")
+}
+
+func retentionRun(args []string) error {
+  if _, err := arguments(flagSet("retention run"), args, 0); err != nil {
+    return err
+  }
+  plan, err := connect().RunRetention()
+  if err != nil {
+    return err
+  }
+  return printRetentionPlan(plan, "deleted")
+}
+
+func configReload(args []string) error {
+  if _, err := arguments(flagSet("config reload"), args, 0); err != nil {
+    return err
+  }
+  result, err := connect().ReloadConfig()
+  if err != nil {
+    return err
+  }
+  if jsonOutput {
+    return printJSON(result)
+  }
+  rows := make([][]string, 0, len(result.Changes) + len(result.Restart))
+  for _, change := range result.Changes {
+    rows = append(rows, []string { change.Setting, change.From, change.To, "now" })
+  }
+  for _, change := range result.Restart {
+    rows = append(rows, []string { change.Setting, change.From, change.To, "after restart" })
+  }
+  if 0 == len(rows) {
+    fmt.Println("nothing changed")
+    return nil
+  }
+  printTable([]string { "SETTING", "FROM", "TO", "APPLIED" }, rows)
+  return nil
+}
+
+func uploadList(args []string) error {
+  if _, err := arguments(flagSet("upload ls"), args, 0); err != nil {
+    return err
+  }
+  uploads, err := connect().ListUploads()
+  if err != nil {
+    return err
+  }
+  if jsonOutput {
+    return printJSON(uploads)
+  }
+  rows := make([][]string, 0, len(uploads))
+  for _, upload := range uploads {
+    rows = append(rows, []string {
+      upload.ID,
+      upload.Name,
+      fmt.Sprintf("%d / %d", upload.Offset, upload.Size),
+      upload.User,
+      upload.ExpiresAt.Local().Format("2006-01-02 15:04:05"),
+    })
+  }
+  printTable([]string { "ID", "NAME", "RECEIVED", "USER", "EXPIRES" }, rows)
+  return nil
+}
+
+func uploadRemove(args []string) error {
+  positional, err := arguments(flagSet("upload rm"), args, 1)
+  if err != nil {
+    return err
+  }
+  return connect().AbortUpload(positional[0])
+}
+
+func tokenList(args []string) error {
+  if _, err := arguments(flagSet("token ls"), args, 0); err != nil {
+    return err
+  }
+  tokens, err := connect().ListTokens()
+  if err != nil {
+    return err
+  }
+  if jsonOutput {
+    return printJSON(tokens)
+  }
+  rows := make([][]string, 0, len(tokens))
+  for _, token := range tokens {
+    used := ""
+    if !token.LastUsedAt.IsZero() {
+      used = token.LastUsedAt.Local().Format("2006-01-02 15:04:05")
+    }
+    rows = append(rows, []string { token.ID, token.Name, token.CreatedAt.Local().Format("2006-01-02 15:04:05"), used })
+  }
+  printTable([]string { "ID", "NAME", "CREATED", "LAST USED" }, rows)
+  return nil
+}
+
+func tokenCreate(args []string) error {
+  positional, err := arguments(flagSet("token create"), args, 1)
+  if err != nil {
+    return err
+  }
+  token, err := connect().CreateToken(positional[0])
+  if err != nil {
+    return err
+  }
+  if jsonOutput {
+    return printJSON(token)
+  }
+  fmt.Println(token.Token)
+  return nil
+}
+
+func tokenRemove(args []string) error {
+  positional, err := arguments(flagSet("token rm"), args, 1)
+  if err != nil {
+    return err
+  }
+  return connect().DeleteToken(positional[0])
+}
+
+// udp
+
+func udpStats(args []string) error {
+  if _, err := arguments(flagSet("udp stats"), args, 0); err != nil {
+    return err
+  }
+  stats, err := connect().UDPStats()
+  if err != nil {
+    return err
+  }
+  if jsonOutput {
+    return printJSON(stats)
+  }
+  fmt.Printf("workers %d, received %d\n", stats.Workers, stats.Received)
+  rows := make([][]string, 0, len(stats.Queues))
+  for _, queue := range stats.Queues {
+    rows = append(rows, []string {
+      queue.Name,
+      fmt.Sprintf("%d/%d", queue.Depth, queue.Capacity),
+      strconv.FormatUint(queue.Handled, 10),
+      strconv.FormatUint(queue.Dropped, 10),
+    })
+  }
+  printTable([]string { "QUEUE", "DEPTH", "HANDLED", "DROPPED" }, rows)
+  return nil
+}
+
+// events
+
+func eventsWatch(args []string) error {
+  flags := flagSet("events watch")
+  all := flags.Bool("all", false, "print the initial state too")
+  if _, err := arguments(flags, args, 0); err != nil {
+    return err
+  }
+  ready := *all
+  return connect().Events(func(event api.Event) error {
+    if "ready" == event.Type {
+      ready = true
+      return nil
+    }
+    if !ready {
+      return nil
+    }
+    if jsonOutput {
+      return printJSON(event)
+    }
+    fmt.Printf("%s %s %s\n", time.Now().Format("2006-01-02 15:04:05"), event.Type, event.Data)
+    return nil
+  })
+}
+
+// audit
+
+// auditFlags registers the filter flags shared by audit ls and export.
+func auditFlags(flags *flag.FlagSet) func() (client.AuditQuery, error) {
+  by := flags.String("by", "", "only actions of the user")
+  action := flags.String("action", "", "only actions containing the text")
+  since := flags.String("since", "", "only actions since the time (RFC3339, e.g. 2006-01-02T15:04:05Z)")
+  failed := flags.Bool("failed", false, "only failed actions")
+  return func() (client.AuditQuery, error) {
+    query := client.AuditQuery { User: *by, Action: *action, Failed: *failed }
+    if "" != *since {
+      value, err := time.Parse(time.RFC3339, *since)
+      if err != nil {
+        return query, usageError("invalid --since: " + err.Error())
+      }
+      query.Since = value
+    }
+    return query, nil
+  }
+}
+
+func auditList(args []string) error {
+  flags := flagSet("audit ls")
+  filter := auditFlags(flags)
+  limit := flags.Int("limit", 50, "number of entries (0 for all)")
+  if _, err := arguments(flags, args, 0); err != nil {
+    return err
+  }
+  query, err := filter()
+  if err != nil {
+    return err
+  }
+  query.Limit = limit
+  entries, err := connect().ListAudit(query)
+  if err != nil {
+    return err
+  }
+  if jsonOutput {
+    return printJSON(entries)
+  }
+  rows := make([][]string, 0, len(entries))
+  for _, entry := range entries {
+    rows = append(rows, []string { entry.Time.Local().Format("2006-01-02 15:04:05"), entry.User, entry.IP, entry.Source, entry.Action, entry.Result })
+  }
+  printTable([]string { "TIME", "USER", "IP", "SOURCE", "ACTION", "RESULT" }, rows)
+  return nil
+}
+
+func auditExport(args []string) error {
+  flags := flagSet("audit export")
+  filter := auditFlags(flags)
+  format := flags.String("format", "csv", "csv or json")
+  output := flags.String("o", "-", "output file (- for stdout)")
+  if _, err := arguments(flags, args, 0); err != nil {
+    return err
+  }
+  if "csv" != *format && "json" != *format {
+    return usageError("--format must be csv or json")
+  }
+  query, err := filter()
+  if err != nil {
+    return err
+  }
+  all := 0
+  query.Limit = &all
+  content, err := connect().ExportAudit(*format, query)
+  if err != nil {
+    return err
+  }
+  defer content.Close()
+  var out io.Writer = os.Stdout
+  if "-" != *output {
+    file, err := os.Create(*output)
+    if err != nil {
+      return err
+    }
+    defer file.Close()
+    out = file
+  }
+  _, err = io.Copy(out, content)
+  return err
+}
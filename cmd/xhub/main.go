@@ -0,0 +1,180 @@
+// xhub operates the hub through its HTTP API.
+//
+//   xhub [--hub URL] [--token TOKEN | --user NAME] [--json] <group> <command> [flags] [args]
+//
+// the hub address defaults to $XHUB_URL or http://127.0.0.1:51700, the token to $XHUB_TOKEN.
+// with --user the password is read from $XHUB_PASSWORD or asked for.
+package main
+
+import (
+  "github.com/pantaroid/test/client"
+  "bufio"
+  "encoding/json"
+  "flag"
+  "fmt"
+  "io"
+  "os"
+  "sort"
+  "strings"
+  "text/tabwriter"
+)
+
+const defaultHub = "http://127.0.0.1:51700"
+
+var (
+  hubURL = defaultHub
+  hubToken = ""
+  hubUser = ""
+  jsonOutput = false
+)
+
+type command struct {
+  usage string
+  summary string
+  run func(args []string) error
+}
+
+// commands by group and name. registered in commands.go.
+var commands = map[string]map[string]*command{}
+
+func register(group string, name string, usage string, summary string, run func([]string) error) {
+  if nil == commands[group] {
+    commands[group] = map[string]*command{}
+  }
+  commands[group][name] = &command { usage: usage, summary: summary, run: run }
+}
+
+// connect returns the client of the hub. call it after the flags are parsed.
+func connect() *client.Client {
+  hub := client.New(hubURL)
+  hub.Token = hubToken
+  if "" != hubUser {
+    hub.User = hubUser
+    hub.Password = os.Getenv("XHUB_PASSWORD")
+    if "" == hub.Password {
+      fmt.Fprintf(os.Stderr, "password for %s: ", hubUser)
+      hub.Password, _ = bufio.NewReader(os.Stdin).ReadString('\n')
+      hub.Password = strings.TrimRight(hub.Password, "\r\n")
+    }
+    hub.Token = ""
+  }
+  return hub
+}
+
+// globalFlags adds the flags every command accepts.
+func globalFlags(flags *flag.FlagSet) {
+  flags.StringVar(&hubURL, "hub", hubURL, "hub address")
+  flags.StringVar(&hubToken, "token", hubToken, "API token")
+  flags.StringVar(&hubUser, "user", hubUser, "user name for basic authentication")
+  flags.BoolVar(&jsonOutput, "json", jsonOutput, "print JSON")
+}
+
+// parse parses the command flags. flags may follow the arguments.
+func parse(flags *flag.FlagSet, args []string) ([]string, error) {
+  globalFlags(flags)
+  positional := make([]string, 0)
+  for {
+    if err := flags.Parse(args); err != nil {
+      return nil, err
+    }
+    args = flags.Args()
+    if 0 == len(args) {
+      return positional, nil
+    }
+    positional = append(positional, args[0])
+    args = args[1:]
+  }
+}
+
+func usage() {
+  out := os.Stderr
+  fmt.Fprintln(out, "usage: xhub [--hub URL] [--token TOKEN | --user NAME] [--json] <group> <command> [flags] [args]")
+  fmt.Fprintln(out)
+  groups := make([]string, 0, len(commands))
+  for group := range commands {
+    groups = append(groups, group)
+  }
+  sort.Strings(groups)
+  for _, group := range groups {
+    names := make([]string, 0, len(commands[group]))
+    for name := range commands[group] {
+      names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+      cmd := commands[group][name]
+      fmt.Fprintf(out, "  %s %s %s\n      %s\n", group, name, cmd.usage, cmd.summary)
+    }
+  }
+}
+
+// printJSON writes v indented to stdout.
+func printJSON(v interface{}) error {
+  blob, err := json.MarshalIndent(v, "", "  ")
+  if err != nil {
+    return err
+  }
+  _, err = fmt.Println(string(blob))
+  return err
+}
+
+// printTable writes the rows aligned under the header.
+func printTable(header []string, rows [][]string) {
+  w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+  fmt.Fprintln(w, strings.Join(header, "\t"))
+  for _, row := range rows {
+    fmt.Fprintln(w, strings.Join(row, "\t"))
+  }
+  w.Flush()
+}
+
+// open returns stdin for "-".
+func open(path string) (io.ReadCloser, error) {
+  if "-" == path {
+    return os.Stdin, nil
+  }
+  return os.Open(path)
+}
+
+func main() {
+  if env := os.Getenv("XHUB_URL"); "" != env {
+    hubURL = env
+  }
+  hubToken = os.Getenv("XHUB_TOKEN")
+  flags := flag.NewFlagSet("xhub", flag.ExitOnError)
+  flags.Usage = usage
+  globalFlags(flags)
+  flags.Parse(os.Args[1:])
+  args := flags.Args()
+  if len(args) < 2 {
+    usage()
+    os.Exit(2)
+  }
+  group, has := commands[args[0]]
+  if !has {
+    fmt.Fprintf(os.Stderr, "unknown group: %s\n", args[0])
+    usage()
+    os.Exit(2)
+  }
+  cmd, has := group[args[1]]
+  if !has {
+    fmt.Fprintf(os.Stderr, "unknown command: %s %s\n", args[0], args[1])
+    usage()
+    os.Exit(2)
+  }
+  err := cmd.run(args[2:])
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+    if _, ok := err.(usageError); ok {
+      fmt.Fprintf(os.Stderr, "usage: xhub %s %s %s\n", args[0], args[1], cmd.usage)
+      os.Exit(2)
+    }
+    os.Exit(1)
+  }
+}
+
+type usageError string
+
+func (err usageError) Error() string {
+  return string(err)
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+  "gopkg.in/yaml.v3"
+  "bytes"
+  "crypto/tls"
+  "flag"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+const defaultConfigFile = "xhub.yaml"
+
+// Config holds the ports, paths and timing of the hub. the values are taken from the
+// defaults, the config file, the XHUB_* environment variables and the flags, in this order.
+//
+// the files named in Paths stay JSON: the hub writes the users, the history, the rollouts
+// and the last retention run itself, and the storage and OIDC files hold credentials,
+// which are kept out of --print-config and the changes reported by reloads. the users,
+// the retention policy, OIDC and the trusted keys are read again by reloads.
+type Config struct {
+  Listen ListenConfig `yaml:"listen"`
+  // UDP port on which the nodes receive commands.
+  NodePort int `yaml:"nodePort"`
+  Paths PathsConfig `yaml:"paths"`
+  TLS TLSConfig `yaml:"tls"`
+  Timing TimingConfig `yaml:"timing"`
+  // send the shutdown message to the nodes when the hub stops.
+  NotifyNodes bool `yaml:"notifyNodes"`
+  // largest module the uploads of the API take, in bytes.
+  MaxUploadSize int `yaml:"maxUploadSize"`
+}
+
+type ListenConfig struct {
+  HTTP string `yaml:"http"`
+  // node messages.
+  UDP string `yaml:"udp"`
+}
+
+// PathsConfig is bound at startup, reloads keep the running paths.
+type PathsConfig struct {
+  // modules of the local storage, unless the storage file sets a directory.
+  Files string `yaml:"files"`
+  // parts of unfinished uploads.
+  Uploads string `yaml:"uploads"`
+  AutoBackup string `yaml:"autoBackup"`
+  Users string `yaml:"users"`
+  History string `yaml:"history"`
+  // rollouts in progress and the last finished ones, written with the auto backup.
+  Rollouts string `yaml:"rollouts"`
+  // JSON lines.
+  Audit string `yaml:"audit"`
+  Retention string `yaml:"retention"`
+  // S3 or a directory other than Files.
+  Storage string `yaml:"storage"`
+  OIDC string `yaml:"oidc"`
+  // public keys of module signatures, one per line.
+  TrustedKeys string `yaml:"trustedKeys"`
+}
+
+// TLSConfig serves HTTPS when both files are set.
+type TLSConfig struct {
+  Cert string `yaml:"cert"`
+  Key string `yaml:"key"`
+}
+
+// TimingConfig takes durations such as "15s" or "500ms".
+type TimingConfig struct {
+  // nodes and servers without a heartbeat for this long move to warning.
+  HeartbeatWarning time.Duration `yaml:"heartbeatWarning"`
+  // and then to danger.
+  HeartbeatDanger time.Duration `yaml:"heartbeatDanger"`
+  // auto backup. changes of the last interval are lost when the hub dies.
+  FlushInterval time.Duration `yaml:"flushInterval"`
+  // time given to requests in progress when the hub stops.
+  ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+  // unfinished uploads without a chunk for this long are removed.
+  UploadTimeout time.Duration `yaml:"uploadTimeout"`
+}
+
+func defaultConfig() *Config {
+  return &Config {
+    Listen: ListenConfig { HTTP: ":51700", UDP: ":51701" },
+    NodePort: 51710,
+    Paths: PathsConfig {
+      Files: "files",
+      Uploads: "uploads",
+      AutoBackup: "xht_autobackup.txt",
+      Users: "xhub_users.json",
+      History: "xhub_history.json",
+      Rollouts: "xhub_rollouts.json",
+      Audit: "xhub_audit.log",
+      Retention: "xhub_retention.json",
+      Storage: "xhub_storage.json",
+      OIDC: "xhub_oidc.json",
+      TrustedKeys: "xhub_trusted_keys.txt",
+    },
+    Timing: TimingConfig {
+      HeartbeatWarning: 15 * time.Second,
+      HeartbeatDanger: 30 * time.Second,
+      FlushInterval: 5 * time.Second,
+      ShutdownTimeout: 15 * time.Second,
+      UploadTimeout: 24 * time.Hour,
+    },
+    MaxUploadSize: 1 << 30,
+  }
+}
+
+// the running config, replaced as a whole by reloads. the lock also guards the OIDC
+// provider and the trusted keys, which are reloaded with it.
+var (
+  reloadable sync.RWMutex
+  hubConfig = defaultConfig()
+)
+
+func currentConfig() *Config {
+  reloadable.RLock()
+  defer reloadable.RUnlock()
+  return hubConfig
+}
+
+// setting is a value of the config which the environment and the flags override.
+type setting struct {
+  // name of the flag. the environment variable is XHUB_ and the name in upper case.
+  name string
+  usage string
+  boolean bool
+  set func(text string) error
+}
+
+func (s setting) env() string {
+  return "XHUB_" + strings.ToUpper(strings.Replace(s.name, "-", "_", -1))
+}
+
+func stringSetting(name string, usage string, value *string) setting {
+  return setting { name: name, usage: usage, set: func(text string) error {
+    *value = text
+    return nil
+  }}
+}
+
+func intSetting(name string, usage string, value *int) setting {
+  return setting { name: name, usage: usage, set: func(text string) error {
+    n, err := strconv.Atoi(text)
+    if err != nil {
+      return fmt.Errorf("%s is no number", text)
+    }
+    *value = n
+    return nil
+  }}
+}
+
+func durationSetting(name string, usage string, value *time.Duration) setting {
+  return setting { name: name, usage: usage, set: func(text string) error {
+    duration, err := time.ParseDuration(text)
+    if err != nil {
+      return err
+    }
+    *value = duration
+    return nil
+  }}
+}
+
+func boolSetting(name string, usage string, value *bool) setting {
+  return setting { name: name, usage: usage, boolean: true, set: func(text string) error {
+    b, err := strconv.ParseBool(text)
+    if err != nil {
+      return fmt.Errorf("%s is no boolean", text)
+    }
+    *value = b
+    return nil
+  }}
+}
+
+func (config *Config) settings() []setting {
+  return []setting {
+    stringSetting("http", "HTTP listen address", &config.Listen.HTTP),
+    stringSetting("udp", "UDP listen address of the node messages", &config.Listen.UDP),
+    intSetting("node-port", "UDP port of the node commands", &config.NodePort),
+    stringSetting("files", "directory of the modules", &config.Paths.Files),
+    stringSetting("uploads", "directory of unfinished uploads", &config.Paths.Uploads),
+    stringSetting("autobackup", "auto backup file", &config.Paths.AutoBackup),
+    stringSetting("users", "users file", &config.Paths.Users),
+    stringSetting("history", "module history file", &config.Paths.History),
+    stringSetting("rollouts", "rollouts file", &config.Paths.Rollouts),
+    stringSetting("audit", "audit log file", &config.Paths.Audit),
+    stringSetting("retention", "retention policy file", &config.Paths.Retention),
+    stringSetting("storage", "module storage file", &config.Paths.Storage),
+    stringSetting("oidc", "OpenID Connect file", &config.Paths.OIDC),
+    stringSetting("trusted-keys", "trusted keys file of module signatures", &config.Paths.TrustedKeys),
+    stringSetting("tls-cert", "certificate file for HTTPS", &config.TLS.Cert),
+    stringSetting("tls-key", "key file for HTTPS", &config.TLS.Key),
+    durationSetting("heartbeat-warning", "time without heartbeat until warning", &config.Timing.HeartbeatWarning),
+    durationSetting("heartbeat-danger", "time without heartbeat until danger", &config.Timing.HeartbeatDanger),
+    durationSetting("flush-interval", "interval of the auto backup", &config.Timing.FlushInterval),
+    durationSetting("shutdown-timeout", "time given to requests on shutdown", &config.Timing.ShutdownTimeout),
+    durationSetting("upload-timeout", "time until unfinished uploads are removed", &config.Timing.UploadTimeout),
+    boolSetting("notify-nodes", "tell the nodes when the hub stops", &config.NotifyNodes),
+    intSetting("max-upload-size", "largest module of API uploads in bytes", &config.MaxUploadSize),
+  }
+}
+
+// settingFlag keeps the text of a flag until the file and the environment are read.
+type settingFlag struct {
+  text string
+  boolean bool
+}
+
+func (f *settingFlag) String() string {
+  return f.text
+}
+
+func (f *settingFlag) Set(text string) error {
+  f.text = text
+  return nil
+}
+
+func (f *settingFlag) IsBoolFlag() bool {
+  return f.boolean
+}
+
+// ConfigOptions are the command line of the hub.
+type ConfigOptions struct {
+  File string
+  Print bool
+  // texts of the settings given as flags.
+  values map[string]string
+}
+
+// parseFlags reads the command line. errors are printed by the flag package.
+func parseFlags(args []string) (*ConfigOptions, error) {
+  options := &ConfigOptions { values: map[string]string{} }
+  flags := flag.NewFlagSet("xengine_hub", flag.ContinueOnError)
+  flags.StringVar(&options.File, "config", os.Getenv("XHUB_CONFIG"), "config file, " + defaultConfigFile + " if it exists ($XHUB_CONFIG)")
+  flags.BoolVar(&options.Print, "print-config", false, "print the config and exit")
+  settingFlags := map[string]*settingFlag{}
+  for _, s := range defaultConfig().settings() {
+    settingFlags[s.name] = &settingFlag { boolean: s.boolean }
+    flags.Var(settingFlags[s.name], s.name, s.usage + " ($" + s.env() + ")")
+  }
+  if err := flags.Parse(args); err != nil {
+    return nil, err
+  }
+  if 0 < flags.NArg() {
+    fmt.Fprintf(os.Stderr, "unexpected argument %s\n", flags.Arg(0))
+    flags.Usage()
+    return nil, fmt.Errorf("unexpected argument %s", flags.Arg(0))
+  }
+  flags.Visit(func(f *flag.Flag) {
+    if value, has := settingFlags[f.Name]; has {
+      options.values[f.Name] = value.text
+    }
+  })
+  return options, nil
+}
+
+// loadConfig reads the config file and applies the environment and the flags. the
+// result is not validated yet.
+func loadConfig(options *ConfigOptions) (*Config, error) {
+  config := defaultConfig()
+  filePath := options.File
+  if "" == filePath {
+    filePath = defaultConfigFile
+  }
+  blob, err := ioutil.ReadFile(filePath)
+  if os.IsNotExist(err) && "" == options.File {
+    blob = nil
+  } else if err != nil {
+    return nil, err
+  }
+  decoder := yaml.NewDecoder(bytes.NewReader(blob))
+  // misspelled keys are errors rather than ignored.
+  decoder.KnownFields(true)
+  if err = decoder.Decode(config); err != nil && err != io.EOF {
+    return nil, fmt.Errorf("%s: %s", filePath, err)
+  }
+  settings := config.settings()
+  for _, s := range settings {
+    if text, has := os.LookupEnv(s.env()); has {
+      if err = s.set(text); err != nil {
+        return nil, fmt.Errorf("$%s: %s", s.env(), err)
+      }
+    }
+  }
+  for _, s := range settings {
+    if text, has := options.values[s.name]; has {
+      if err = s.set(text); err != nil {
+        return nil, fmt.Errorf("--%s: %s", s.name, err)
+      }
+    }
+  }
+  return config, nil
+}
+
+// validate reports every problem of the config at once.
+func (config *Config) validate() error {
+  problems := []string{}
+  check := func(err error) {
+    if err != nil {
+      problems = append(problems, err.Error())
+    }
+  }
+  check(checkAddress("listen.http", config.Listen.HTTP))
+  check(checkAddress("listen.udp", config.Listen.UDP))
+  if config.NodePort < 1 || 65535 < config.NodePort {
+    check(fmt.Errorf("nodePort: %d is no port", config.NodePort))
+  }
+  if config.MaxUploadSize < 1 {
+    check(fmt.Errorf("maxUploadSize: must be positive"))
+  }
+  for name, path := range map[string]string {
+    "paths.files": config.Paths.Files,
+    "paths.uploads": config.Paths.Uploads,
+    "paths.autoBackup": config.Paths.AutoBackup,
+    "paths.users": config.Paths.Users,
+    "paths.history": config.Paths.History,
+    "paths.rollouts": config.Paths.Rollouts,
+    "paths.audit": config.Paths.Audit,
+    "paths.retention": config.Paths.Retention,
+    "paths.storage": config.Paths.Storage,
+    "paths.oidc": config.Paths.OIDC,
+    "paths.trustedKeys": config.Paths.TrustedKeys,
+  } {
+    if "" == path {
+      check(fmt.Errorf("%s: missing", name))
+    }
+  }
+  if ("" == config.TLS.Cert) != ("" == config.TLS.Key) {
+    check(fmt.Errorf("tls: cert and key are both needed"))
+  } else if "" != config.TLS.Cert {
+    if _, err := tls.LoadX509KeyPair(config.TLS.Cert, config.TLS.Key); err != nil {
+      check(fmt.Errorf("tls: %s", err))
+    }
+  }
+  for name, duration := range map[string]time.Duration {
+    "timing.heartbeatWarning": config.Timing.HeartbeatWarning,
+    "timing.heartbeatDanger": config.Timing.HeartbeatDanger,
+    "timing.flushInterval": config.Timing.FlushInterval,
+    "timing.shutdownTimeout": config.Timing.ShutdownTimeout,
+    "timing.uploadTimeout": config.Timing.UploadTimeout,
+  } {
+    if duration <= 0 {
+      check(fmt.Errorf("%s: must be positive", name))
+    }
+  }
+  if config.Timing.HeartbeatDanger <= config.Timing.HeartbeatWarning {
+    check(fmt.Errorf("timing.heartbeatDanger: must be longer than heartbeatWarning"))
+  }
+  if 0 < len(problems) {
+    // the maps above are not ordered.
+    sort.Strings(problems)
+    return fmt.Errorf("invalid config\n  %s", strings.Join(problems, "\n  "))
+  }
+  return nil
+}
+
+// checkAddress accepts host:port and :port.
+func checkAddress(name string, address string) error {
+  _, port, err := net.SplitHostPort(address)
+  if err != nil {
+    return fmt.Errorf("%s: %s", name, err)
+  }
+  if n, err := strconv.Atoi(port); err != nil || n < 1 || 65535 < n {
+    return fmt.Errorf("%s: %s is no port", name, port)
+  }
+  return nil
+}
+
+// Print writes the config as YAML, for --print-config.
+func (config *Config) Print() error {
+  encoder := yaml.NewEncoder(os.Stdout)
+  encoder.SetIndent(2)
+  if err := encoder.Encode(config); err != nil {
+    return err
+  }
+  return encoder.Close()
+}
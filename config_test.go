@@ -0,0 +1,79 @@
+package main
+
+import (
+  "io/ioutil"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func TestValidate(t *testing.T) {
+  if err := defaultConfig().validate(); err != nil {
+    t.Fatalf("defaults: %s", err)
+  }
+  tests := []struct {
+    name string
+    change func(config *Config)
+    problems []string
+  }{
+    { "listen", func(config *Config) {
+      config.Listen.HTTP = "51700"
+      config.Listen.UDP = ":0"
+    }, []string { "listen.http:", "listen.udp: 0 is no port" } },
+    { "ports and sizes", func(config *Config) {
+      config.NodePort = 70000
+      config.MaxUploadSize = 0
+    }, []string { "nodePort: 70000 is no port", "maxUploadSize: must be positive" } },
+    { "paths", func(config *Config) {
+      config.Paths.Users = ""
+      config.Paths.Rollouts = ""
+    }, []string { "paths.users: missing", "paths.rollouts: missing" } },
+    { "tls", func(config *Config) {
+      config.TLS.Cert = "hub.crt"
+    }, []string { "tls: cert and key are both needed" } },
+    { "timing", func(config *Config) {
+      config.Timing.FlushInterval = 0
+      config.Timing.HeartbeatDanger = config.Timing.HeartbeatWarning
+    }, []string { "timing.flushInterval: must be positive", "timing.heartbeatDanger: must be longer" } },
+  }
+  for _, test := range tests {
+    config := defaultConfig()
+    test.change(config)
+    err := config.validate()
+    if nil == err {
+      t.Errorf("%s: accepted", test.name)
+      continue
+    }
+    // every problem is reported, not only the first.
+    for _, problem := range test.problems {
+      if !strings.Contains(err.Error(), problem) {
+        t.Errorf("%s: %q not in %s", test.name, problem, err)
+      }
+    }
+  }
+}
+
+func TestLoadConfig(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "xhub.yaml")
+  if err := ioutil.WriteFile(path, []byte("nodePort: 51711\ntiming:\n  flushInterval: 10s\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  // flags win over the file.
+  config, err := loadConfig(&ConfigOptions { File: path, values: map[string]string { "node-port": "51712" } })
+  if err != nil {
+    t.Fatal(err)
+  }
+  if 51712 != config.NodePort || "10s" != config.Timing.FlushInterval.String() || ":51700" != config.Listen.HTTP {
+    t.Errorf("loaded %+v", config)
+  }
+
+  if err := ioutil.WriteFile(path, []byte("nodPort: 51711\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  if _, err = loadConfig(&ConfigOptions { File: path, values: map[string]string{} }); nil == err {
+    t.Error("misspelled key accepted")
+  }
+  if _, err = loadConfig(&ConfigOptions { File: filepath.Join(filepath.Dir(path), "missing.yaml"), values: map[string]string{} }); nil == err {
+    t.Error("missing config file accepted")
+  }
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+  "time"
+)
+
+const defaultDrainPeriod = 60 * time.Second
+
+// Resolvable reports whether D resolutions may be answered with the server.
+func (server *ServiceServer) Resolvable() bool {
+  return !server.Draining && !server.Maintenance && !server.Node.Draining && !server.Node.Maintenance
+}
+
+// Idle reports whether the last heartbeat carried zero active sessions.
+func (server *ServiceServer) Idle() bool {
+  return 0 == server.Status || (!server.SessionsAt.IsZero() && 0 == server.Sessions)
+}
+
+func (server *ServiceServer) UnderMaintenance() bool {
+  return server.Maintenance || server.Node.Maintenance
+}
+
+func (node *Node) Idle() bool {
+  for _, server := range node.ServiceServers {
+    if !server.Idle() {
+      return false
+    }
+  }
+  return true
+}
+
+// drainServer stops new resolutions to the server and stops it after the period
+// or as soon as the node reports no active sessions.
+func drainServer(server *ServiceServer, period time.Duration) {
+  if 1 != server.Status && 8 != server.Status {
+    return
+  }
+  if period <= 0 {
+    period = defaultDrainPeriod
+  }
+  server.Draining = true
+  server.DrainUntil = time.Now().Add(period)
+}
+
+func drainNode(node *Node, period time.Duration) {
+  if 0 == node.Status || 9 == node.Status {
+    return
+  }
+  if period <= 0 {
+    period = defaultDrainPeriod
+  }
+  node.Draining = true
+  node.DrainUntil = time.Now().Add(period)
+}
+
+func cancelDrain(node *Node, server *ServiceServer) {
+  if nil != server {
+    server.Draining = false
+  } else {
+    node.Draining = false
+  }
+}
+
+// stepDrains stops the drained servers and nodes. it is called periodically under lock.
+// drains restored from the auto backup wait for the first heartbeat before the sessions
+// count, until then the servers look stopped.
+func stepDrains(info *HubInfo) {
+  now := time.Now()
+  for _, node := range info.Nodes {
+    if node.Draining && (now.After(node.DrainUntil) || (!node.LastModifiedAt.IsZero() && node.Idle())) {
+      node.Draining = false
+      node.SendMessage("C>")
+      recordHistory(info, "drainNode", node.IP, "", "")
+    }
+    for _, server := range node.ServiceServers {
+      if server.Draining && (now.After(server.DrainUntil) || (!server.LastModifiedAt.IsZero() && server.Idle())) {
+        server.Draining = false
+        if 1 == server.Status || 8 == server.Status {
+          server.Status = 2
+          node.SendMessage("C>" + server.Port)
+        }
+        recordHistory(info, "drainServer", server.Target(), server.Module, "")
+      }
+    }
+  }
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+  "io/ioutil"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+func TestDrainRestored(t *testing.T) {
+  info, server := newTestServer(t)
+  node := server.Node
+  until := time.Now().Add(time.Minute).Truncate(time.Second)
+  drainNode(node, time.Minute)
+  drainServer(server, time.Minute)
+  node.DrainUntil = until
+  server.DrainUntil = until
+  server.Maintenance = true
+  path := filepath.Join(t.TempDir(), "autobackup.txt")
+  if err := ioutil.WriteFile(path, Backup(info), 0644); err != nil {
+    t.Fatal(err)
+  }
+  restored, err := Restore("Auto backup", path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  restoredNode := restored.Nodes[node.IP]
+  restoredServer := restoredNode.ServiceServers[server.Port]
+  if !restoredNode.Draining || !restoredNode.DrainUntil.Equal(until) || !restoredServer.Draining || !restoredServer.DrainUntil.Equal(until) {
+    t.Errorf("drains not restored: node %t %s, server %t %s", restoredNode.Draining, restoredNode.DrainUntil, restoredServer.Draining, restoredServer.DrainUntil)
+  }
+  if !restoredServer.Maintenance || restoredNode.Maintenance {
+    t.Errorf("maintenance: node %t, server %t", restoredNode.Maintenance, restoredServer.Maintenance)
+  }
+
+  // the restored servers are stopped until they report, the drain goes on.
+  stepDrains(restored)
+  if !restoredNode.Draining || !restoredServer.Draining {
+    t.Error("restored drains ended before a heartbeat")
+  }
+}
+
+func TestStepDrains(t *testing.T) {
+  tests := []struct {
+    name string
+    sessions int
+    until time.Duration
+    reported bool
+    draining bool
+  }{
+    { "sessions", 3, time.Minute, true, true },
+    { "idle", 0, time.Minute, true, false },
+    { "period over", 3, -time.Second, true, false },
+    { "not reported", 0, time.Minute, false, true },
+    { "not reported, period over", 0, -time.Second, false, false },
+  }
+  for _, test := range tests {
+    info, server := newTestServer(t)
+    drainServer(server, time.Minute)
+    server.DrainUntil = time.Now().Add(test.until)
+    server.Sessions = test.sessions
+    if test.reported {
+      server.LastModifiedAt = time.Now()
+      server.SessionsAt = time.Now()
+    }
+    if server.Resolvable() {
+      t.Errorf("%s: draining server resolvable", test.name)
+    }
+    stepDrains(info)
+    if test.draining != server.Draining {
+      t.Errorf("%s: draining %t, want %t", test.name, server.Draining, test.draining)
+    }
+    // the node is told to stop the drained server.
+    if !test.draining && 2 != server.Status {
+      t.Errorf("%s: status %d", test.name, server.Status)
+    }
+  }
+}
+
+func TestMaintenance(t *testing.T) {
+  info, server := newTestServer(t)
+  info.Domains["example.com"] = &Domain { Key: "example.com", AssignPriorities: []*AssignPriority {{ Priority: 1, ServiceServer: server }} }
+  tests := []struct {
+    port string
+    enabled bool
+    resolvable bool
+  }{
+    { ":9000", true, false },
+    { ":9000", false, true },
+    { "", true, false },
+    { "", false, true },
+  }
+  for _, test := range tests {
+    if err := setMaintenance(info, "127.0.0.1", test.port, test.enabled); err != nil {
+      t.Fatal(err)
+    }
+    if resolved := resolveDomain(info, "example.com"); test.resolvable != (server == resolved) {
+      t.Errorf("port %q, maintenance %t: resolved %v", test.port, test.enabled, resolved)
+    }
+  }
+  if err := setMaintenance(info, "127.0.0.1", ":9001", true); nil == err {
+    t.Error("unknown server put under maintenance")
+  }
+}
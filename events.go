@@ -0,0 +1,264 @@
+package main
+
+import (
+  "github.com/pantaroid/test/api"
+  "gopkg.in/gin-gonic/gin.v1"
+  "net/http"
+  "encoding/json"
+  "fmt"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  // events a subscriber may fall behind before it is dropped. the client reconnects
+  // and starts again from a snapshot.
+  eventBacklog = 256
+  eventKeepAlive = 15 * time.Second
+)
+
+// Event is one server-sent event. Type is node, domain, rollout, canary, removed or ready.
+type Event struct {
+  Type string
+  Data []byte
+}
+
+// EventBroker pushes the changes of the hub state to the subscribers of /api/events.
+type EventBroker struct {
+  sync.Mutex
+  subscribers map[chan *Event]bool
+  // published state by "type/key", without timestamps.
+  last map[string][]byte
+  // set on shutdown.
+  closed bool
+}
+
+var events = &EventBroker {
+  subscribers: map[chan *Event]bool{},
+  last: map[string][]byte{},
+}
+
+type stateResource struct {
+  Type string
+  Key string
+  Resource interface{}
+  // compared to find changes. heartbeats only move the timestamps and are not pushed.
+  Digest interface{}
+}
+
+// resourceScope returns the resources an update may have changed by "type/key". a nil
+// resource was removed. the resources are built with the state locked and marshaled
+// after it is unlocked, so they must not point into the state.
+type resourceScope func(info *HubInfo) map[string]*stateResource
+
+func newNodeState(node *Node) *stateResource {
+  resource := newNodeResource(node)
+  return &stateResource { Type: "node", Key: node.IP, Resource: resource, Digest: withoutTimestamps(resource) }
+}
+
+func newCanaryState(canary *Canary) *stateResource {
+  resource := newCanaryResource(canary)
+  return &stateResource { Type: "canary", Key: canary.ID, Resource: resource, Digest: resource }
+}
+
+// stateResources returns every pushed resource by "type/key".
+func stateResources(info *HubInfo) map[string]*stateResource {
+  resources := map[string]*stateResource{}
+  for _, node := range info.Nodes {
+    resources["node/" + node.IP] = newNodeState(node)
+  }
+  for _, domain := range info.Domains {
+    resource := newDomainResource(domain)
+    resources["domain/" + domain.Key] = &stateResource { Type: "domain", Key: domain.Key, Resource: resource, Digest: resource }
+  }
+  for _, rollout := range info.Rollouts {
+    resource := newRolloutResource(rollout)
+    resources["rollout/" + rollout.ID] = &stateResource { Type: "rollout", Key: rollout.ID, Resource: resource, Digest: resource }
+  }
+  for _, canary := range info.Canaries {
+    resources["canary/" + canary.ID] = newCanaryState(canary)
+  }
+  return resources
+}
+
+// nodeScope is the node with its servers, for the messages of the node.
+func nodeScope(ip string) resourceScope {
+  return func(info *HubInfo) map[string]*stateResource {
+    var resource *stateResource
+    if node, has := info.Nodes[ip]; has {
+      resource = newNodeState(node)
+    }
+    return map[string]*stateResource { "node/" + ip: resource }
+  }
+}
+
+// canaryScope is the canaries, whose counters the domain queries and errors of nodes move.
+func canaryScope(info *HubInfo) map[string]*stateResource {
+  resources := map[string]*stateResource{}
+  for _, canary := range info.Canaries {
+    resources["canary/" + canary.ID] = newCanaryState(canary)
+  }
+  return resources
+}
+
+func withoutTimestamps(node api.NodeResource) api.NodeResource {
+  node.LastModifiedAt = time.Time{}
+  servers := make([]api.ServerResource, len(node.Servers))
+  for i, server := range node.Servers {
+    server.LastModifiedAt = time.Time{}
+    servers[i] = server
+  }
+  node.Servers = servers
+  return node
+}
+
+func newEvent(kind string, v interface{}) *Event {
+  blob, err := json.Marshal(v)
+  if err != nil {
+    fmt.Printf("Error: %s\n", err)
+  }
+  return &Event { Type: kind, Data: blob }
+}
+
+// subscribe returns a channel that starts with every resource followed by a ready event.
+// it is called with the hub state locked for reading.
+func (broker *EventBroker) subscribe(info *HubInfo) chan *Event {
+  broker.Lock()
+  defer broker.Unlock()
+  if broker.closed {
+    channel := make(chan *Event)
+    close(channel)
+    return channel
+  }
+  resources := stateResources(info)
+  // the others get the changes first, so that the snapshot is the state of everyone.
+  broker.send(resources, true)
+  channel := make(chan *Event, len(resources) + eventBacklog)
+  for _, resource := range resources {
+    channel <- newEvent(resource.Type, resource.Resource)
+  }
+  channel <- &Event { Type: "ready", Data: []byte("{}") }
+  broker.subscribers[channel] = true
+  return channel
+}
+
+func (broker *EventBroker) unsubscribe(channel chan *Event) {
+  broker.Lock()
+  defer broker.Unlock()
+  if broker.subscribers[channel] {
+    delete(broker.subscribers, channel)
+    close(channel)
+  }
+}
+
+// Close ends every stream, so that the HTTP server can shut down. later subscribers
+// get a closed channel.
+func (broker *EventBroker) Close() {
+  broker.Lock()
+  defer broker.Unlock()
+  broker.closed = true
+  for channel := range broker.subscribers {
+    delete(broker.subscribers, channel)
+    close(channel)
+  }
+}
+
+// publish sends the resources of scope, or all with a nil scope, that changed since
+// they were sent last. it is called at the end of every update with the state locked
+// for writing and calls unlock once the resources are taken. the broker stays locked
+// until they are sent, so that the events keep the order of the updates. nothing is
+// computed without subscribers.
+func (broker *EventBroker) publish(info *HubInfo, scope resourceScope, unlock func()) {
+  broker.Lock()
+  defer broker.Unlock()
+  if 0 == len(broker.subscribers) {
+    unlock()
+    return
+  }
+  var resources map[string]*stateResource
+  if nil == scope {
+    resources = stateResources(info)
+  } else {
+    resources = scope(info)
+  }
+  unlock()
+  broker.send(resources, nil == scope)
+}
+
+// send is called with the broker locked. when complete, the resources not given were
+// removed.
+func (broker *EventBroker) send(resources map[string]*stateResource, complete bool) {
+  changes := make([]*Event, 0)
+  removed := func(key string) {
+    delete(broker.last, key)
+    parts := strings.SplitN(key, "/", 2)
+    changes = append(changes, newEvent("removed", map[string]string { "type": parts[0], "key": parts[1] }))
+  }
+  for key, resource := range resources {
+    if nil == resource {
+      if _, has := broker.last[key]; has {
+        removed(key)
+      }
+      continue
+    }
+    digest, _ := json.Marshal(resource.Digest)
+    if string(broker.last[key]) != string(digest) {
+      broker.last[key] = digest
+      changes = append(changes, newEvent(resource.Type, resource.Resource))
+    }
+  }
+  if complete {
+    for key := range broker.last {
+      if _, has := resources[key]; !has {
+        removed(key)
+      }
+    }
+  }
+  for channel := range broker.subscribers {
+    for _, event := range changes {
+      select {
+        case channel <- event:
+          continue
+        default:
+      }
+      // too slow. the client reconnects and gets a fresh snapshot.
+      delete(broker.subscribers, channel)
+      close(channel)
+      break
+    }
+  }
+}
+
+// streamEvents serves the events as text/event-stream until the client goes away.
+func streamEvents(c *gin.Context, state *StateStore) {
+  var channel chan *Event
+  state.View(func(info *HubInfo) {
+    channel = events.subscribe(info)
+  })
+  defer events.unsubscribe(channel)
+
+  c.Header("Content-Type", "text/event-stream")
+  c.Header("Cache-Control", "no-cache")
+  // no buffering by reverse proxies.
+  c.Header("X-Accel-Buffering", "no")
+  c.Status(http.StatusOK)
+  c.Writer.Flush()
+  closed := c.Writer.CloseNotify()
+  keepAlive := time.NewTicker(eventKeepAlive)
+  defer keepAlive.Stop()
+  for {
+    select {
+      case event, ok := <- channel:
+        if !ok {
+          return
+        }
+        fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event.Type, event.Data)
+      case <- keepAlive.C:
+        fmt.Fprint(c.Writer, ": keep-alive\n\n")
+      case <- closed:
+        return
+    }
+    c.Writer.Flush()
+  }
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "time"
+)
+
+const (
+  maxHistory = 1000
+)
+
+type HistoryEntry struct {
+  Time time.Time `json:"time"`
+  Action string `json:"action"`
+  Target string `json:"target"`
+  Module string `json:"module"`
+  Previous string `json:"previous"`
+}
+
+func (entry HistoryEntry) TimeText() string {
+  return entry.Time.Format(dateTimeLayout)
+}
+
+// the history file has one entry per line. changes append a line, the file is rewritten
+// with the last maxHistory entries once it has twice as many. guarded by the state lock.
+var historyLines int
+
+func loadHistory() []*HistoryEntry {
+  history := make([]*HistoryEntry, 0)
+  blob, err := ioutil.ReadFile(currentConfig().Paths.History)
+  if err != nil {
+    return history
+  }
+  if bytes.HasPrefix(bytes.TrimSpace(blob), []byte("[")) {
+    // one array, written by earlier versions.
+    json.Unmarshal(blob, &history)
+    if nil == history {
+      history = make([]*HistoryEntry, 0)
+    }
+    if err = writeHistory(history); err != nil {
+      fmt.Printf("Error: %s\n", err)
+    }
+    return history
+  }
+  for _, line := range bytes.Split(blob, []byte("\n")) {
+    var entry HistoryEntry
+    // a crash may leave half a line.
+    if err := json.Unmarshal(line, &entry); err == nil {
+      history = append(history, &entry)
+    }
+  }
+  historyLines = len(history)
+  if maxHistory < len(history) {
+    history = history[len(history) - maxHistory:]
+  }
+  return history
+}
+
+// writeHistory replaces the history file.
+func writeHistory(history []*HistoryEntry) error {
+  var buf bytes.Buffer
+  for _, entry := range history {
+    blob, err := json.Marshal(entry)
+    if err != nil {
+      return err
+    }
+    buf.Write(blob)
+    buf.WriteByte('\n')
+  }
+  if err := writeFileAtomic(currentConfig().Paths.History, buf.Bytes(), 0644); err != nil {
+    return err
+  }
+  historyLines = len(history)
+  return nil
+}
+
+// appendHistory writes the entry, which has been added to info.History.
+func appendHistory(info *HubInfo, entry *HistoryEntry) error {
+  if 2 * maxHistory <= historyLines {
+    return writeHistory(info.History)
+  }
+  blob, err := json.Marshal(entry)
+  if err != nil {
+    return err
+  }
+  file, err := os.OpenFile(currentConfig().Paths.History, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+  if _, err = file.Write(append(blob, '\n')); err != nil {
+    return err
+  }
+  historyLines++
+  return nil
+}
+
+// recordHistory appends a module change, dropping the oldest entries over maxHistory.
+func recordHistory(info *HubInfo, action string, target string, module string, previous string) {
+  entry := &HistoryEntry {
+    Time: time.Now(),
+    Action: action,
+    Target: target,
+    Module: module,
+    Previous: previous,
+  }
+  info.History = append(info.History, entry)
+  if maxHistory < len(info.History) {
+    info.History = info.History[len(info.History) - maxHistory:]
+  }
+  if err := appendHistory(info, entry); err != nil {
+    fmt.Printf("Error: %s\n", err)
+  }
+}
+
+// recentHistory returns the entries newest first.
+func recentHistory(info *HubInfo) []*HistoryEntry {
+  recent := make([]*HistoryEntry, 0, len(info.History))
+  for i := len(info.History) - 1; 0 <= i; i-- {
+    recent = append(recent, info.History[i])
+  }
+  return recent
+}
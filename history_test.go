@@ -0,0 +1,78 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "io/ioutil"
+  "path/filepath"
+  "testing"
+)
+
+// useHistoryFile points the config to a history file in a temporary directory.
+func useHistoryFile(t *testing.T) string {
+  path := filepath.Join(t.TempDir(), "history.json")
+  reloadable.Lock()
+  previous := hubConfig
+  config := *hubConfig
+  config.Paths.History = path
+  hubConfig = &config
+  reloadable.Unlock()
+  t.Cleanup(func() {
+    reloadable.Lock()
+    hubConfig = previous
+    reloadable.Unlock()
+    historyLines = 0
+  })
+  return path
+}
+
+func TestHistoryAppend(t *testing.T) {
+  path := useHistoryFile(t)
+  info := &HubInfo { History: loadHistory() }
+  for i := 0; i < 2 * maxHistory + 10; i++ {
+    recordHistory(info, "setModule", "10.0.0.1:9000", "app.zip", "")
+  }
+  if maxHistory != len(info.History) {
+    t.Fatalf("%d entries kept", len(info.History))
+  }
+  blob, err := ioutil.ReadFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  // rewritten by the entry after twice maxHistory, appended since.
+  if lines := bytes.Count(blob, []byte("\n")); maxHistory + 9 != lines {
+    t.Errorf("%d lines, want %d", lines, maxHistory + 9)
+  }
+  if loaded := loadHistory(); maxHistory != len(loaded) || !loaded[len(loaded) - 1].Time.Equal(info.History[len(info.History) - 1].Time) {
+    t.Errorf("loaded %d entries", len(loaded))
+  }
+}
+
+func TestHistoryMigrate(t *testing.T) {
+  path := useHistoryFile(t)
+  blob, _ := json.Marshal([]*HistoryEntry {
+    { Action: "setModule", Target: "10.0.0.1:9000", Module: "a.zip" },
+    { Action: "setModule", Target: "10.0.0.1:9000", Module: "b.zip" },
+  })
+  if err := ioutil.WriteFile(path, blob, 0644); err != nil {
+    t.Fatal(err)
+  }
+  info := &HubInfo { History: loadHistory() }
+  recordHistory(info, "setModule", "10.0.0.1:9000", "c.zip", "b.zip")
+  // a half written line is skipped.
+  if err := ioutil.WriteFile(path, append(mustRead(t, path), []byte(`{"action":"set`)...), 0644); err != nil {
+    t.Fatal(err)
+  }
+  loaded := loadHistory()
+  if 3 != len(loaded) || "a.zip" != loaded[0].Module || "c.zip" != loaded[2].Module {
+    t.Errorf("loaded %+v", loaded)
+  }
+}
+
+func mustRead(t *testing.T, path string) []byte {
+  blob, err := ioutil.ReadFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return blob
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+  "fmt"
+  "os"
+  "sort"
+  "strings"
+  "time"
+)
+
+// replaces descriptionFile, which is migrated on start.
+const metadataFile = "xhub_modules.json"
+
+// ModuleMeta describes one module version. the record moves with the module when
+// an upload backs it up.
+type ModuleMeta struct {
+  Description string `json:"description"`
+  Version string `json:"version"`
+  Uploader string `json:"uploader"`
+  UploadedAt time.Time `json:"uploadedAt"`
+  Changelog string `json:"changelog"`
+  Tags []string `json:"tags"`
+  // labels of the nodes the module is meant for.
+  NodeLabels []string `json:"nodeLabels"`
+  Size int64 `json:"size"`
+  SHA256 string `json:"sha256"`
+}
+
+// ModuleEdit is what users write. the rest is recorded by the hub.
+type ModuleEdit struct {
+  Description *string
+  Version *string
+  Changelog *string
+  Tags []string
+  NodeLabels []string
+}
+
+// apply validates and sets the given fields. nil tags or labels are kept, empty ones cleared.
+func (edit *ModuleEdit) apply(meta *ModuleMeta) error {
+  if nil != edit.Version && 64 < len(*edit.Version) {
+    return invalid("version", "version is longer than 64 characters")
+  }
+  tags, err := normalizeLabels("tags", edit.Tags)
+  if err != nil {
+    return err
+  }
+  labels, err := normalizeLabels("nodeLabels", edit.NodeLabels)
+  if err != nil {
+    return err
+  }
+  if nil != edit.Description {
+    meta.Description = strings.TrimSpace(*edit.Description)
+  }
+  if nil != edit.Version {
+    meta.Version = strings.TrimSpace(*edit.Version)
+  }
+  if nil != edit.Changelog {
+    meta.Changelog = strings.TrimSpace(*edit.Changelog)
+  }
+  if nil != edit.Tags {
+    meta.Tags = tags
+  }
+  if nil != edit.NodeLabels {
+    meta.NodeLabels = labels
+  }
+  return nil
+}
+
+// normalizeLabels trims, sorts and deduplicates tags and node labels.
+func normalizeLabels(field string, values []string) ([]string, error) {
+  seen := map[string]bool{}
+  labels := make([]string, 0, len(values))
+  for _, value := range values {
+    value = strings.TrimSpace(value)
+    switch {
+      case "" == value || seen[value]:
+        continue
+      case 64 < len(value):
+        return nil, invalid(field, fmt.Sprintf("%s is longer than 64 characters", value))
+      case strings.ContainsAny(value, ", \t\r\n"):
+        return nil, invalid(field, fmt.Sprintf("%q must not contain commas or spaces", value))
+    }
+    seen[value] = true
+    labels = append(labels, value)
+  }
+  sort.Strings(labels)
+  return labels, nil
+}
+
+// splitLabels reads a comma separated list, as the upload form and queries send them.
+// empty text is nil, so that nothing is changed.
+func splitLabels(text string) []string {
+  if "" == strings.TrimSpace(text) {
+    return nil
+  }
+  return strings.Split(text, ",")
+}
+
+func hasLabel(labels []string, label string) bool {
+  for _, value := range labels {
+    if label == value {
+      return true
+    }
+  }
+  return false
+}
+
+// ModuleQuery filters modules. empty fields match everything.
+type ModuleQuery struct {
+  // case insensitive substring of name, description, version, changelog, uploader or tags.
+  Text string
+  Tag string
+  NodeLabel string
+  Uploader string
+}
+
+func (query *ModuleQuery) Match(name string, meta *ModuleMeta) bool {
+  if "" != query.Tag && !hasLabel(meta.Tags, query.Tag) {
+    return false
+  }
+  if "" != query.NodeLabel && !hasLabel(meta.NodeLabels, query.NodeLabel) {
+    return false
+  }
+  if "" != query.Uploader && query.Uploader != meta.Uploader {
+    return false
+  }
+  return "" == query.Text || strings.Contains(moduleSearchText(name, meta), strings.ToLower(query.Text))
+}
+
+// moduleSearchText is matched by the search of the API and of the modules tab.
+func moduleSearchText(name string, meta *ModuleMeta) string {
+  return strings.ToLower(strings.Join([]string {
+    name, meta.Description, meta.Version, meta.Changelog, meta.Uploader, strings.Join(meta.Tags, " "),
+  }, " "))
+}
+
+// moduleMeta returns the record of the module, empty for modules without one.
+func moduleMeta(info *HubInfo, name string) *ModuleMeta {
+  if meta, has := info.Metadata[name]; has {
+    return meta
+  }
+  return &ModuleMeta{}
+}
+
+// moduleTags lists the tags of every module for the filter of the modules tab.
+func moduleTags(info *HubInfo) []string {
+  seen := map[string]bool{}
+  tags := make([]string, 0)
+  for _, meta := range info.Metadata {
+    for _, tag := range meta.Tags {
+      if !seen[tag] {
+        seen[tag] = true
+        tags = append(tags, tag)
+      }
+    }
+  }
+  sort.Strings(tags)
+  return tags
+}
+
+// fillSums records the sha256 of the modules stored before it was part of the metadata,
+// for the ETags of downloads. modules without a record get one. it reports how many.
+func fillSums(metadata map[string]*ModuleMeta) int {
+  files, err := modules.List()
+  if err != nil {
+    fmt.Printf("Error: %s\n", err)
+    return 0
+  }
+  filled := 0
+  for _, file := range files {
+    meta, has := metadata[file.Name]
+    if has && "" != meta.SHA256 {
+      continue
+    }
+    sum, err := modules.Sum(file.Name)
+    if err != nil {
+      fmt.Printf("Error: %s\n", err)
+      continue
+    }
+    if !has {
+      meta = &ModuleMeta { Size: file.Size, UploadedAt: file.ModTime }
+      metadata[file.Name] = meta
+    }
+    meta.SHA256 = sum
+    filled++
+  }
+  return filled
+}
+
+func saveMetadata(info *HubInfo) {
+  if err := modules.WriteMetadata(info.Metadata); err != nil {
+    fmt.Printf("Error: %s\n", err)
+  }
+}
+
+// loadMetadata reads the metadata, and creates it from the descriptions of older
+// versions when there is none.
+func loadMetadata() (map[string]*ModuleMeta, error) {
+  metadata, err := modules.ReadMetadata()
+  if nil == err {
+    if filled := fillSums(metadata); 0 < filled {
+      fmt.Printf("Recorded the sha256 of %d modules in %s\n", filled, metadataFile)
+      err = modules.WriteMetadata(metadata)
+    }
+    return metadata, err
+  } else if !os.IsNotExist(err) {
+    return nil, err
+  }
+  metadata = map[string]*ModuleMeta{}
+  descriptions, err := modules.ReadDescriptions()
+  if err != nil && !os.IsNotExist(err) {
+    return nil, err
+  }
+  for name, description := range descriptions {
+    metadata[name] = &ModuleMeta { Description: description }
+  }
+  if files, err := modules.List(); err == nil {
+    for _, file := range files {
+      if meta, has := metadata[file.Name]; has {
+        meta.Size = file.Size
+        meta.UploadedAt = file.ModTime
+      }
+    }
+  }
+  fillSums(metadata)
+  if err = modules.WriteMetadata(metadata); err != nil {
+    return nil, err
+  }
+  if 0 < len(descriptions) {
+    fmt.Printf("Migrated %d descriptions to %s\n", len(descriptions), metadataFile)
+    modules.RemoveDescriptions()
+  }
+  return metadata, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+  "gopkg.in/gin-gonic/gin.v1"
+  "net/http"
+  "bytes"
+  "fmt"
+  "io"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+const (
+  // failures of more names than this are counted as domain "other". queries for names
+  // that are no domain would grow the metrics without limit otherwise.
+  maxFailedDomains = 1000
+  metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// histogram counts observations in buckets without a lock. values are integers, such
+// as nanoseconds or bytes, and are written multiplied by scale.
+type histogram struct {
+  // first, 64 bit aligned for atomic.
+  sum uint64
+  bounds []uint64
+  // one more than bounds, the last one is +Inf.
+  counts []uint64
+  scale float64
+}
+
+func newHistogram(scale float64, bounds ...uint64) *histogram {
+  return &histogram { bounds: bounds, counts: make([]uint64, len(bounds) + 1), scale: scale }
+}
+
+func (h *histogram) observe(value uint64) {
+  i := sort.Search(len(h.bounds), func(i int) bool {
+    return value <= h.bounds[i]
+  })
+  atomic.AddUint64(&h.counts[i], 1)
+  atomic.AddUint64(&h.sum, value)
+}
+
+// write writes the series of the histogram. labels are "" or such as `mode="read"`.
+func (h *histogram) write(w io.Writer, name string, labels string) {
+  separator := ""
+  if "" != labels {
+    separator = ","
+  }
+  var count uint64
+  for i, bound := range h.bounds {
+    count += atomic.LoadUint64(&h.counts[i])
+    le := strconv.FormatFloat(float64(bound) * h.scale, 'f', -1, 64)
+    fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, separator, le, count)
+  }
+  count += atomic.LoadUint64(&h.counts[len(h.bounds)])
+  fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, separator, count)
+  if "" != labels {
+    labels = "{" + labels + "}"
+  }
+  fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, float64(atomic.LoadUint64(&h.sum)) * h.scale)
+  fmt.Fprintf(w, "%s_count%s %d\n", name, labels, count)
+}
+
+// Metrics counts what the hub does, for GET /metrics. the numbers of nodes and servers
+// are taken from the state when scraped.
+type Metrics struct {
+  // first, 64 bit aligned for atomic.
+  heartbeats uint64
+  commands uint64
+  commandErrors uint64
+  // guards the resolution counters.
+  lock sync.Mutex
+  // by domain key.
+  resolutions map[string]uint64
+  // by domain key, or by the queried name when no domain matched.
+  failures map[string]uint64
+  uploadSizes *histogram
+  readWait *histogram
+  writeWait *histogram
+}
+
+var metrics = newMetrics()
+
+func newMetrics() *Metrics {
+  // seconds, 10µs to 1s.
+  lockWait := func() *histogram {
+    return newHistogram(1e-9, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9)
+  }
+  return &Metrics {
+    resolutions: map[string]uint64{},
+    failures: map[string]uint64{},
+    // bytes, 64KiB to 1GiB.
+    uploadSizes: newHistogram(1, 1 << 16, 1 << 18, 1 << 20, 1 << 22, 1 << 24, 1 << 26, 1 << 28, 1 << 30),
+    readWait: lockWait(),
+    writeWait: lockWait(),
+  }
+}
+
+func (m *Metrics) Heartbeat() {
+  atomic.AddUint64(&m.heartbeats, 1)
+}
+
+// CommandSent counts a message to a node and whether it failed.
+func (m *Metrics) CommandSent(err error) {
+  atomic.AddUint64(&m.commands, 1)
+  if err != nil {
+    atomic.AddUint64(&m.commandErrors, 1)
+  }
+}
+
+// Resolution counts a domain query. domain is the matched domain key, or the queried
+// name when it failed for want of a domain.
+func (m *Metrics) Resolution(domain string, resolved bool) {
+  m.lock.Lock()
+  defer m.lock.Unlock()
+  if resolved {
+    m.resolutions[domain]++
+    return
+  }
+  if _, has := m.failures[domain]; !has && maxFailedDomains <= len(m.failures) {
+    domain = "other"
+  }
+  m.failures[domain]++
+}
+
+func (m *Metrics) UploadSize(size int64) {
+  m.uploadSizes.observe(uint64(size))
+}
+
+// LockWait records how long a reader or writer waited for the state lock.
+func (m *Metrics) LockWait(write bool, wait time.Duration) {
+  if write {
+    m.writeWait.observe(uint64(wait))
+  } else {
+    m.readWait.observe(uint64(wait))
+  }
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeMetricHeader(w io.Writer, name string, kind string, help string) {
+  fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeCounts writes one series per key, sorted.
+func writeCounts(w io.Writer, name string, label string, counts map[string]uint64) {
+  keys := make([]string, 0, len(counts))
+  for key := range counts {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  for _, key := range keys {
+    fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, labelEscaper.Replace(key), counts[key])
+  }
+}
+
+// write writes every metric in the Prometheus text format.
+func (m *Metrics) write(w io.Writer, state *StateStore) {
+  // every status is written, also when no node has it.
+  statuses := []int { 0, 1, 2, 8, 9 }
+  nodes := map[string]uint64{}
+  servers := map[string]uint64{}
+  for _, status := range statuses {
+    nodes[statusText(status)] = 0
+    servers[statusText(status)] = 0
+  }
+  var domains int
+  state.View(func(info *HubInfo) {
+    for _, node := range info.Nodes {
+      nodes[statusText(node.Status)]++
+      for _, server := range node.ServiceServers {
+        servers[statusText(server.Status)]++
+      }
+    }
+    domains = len(info.Domains)
+  })
+  writeMetricHeader(w, "xhub_nodes", "gauge", "Nodes by status.")
+  writeCounts(w, "xhub_nodes", "status", nodes)
+  writeMetricHeader(w, "xhub_servers", "gauge", "Service servers by status.")
+  writeCounts(w, "xhub_servers", "status", servers)
+  writeMetricHeader(w, "xhub_domains", "gauge", "Configured domains.")
+  fmt.Fprintf(w, "xhub_domains %d\n", domains)
+
+  m.lock.Lock()
+  writeMetricHeader(w, "xhub_resolutions_total", "counter", "Domain queries answered with a server, by domain.")
+  writeCounts(w, "xhub_resolutions_total", "domain", m.resolutions)
+  writeMetricHeader(w, "xhub_resolution_failures_total", "counter", "Domain queries answered with E@NotAssignDomain, by domain or queried name.")
+  writeCounts(w, "xhub_resolution_failures_total", "domain", m.failures)
+  m.lock.Unlock()
+
+  writeMetricHeader(w, "xhub_heartbeats_total", "counter", "Heartbeats of nodes and servers.")
+  fmt.Fprintf(w, "xhub_heartbeats_total %d\n", atomic.LoadUint64(&m.heartbeats))
+  writeMetricHeader(w, "xhub_commands_sent_total", "counter", "Messages sent to nodes.")
+  fmt.Fprintf(w, "xhub_commands_sent_total %d\n", atomic.LoadUint64(&m.commands))
+  writeMetricHeader(w, "xhub_command_send_errors_total", "counter", "Messages to nodes that could not be sent.")
+  fmt.Fprintf(w, "xhub_command_send_errors_total %d\n", atomic.LoadUint64(&m.commandErrors))
+
+  if nil != udpPipeline {
+    stats := udpPipeline.Stats()
+    writeMetricHeader(w, "xhub_udp_received_total", "counter", "Datagrams received from nodes.")
+    fmt.Fprintf(w, "xhub_udp_received_total %d\n", stats.Received)
+    handled := map[string]uint64{}
+    dropped := map[string]uint64{}
+    depth := map[string]uint64{}
+    for _, queue := range stats.Queues {
+      handled[queue.Name] = queue.Handled
+      dropped[queue.Name] = queue.Dropped
+      depth[queue.Name] = uint64(queue.Depth)
+    }
+    writeMetricHeader(w, "xhub_udp_handled_total", "counter", "Node messages handled, by queue.")
+    writeCounts(w, "xhub_udp_handled_total", "queue", handled)
+    writeMetricHeader(w, "xhub_udp_dropped_total", "counter", "Node messages dropped by a full queue, by queue.")
+    writeCounts(w, "xhub_udp_dropped_total", "queue", dropped)
+    writeMetricHeader(w, "xhub_udp_queue_depth", "gauge", "Node messages waiting, by queue.")
+    writeCounts(w, "xhub_udp_queue_depth", "queue", depth)
+  }
+
+  writeMetricHeader(w, "xhub_upload_size_bytes", "histogram", "Sizes of uploaded modules.")
+  m.uploadSizes.write(w, "xhub_upload_size_bytes", "")
+  writeMetricHeader(w, "xhub_state_lock_wait_seconds", "histogram", "Time waited for the hub state lock, by mode.")
+  m.readWait.write(w, "xhub_state_lock_wait_seconds", `mode="read"`)
+  m.writeWait.write(w, "xhub_state_lock_wait_seconds", `mode="write"`)
+}
+
+func serveMetrics(c *gin.Context, state *StateStore) {
+  var buf bytes.Buffer
+  metrics.write(&buf, state)
+  c.Data(http.StatusOK, metricsContentType, buf.Bytes())
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+  "gopkg.in/gin-gonic/gin.v1"
+  "net/http"
+  "crypto"
+  "crypto/rsa"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "math/big"
+  "net/url"
+  "os"
+  "strings"
+  "sync"
+  "time"
+)
+
+const oidcCookie = "xhub_oidc"
+
+// OIDCConfig enables sign-in through an OpenID Connect provider (authorization code flow).
+type OIDCConfig struct {
+  Issuer string `json:"issuer"`
+  ClientID string `json:"clientId"`
+  ClientSecret string `json:"clientSecret"`
+  // e.g. http://hub.example.com:51700/login/oidc/callback
+  RedirectURL string `json:"redirectUrl"`
+  Scopes []string `json:"scopes"`
+  // claim holding a role name or a list of group names, e.g. "groups".
+  RoleClaim string `json:"roleClaim"`
+  // claim value to role, e.g. {"xhub-admins": "admin"}. the highest matching role wins.
+  Roles map[string]string `json:"roles"`
+  // role of users without a matching claim. empty denies them.
+  DefaultRole string `json:"defaultRole"`
+}
+
+type oidcProvider struct {
+  sync.Mutex
+  Config *OIDCConfig
+  AuthorizationEndpoint string `json:"authorization_endpoint"`
+  TokenEndpoint string `json:"token_endpoint"`
+  JWKSURI string `json:"jwks_uri"`
+  Keys map[string]*rsa.PublicKey
+  KeysAt time.Time
+}
+
+// nil while OIDC is disabled.
+var oidc *oidcProvider
+
+func currentOIDC() *oidcProvider {
+  reloadable.RLock()
+  defer reloadable.RUnlock()
+  return oidc
+}
+
+func oidcEnabled() bool {
+  return nil != currentOIDC()
+}
+
+// loadOIDC reads the provider configuration. OIDC stays disabled without the file.
+func loadOIDC(filePath string) (*oidcProvider, error) {
+  blob, err := ioutil.ReadFile(filePath)
+  if os.IsNotExist(err) {
+    return nil, nil
+  } else if err != nil {
+    return nil, err
+  }
+  var config OIDCConfig
+  if err = json.Unmarshal(blob, &config); err != nil {
+    return nil, fmt.Errorf("%s: %s", filePath, err)
+  }
+  if "" == config.Issuer || "" == config.ClientID || "" == config.RedirectURL {
+    return nil, fmt.Errorf("%s: issuer, clientId and redirectUrl are required", filePath)
+  }
+  if "" != config.DefaultRole && !validRole(config.DefaultRole) {
+    return nil, fmt.Errorf("%s: unknown default role %s", filePath, config.DefaultRole)
+  }
+  for value, role := range config.Roles {
+    if !validRole(role) {
+      return nil, fmt.Errorf("%s: unknown role %s for %s", filePath, role, value)
+    }
+  }
+  if 0 == len(config.Scopes) {
+    config.Scopes = []string { "openid", "profile", "email" }
+  }
+  config.Issuer = strings.TrimRight(config.Issuer, "/")
+  return &oidcProvider { Config: &config }, nil
+}
+
+var oidcClient = &http.Client { Timeout: 10 * time.Second }
+
+func getJSON(target string, v interface{}) error {
+  resp, err := oidcClient.Get(target)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+  if http.StatusOK != resp.StatusCode {
+    return fmt.Errorf("%s: %s", target, resp.Status)
+  }
+  return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover fetches the provider metadata once.
+func (provider *oidcProvider) discover() error {
+  provider.Lock()
+  defer provider.Unlock()
+  if "" != provider.TokenEndpoint {
+    return nil
+  }
+  return getJSON(provider.Config.Issuer + "/.well-known/openid-configuration", provider)
+}
+
+// key returns the RSA key of the id token. unknown key ids refetch the key set
+// at most once a minute, so that rotated keys are picked up.
+func (provider *oidcProvider) key(kid string) (*rsa.PublicKey, error) {
+  provider.Lock()
+  defer provider.Unlock()
+  if key, has := provider.Keys[kid]; has {
+    return key, nil
+  }
+  if time.Since(provider.KeysAt) < time.Minute {
+    return nil, fmt.Errorf("unknown key %s", kid)
+  }
+  var set struct {
+    Keys []struct {
+      Kty string `json:"kty"`
+      Kid string `json:"kid"`
+      Use string `json:"use"`
+      N string `json:"n"`
+      E string `json:"e"`
+    } `json:"keys"`
+  }
+  provider.KeysAt = time.Now()
+  if err := getJSON(provider.JWKSURI, &set); err != nil {
+    return nil, err
+  }
+  provider.Keys = map[string]*rsa.PublicKey{}
+  for _, jwk := range set.Keys {
+    if "RSA" != jwk.Kty || ("" != jwk.Use && "sig" != jwk.Use) {
+      continue
+    }
+    n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+    if err != nil {
+      continue
+    }
+    e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+    if err != nil {
+      continue
+    }
+    provider.Keys[jwk.Kid] = &rsa.PublicKey {
+      N: new(big.Int).SetBytes(n),
+      E: int(new(big.Int).SetBytes(e).Int64()),
+    }
+  }
+  if key, has := provider.Keys[kid]; has {
+    return key, nil
+  }
+  return nil, fmt.Errorf("unknown key %s", kid)
+}
+
+// verify checks the RS256 signature and the standard claims of the id token.
+func (provider *oidcProvider) verify(token string, nonce string) (map[string]interface{}, error) {
+  parts := strings.Split(token, ".")
+  if 3 != len(parts) {
+    return nil, errors.New("malformed id token")
+  }
+  var header struct {
+    Alg string `json:"alg"`
+    Kid string `json:"kid"`
+  }
+  blob, err := base64.RawURLEncoding.DecodeString(parts[0])
+  if err != nil || json.Unmarshal(blob, &header) != nil {
+    return nil, errors.New("malformed id token header")
+  }
+  if "RS256" != header.Alg {
+    return nil, fmt.Errorf("unsupported id token algorithm %s", header.Alg)
+  }
+  key, err := provider.key(header.Kid)
+  if err != nil {
+    return nil, err
+  }
+  signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+  if err != nil {
+    return nil, errors.New("malformed id token signature")
+  }
+  digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+  if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+    return nil, errors.New("invalid id token signature")
+  }
+
+  claims := map[string]interface{}{}
+  blob, err = base64.RawURLEncoding.DecodeString(parts[1])
+  if err != nil || json.Unmarshal(blob, &claims) != nil {
+    return nil, errors.New("malformed id token claims")
+  }
+  if issuer, _ := claims["iss"].(string); provider.Config.Issuer != strings.TrimRight(issuer, "/") {
+    return nil, errors.New("id token issuer mismatch")
+  }
+  audience := false
+  switch aud := claims["aud"].(type) {
+    case string:
+      audience = provider.Config.ClientID == aud
+    case []interface{}:
+      for _, value := range aud {
+        audience = audience || provider.Config.ClientID == value
+      }
+  }
+  if !audience {
+    return nil, errors.New("id token audience mismatch")
+  }
+  exp, _ := claims["exp"].(float64)
+  if time.Now().After(time.Unix(int64(exp), 0).Add(time.Minute)) {
+    return nil, errors.New("id token expired")
+  }
+  if value, _ := claims["nonce"].(string); nonce != value {
+    return nil, errors.New("id token nonce mismatch")
+  }
+  return claims, nil
+}
+
+// role maps the role claim to the highest configured role.
+func (provider *oidcProvider) role(claims map[string]interface{}) string {
+  values := make([]string, 0)
+  switch claim := claims[provider.Config.RoleClaim].(type) {
+    case string:
+      values = append(values, claim)
+    case []interface{}:
+      for _, value := range claim {
+        if text, ok := value.(string); ok {
+          values = append(values, text)
+        }
+      }
+  }
+  role := provider.Config.DefaultRole
+  for _, value := range values {
+    if mapped, has := provider.Config.Roles[value]; has && roleLevels[role] < roleLevels[mapped] {
+      role = mapped
+    }
+  }
+  return role
+}
+
+// oidcLogin redirects to the provider. state and nonce are kept in a short-lived cookie.
+func oidcLogin(c *gin.Context) {
+  provider := currentOIDC()
+  if nil == provider {
+    c.Status(http.StatusNotFound)
+    return
+  }
+  if err := provider.discover(); err != nil {
+    fmt.Printf("Error: %s\n", err)
+    setAlert(c, "identity provider is not available")
+    c.Redirect(http.StatusFound, "/login")
+    return
+  }
+  state := randomHex(16)
+  nonce := randomHex(16)
+  setCookie(c, oidcCookie, state + "." + nonce, 600, "/login/oidc")
+  query := url.Values {
+    "response_type": { "code" },
+    "client_id": { provider.Config.ClientID },
+    "redirect_uri": { provider.Config.RedirectURL },
+    "scope": { strings.Join(provider.Config.Scopes, " ") },
+    "state": { state },
+    "nonce": { nonce },
+  }
+  separator := "?"
+  if strings.Contains(provider.AuthorizationEndpoint, "?") {
+    separator = "&"
+  }
+  c.Redirect(http.StatusFound, provider.AuthorizationEndpoint + separator + query.Encode())
+}
+
+func oidcCallback(c *gin.Context) {
+  if !oidcEnabled() {
+    c.Status(http.StatusNotFound)
+    return
+  }
+  user, err := oidcExchange(c)
+  if err != nil {
+    fmt.Printf("Error: oidc: %s\n", err)
+    recordAudit(c, "oidcLogin", err.Error())
+    setAlert(c, "sign-in failed: " + err.Error())
+    c.Redirect(http.StatusFound, "/login")
+    return
+  }
+  c.Set("user", user)
+  recordAudit(c, "oidcLogin", "ok")
+  startSession(c, user)
+  c.Redirect(http.StatusFound, "/")
+}
+
+func oidcExchange(c *gin.Context) (*User, error) {
+  provider := currentOIDC()
+  if nil == provider {
+    return nil, errors.New("single sign-on is disabled")
+  }
+  cookie, err := c.Cookie(oidcCookie)
+  setCookie(c, oidcCookie, "", -1, "/login/oidc")
+  if err != nil {
+    return nil, errors.New("sign-in expired")
+  }
+  stateNonce := strings.SplitN(cookie, ".", 2)
+  if 2 != len(stateNonce) || stateNonce[0] != c.Query("state") {
+    return nil, errors.New("state mismatch")
+  }
+  if message := c.Query("error"); "" != message {
+    return nil, errors.New(message)
+  }
+  if err = provider.discover(); err != nil {
+    return nil, err
+  }
+  resp, err := oidcClient.PostForm(provider.TokenEndpoint, url.Values {
+    "grant_type": { "authorization_code" },
+    "code": { c.Query("code") },
+    "redirect_uri": { provider.Config.RedirectURL },
+    "client_id": { provider.Config.ClientID },
+    "client_secret": { provider.Config.ClientSecret },
+  })
+  if err != nil {
+    return nil, err
+  }
+  defer resp.Body.Close()
+  var tokens struct {
+    IDToken string `json:"id_token"`
+    Error string `json:"error"`
+  }
+  if err = json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+    return nil, err
+  }
+  if http.StatusOK != resp.StatusCode || "" == tokens.IDToken {
+    return nil, fmt.Errorf("token request failed: %s %s", resp.Status, tokens.Error)
+  }
+  claims, err := provider.verify(tokens.IDToken, stateNonce[1])
+  if err != nil {
+    return nil, err
+  }
+  name := ""
+  for _, claim := range []string { "preferred_username", "email", "sub" } {
+    if value, _ := claims[claim].(string); "" == name && "" != value {
+      name = value
+    }
+  }
+  if "" == name {
+    // the audit log and the sessions need a name.
+    return nil, errors.New("id token has no user name")
+  }
+  role := provider.role(claims)
+  if "" == role {
+    return nil, fmt.Errorf("%s has no hub role", name)
+  }
+  return &User { Name: name, Role: role, External: true }, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+  "gopkg.in/gin-gonic/gin.v1"
+  "net/http"
+  "net/http/httptest"
+  "crypto"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/json"
+  "math/big"
+  "net/url"
+  "strings"
+  "testing"
+  "time"
+)
+
+// testProvider is an OpenID Connect provider with discovery, a key set and a token
+// endpoint, which answers every code with idToken.
+type testProvider struct {
+  server *httptest.Server
+  key *rsa.PrivateKey
+  idToken string
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+  key, err := rsa.GenerateKey(rand.Reader, 2048)
+  if err != nil {
+    t.Fatal(err)
+  }
+  provider := &testProvider { key: key }
+  mux := http.NewServeMux()
+  mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+    json.NewEncoder(w).Encode(map[string]string {
+      "issuer": provider.server.URL,
+      "authorization_endpoint": provider.server.URL + "/authorize",
+      "token_endpoint": provider.server.URL + "/token",
+      "jwks_uri": provider.server.URL + "/jwks",
+    })
+  })
+  mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+    json.NewEncoder(w).Encode(map[string]interface{} {
+      "keys": []map[string]string {{
+        "kty": "RSA",
+        "kid": "test",
+        "use": "sig",
+        "n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+        "e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+      }},
+    })
+  })
+  mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+    if "authorization_code" != r.FormValue("grant_type") || "code" != r.FormValue("code") || "hub" != r.FormValue("client_id") {
+      w.WriteHeader(http.StatusBadRequest)
+      json.NewEncoder(w).Encode(map[string]string { "error": "invalid_grant" })
+      return
+    }
+    json.NewEncoder(w).Encode(map[string]string { "id_token": provider.idToken })
+  })
+  provider.server = httptest.NewServer(mux)
+  t.Cleanup(provider.server.Close)
+  return provider
+}
+
+// sign returns an RS256 id token with the claims.
+func (provider *testProvider) sign(t *testing.T, claims map[string]interface{}) string {
+  header, _ := json.Marshal(map[string]string { "alg": "RS256", "kid": "test", "typ": "JWT" })
+  payload, _ := json.Marshal(claims)
+  signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+  digest := sha256.Sum256([]byte(signed))
+  signature, err := rsa.SignPKCS1v15(rand.Reader, provider.key, crypto.SHA256, digest[:])
+  if err != nil {
+    t.Fatal(err)
+  }
+  return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// claims are valid for the client "hub" and the nonce "nonce". changes replace them,
+// nil values remove them.
+func (provider *testProvider) claims(changes map[string]interface{}) map[string]interface{} {
+  claims := map[string]interface{} {
+    "iss": provider.server.URL,
+    "aud": "hub",
+    "sub": "0001",
+    "preferred_username": "alice",
+    "exp": time.Now().Add(time.Hour).Unix(),
+    "iat": time.Now().Unix(),
+    "nonce": "nonce",
+    "groups": []string { "xhub-operators" },
+  }
+  for name, value := range changes {
+    if nil == value {
+      delete(claims, name)
+    } else {
+      claims[name] = value
+    }
+  }
+  return claims
+}
+
+func (provider *testProvider) hubProvider(t *testing.T) *oidcProvider {
+  hub := &oidcProvider { Config: &OIDCConfig {
+    Issuer: provider.server.URL,
+    ClientID: "hub",
+    RedirectURL: "http://hub.example.com/login/oidc/callback",
+    RoleClaim: "groups",
+    Roles: map[string]string { "xhub-operators": roleOperator },
+  }}
+  if err := hub.discover(); err != nil {
+    t.Fatal(err)
+  }
+  return hub
+}
+
+func TestOIDCVerify(t *testing.T) {
+  provider := newTestProvider(t)
+  hub := provider.hubProvider(t)
+  tests := []struct {
+    name string
+    changes map[string]interface{}
+    nonce string
+    err string
+  }{
+    { "valid", nil, "nonce", "" },
+    { "audience list", map[string]interface{} { "aud": []string { "other", "hub" } }, "nonce", "" },
+    { "expired", map[string]interface{} { "exp": time.Now().Add(-time.Hour).Unix() }, "nonce", "expired" },
+    { "wrong audience", map[string]interface{} { "aud": "other" }, "nonce", "audience" },
+    { "wrong issuer", map[string]interface{} { "iss": "https://evil.example.com" }, "nonce", "issuer" },
+    { "wrong nonce", nil, "other", "nonce" },
+    { "missing nonce", map[string]interface{} { "nonce": nil }, "nonce", "nonce" },
+  }
+  for _, test := range tests {
+    claims, err := hub.verify(provider.sign(t, provider.claims(test.changes)), test.nonce)
+    if "" == test.err {
+      if err != nil {
+        t.Errorf("%s: %s", test.name, err)
+      } else if "alice" != claims["preferred_username"] {
+        t.Errorf("%s: claims %v", test.name, claims)
+      }
+    } else if nil == err || !strings.Contains(err.Error(), test.err) {
+      t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+    }
+  }
+
+  // signed by another key.
+  token := provider.sign(t, provider.claims(nil))
+  otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+  if err != nil {
+    t.Fatal(err)
+  }
+  other := &testProvider { key: otherKey }
+  forged := strings.Join(strings.Split(token, ".")[:2], ".") + "." + strings.Split(other.sign(t, provider.claims(nil)), ".")[2]
+  if _, err := hub.verify(forged, "nonce"); nil == err {
+    t.Error("token with a foreign signature verified")
+  }
+}
+
+// exchange runs oidcExchange for a callback with the code and the sign-in cookie.
+func exchange(hub *oidcProvider) (*User, error) {
+  reloadable.Lock()
+  previous := oidc
+  oidc = hub
+  reloadable.Unlock()
+  defer func() {
+    reloadable.Lock()
+    oidc = previous
+    reloadable.Unlock()
+  }()
+  var user *User
+  var err error
+  gin.SetMode(gin.TestMode)
+  router := gin.New()
+  router.GET("/login/oidc/callback", func(c *gin.Context) {
+    user, err = oidcExchange(c)
+  })
+  req, _ := http.NewRequest("GET", "/login/oidc/callback?" + url.Values { "state": { "state" }, "code": { "code" } }.Encode(), nil)
+  req.AddCookie(&http.Cookie { Name: oidcCookie, Value: "state.nonce" })
+  router.ServeHTTP(httptest.NewRecorder(), req)
+  return user, err
+}
+
+func TestOIDCExchange(t *testing.T) {
+  provider := newTestProvider(t)
+  hub := provider.hubProvider(t)
+
+  provider.idToken = provider.sign(t, provider.claims(nil))
+  user, err := exchange(hub)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if "alice" != user.Name || roleOperator != user.Role || !user.External {
+    t.Errorf("user %+v", user)
+  }
+
+  // the name falls back to the email and the subject.
+  provider.idToken = provider.sign(t, provider.claims(map[string]interface{} { "preferred_username": nil, "email": "bob@example.com" }))
+  if user, err = exchange(hub); err != nil || "bob@example.com" != user.Name {
+    t.Errorf("email: %+v, %v", user, err)
+  }
+
+  provider.idToken = provider.sign(t, provider.claims(map[string]interface{} { "preferred_username": nil, "sub": nil }))
+  if user, err = exchange(hub); nil == err {
+    t.Errorf("user without name signed in: %+v", user)
+  }
+  provider.idToken = provider.sign(t, provider.claims(map[string]interface{} { "preferred_username": "", "sub": "" }))
+  if user, err = exchange(hub); nil == err {
+    t.Errorf("user with empty name signed in: %+v", user)
+  }
+
+  provider.idToken = provider.sign(t, provider.claims(map[string]interface{} { "groups": []string { "others" } }))
+  if user, err = exchange(hub); nil == err {
+    t.Errorf("user without role signed in: %+v", user)
+  }
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "sort"
+  "strings"
+  "time"
+)
+
+// HubError is an operation failure with the HTTP status it maps to.
+type HubError struct {
+  Status int
+  Message string
+  Fields map[string]string
+}
+
+func (err *HubError) Error() string {
+  return err.Message
+}
+
+func badRequest(format string, args ...interface{}) error {
+  return &HubError { Status: http.StatusBadRequest, Message: fmt.Sprintf(format, args...) }
+}
+
+func notFound(format string, args ...interface{}) error {
+  return &HubError { Status: http.StatusNotFound, Message: fmt.Sprintf(format, args...) }
+}
+
+func conflict(format string, args ...interface{}) error {
+  return &HubError { Status: http.StatusConflict, Message: fmt.Sprintf(format, args...) }
+}
+
+func invalid(field string, message string) error {
+  return &HubError {
+    Status: http.StatusUnprocessableEntity,
+    Message: message,
+    Fields: map[string]string { field: message },
+  }
+}
+
+func findNode(info *HubInfo, ip string) (*Node, error) {
+  node, has := info.Nodes[ip]
+  if !has {
+    return nil, notFound("node %s not found", ip)
+  }
+  return node, nil
+}
+
+func findServer(info *HubInfo, ip string, port string) (*ServiceServer, error) {
+  node, err := findNode(info, ip)
+  if err != nil {
+    return nil, err
+  }
+  server, has := node.ServiceServers[port]
+  if !has {
+    return nil, notFound("server %s%s not found", ip, port)
+  }
+  return server, nil
+}
+
+func findDomain(info *HubInfo, key string) (*Domain, error) {
+  domain, has := info.Domains[key]
+  if !has {
+    return nil, notFound("domain %s not found", key)
+  }
+  return domain, nil
+}
+
+func stopNode(info *HubInfo, ip string) error {
+  node, err := findNode(info, ip)
+  if err != nil {
+    return err
+  }
+  node.SendMessage("C>")
+  return nil
+}
+
+// addServer asks the node to create a service server. it shows up with the next heartbeat.
+func addServer(info *HubInfo, ip string) error {
+  node, err := findNode(info, ip)
+  if err != nil {
+    return err
+  }
+  node.SendMessage("S>")
+  return nil
+}
+
+func renameServer(info *HubInfo, ip string, port string, name string) error {
+  server, err := findServer(info, ip, port)
+  if err != nil {
+    return err
+  }
+  server.Name = name
+  return nil
+}
+
+// checkStart reports why the server cannot be started. a running server is started already.
+func checkStart(server *ServiceServer) error {
+  if 2 == server.Status {
+    return conflict("server %s is synchronizing", server.Target())
+  }
+  return nil
+}
+
+func startServer(info *HubInfo, ip string, port string) error {
+  server, err := findServer(info, ip, port)
+  if err != nil {
+    return err
+  }
+  if err = checkStart(server); err != nil {
+    return err
+  }
+  if 0 == server.Status {
+    server.Status = 2
+    server.LastModifiedAt = time.Now()
+    server.Node.SendMessage("S>" + port)
+  }
+  return nil
+}
+
+// checkStop reports why the server cannot be stopped. a stopped server is stopped already.
+func checkStop(server *ServiceServer) error {
+  if 1 != server.Status && 0 != server.Status {
+    return conflict("server %s is not active", server.Target())
+  }
+  return nil
+}
+
+func stopServer(info *HubInfo, ip string, port string) error {
+  server, err := findServer(info, ip, port)
+  if err != nil {
+    return err
+  }
+  if err = checkStop(server); err != nil {
+    return err
+  }
+  if 1 == server.Status {
+    server.Status = 2
+    server.Node.SendMessage("C>" + port)
+  }
+  return nil
+}
+
+func syncServer(info *HubInfo, ip string, port string) error {
+  server, err := findServer(info, ip, port)
+  if err != nil {
+    return err
+  }
+  if 1 != server.Status && 8 != server.Status {
+    return conflict("server %s is not active", server.Target())
+  }
+  if "" == server.Module || !moduleAvailable(info, server.Module) {
+    return conflict("server %s has no available module", server.Target())
+  }
+  server.Status = 2
+  server.Node.SendMessage("S>" + port + "><" + server.Module)
+  return nil
+}
+
+// checkSetModule reports why the server cannot change to the module.
+func checkSetModule(info *HubInfo, server *ServiceServer, name string) error {
+  if !moduleAvailable(info, name) {
+    return invalid("module", "module is not available or not signed by a trusted key")
+  }
+  if server.Module != name && 1 != server.Status {
+    return conflict("server %s is not active", server.Target())
+  }
+  return nil
+}
+
+func setModule(info *HubInfo, ip string, port string, name string) error {
+  server, err := findServer(info, ip, port)
+  if err != nil {
+    return err
+  }
+  if err = checkSetModule(info, server, name); err != nil {
+    return err
+  }
+  if server.Module == name {
+    return nil
+  }
+  previous := server.Module
+  changeModule(server, name)
+  recordHistory(info, "setModule", server.Target(), name, previous)
+  return nil
+}
+
+// addDomain creates the domain. it reports false when the domain already exists.
+func addDomain(info *HubInfo, key string) (bool, error) {
+  if "" == key {
+    return false, invalid("domain", "domain must not be empty")
+  }
+  if _, has := info.Domains[key]; has {
+    return false, nil
+  }
+  info.Domains[key] = &(Domain {
+    Key: key,
+    Class: "d" + time.Now().Format(dateTimeTemplateLayout),
+  })
+  return true, nil
+}
+
+func deleteDomain(info *HubInfo, key string) error {
+  domain, err := findDomain(info, key)
+  if err != nil {
+    return err
+  }
+  for index := range domain.AssignPriorities {
+    assign := domain.AssignPriorities[index]
+    if nil != assign.ServiceServer {
+      priorities := make([]*AssignPriority, 0)
+      for i := range assign.ServiceServer.AssignPriorities {
+        a := assign.ServiceServer.AssignPriorities[i]
+        if a != assign {
+          priorities = append(priorities, a)
+        }
+      }
+      assign.ServiceServer.AssignPriorities = priorities
+    }
+  }
+  delete(info.Domains, key)
+  return nil
+}
+
+// assignServer assigns the server to the domain or updates the priority.
+// it reports true when a new assignment was created.
+func assignServer(info *HubInfo, ip string, port string, domainKey string, priority int) (bool, error) {
+  if priority < 1 || 2 < priority {
+    return false, invalid("priority", "priority must be 1 (primary) or 2 (secondary)")
+  }
+  server, err := findServer(info, ip, port)
+  if err != nil {
+    return false, err
+  }
+  for i := range server.AssignPriorities {
+    if domainKey == server.AssignPriorities[i].Domain.Key {
+      server.AssignPriorities[i].Priority = priority
+      return false, nil
+    }
+  }
+  domain, err := findDomain(info, domainKey)
+  if err != nil {
+    return false, err
+  }
+  assign := AssignPriority {
+    Priority: priority,
+    Domain: domain,
+    ServiceServer: server,
+  }
+  server.AssignPriorities = append(server.AssignPriorities, &assign)
+  domain.AssignPriorities = append(domain.AssignPriorities, &assign)
+  return true, nil
+}
+
+// excludeServer removes the assignment. it reports false when there was none.
+func excludeServer(info *HubInfo, ip string, port string, domainKey string) bool {
+  found := false
+  server := info.Server(ip, port)
+  if nil != server {
+    assigns := make([]*AssignPriority, 0)
+    for index := range server.AssignPriorities {
+      assign := server.AssignPriorities[index]
+      if domainKey != assign.Domain.Key {
+        assigns = append(assigns, assign)
+      } else {
+        found = true
+      }
+    }
+    server.AssignPriorities = assigns
+  }
+  domain, has := info.Domains[domainKey]
+  if has {
+    assigns := make([]*AssignPriority, 0)
+    for index := range domain.AssignPriorities {
+      assign := domain.AssignPriorities[index]
+      if port != assign.ServiceServer.Port || ip != assign.ServiceServer.Node.IP {
+        assigns = append(assigns, assign)
+      } else {
+        found = true
+      }
+    }
+    domain.AssignPriorities = assigns
+  }
+  return found
+}
+
+func setMaintenance(info *HubInfo, ip string, port string, enabled bool) error {
+  if "" == port {
+    node, err := findNode(info, ip)
+    if err != nil {
+      return err
+    }
+    node.Maintenance = enabled
+    return nil
+  }
+  server, err := findServer(info, ip, port)
+  if err != nil {
+    return err
+  }
+  server.Maintenance = enabled
+  return nil
+}
+
+func moduleExists(name string) bool {
+  return modules.Exists(name)
+}
+
+func removeModule(info *HubInfo, name string) error {
+  if !moduleExists(name) {
+    return notFound("module %s not found", name)
+  }
+  if servers := assignedServers(info, name); 0 < len(servers) {
+    return conflict("module %s is assigned to %s", name, strings.Join(servers, ", "))
+  }
+  if err := modules.Remove(name); err != nil {
+    return err
+  }
+  forgetTrusted(name)
+  delete(info.Metadata, name)
+  saveMetadata(info)
+  return nil
+}
+
+// editModule changes the metadata of the module.
+func editModule(info *HubInfo, name string, edit ModuleEdit) error {
+  if !moduleExists(name) {
+    return notFound("module %s not found", name)
+  }
+  meta := *moduleMeta(info, name)
+  if err := edit.apply(&meta); err != nil {
+    return err
+  }
+  info.Metadata[name] = &meta
+  saveMetadata(info)
+  return nil
+}
+
+// storeModule saves an uploaded module with a new metadata record. with backup the
+// existing file is kept under a timestamp-prefixed name, together with its record.
+// the content is written and moved into place without the state lock, which is only
+// taken to swap in the metadata. it reports true when the module is new.
+func storeModule(state *StateStore, fileName string, content io.Reader, signature []byte, edit ModuleEdit, uploader string, backup bool) (bool, error) {
+  if err := validModuleName(fileName); err != nil {
+    return false, err
+  }
+  meta := &ModuleMeta { Uploader: uploader, UploadedAt: time.Now() }
+  if err := edit.apply(meta); err != nil {
+    return false, err
+  }
+  signing := signingEnabled()
+  if signing && nil == signature {
+    return false, invalid("signature", "module signature is required")
+  }
+  temp, size, sum, err := modules.Stage(content)
+  if err != nil {
+    return false, err
+  }
+  if signing {
+    // verify the staged content before touching the stored module.
+    trusted, err := verifyStaged(temp, signature)
+    if err != nil || !trusted {
+      modules.Discard(temp)
+    }
+    if err != nil {
+      return false, err
+    }
+    if !trusted {
+      return false, invalid("signature", "module signature is not trusted")
+    }
+  }
+
+  modules.changes.Lock()
+  defer modules.changes.Unlock()
+  created := !moduleExists(fileName)
+  backupName := ""
+  if backup && !created {
+    backupName = time.Now().Format(dateTimeTemplateLayout)  + "_" + fileName
+    if err = modules.Rename(fileName, backupName); err != nil {
+      modules.Discard(temp)
+      return false, err
+    }
+  }
+  if err = modules.Commit(temp, fileName); err != nil {
+    modules.Discard(temp)
+    if "" != backupName {
+      // put the replaced module back.
+      modules.Rename(backupName, fileName)
+    }
+    return false, err
+  }
+  if nil != signature {
+    writeSignature(fileName, signature)
+  } else {
+    modules.RemoveSignature(fileName)
+  }
+  meta.Size = size
+  meta.SHA256 = sum
+  metrics.UploadSize(size)
+  state.Update(func(info *HubInfo) {
+    if "" != backupName {
+      if previous, has := info.Metadata[fileName]; has {
+        info.Metadata[backupName] = previous
+      }
+      moveTrusted(fileName, backupName)
+    }
+    info.Metadata[fileName] = meta
+    saveMetadata(info)
+    if signing {
+      // verified above.
+      setTrusted(fileName, sum, true)
+    } else {
+      forgetTrusted(fileName)
+    }
+  })
+  return created, nil
+}
+
+// maxTemplateSize limits the templates sent to the hub.
+const maxTemplateSize = 16 * 1024 * 1024
+
+// restoreTemplate parses a template without touching the running hub.
+func restoreTemplate(templateName string, content io.Reader) (*HubInfo, error) {
+  temp, err := ioutil.TempFile("", "xht")
+  if err != nil {
+    return nil, err
+  }
+  defer os.Remove(temp.Name())
+  n, err := io.Copy(temp, io.LimitReader(content, maxTemplateSize + 1))
+  temp.Close()
+  if err != nil {
+    return nil, err
+  }
+  if maxTemplateSize < n {
+    return nil, fmt.Errorf("template is larger than %d bytes", maxTemplateSize)
+  }
+  return Restore(templateName, temp.Name())
+}
+
+// diffLines lists the lines only in after (added) and only in before (removed).
+// the order of lines is ignored, as Backup writes maps in random order.
+func diffLines(before []byte, after []byte) (added []string, removed []string) {
+  current := map[string]bool{}
+  for _, line := range strings.Split(string(before), "\n") {
+    if "" != line {
+      current[line] = true
+    }
+  }
+  planned := map[string]bool{}
+  added = make([]string, 0)
+  for _, line := range strings.Split(string(after), "\n") {
+    if "" == line || planned[line] {
+      continue
+    }
+    planned[line] = true
+    if !current[line] {
+      added = append(added, line)
+    }
+  }
+  removed = make([]string, 0)
+  for line := range current {
+    if !planned[line] {
+      removed = append(removed, line)
+    }
+  }
+  sort.Strings(removed)
+  return
+}
+
+// planTemplate lists the template records newInfo adds to and removes from info.
+func planTemplate(info *HubInfo, newInfo *HubInfo) (added []string, removed []string) {
+  return diffLines(Backup(info), Backup(newInfo))
+}
+
+// replaceTemplate restores the hub from a template and swaps it in,
+// keeping descriptions, history and deployments. the configurations before
+// and after are returned for the audit trail.
+func replaceTemplate(state *StateStore, templateName string, content io.Reader) ([]byte, []byte, error) {
+  newInfo, err := restoreTemplate(templateName, content)
+  if err != nil {
+    return nil, nil, err
+  }
+  var before, after []byte
+  state.Swap(func(info *HubInfo) *HubInfo {
+    newInfo.Metadata = info.Metadata
+    newInfo.History = info.History
+    newInfo.Rollouts = info.Rollouts
+    newInfo.Canaries = info.Canaries
+    before = Backup(info)
+    after = Backup(newInfo)
+    return newInfo
+  })
+  return before, after, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// Persister writes the auto backup of the hub state. updates only mark the state
+// dirty, the backup is written at most once per interval and only when it changed,
+// heartbeats move statuses and timestamps which are not part of it.
+type Persister struct {
+  // serializes flushes. never taken by updates, which hold the state lock.
+  sync.Mutex
+  Path string
+  // rollouts file, not written while empty.
+  RolloutsPath string
+  // 1 when the state changed since the last flush.
+  dirty int32
+  // content of the files.
+  last []byte
+  lastRollouts []byte
+}
+
+func newPersister(path string) *Persister {
+  return &Persister { Path: path }
+}
+
+// MarkDirty is called after every update.
+func (persister *Persister) MarkDirty() {
+  atomic.StoreInt32(&persister.dirty, 1)
+}
+
+// Flush writes the backup and the rollouts when the state changed. it is also called on
+// shutdown.
+func (persister *Persister) Flush(state *StateStore) error {
+  persister.Lock()
+  defer persister.Unlock()
+  if !atomic.CompareAndSwapInt32(&persister.dirty, 1, 0) {
+    return nil
+  }
+  var backup, rollouts []byte
+  var err error
+  state.View(func(info *HubInfo) {
+    backup = Backup(info)
+    if "" != persister.RolloutsPath {
+      rollouts, err = json.Marshal(info.Rollouts)
+    }
+  })
+  if err != nil {
+    return err
+  }
+  if nil == persister.last || !bytes.Equal(backup, persister.last) {
+    if err = writeFileAtomic(persister.Path, backup, 0644); err != nil {
+      // tried again with the next flush.
+      persister.MarkDirty()
+      return err
+    }
+    persister.last = backup
+  }
+  if nil != rollouts && !bytes.Equal(rollouts, persister.lastRollouts) {
+    if err = writeFileAtomic(persister.RolloutsPath, rollouts, 0644); err != nil {
+      persister.MarkDirty()
+      return err
+    }
+    persister.lastRollouts = rollouts
+  }
+  return nil
+}
+
+// Run flushes at the interval of the config until stop is closed. a reloaded interval
+// is used after the current one.
+func (persister *Persister) Run(state *StateStore, stop chan struct{}) {
+  for {
+    timer := time.NewTimer(currentConfig().Timing.FlushInterval)
+    select {
+      case <- timer.C:
+        if err := persister.Flush(state); err != nil {
+          fmt.Printf("Error: %s\n", err)
+        }
+      case <- stop:
+        timer.Stop()
+        return
+    }
+  }
+}
+
+// writeFileAtomic replaces the file, so that a crash never leaves half of it.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+  temp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path) + ".tmp")
+  if err != nil {
+    return err
+  }
+  _, err = temp.Write(data)
+  if closeErr := temp.Close(); err == nil {
+    err = closeErr
+  }
+  if err == nil {
+    err = os.Chmod(temp.Name(), perm)
+  }
+  if err == nil {
+    err = os.Rename(temp.Name(), path)
+  }
+  if err != nil {
+    os.Remove(temp.Name())
+  }
+  return err
+}
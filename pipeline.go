@@ -0,0 +1,188 @@
+package main
+
+import (
+  "github.com/pantaroid/test/api"
+  "gopkg.in/gin-gonic/gin.v1"
+  "net/http"
+  "fmt"
+  "hash/fnv"
+  "net"
+  "sync"
+  "sync/atomic"
+)
+
+const (
+  udpWorkers = 4
+  // datagrams waiting for a worker. more are dropped, nodes send heartbeats again
+  // and ask again for domains.
+  resolutionQueueSize = 1024
+  // per worker.
+  messageQueueSize = 1024
+)
+
+type nodeMessage struct {
+  remote *net.UDPAddr
+  text string
+}
+
+// messageQueue is a bounded queue with its counters, read with atomic.
+type messageQueue struct {
+  // first, 64 bit aligned for atomic.
+  handled uint64
+  dropped uint64
+  channels []chan nodeMessage
+}
+
+func newMessageQueue(count int, size int) *messageQueue {
+  queue := &messageQueue { channels: make([]chan nodeMessage, count) }
+  for i := range queue.channels {
+    queue.channels[i] = make(chan nodeMessage, size)
+  }
+  return queue
+}
+
+// push never blocks, a full queue drops the message.
+func (queue *messageQueue) push(index int, message nodeMessage) {
+  select {
+    case queue.channels[index] <- message:
+    default:
+      atomic.AddUint64(&queue.dropped, 1)
+  }
+}
+
+func (queue *messageQueue) stats(name string) api.UDPQueue {
+  stats := api.UDPQueue {
+    Name: name,
+    Handled: atomic.LoadUint64(&queue.handled),
+    Dropped: atomic.LoadUint64(&queue.dropped),
+  }
+  for _, channel := range queue.channels {
+    stats.Depth += len(channel)
+    stats.Capacity += cap(channel)
+  }
+  return stats
+}
+
+// MessagePipeline reads the datagrams of the nodes and hands them to a pool of workers.
+// domain resolutions (D) share one queue, which every worker empties first, so that a
+// burst of heartbeats never delays them. the other messages are queued per node IP,
+// so that the messages of a node are handled in the order they were sent.
+type MessagePipeline struct {
+  received uint64
+  // 1 once Stop closed the socket.
+  stopping int32
+  workers sync.WaitGroup
+  conn *net.UDPConn
+  state *StateStore
+  resolutions *messageQueue
+  messages *messageQueue
+}
+
+// set in main, read by the API.
+var udpPipeline *MessagePipeline
+
+func newMessagePipeline(conn *net.UDPConn, state *StateStore) *MessagePipeline {
+  return &MessagePipeline {
+    conn: conn,
+    state: state,
+    resolutions: newMessageQueue(1, resolutionQueueSize),
+    messages: newMessageQueue(udpWorkers, messageQueueSize),
+  }
+}
+
+// Start runs the workers and the reader.
+func (pipeline *MessagePipeline) Start() {
+  for i := 0; i < udpWorkers; i++ {
+    pipeline.workers.Add(1)
+    go pipeline.work(i)
+  }
+  go pipeline.read()
+}
+
+// Stop closes the socket and returns once the queued messages are handled.
+func (pipeline *MessagePipeline) Stop() {
+  atomic.StoreInt32(&pipeline.stopping, 1)
+  pipeline.conn.Close()
+  pipeline.workers.Wait()
+}
+
+func (pipeline *MessagePipeline) read() {
+  buf := make([]byte, 1024)
+  for {
+    rlen, remote, err := pipeline.conn.ReadFromUDP(buf)
+    if err != nil && 1 == atomic.LoadInt32(&pipeline.stopping) {
+      // the reader is the only sender, the workers finish the queues.
+      close(pipeline.resolutions.channels[0])
+      for _, channel := range pipeline.messages.channels {
+        close(channel)
+      }
+      return
+    } else if err != nil {
+      continue
+    }
+    atomic.AddUint64(&pipeline.received, 1)
+    message := nodeMessage { remote: remote, text: string(buf[:rlen]) }
+    if 0 < rlen && 'D' == buf[0] {
+      pipeline.resolutions.push(0, message)
+    } else {
+      pipeline.messages.push(pipeline.shard(remote.IP), message)
+    }
+  }
+}
+
+func (pipeline *MessagePipeline) shard(ip net.IP) int {
+  hash := fnv.New32a()
+  hash.Write(ip)
+  return int(hash.Sum32() % uint32(udpWorkers))
+}
+
+// work handles the queued messages until both queues are closed and empty.
+func (pipeline *MessagePipeline) work(index int) {
+  defer pipeline.workers.Done()
+  resolutions := pipeline.resolutions.channels[0]
+  messages := pipeline.messages.channels[index]
+  for nil != resolutions || nil != messages {
+    var message nodeMessage
+    ok := false
+    queue := pipeline.resolutions
+    select {
+      case message, ok = <- resolutions:
+      default:
+        select {
+          case message, ok = <- resolutions:
+          case message, ok = <- messages:
+            queue = pipeline.messages
+        }
+    }
+    if ok {
+      pipeline.handle(queue, message)
+    } else if queue == pipeline.resolutions {
+      resolutions = nil
+    } else {
+      messages = nil
+    }
+  }
+}
+
+func (pipeline *MessagePipeline) handle(queue *messageQueue, message nodeMessage) {
+  fmt.Printf("Receive %v:%v -> %v\n", message.remote.IP, message.remote.Port, message.text)
+  handleMessage(pipeline.conn, message.remote, message.text, pipeline.state)
+  atomic.AddUint64(&queue.handled, 1)
+}
+
+func (pipeline *MessagePipeline) Stats() api.UDPStats {
+  return api.UDPStats {
+    Workers: udpWorkers,
+    Received: atomic.LoadUint64(&pipeline.received),
+    Queues: []api.UDPQueue {
+      pipeline.resolutions.stats("resolutions"),
+      pipeline.messages.stats("messages"),
+    },
+  }
+}
+
+// API
+
+func apiUDPStats(c *gin.Context) {
+  c.JSON(http.StatusOK, udpPipeline.Stats())
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+  "fmt"
+  "net"
+  "os"
+  "runtime"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+// messages sent but not yet handled. fewer than the queues and the socket buffer hold,
+// so that nothing is dropped.
+const benchmarkWindow = 64
+
+// benchmarkNodes sends heartbeats from node addresses 127.0.0.1 and up, one socket each.
+type benchmarkNodes struct {
+  // first, 64 bit aligned for atomic.
+  sent uint64
+  conns []*net.UDPConn
+  next uint32
+  pipeline *MessagePipeline
+}
+
+func newBenchmarkNodes(b *testing.B, count int, pipeline *MessagePipeline) *benchmarkNodes {
+  hub := pipeline.conn.LocalAddr().(*net.UDPAddr)
+  nodes := &benchmarkNodes { pipeline: pipeline }
+  for i := 0; i < count; i++ {
+    local := &net.UDPAddr { IP: net.IPv4(127, 0, byte((i + 1) / 256), byte((i + 1) % 256)) }
+    conn, err := net.DialUDP("udp", local, hub)
+    if err != nil {
+      b.Skipf("node address %s: %s", local.IP, err)
+    }
+    nodes.conns = append(nodes.conns, conn)
+  }
+  return nodes
+}
+
+// send waits until the pipeline has caught up with the window.
+func (nodes *benchmarkNodes) send(node *net.UDPConn, text string) {
+  for handled(nodes.pipeline) + benchmarkWindow <= atomic.LoadUint64(&nodes.sent) {
+    runtime.Gosched()
+  }
+  atomic.AddUint64(&nodes.sent, 1)
+  node.Write([]byte(text))
+}
+
+func (nodes *benchmarkNodes) Close() {
+  for _, conn := range nodes.conns {
+    conn.Close()
+  }
+}
+
+// handled counts the messages the pipeline is done with, dropped ones included.
+func handled(pipeline *MessagePipeline) uint64 {
+  var count uint64
+  for _, queue := range pipeline.Stats().Queues {
+    count += queue.Handled + queue.Dropped
+  }
+  return count
+}
+
+// BenchmarkHeartbeat sends heartbeats of five servers per node through the UDP pipeline
+// into the state, from parallel senders, and waits until every one is handled. with
+// subscribers the events are published as well.
+func BenchmarkHeartbeat(b *testing.B) {
+  for _, nodeCount := range []int { 10, 100, 1000 } {
+    for _, subscribers := range []int { 0, 1 } {
+      b.Run(fmt.Sprintf("nodes=%d/subscribers=%d", nodeCount, subscribers), func(b *testing.B) {
+        benchmarkHeartbeat(b, nodeCount, subscribers)
+      })
+    }
+  }
+}
+
+func benchmarkHeartbeat(b *testing.B, nodeCount int, subscribers int) {
+  // the hub prints every message.
+  stdout := os.Stdout
+  devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+  if err != nil {
+    b.Fatal(err)
+  }
+  os.Stdout = devNull
+  defer func() {
+    os.Stdout = stdout
+    devNull.Close()
+  }()
+
+  info := &HubInfo { Nodes: map[string]*Node{}, Domains: map[string]*Domain{}, Metadata: map[string]*ModuleMeta{} }
+  state := newStateStore(info, newPersister(os.DevNull))
+  conn, err := net.ListenUDP("udp", &net.UDPAddr { IP: net.IPv4(127, 0, 0, 1) })
+  if err != nil {
+    b.Fatal(err)
+  }
+  pipeline := newMessagePipeline(conn, state)
+  pipeline.Start()
+  defer pipeline.Stop()
+  nodes := newBenchmarkNodes(b, nodeCount, pipeline)
+  defer nodes.Close()
+
+  // every node and server exists before the timer starts.
+  for _, node := range nodes.conns {
+    for port := 0; port < 5; port++ {
+      nodes.send(node, fmt.Sprintf("N>%d", 9000 + port))
+    }
+  }
+  waitHandled(b, pipeline, nodes.sent)
+  for i := 0; i < subscribers; i++ {
+    var channel chan *Event
+    state.View(func(info *HubInfo) {
+      channel = events.subscribe(info)
+    })
+    defer events.unsubscribe(channel)
+    go func() {
+      for range channel {
+      }
+    }()
+  }
+
+  b.ResetTimer()
+  b.RunParallel(func(pb *testing.PB) {
+    i := 0
+    for pb.Next() {
+      node := nodes.conns[int(atomic.AddUint32(&nodes.next, 1)) % len(nodes.conns)]
+      nodes.send(node, fmt.Sprintf("N>%d", 9000 + i % 5))
+      i++
+    }
+  })
+  waitHandled(b, pipeline, atomic.LoadUint64(&nodes.sent))
+  b.StopTimer()
+  if dropped := pipeline.Stats().Queues[1].Dropped; 0 < dropped {
+    b.Errorf("%d messages dropped", dropped)
+  }
+}
+
+func waitHandled(b *testing.B, pipeline *MessagePipeline, count uint64) {
+  deadline := time.Now().Add(10 * time.Second)
+  for handled(pipeline) < count {
+    if time.Now().After(deadline) {
+      b.Fatalf("%d of %d messages handled", handled(pipeline), count)
+    }
+    time.Sleep(time.Millisecond)
+  }
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+  "github.com/pantaroid/test/api"
+  "gopkg.in/gin-gonic/gin.v1"
+  "gopkg.in/yaml.v3"
+  "net/http"
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+// the command line of the hub, read again by reloads. set in main.
+var startOptions = &ConfigOptions { values: map[string]string{} }
+
+// serializes reloads.
+var reloadLock sync.Mutex
+
+// keepStartup takes the settings that are bound at startup from the running config.
+// their changes wait for a restart: the listeners are not bound again and the
+// certificate is not read again, the changes are reported in the restart list.
+func (config *Config) keepStartup(running *Config) {
+  config.Listen = running.Listen
+  config.TLS = running.TLS
+  config.Paths = running.Paths
+}
+
+// reloadConfig reads the config and the files of the users, OIDC, the trusted keys and
+// the retention policy again and applies them at once. when one of them is invalid
+// nothing changes.
+func reloadConfig(state *StateStore) (*api.ReloadResult, error) {
+  reloadLock.Lock()
+  defer reloadLock.Unlock()
+  config, err := loadConfig(startOptions)
+  if err == nil {
+    err = config.validate()
+  }
+  if err != nil {
+    return nil, err
+  }
+  // the files are read from the running paths.
+  paths := currentConfig().Paths
+  provider, err := loadOIDC(paths.OIDC)
+  if err != nil {
+    return nil, err
+  }
+  keys, err := loadTrustedKeys(paths.TrustedKeys)
+  if err != nil {
+    return nil, err
+  }
+  users, err := readUsers(paths.Users)
+  if err != nil {
+    return nil, err
+  }
+  if 0 == len(users) {
+    // nobody could sign in to fix it.
+    return nil, fmt.Errorf("%s: no users", paths.Users)
+  }
+  policy, err := loadRetention(paths.Retention)
+  if err != nil {
+    return nil, err
+  }
+
+  result := &api.ReloadResult { Changes: []api.ConfigChange{}, Restart: []api.ConfigChange{} }
+  keysChanged := false
+  changed := func(file string) {
+    result.Changes = append(result.Changes, api.ConfigChange { Setting: file })
+  }
+  // the retention policy is used with the state locked, the scheduler sees all or nothing.
+  state.Update(func(info *HubInfo) {
+    reloadable.Lock()
+    defer reloadable.Unlock()
+    accounts.Lock()
+    defer accounts.Unlock()
+
+    applied := *config
+    applied.keepStartup(hubConfig)
+    result.Changes = append(result.Changes, diffConfig(hubConfig, &applied)...)
+    result.Restart = append(result.Restart, diffConfig(&applied, config)...)
+    hubConfig = &applied
+
+    var before, after *OIDCConfig
+    if nil != oidc {
+      before = oidc.Config
+    }
+    if nil != provider {
+      after = provider.Config
+    }
+    // an unchanged provider keeps its discovered endpoints and keys.
+    if !sameJSON(before, after) {
+      oidc = provider
+      changed(paths.OIDC)
+    }
+    if !sameJSON(trustedKeys, keys) {
+      trustedKeys = keys
+      resetTrusted()
+      keysChanged = true
+      changed(paths.TrustedKeys)
+    }
+    if !sameJSON(accounts.Users, users) {
+      accounts.Users = users
+      changed(paths.Users)
+    }
+    policy.LastRunAt = retention.LastRunAt
+    if !sameJSON(retention, policy) {
+      retention = policy
+      changed(paths.Retention)
+    }
+  })
+  if keysChanged {
+    go verifyTrusted(state)
+  }
+  return result, nil
+}
+
+func sameJSON(a interface{}, b interface{}) bool {
+  blobA, errA := json.Marshal(a)
+  blobB, errB := json.Marshal(b)
+  return errA == nil && errB == nil && bytes.Equal(blobA, blobB)
+}
+
+// configValues lists the settings by their path in the config file, such as
+// timing.heartbeatWarning.
+func configValues(config *Config) map[string]string {
+  values := map[string]string{}
+  blob, err := yaml.Marshal(config)
+  if err != nil {
+    return values
+  }
+  var tree map[string]interface{}
+  if err = yaml.Unmarshal(blob, &tree); err != nil {
+    return values
+  }
+  var flatten func(prefix string, tree map[string]interface{})
+  flatten = func(prefix string, tree map[string]interface{}) {
+    for key, value := range tree {
+      if sub, ok := value.(map[string]interface{}); ok {
+        flatten(prefix + key + ".", sub)
+      } else {
+        values[prefix + key] = fmt.Sprint(value)
+      }
+    }
+  }
+  flatten("", tree)
+  return values
+}
+
+// diffConfig returns the settings that differ, sorted by path.
+func diffConfig(from *Config, to *Config) []api.ConfigChange {
+  fromValues := configValues(from)
+  toValues := configValues(to)
+  changes := make([]api.ConfigChange, 0)
+  for setting, value := range toValues {
+    if fromValues[setting] != value {
+      changes = append(changes, api.ConfigChange { Setting: setting, From: fromValues[setting], To: value })
+    }
+  }
+  sort.Slice(changes, func(i, j int) bool {
+    return changes[i].Setting < changes[j].Setting
+  })
+  return changes
+}
+
+// changeLines renders the changes for the audit log, files without values.
+func changeLines(result *api.ReloadResult) ([]string, []string) {
+  before := make([]string, 0)
+  after := make([]string, 0)
+  for _, change := range result.Changes {
+    if "" == change.From && "" == change.To {
+      after = append(after, change.Setting + " reloaded")
+    } else {
+      before = append(before, change.Setting + ": " + change.From)
+      after = append(after, change.Setting + ": " + change.To)
+    }
+  }
+  return before, after
+}
+
+func printReload(result *api.ReloadResult) {
+  if 0 == len(result.Changes) && 0 == len(result.Restart) {
+    fmt.Println("Reloaded config, nothing changed")
+    return
+  }
+  fmt.Println("Reloaded config")
+  for _, change := range result.Changes {
+    if "" == change.From && "" == change.To {
+      fmt.Printf("  %s\n", change.Setting)
+    } else {
+      fmt.Printf("  %s: %s -> %s\n", change.Setting, change.From, change.To)
+    }
+  }
+  for _, change := range result.Restart {
+    fmt.Printf("  %s: %s -> %s (after restart)\n", change.Setting, change.From, change.To)
+  }
+}
+
+// reloadOnSignal reloads on SIGHUP. the result is printed and recorded in the audit log.
+func reloadOnSignal(state *StateStore) {
+  entry := &AuditEntry {
+    Time: time.Now(),
+    Source: "signal",
+    Action: "SIGHUP reload",
+    Status: http.StatusOK,
+    Result: "ok",
+  }
+  result, err := reloadConfig(state)
+  if err != nil {
+    fmt.Printf("Error: reload: %s\n", err)
+    entry.Status = http.StatusUnprocessableEntity
+    entry.Result = err.Error()
+  } else {
+    printReload(result)
+    before, after := changeLines(result)
+    if 0 < len(before) {
+      entry.Before = before
+    }
+    if 0 < len(after) {
+      entry.After = after
+    }
+  }
+  appendAudit(entry)
+}
+
+// API
+
+func apiReloadConfig(c *gin.Context, state *StateStore) {
+  result, err := reloadConfig(state)
+  if err != nil {
+    apiError(c, invalid("config", err.Error()))
+    return
+  }
+  printReload(result)
+  before, after := changeLines(result)
+  auditState(c, []byte(strings.Join(before, "\n")), []byte(strings.Join(after, "\n")))
+  c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+  "crypto/ed25519"
+  "encoding/json"
+  "github.com/pantaroid/test/api"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+// useReload points the running config to files in a temporary directory, with an admin
+// in the users file, and reloads read the returned config file. everything reloads
+// change is restored after the test.
+func useReload(t *testing.T) (string, *PathsConfig) {
+  dir := t.TempDir()
+  useAccounts(t, &User { Name: "admin", Role: roleAdmin, PasswordHash: "x", Tokens: make([]*APIToken, 0) })
+  reloadable.Lock()
+  previous, previousOIDC, previousKeys := hubConfig, oidc, trustedKeys
+  config := *defaultConfig()
+  for _, path := range []*string { &config.Paths.Users, &config.Paths.Retention, &config.Paths.OIDC, &config.Paths.TrustedKeys } {
+    *path = filepath.Join(dir, *path)
+  }
+  hubConfig = &config
+  // as read at startup, the missing files.
+  oidc, trustedKeys = nil, []ed25519.PublicKey{}
+  reloadable.Unlock()
+  previousRetention, previousOptions := retention, startOptions
+  retention = &RetentionPolicy{}
+  configFile := filepath.Join(dir, "xhub.yaml")
+  startOptions = &ConfigOptions { File: configFile, values: map[string]string{} }
+  t.Cleanup(func() {
+    reloadable.Lock()
+    hubConfig, oidc, trustedKeys = previous, previousOIDC, previousKeys
+    reloadable.Unlock()
+    resetTrusted()
+    retention, startOptions = previousRetention, previousOptions
+  })
+
+  blob, err := json.Marshal([]*User { { Name: "admin", Role: roleAdmin, PasswordHash: "x" } })
+  if nil == err {
+    err = ioutil.WriteFile(config.Paths.Users, blob, 0600)
+  }
+  if err != nil {
+    t.Fatal(err)
+  }
+  return configFile, &config.Paths
+}
+
+func settingNames(changes []api.ConfigChange) string {
+  names := make([]string, 0, len(changes))
+  for _, change := range changes {
+    names = append(names, change.Setting)
+  }
+  return strings.Join(names, " ")
+}
+
+func TestReloadConfig(t *testing.T) {
+  info, _ := newTestServer(t)
+  state := newStateStore(info, newPersister(os.DevNull))
+  configFile, paths := useReload(t)
+  // the paths of the file are the running ones, they are not reported.
+  pathLines := "paths:\n  users: " + paths.Users + "\n  retention: " + paths.Retention + "\n  oidc: " + paths.OIDC + "\n  trustedKeys: " + paths.TrustedKeys + "\n"
+  if err := ioutil.WriteFile(configFile, []byte(pathLines + "nodePort: 51711\nlisten:\n  http: \":51800\"\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  result, err := reloadConfig(state)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if "nodePort" != settingNames(result.Changes) || "listen.http" != settingNames(result.Restart) {
+    t.Errorf("changes %v, restart %v", result.Changes, result.Restart)
+  }
+  running := currentConfig()
+  if 51711 != running.NodePort || ":51700" != running.Listen.HTTP {
+    t.Errorf("running node port %d, listen %s", running.NodePort, running.Listen.HTTP)
+  }
+
+  tests := []struct {
+    name string
+    config string
+    users string
+  }{
+    { "invalid value", pathLines + "nodePort: 0\ntiming:\n  flushInterval: 10s\n", "" },
+    { "unknown key", pathLines + "nodPort: 51712\n", "" },
+    { "no users", pathLines + "nodePort: 51712\n", "[]" },
+    { "broken users", pathLines + "nodePort: 51712\n", "[{" },
+  }
+  for _, test := range tests {
+    if err := ioutil.WriteFile(configFile, []byte(test.config), 0644); err != nil {
+      t.Fatal(err)
+    }
+    if "" != test.users {
+      if err := ioutil.WriteFile(paths.Users, []byte(test.users), 0600); err != nil {
+        t.Fatal(err)
+      }
+    }
+    if _, err := reloadConfig(state); nil == err {
+      t.Errorf("%s: reloaded", test.name)
+    }
+    // nothing of a rejected reload is applied.
+    if running != currentConfig() {
+      t.Errorf("%s: running config replaced", test.name)
+    }
+    accounts.Lock()
+    _, has := accounts.Users["admin"]
+    accounts.Unlock()
+    if !has {
+      t.Errorf("%s: users replaced", test.name)
+    }
+  }
+}
+
+func TestDiffConfig(t *testing.T) {
+  from := defaultConfig()
+  to := defaultConfig()
+  if changes := diffConfig(from, to); 0 != len(changes) {
+    t.Errorf("same configs differ: %v", changes)
+  }
+  to.NodePort = 51711
+  to.Timing.FlushInterval *= 2
+  to.TLS.Cert = "hub.crt"
+  changes := diffConfig(from, to)
+  want := []api.ConfigChange {
+    { Setting: "nodePort", From: "51710", To: "51711" },
+    { Setting: "timing.flushInterval", From: "5s", To: "10s" },
+    { Setting: "tls.cert", From: "", To: "hub.crt" },
+  }
+  if len(want) != len(changes) {
+    t.Fatalf("changes %v", changes)
+  }
+  for i := range want {
+    if want[i] != changes[i] {
+      t.Errorf("change %v, want %v", changes[i], want[i])
+    }
+  }
+}
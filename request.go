@@ -0,0 +1,135 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "strconv"
+  "strings"
+)
+
+// bodies of /execute are small.
+const maxExecuteBody = 64 * 1024
+
+// Number is a number sent as JSON number or as text, as the page sends the input of prompts.
+// empty text is 0.
+type Number int
+
+func (number *Number) UnmarshalJSON(blob []byte) error {
+  var text string
+  if json.Unmarshal(blob, &text) == nil {
+    text = strings.TrimSpace(text)
+    if "" == text {
+      *number = 0
+      return nil
+    }
+    value, err := strconv.Atoi(text)
+    if err != nil {
+      return fmt.Errorf("%q is not a number", text)
+    }
+    *number = Number(value)
+    return nil
+  }
+  var value int
+  if err := json.Unmarshal(blob, &value); err != nil {
+    return fmt.Errorf("%s is not a number", blob)
+  }
+  *number = Number(value)
+  return nil
+}
+
+// ExecuteRequest is the body of POST /execute. Key names the action.
+type ExecuteRequest struct {
+  Key string `json:"key"`
+  IP string `json:"ip"`
+  Port string `json:"port"`
+  Name string `json:"name"`
+  Domain string `json:"domain"`
+  ID string `json:"id"`
+  Priority Number `json:"priority"`
+  // on or off
+  Enabled string `json:"enabled"`
+  Seconds Number `json:"seconds"`
+  // rollouts
+  Batch Number `json:"batch"`
+  Timeout Number `json:"timeout"`
+  Failure string `json:"failure"`
+  // canaries, servers as "ip@port"
+  Servers []string `json:"servers"`
+  Weight Number `json:"weight"`
+  Window Number `json:"window"`
+  Errors Number `json:"errors"`
+}
+
+// executeFields lists the fields each action requires. fields typed by the user,
+// such as the name of a new domain, are checked by the action itself.
+var executeFields = map[string][]string {
+  "removeFile": { "name" },
+  "stopNode": { "ip" },
+  "addServer": { "ip" },
+  "renameServer": { "ip", "port" },
+  "startServer": { "ip", "port" },
+  "stopServer": { "ip", "port" },
+  "syncServer": { "ip", "port" },
+  "setModule": { "ip", "port" },
+  "rollbackServer": { "ip", "port" },
+  "rollbackDomain": { "domain" },
+  "rollbackModule": { "name" },
+  "startRollout": { "domain" },
+  "pauseRollout": { "id" },
+  "resumeRollout": { "id" },
+  "abortRollout": { "id" },
+  "drainServer": { "ip", "port" },
+  "drainNode": { "ip" },
+  "cancelDrain": { "ip" },
+  "maintenance": { "ip", "enabled" },
+  "startCanary": { "domain" },
+  "promoteCanary": { "id" },
+  "abortCanary": { "id" },
+  "addDomain": {},
+  "delDomain": { "name" },
+  "assign": { "ip", "port", "domain" },
+  "exclude": { "ip", "port", "domain" },
+}
+
+func (request *ExecuteRequest) validate() error {
+  fields, has := executeFields[request.Key]
+  if !has {
+    return badRequest("unknown action %q", request.Key)
+  }
+  values := map[string]string {
+    "ip": request.IP,
+    "port": request.Port,
+    "name": request.Name,
+    "domain": request.Domain,
+    "id": request.ID,
+    "enabled": request.Enabled,
+  }
+  for _, field := range fields {
+    if "" == values[field] {
+      return badRequest("%s: %s is required", request.Key, field)
+    }
+  }
+  if "" != request.Enabled && "on" != request.Enabled && "off" != request.Enabled {
+    return badRequest("enabled must be on or off")
+  }
+  return nil
+}
+
+// decodeExecuteRequest reads the body strictly, unknown fields included. the page posts
+// JSON as form data, so the content type is not checked.
+func decodeExecuteRequest(r *http.Request) (*ExecuteRequest, error) {
+  var request ExecuteRequest
+  decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxExecuteBody))
+  decoder.DisallowUnknownFields()
+  if err := decoder.Decode(&request); err != nil {
+    return nil, badRequest("invalid request: %s", err)
+  }
+  if decoder.More() {
+    return nil, badRequest("invalid request: trailing data")
+  }
+  if err := request.validate(); err != nil {
+    return nil, err
+  }
+  return &request, nil
+}
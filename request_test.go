@@ -0,0 +1,78 @@
+package main
+
+import (
+  "net/http"
+  "strings"
+  "testing"
+)
+
+func TestDecodeExecuteRequest(t *testing.T) {
+  tests := []struct {
+    body string
+    valid bool
+  }{
+    { `{"key":"startServer","ip":"10.0.0.1","port":">9000"}`, true },
+    { `{"key":"drainNode","ip":"10.0.0.1","seconds":"60"}`, true },
+    { `{"key":"drainNode","ip":"10.0.0.1","seconds":""}`, true },
+    { `{"key":"drainNode","ip":"10.0.0.1","seconds":"soon"}`, false },
+    { `{"key":"startServer","ip":"10.0.0.1","port":">9000","prot":">9001"}`, false },
+    { `{"key":"startServer","ip":"10.0.0.1"}`, false },
+    { `{"key":"unknown"}`, false },
+    { `{"key":"maintenance","ip":"10.0.0.1","enabled":"yes"}`, false },
+    { `{"key":"stopNode","ip":"10.0.0.1"} {}`, false },
+    { `{"key":`, false },
+  }
+  for _, test := range tests {
+    r, _ := http.NewRequest("POST", "/execute", strings.NewReader(test.body))
+    _, err := decodeExecuteRequest(r)
+    if test.valid && nil != err {
+      t.Errorf("%s: %s", test.body, err)
+    }
+    if !test.valid && nil == err {
+      t.Errorf("%s: accepted", test.body)
+    }
+  }
+}
+
+func TestExecuteRollback(t *testing.T) {
+  info, server := newTestServer(t)
+  info.Domains["example.com"] = &Domain { Key: "example.com", AssignPriorities: []*AssignPriority {{ ServiceServer: server }} }
+  for _, request := range []*ExecuteRequest {
+    { Key: "rollbackServer", IP: "127.0.0.1", Port: ":9000" },
+    { Key: "rollbackDomain", Domain: "example.com" },
+    { Key: "rollbackModule", Name: "a.zip" },
+  } {
+    err := executeAction(info, request)
+    if hubErr, ok := err.(*HubError); !ok || http.StatusConflict != hubErr.Status {
+      t.Errorf("%s without a previous module: %v", request.Key, err)
+    }
+  }
+  if err := executeAction(info, &ExecuteRequest { Key: "rollbackServer", IP: "127.0.0.1", Port: ":9001" }); nil == err {
+    t.Error("unknown server rolled back")
+  }
+
+  server.History = []string { "b.zip" }
+  if err := executeAction(info, &ExecuteRequest { Key: "rollbackServer", IP: "127.0.0.1", Port: ":9000" }); err != nil || "b.zip" != server.Module {
+    t.Errorf("rollback: %v, module %s", err, server.Module)
+  }
+}
+
+func TestExecuteCancelDrain(t *testing.T) {
+  info, server := newTestServer(t)
+  node := server.Node
+  node.Draining = true
+  server.Draining = true
+  err := executeAction(info, &ExecuteRequest { Key: "cancelDrain", IP: "127.0.0.1", Port: ":9001" })
+  if hubErr, ok := err.(*HubError); !ok || http.StatusNotFound != hubErr.Status {
+    t.Errorf("unknown port: %v", err)
+  }
+  if !node.Draining || !server.Draining {
+    t.Error("drain canceled for an unknown port")
+  }
+  if err = executeAction(info, &ExecuteRequest { Key: "cancelDrain", IP: "127.0.0.1", Port: ":9000" }); err != nil || server.Draining || !node.Draining {
+    t.Errorf("server: %v, node %t, server %t", err, node.Draining, server.Draining)
+  }
+  if err = executeAction(info, &ExecuteRequest { Key: "cancelDrain", IP: "127.0.0.1" }); err != nil || node.Draining {
+    t.Errorf("node: %v, node %t", err, node.Draining)
+  }
+}
@@ -16,6 +16,20 @@ function download(filename) {
   $("#download_form").submit();
 }
 
+// every changing request carries the CSRF token of the session.
+$(document).ajaxSend(function(event, xhr, settings) {
+  if ("GET" !== settings.type) {
+    xhr.setRequestHeader("X-CSRF-Token", $("meta[name=csrf-token]").attr("content"));
+  }
+});
+
+// show requests the hub refused.
+$(document).ajaxError(function(event, xhr, settings) {
+  if (400 === xhr.status || 403 === xhr.status) {
+    alert(xhr.responseText);
+  }
+});
+
 // execute command and refresh window.
 function execute(params) {
   execute(params, null);
@@ -34,15 +48,67 @@ function redirect(tab, params) {
   $.post("/execute", JSON.stringify(params), function(data){ location.href = "/" + tab; location.reload(); });
 }
 
-var isReload = false;
-function reloadServers(num) {
-  if (!isReload) {
-    setTimeout(function() {
-      location.href = "/#servers";
-      location.reload();
-    }, num ? num : 3000);
-    isReload = true;
-  }
+// show only the options assigned to the domain.
+function filterDomainOptions(select, domain) {
+  $(select).val([]);
+  $(select).find("option").each(function() {
+    $(this).toggle(0 <= $(this).attr("data-domains").indexOf(" " + domain + " "));
+  });
+}
+
+// show only the audit rows containing the text.
+function filterAudit(text) {
+  text = text.toLowerCase();
+  $("#audit .audit-row").each(function() {
+    $(this).toggle(0 <= $(this).text().toLowerCase().indexOf(text));
+  });
+}
+
+function filterModules() {
+  var text = $("#moduleSearch").val().toLowerCase();
+  var tag = $("#moduleTag").val();
+  $("#modules .module-row").each(function() {
+    var match = 0 <= String($(this).data("search")).indexOf(text);
+    if ("" != tag) { match = match && 0 <= $(this).attr("data-tags").indexOf(" " + tag + " "); }
+    $(this).toggle(match);
+  });
+}
+
+// replace the tab with the current panel, keeping the expanded nodes and domains.
+function refreshPanel(name) {
+  $.get("/panels/" + name, function(html) {
+    var expanded = {};
+    $("#" + name + " .collapse").each(function() { expanded[this.id] = $(this).hasClass("in"); });
+    $("#" + name).html(html);
+    $("#" + name + " .collapse").each(function() {
+      if (this.id in expanded) { $(this).toggleClass("in", expanded[this.id]); }
+    });
+  });
+}
+
+// refresh the servers and domains tabs when the hub pushes a change.
+// the stream starts with the whole state, which is skipped until "ready".
+var refreshTimer = null;
+function listenEvents() {
+  if (!window.EventSource) { return; }
+  var source = new EventSource("/api/events");
+  var ready = false;
+  var connected = false;
+  var refresh = function() {
+    if (!ready) { return; }
+    clearTimeout(refreshTimer);
+    refreshTimer = setTimeout(function() { refreshPanel("servers"); refreshPanel("domains"); }, 300);
+  };
+  ["node", "domain", "rollout", "canary", "removed"].forEach(function(type) {
+    source.addEventListener(type, refresh);
+  });
+  source.addEventListener("ready", function() {
+    ready = true;
+    // changes may have been missed while reconnecting.
+    if (connected) { refresh(); }
+    connected = true;
+  });
+  source.onerror = function() { ready = false; };
 }
 
 $(document).ready(function() {
@@ -0,0 +1,343 @@
+package main
+
+import (
+  "github.com/pantaroid/test/api"
+  "gopkg.in/gin-gonic/gin.v1"
+  "net/http"
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "regexp"
+  "sort"
+  "sync"
+  "time"
+)
+
+// RetentionPolicy removes old backups of modules, the timestamp-prefixed copies left by
+// uploads with backup. current modules are never removed. zero values disable a rule.
+type RetentionPolicy struct {
+  // versions kept per module, the current one included.
+  KeepVersions int `json:"keepVersions"`
+  // backups older than this are removed.
+  MaxAgeDays int `json:"maxAgeDays"`
+  // hours between scheduled runs, 0 runs only on request.
+  IntervalHours int `json:"intervalHours"`
+  LastRunAt time.Time `json:"lastRunAt"`
+}
+
+// the policy is used with the hub state locked.
+var retention = &RetentionPolicy{}
+
+func loadRetention(filePath string) (*RetentionPolicy, error) {
+  policy := &RetentionPolicy{}
+  blob, err := ioutil.ReadFile(filePath)
+  if os.IsNotExist(err) {
+    return policy, nil
+  } else if err != nil {
+    return nil, err
+  }
+  if err = json.Unmarshal(blob, policy); err != nil {
+    return nil, fmt.Errorf("%s: %s", filePath, err)
+  }
+  if err = policy.validate(); err != nil {
+    return nil, fmt.Errorf("%s: %s", filePath, err)
+  }
+  return policy, nil
+}
+
+func saveRetention(policy *RetentionPolicy) error {
+  blob, err := json.MarshalIndent(policy, "", "  ")
+  if err != nil {
+    return err
+  }
+  return ioutil.WriteFile(currentConfig().Paths.Retention, blob, 0644)
+}
+
+func (policy *RetentionPolicy) validate() error {
+  switch {
+    case policy.KeepVersions < 0:
+      return invalid("keepVersions", "keepVersions must not be negative")
+    case policy.MaxAgeDays < 0:
+      return invalid("maxAgeDays", "maxAgeDays must not be negative")
+    case policy.IntervalHours < 0:
+      return invalid("intervalHours", "intervalHours must not be negative")
+  }
+  return nil
+}
+
+func (policy *RetentionPolicy) NextRunAt() time.Time {
+  if 0 == policy.IntervalHours {
+    return time.Time{}
+  }
+  return policy.LastRunAt.Add(time.Duration(policy.IntervalHours) * time.Hour)
+}
+
+// backupPattern matches the names storeModule gives replaced modules.
+var backupPattern = regexp.MustCompile(`^(\d{8}_\d{6})_(.+)$`)
+
+// parseBackup returns the module and the time of the backup.
+func parseBackup(name string) (string, time.Time, bool) {
+  match := backupPattern.FindStringSubmatch(name)
+  if nil == match {
+    return "", time.Time{}, false
+  }
+  at, err := time.ParseInLocation(dateTimeTemplateLayout, match[1], time.Local)
+  if err != nil {
+    return "", time.Time{}, false
+  }
+  return match[2], at, true
+}
+
+// assignedServers returns the servers running the module.
+func assignedServers(info *HubInfo, name string) []string {
+  targets := make([]string, 0)
+  for _, node := range info.Nodes {
+    for _, server := range node.ServiceServers {
+      if name == server.Module {
+        targets = append(targets, server.Target())
+      }
+    }
+  }
+  sort.Strings(targets)
+  return targets
+}
+
+// moduleReferences tells why modules must be kept: they run on a server, a server
+// rolls back to them, or a rollout or canary in progress deploys or reverts to them.
+func moduleReferences(info *HubInfo) map[string]string {
+  references := map[string]string{}
+  refer := func(name string, reason string) {
+    if _, has := references[name]; !has && "" != name {
+      references[name] = reason
+    }
+  }
+  for _, node := range info.Nodes {
+    for _, server := range node.ServiceServers {
+      refer(server.Module, "running on " + server.Target())
+    }
+  }
+  for _, node := range info.Nodes {
+    for _, server := range node.ServiceServers {
+      for _, module := range server.History {
+        refer(module, "rollback history of " + server.Target())
+      }
+    }
+  }
+  for _, rollout := range info.Rollouts {
+    if rollout.Active() {
+      refer(rollout.Module, "rollout " + rollout.ID)
+      for _, target := range rollout.Targets {
+        refer(target.Previous, "rollout " + rollout.ID)
+      }
+    }
+  }
+  for _, canary := range info.Canaries {
+    if canary.Active() {
+      refer(canary.Module, "canary " + canary.ID)
+      for _, target := range canary.Targets {
+        refer(target.Previous, "canary " + canary.ID)
+      }
+    }
+  }
+  return references
+}
+
+type retentionBackup struct {
+  Name string
+  At time.Time
+}
+
+// planRetention lists the backups the policy removes, and those it keeps only
+// because they are referenced.
+func planRetention(info *HubInfo, policy *RetentionPolicy, files []ObjectInfo, now time.Time) api.RetentionPlan {
+  plan := api.RetentionPlan { Delete: make([]api.RetentionItem, 0), Keep: make([]api.RetentionItem, 0) }
+  current := map[string]bool{}
+  backups := map[string][]retentionBackup{}
+  for _, file := range files {
+    if module, at, ok := parseBackup(file.Name); ok {
+      backups[module] = append(backups[module], retentionBackup { Name: file.Name, At: at })
+    } else {
+      current[file.Name] = true
+    }
+  }
+  references := moduleReferences(info)
+  names := make([]string, 0, len(backups))
+  for module := range backups {
+    names = append(names, module)
+  }
+  sort.Strings(names)
+  for _, module := range names {
+    list := backups[module]
+    sort.Slice(list, func(i, j int) bool {
+      return list[i].At.After(list[j].At)
+    })
+    version := 0
+    if current[module] {
+      version++
+    }
+    for _, backup := range list {
+      version++
+      reason := ""
+      if 0 < policy.KeepVersions && policy.KeepVersions < version {
+        reason = fmt.Sprintf("beyond the last %d versions", policy.KeepVersions)
+      } else if 0 < policy.MaxAgeDays && backup.At.Before(now.AddDate(0, 0, -policy.MaxAgeDays)) {
+        reason = fmt.Sprintf("older than %d days", policy.MaxAgeDays)
+      }
+      if "" == reason {
+        continue
+      }
+      item := api.RetentionItem { Name: backup.Name, Module: module, Reason: reason }
+      if reference, has := references[backup.Name]; has {
+        item.Reason = reference
+        plan.Keep = append(plan.Keep, item)
+      } else {
+        plan.Delete = append(plan.Delete, item)
+      }
+    }
+  }
+  return plan
+}
+
+// serializes the runs of the scheduler and the API.
+var retentionLock sync.Mutex
+
+// runRetention removes the backups of the plan. failures are reported per item. the plan
+// is made with the state locked for reading. each backup is checked again and deleted
+// with the state locked, as a server or rollout may have taken it up since, and the
+// lock is taken once more to drop their metadata.
+func runRetention(state *StateStore, dryRun bool) (api.RetentionPlan, error) {
+  retentionLock.Lock()
+  defer retentionLock.Unlock()
+  files, err := modules.List()
+  if err != nil {
+    return api.RetentionPlan{}, err
+  }
+  var plan api.RetentionPlan
+  state.View(func(info *HubInfo) {
+    plan = planRetention(info, retention, files, time.Now())
+  })
+  if dryRun {
+    return plan, nil
+  }
+  removed := make([]string, 0, len(plan.Delete))
+  deleted := plan.Delete[:0]
+  modules.changes.Lock()
+  for _, item := range plan.Delete {
+    reference := ""
+    var err error
+    state.View(func(info *HubInfo) {
+      if reason, has := moduleReferences(info)[item.Name]; has {
+        reference = reason
+        return
+      }
+      err = modules.Remove(item.Name)
+    })
+    if "" != reference {
+      item.Reason = reference
+      plan.Keep = append(plan.Keep, item)
+      continue
+    }
+    if err != nil {
+      fmt.Printf("Error: %s\n", err)
+      item.Error = err.Error()
+    } else {
+      fmt.Printf("Retention removed %s (%s)\n", item.Name, item.Reason)
+      removed = append(removed, item.Name)
+    }
+    deleted = append(deleted, item)
+  }
+  modules.changes.Unlock()
+  plan.Delete = deleted
+  state.Update(func(info *HubInfo) {
+    for _, name := range removed {
+      delete(info.Metadata, name)
+      forgetTrusted(name)
+    }
+    if 0 < len(removed) {
+      saveMetadata(info)
+    }
+    retention.LastRunAt = time.Now()
+    if err := saveRetention(retention); err != nil {
+      fmt.Printf("Error: %s\n", err)
+    }
+  })
+  return plan, nil
+}
+
+// stepRetention runs the policy when it is due. it is called by the scheduler.
+func stepRetention(state *StateStore) {
+  var next time.Time
+  state.View(func(info *HubInfo) {
+    next = retention.NextRunAt()
+  })
+  if next.IsZero() || time.Now().Before(next) {
+    return
+  }
+  if _, err := runRetention(state, false); err != nil {
+    // tried again at the next interval.
+    fmt.Printf("Error: %s\n", err)
+    state.Update(func(info *HubInfo) {
+      retention.LastRunAt = time.Now()
+    })
+  }
+}
+
+// API
+
+func newRetentionResource(policy *RetentionPolicy) api.RetentionPolicy {
+  return api.RetentionPolicy {
+    KeepVersions: policy.KeepVersions,
+    MaxAgeDays: policy.MaxAgeDays,
+    IntervalHours: policy.IntervalHours,
+    LastRunAt: policy.LastRunAt,
+    NextRunAt: policy.NextRunAt(),
+  }
+}
+
+func apiGetRetention(c *gin.Context, info *HubInfo) {
+  c.JSON(http.StatusOK, newRetentionResource(retention))
+}
+
+func apiPutRetention(c *gin.Context, info *HubInfo) {
+  var request api.RetentionPolicy
+  if err := decodeBody(c, &request, false); err != nil {
+    apiError(c, err)
+    return
+  }
+  policy := &RetentionPolicy {
+    KeepVersions: request.KeepVersions,
+    MaxAgeDays: request.MaxAgeDays,
+    IntervalHours: request.IntervalHours,
+    LastRunAt: retention.LastRunAt,
+  }
+  if err := policy.validate(); err != nil {
+    apiError(c, err)
+    return
+  }
+  if err := saveRetention(policy); err != nil {
+    apiError(c, err)
+    return
+  }
+  retention = policy
+  c.JSON(http.StatusOK, newRetentionResource(retention))
+}
+
+// apiRetentionPlan previews a run, apiRunRetention removes the backups.
+func apiRetentionPlan(c *gin.Context, state *StateStore) {
+  plan, err := runRetention(state, true)
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  c.JSON(http.StatusOK, plan)
+}
+
+func apiRunRetention(c *gin.Context, state *StateStore) {
+  plan, err := runRetention(state, false)
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  c.JSON(http.StatusOK, plan)
+}
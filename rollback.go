@@ -0,0 +1,90 @@
+package main
+
+// number of replaced modules kept per server.
+const maxModuleHistory = 10
+
+// changeModule switches the server to the module and pushes it to the node.
+// the replaced module is kept so that it can be rolled back.
+func changeModule(server *ServiceServer, name string) {
+  if "" != server.Module {
+    server.History = append(server.History, server.Module)
+    if maxModuleHistory < len(server.History) {
+      server.History = server.History[len(server.History) - maxModuleHistory:]
+    }
+  }
+  server.Module = name
+  pushModule(server)
+}
+
+// pushModule sends the current module to the node unless the server is stopped.
+// a stopped server receives it on the next heartbeat after it starts.
+func pushModule(server *ServiceServer) {
+  if 0 != server.Status {
+    server.Status = 2
+    server.Node.SendMessage("S>" + server.Port + ">" + server.Module)
+  }
+}
+
+func (server *ServiceServer) Target() string {
+  return server.Node.IP + server.Port
+}
+
+func (server *ServiceServer) PreviousModule() string {
+  if 0 == len(server.History) {
+    return ""
+  }
+  return server.History[len(server.History) - 1]
+}
+
+// noRollback is the error of a server that cannot be rolled back, for the API and the page.
+func noRollback(server *ServiceServer) error {
+  return conflict("server %s has no module to roll back to", server.Target())
+}
+
+// rollbackServer restores the module used before the current one.
+func rollbackServer(info *HubInfo, server *ServiceServer) bool {
+  if 2 == server.Status {
+    return false
+  }
+  return revertModule(info, server, "rollback")
+}
+
+// revertModule restores the previous module regardless of the server status.
+func revertModule(info *HubInfo, server *ServiceServer, action string) bool {
+  previous := server.PreviousModule()
+  if "" == previous || !moduleAvailable(info, previous) {
+    return false
+  }
+  current := server.Module
+  server.History = server.History[:len(server.History) - 1]
+  server.Module = previous
+  pushModule(server)
+  recordHistory(info, action, server.Target(), previous, current)
+  return true
+}
+
+func rollbackDomain(info *HubInfo, domain *Domain) int {
+  count := 0
+  done := map[*ServiceServer]bool{}
+  for _, assign := range domain.AssignPriorities {
+    if !done[assign.ServiceServer] {
+      done[assign.ServiceServer] = true
+      if rollbackServer(info, assign.ServiceServer) {
+        count++
+      }
+    }
+  }
+  return count
+}
+
+func rollbackModule(info *HubInfo, name string) int {
+  count := 0
+  for _, node := range info.Nodes {
+    for _, server := range node.ServiceServers {
+      if name == server.Module && rollbackServer(info, server) {
+        count++
+      }
+    }
+  }
+  return count
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const (
+  // number of finished rollouts kept for display.
+  maxFinishedRollouts = 20
+  defaultRolloutTimeout = 300 * time.Second
+)
+
+type RolloutTarget struct {
+  IP string `json:"ip"`
+  Port string `json:"port"`
+  Previous string `json:"previous"`
+  Batch int `json:"batch"`
+  State string `json:"state"`
+  // pending
+  // updating
+  // done
+  // failed
+  // reverted
+}
+
+type Rollout struct {
+  ID string `json:"id"`
+  Domain string `json:"domain"`
+  Module string `json:"module"`
+  BatchSize int `json:"batchSize"`
+  Timeout time.Duration `json:"timeout"`
+  OnFailure string `json:"onFailure"`
+  // pause: stop and wait for resume or abort
+  // abort: revert every updated server
+  Status string `json:"status"`
+  // running
+  // paused
+  // completed
+  // aborted
+  Message string `json:"message"`
+
+  Batch int `json:"batch"`
+  Deadline time.Time `json:"deadline"`
+  StartedAt time.Time `json:"startedAt"`
+  Targets []*RolloutTarget `json:"targets"`
+}
+
+func (server *ServiceServer) Healthy() bool {
+  return 1 == server.Status && 1 == server.Node.Status
+}
+
+func (rollout *Rollout) Batches() int {
+  return (len(rollout.Targets) + rollout.BatchSize - 1) / rollout.BatchSize
+}
+
+// CurrentBatch is the one-based batch number for display.
+func (rollout *Rollout) CurrentBatch() int {
+  return rollout.Batch + 1
+}
+
+func (rollout *Rollout) Done() int {
+  count := 0
+  for _, target := range rollout.Targets {
+    if "done" == target.State {
+      count++
+    }
+  }
+  return count
+}
+
+// Progress in percent.
+func (rollout *Rollout) Progress() int {
+  if 0 == len(rollout.Targets) {
+    return 100
+  }
+  return rollout.Done() * 100 / len(rollout.Targets)
+}
+
+func (rollout *Rollout) Active() bool {
+  return "running" == rollout.Status || "paused" == rollout.Status
+}
+
+func (rollout *Rollout) StartedText() string {
+  return rollout.StartedAt.Format(dateTimeLayout)
+}
+
+func findRollout(info *HubInfo, id string) *Rollout {
+  for _, rollout := range info.Rollouts {
+    if id == rollout.ID {
+      return rollout
+    }
+  }
+  return nil
+}
+
+// domainServers returns the servers assigned to the domain ordered by address.
+func domainServers(domain *Domain) []*ServiceServer {
+  servers := make([]*ServiceServer, 0)
+  done := map[*ServiceServer]bool{}
+  for _, assign := range domain.AssignPriorities {
+    if !done[assign.ServiceServer] {
+      done[assign.ServiceServer] = true
+      servers = append(servers, assign.ServiceServer)
+    }
+  }
+  sort.Slice(servers, func(i, j int) bool {
+    return servers[i].Target() < servers[j].Target()
+  })
+  return servers
+}
+
+// startRollout updates the servers of the domain in batches of batchSize.
+func startRollout(info *HubInfo, domainKey string, module string, batchSize int, timeout time.Duration, onFailure string) (*Rollout, error) {
+  domain, has := info.Domains[domainKey]
+  if !has {
+    return nil, notFound("domain %s not found", domainKey)
+  }
+  if !moduleAvailable(info, module) {
+    return nil, invalid("module", "module is not available: " + module)
+  }
+  if batchSize < 1 {
+    return nil, invalid("batchSize", "batch size must be positive")
+  }
+  if timeout <= 0 {
+    timeout = defaultRolloutTimeout
+  }
+  if "abort" != onFailure {
+    onFailure = "pause"
+  }
+  for _, rollout := range info.Rollouts {
+    if domainKey == rollout.Domain && rollout.Active() {
+      return nil, conflict("rollout already in progress: %s", rollout.ID)
+    }
+  }
+  if nil != domainCanary(info, domainKey) {
+    return nil, conflict("canary release in progress on %s", domainKey)
+  }
+  rollout := &Rollout {
+    ID: "r" + time.Now().Format(dateTimeSimple) + strconv.Itoa(len(info.Rollouts)),
+    Domain: domainKey,
+    Module: module,
+    BatchSize: batchSize,
+    Timeout: timeout,
+    OnFailure: onFailure,
+    Status: "running",
+    StartedAt: time.Now(),
+    Targets: make([]*RolloutTarget, 0),
+  }
+  for index, server := range domainServers(domain) {
+    rollout.Targets = append(rollout.Targets, &RolloutTarget {
+      IP: server.Node.IP,
+      Port: server.Port,
+      Batch: index / batchSize,
+      State: "pending",
+    })
+  }
+  if 0 == len(rollout.Targets) {
+    return nil, conflict("no servers assigned to %s", domainKey)
+  }
+  info.Rollouts = append(info.Rollouts, rollout)
+  trimRollouts(info)
+  recordHistory(info, "startRollout", domainKey, module, "")
+  return rollout, nil
+}
+
+// loadRollouts reads the rollouts written with the auto backup. the hub may have been
+// down for longer than a batch takes and the nodes report again only after the start,
+// so running rollouts are paused until an operator resumes them.
+func loadRollouts(filePath string) ([]*Rollout, error) {
+  rollouts := make([]*Rollout, 0)
+  blob, err := ioutil.ReadFile(filePath)
+  if os.IsNotExist(err) {
+    return rollouts, nil
+  } else if err != nil {
+    return rollouts, err
+  }
+  if err = json.Unmarshal(blob, &rollouts); err != nil {
+    return make([]*Rollout, 0), fmt.Errorf("%s: %s", filePath, err)
+  }
+  for _, rollout := range rollouts {
+    if "running" == rollout.Status {
+      rollout.Status = "paused"
+      rollout.Message = "paused by the restart of the hub"
+    }
+  }
+  return rollouts, nil
+}
+
+func trimRollouts(info *HubInfo) {
+  finished := 0
+  rollouts := make([]*Rollout, 0, len(info.Rollouts))
+  for i := len(info.Rollouts) - 1; 0 <= i; i-- {
+    rollout := info.Rollouts[i]
+    if !rollout.Active() {
+      finished++
+      if maxFinishedRollouts < finished {
+        continue
+      }
+    }
+    rollouts = append([]*Rollout{rollout}, rollouts...)
+  }
+  info.Rollouts = rollouts
+}
+
+func pauseRollout(rollout *Rollout) {
+  if "running" == rollout.Status {
+    rollout.Status = "paused"
+    rollout.Message = "paused by operator"
+  }
+}
+
+// resumeRollout restarts the current batch with a new deadline.
+func resumeRollout(rollout *Rollout) {
+  if "paused" == rollout.Status {
+    for _, target := range rollout.Targets {
+      if rollout.Batch == target.Batch && "done" != target.State {
+        target.State = "pending"
+      }
+    }
+    rollout.Deadline = time.Time{}
+    rollout.Status = "running"
+    rollout.Message = ""
+  }
+}
+
+// abortRollout reverts every server the rollout has touched.
+func abortRollout(info *HubInfo, rollout *Rollout, message string) {
+  if !rollout.Active() {
+    return
+  }
+  for _, target := range rollout.Targets {
+    if "pending" == target.State || "" == target.Previous {
+      continue
+    }
+    server := info.Server(target.IP, target.Port)
+    if nil != server && rollout.Module == server.Module && target.Previous == server.PreviousModule() {
+      if revertModule(info, server, "abortRollout") {
+        target.State = "reverted"
+      }
+    }
+  }
+  rollout.Status = "aborted"
+  rollout.Message = message
+}
+
+// stepRollouts advances the running rollouts. it is called periodically under lock.
+func stepRollouts(info *HubInfo) {
+  for _, rollout := range info.Rollouts {
+    if "running" == rollout.Status {
+      stepRollout(info, rollout)
+    }
+  }
+}
+
+func stepRollout(info *HubInfo, rollout *Rollout) {
+  if rollout.Deadline.IsZero() {
+    // start the batch. stopped servers never report the module active, they fail at
+    // once rather than at the deadline.
+    for _, target := range rollout.Targets {
+      if rollout.Batch != target.Batch || "pending" != target.State {
+        continue
+      }
+      server := info.Server(target.IP, target.Port)
+      if nil == server || 0 == server.Status || 0 == server.Node.Status {
+        target.State = "failed"
+      } else if rollout.Module != server.Module {
+        target.Previous = server.Module
+        target.State = "updating"
+        changeModule(server, rollout.Module)
+        recordHistory(info, "rollout", server.Target(), rollout.Module, target.Previous)
+      } else if server.Healthy() {
+        target.State = "done"
+      } else {
+        target.State = "updating"
+        pushModule(server)
+      }
+    }
+    rollout.Deadline = time.Now().Add(rollout.Timeout)
+  }
+
+  finished := true
+  updating := false
+  failed := make([]string, 0)
+  for _, target := range rollout.Targets {
+    if rollout.Batch != target.Batch {
+      continue
+    }
+    if "updating" == target.State {
+      server := info.Server(target.IP, target.Port)
+      if nil != server && rollout.Module == server.Module && server.Healthy() {
+        target.State = "done"
+      }
+    }
+    switch target.State {
+      case "updating":
+        updating = true
+      case "failed":
+        failed = append(failed, target.IP + target.Port)
+    }
+    if "done" != target.State {
+      finished = false
+    }
+  }
+
+  if finished {
+    rollout.Batch++
+    rollout.Deadline = time.Time{}
+    if rollout.Batches() <= rollout.Batch {
+      rollout.Status = "completed"
+      rollout.Message = ""
+      recordHistory(info, "completeRollout", rollout.Domain, rollout.Module, "")
+    }
+  } else if (0 < len(failed) && !updating) || time.Now().After(rollout.Deadline) {
+    for _, target := range rollout.Targets {
+      if rollout.Batch == target.Batch && "updating" == target.State {
+        target.State = "failed"
+      }
+    }
+    message := fmt.Sprintf("batch %d/%d did not become active within %v", rollout.Batch + 1, rollout.Batches(), rollout.Timeout)
+    if !updating {
+      message = fmt.Sprintf("batch %d/%d: %s stopped or removed", rollout.Batch + 1, rollout.Batches(), strings.Join(failed, ", "))
+    }
+    if "abort" == rollout.OnFailure {
+      abortRollout(info, rollout, message)
+    } else {
+      rollout.Status = "paused"
+      rollout.Message = message
+    }
+    fmt.Printf("Rollout %s: %s\n", rollout.ID, message)
+  }
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+// newTestDomain returns the hub of newTestServer with the servers :9000 to :9002 on a.zip,
+// all assigned to example.com.
+func newTestDomain(t *testing.T) (*HubInfo, []*ServiceServer) {
+  info, server := newTestServer(t)
+  node := server.Node
+  domain := &Domain { Key: "example.com" }
+  info.Domains[domain.Key] = domain
+  servers := []*ServiceServer { server }
+  for _, port := range []string { ":9001", ":9002" } {
+    other := &ServiceServer { Port: port, Status: 1, Module: "a.zip", Node: node }
+    node.ServiceServers[port] = other
+    servers = append(servers, other)
+  }
+  for _, server := range servers {
+    assign := &AssignPriority { Priority: 1, Domain: domain, ServiceServer: server }
+    server.AssignPriorities = append(server.AssignPriorities, assign)
+    domain.AssignPriorities = append(domain.AssignPriorities, assign)
+  }
+  return info, servers
+}
+
+// activate lets the servers report their module as running.
+func activate(servers ...*ServiceServer) {
+  for _, server := range servers {
+    server.Status = 1
+  }
+}
+
+func TestRollout(t *testing.T) {
+  tests := []struct {
+    name string
+    onFailure string
+    run func(info *HubInfo, rollout *Rollout, servers []*ServiceServer)
+    status string
+    modules string
+  }{
+    { "batches", "pause", func(info *HubInfo, rollout *Rollout, servers []*ServiceServer) {
+      stepRollouts(info)
+      if 2 != servers[0].Status || 2 != servers[1].Status || "a.zip" != servers[2].Module {
+        t.Error("batches: first batch is not the first two servers")
+      }
+      activate(servers...)
+      stepRollouts(info)
+      stepRollouts(info)
+      activate(servers...)
+      stepRollouts(info)
+    }, "completed", "b.zip b.zip b.zip" },
+    { "pause on timeout", "pause", func(info *HubInfo, rollout *Rollout, servers []*ServiceServer) {
+      stepRollouts(info)
+      rollout.Deadline = time.Now().Add(-time.Second)
+      stepRollouts(info)
+    }, "paused", "b.zip b.zip a.zip" },
+    { "abort on timeout", "abort", func(info *HubInfo, rollout *Rollout, servers []*ServiceServer) {
+      stepRollouts(info)
+      rollout.Deadline = time.Now().Add(-time.Second)
+      stepRollouts(info)
+    }, "aborted", "a.zip a.zip a.zip" },
+    { "pause and resume", "pause", func(info *HubInfo, rollout *Rollout, servers []*ServiceServer) {
+      stepRollouts(info)
+      pauseRollout(rollout)
+      activate(servers...)
+      stepRollouts(info)
+      if 0 != rollout.Batch {
+        t.Error("pause and resume: paused rollout went on")
+      }
+      resumeRollout(rollout)
+      stepRollouts(info)
+      stepRollouts(info)
+      activate(servers...)
+      stepRollouts(info)
+    }, "completed", "b.zip b.zip b.zip" },
+    { "abort", "pause", func(info *HubInfo, rollout *Rollout, servers []*ServiceServer) {
+      stepRollouts(info)
+      abortRollout(info, rollout, "aborted by operator")
+    }, "aborted", "a.zip a.zip a.zip" },
+    { "stopped server", "pause", func(info *HubInfo, rollout *Rollout, servers []*ServiceServer) {
+      servers[1].Status = 0
+      stepRollouts(info)
+      activate(servers[0])
+      stepRollouts(info)
+      if !strings.Contains(rollout.Message, "127.0.0.1:9001") {
+        t.Errorf("stopped server: message %s", rollout.Message)
+      }
+    }, "paused", "b.zip a.zip a.zip" },
+  }
+  for _, test := range tests {
+    info, servers := newTestDomain(t)
+    rollout, err := startRollout(info, "example.com", "b.zip", 2, time.Minute, test.onFailure)
+    if err != nil {
+      t.Fatal(err)
+    }
+    test.run(info, rollout, servers)
+    if test.status != rollout.Status {
+      t.Errorf("%s: status %s, want %s (%s)", test.name, rollout.Status, test.status, rollout.Message)
+    }
+    got := make([]string, 0, len(servers))
+    for _, server := range servers {
+      got = append(got, server.Module)
+    }
+    if test.modules != strings.Join(got, " ") {
+      t.Errorf("%s: modules %v, want %s", test.name, got, test.modules)
+    }
+  }
+}
+
+func TestRolloutsPersisted(t *testing.T) {
+  info, _ := newTestDomain(t)
+  if _, err := startRollout(info, "example.com", "b.zip", 1, time.Minute, "pause"); err != nil {
+    t.Fatal(err)
+  }
+  dir := t.TempDir()
+  persister := newPersister(filepath.Join(dir, "autobackup.txt"))
+  persister.RolloutsPath = filepath.Join(dir, "rollouts.json")
+  persister.MarkDirty()
+  if err := persister.Flush(newStateStore(info, persister)); err != nil {
+    t.Fatal(err)
+  }
+  rollouts, err := loadRollouts(persister.RolloutsPath)
+  if err != nil {
+    t.Fatal(err)
+  }
+  // running rollouts wait for an operator after a restart.
+  if 1 != len(rollouts) || info.Rollouts[0].ID != rollouts[0].ID || "paused" != rollouts[0].Status || 3 != len(rollouts[0].Targets) {
+    t.Errorf("loaded %+v", rollouts)
+  }
+}
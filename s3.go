@@ -0,0 +1,435 @@
+package main
+
+import (
+  "net/http"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/xml"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/url"
+  "os"
+  "sort"
+  "strings"
+  "time"
+)
+
+// hash of an empty payload.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Config is an S3 compatible object storage, e.g. AWS S3 or MinIO.
+type S3Config struct {
+  // e.g. https://s3.ap-northeast-1.amazonaws.com or http://127.0.0.1:9000
+  Endpoint string `json:"endpoint"`
+  Region string `json:"region"`
+  Bucket string `json:"bucket"`
+  // key prefix of the objects, e.g. "xhub/".
+  Prefix string `json:"prefix"`
+  // taken from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN when empty.
+  AccessKey string `json:"accessKey"`
+  SecretKey string `json:"secretKey"`
+  SessionToken string `json:"sessionToken"`
+  // bucket as host name (bucket.endpoint) instead of the first path segment.
+  VirtualHost bool `json:"virtualHost"`
+}
+
+// S3Storage keeps the objects in a bucket. requests are signed with AWS Signature Version 4.
+type S3Storage struct {
+  Config *S3Config
+  Client *http.Client
+  endpoint *url.URL
+}
+
+func newS3Storage(config *S3Config) (*S3Storage, error) {
+  if "" == config.Endpoint || "" == config.Bucket {
+    return nil, errors.New("s3: endpoint and bucket are required")
+  }
+  endpoint, err := url.Parse(strings.TrimRight(config.Endpoint, "/"))
+  if err != nil || "" == endpoint.Host {
+    return nil, fmt.Errorf("s3: invalid endpoint %s", config.Endpoint)
+  }
+  if "" == config.Region {
+    config.Region = "us-east-1"
+  }
+  if "" == config.AccessKey {
+    config.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+    config.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+    config.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+  }
+  if "" == config.AccessKey || "" == config.SecretKey {
+    return nil, errors.New("s3: access key and secret key are required")
+  }
+  return &S3Storage {
+    Config: config,
+    // no overall timeout, downloads are streamed.
+    Client: &http.Client {
+      Transport: &http.Transport {
+        Proxy: http.ProxyFromEnvironment,
+        ResponseHeaderTimeout: 30 * time.Second,
+      },
+    },
+    endpoint: endpoint,
+  }, nil
+}
+
+// s3Escape encodes everything but the unreserved characters, as signature version 4 requires.
+func s3Escape(text string, slash bool) string {
+  var buf strings.Builder
+  for _, b := range []byte(text) {
+    if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') ||
+      '-' == b || '.' == b || '_' == b || '~' == b || ('/' == b && !slash) {
+      buf.WriteByte(b)
+    } else {
+      fmt.Fprintf(&buf, "%%%02X", b)
+    }
+  }
+  return buf.String()
+}
+
+// objectURL returns the URL of the object. an empty name is the bucket.
+func (storage *S3Storage) objectURL(name string, query url.Values) string {
+  path := ""
+  if "" != name {
+    path = "/" + s3Escape(storage.Config.Prefix + name, false)
+  }
+  host := storage.endpoint.Host
+  if storage.Config.VirtualHost {
+    host = storage.Config.Bucket + "." + host
+  } else {
+    path = "/" + s3Escape(storage.Config.Bucket, true) + path
+  }
+  target := storage.endpoint.Scheme + "://" + host + strings.TrimRight(storage.endpoint.Path, "/") + path
+  if 0 < len(query) {
+    target += "?" + query.Encode()
+  }
+  return target
+}
+
+func hmacSHA256(key []byte, text string) []byte {
+  mac := hmac.New(sha256.New, key)
+  mac.Write([]byte(text))
+  return mac.Sum(nil)
+}
+
+// sign adds the signature version 4 headers. host and every x-amz header are signed.
+func (storage *S3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+  amzDate := now.UTC().Format("20060102T150405Z")
+  date := amzDate[:8]
+  req.Header.Set("X-Amz-Date", amzDate)
+  req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+  if "" != storage.Config.SessionToken {
+    req.Header.Set("X-Amz-Security-Token", storage.Config.SessionToken)
+  }
+
+  headers := map[string]string { "host": req.URL.Host }
+  for key, values := range req.Header {
+    lower := strings.ToLower(key)
+    if strings.HasPrefix(lower, "x-amz-") || "range" == lower || "content-type" == lower || "content-md5" == lower {
+      headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+    }
+  }
+  names := make([]string, 0, len(headers))
+  for name := range headers {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  var canonicalHeaders strings.Builder
+  for _, name := range names {
+    canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+  }
+  signedHeaders := strings.Join(names, ";")
+
+  query := req.URL.Query()
+  keys := make([]string, 0, len(query))
+  for key := range query {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  pairs := make([]string, 0, len(keys))
+  for _, key := range keys {
+    values := query[key]
+    sort.Strings(values)
+    for _, value := range values {
+      pairs = append(pairs, s3Escape(key, true) + "=" + s3Escape(value, true))
+    }
+  }
+  path := req.URL.EscapedPath()
+  if "" == path {
+    path = "/"
+  }
+  canonicalRequest := strings.Join([]string {
+    req.Method,
+    path,
+    strings.Join(pairs, "&"),
+    canonicalHeaders.String(),
+    signedHeaders,
+    payloadHash,
+  }, "\n")
+
+  scope := date + "/" + storage.Config.Region + "/s3/aws4_request"
+  digest := sha256.Sum256([]byte(canonicalRequest))
+  stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+  key := hmacSHA256([]byte("AWS4" + storage.Config.SecretKey), date)
+  key = hmacSHA256(key, storage.Config.Region)
+  key = hmacSHA256(key, "s3")
+  key = hmacSHA256(key, "aws4_request")
+  signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+  req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=" + storage.Config.AccessKey + "/" + scope +
+    ", SignedHeaders=" + signedHeaders + ", Signature=" + signature)
+}
+
+// S3Error is the error document of a failed request.
+type S3Error struct {
+  StatusCode int
+  Code string `xml:"Code"`
+  Message string `xml:"Message"`
+}
+
+func (err *S3Error) Error() string {
+  if "" == err.Code {
+    return fmt.Sprintf("s3: %d %s", err.StatusCode, http.StatusText(err.StatusCode))
+  }
+  return fmt.Sprintf("s3: %s: %s", err.Code, err.Message)
+}
+
+// do sends the signed request. body must be nil or fit payloadHash and size.
+// responses other than 2xx are closed and returned as error, 404 as not exist.
+func (storage *S3Storage) do(method string, name string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+  req, err := http.NewRequest(method, storage.objectURL(name, query), body)
+  if err != nil {
+    return nil, err
+  }
+  for key, values := range header {
+    req.Header[key] = values
+  }
+  if nil != body {
+    req.ContentLength = size
+  }
+  storage.sign(req, payloadHash, time.Now())
+  resp, err := storage.Client.Do(req)
+  if err != nil {
+    return nil, err
+  }
+  if resp.StatusCode < 200 || 299 < resp.StatusCode {
+    defer resp.Body.Close()
+    if http.StatusNotFound == resp.StatusCode && "" != name {
+      return nil, &os.PathError { Op: strings.ToLower(method), Path: name, Err: os.ErrNotExist }
+    }
+    s3Err := &S3Error { StatusCode: resp.StatusCode }
+    blob, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64 * 1024))
+    xml.Unmarshal(blob, s3Err)
+    return nil, s3Err
+  }
+  return resp, nil
+}
+
+func (storage *S3Storage) Init() error {
+  resp, err := storage.do("HEAD", "", nil, nil, nil, 0, emptyPayloadHash)
+  if err != nil {
+    return fmt.Errorf("bucket %s: %s", storage.Config.Bucket, err)
+  }
+  resp.Body.Close()
+  return nil
+}
+
+func objectInfo(name string, resp *http.Response) ObjectInfo {
+  info := ObjectInfo { Name: name, Size: resp.ContentLength }
+  if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+    info.ModTime = modTime
+  }
+  return info
+}
+
+// List returns the objects directly under the prefix.
+func (storage *S3Storage) List() ([]ObjectInfo, error) {
+  var result struct {
+    Contents []struct {
+      Key string `xml:"Key"`
+      Size int64 `xml:"Size"`
+      LastModified time.Time `xml:"LastModified"`
+    } `xml:"Contents"`
+    IsTruncated bool `xml:"IsTruncated"`
+    NextContinuationToken string `xml:"NextContinuationToken"`
+  }
+  list := make([]ObjectInfo, 0)
+  token := ""
+  for {
+    query := url.Values { "list-type": { "2" } }
+    if "" != storage.Config.Prefix {
+      query.Set("prefix", storage.Config.Prefix)
+    }
+    if "" != token {
+      query.Set("continuation-token", token)
+    }
+    resp, err := storage.do("GET", "", query, nil, nil, 0, emptyPayloadHash)
+    if err != nil {
+      return nil, err
+    }
+    result.Contents = nil
+    err = xml.NewDecoder(resp.Body).Decode(&result)
+    resp.Body.Close()
+    if err != nil {
+      return nil, err
+    }
+    for _, content := range result.Contents {
+      name := strings.TrimPrefix(content.Key, storage.Config.Prefix)
+      if "" != name && !strings.Contains(name, "/") {
+        list = append(list, ObjectInfo { Name: name, Size: content.Size, ModTime: content.LastModified })
+      }
+    }
+    if !result.IsTruncated || "" == result.NextContinuationToken {
+      return list, nil
+    }
+    token = result.NextContinuationToken
+  }
+}
+
+func (storage *S3Storage) Stat(name string) (ObjectInfo, error) {
+  resp, err := storage.do("HEAD", name, nil, nil, nil, 0, emptyPayloadHash)
+  if err != nil {
+    return ObjectInfo{}, err
+  }
+  resp.Body.Close()
+  return objectInfo(name, resp), nil
+}
+
+// Get starts reading the object. seeking closes the response and the next read
+// requests the rest of the object from the new offset.
+func (storage *S3Storage) Get(name string) (ObjectReader, ObjectInfo, error) {
+  resp, err := storage.do("GET", name, nil, nil, nil, 0, emptyPayloadHash)
+  if err != nil {
+    return nil, ObjectInfo{}, err
+  }
+  info := objectInfo(name, resp)
+  return &s3Reader { storage: storage, info: info, etag: resp.Header.Get("ETag"), body: resp.Body }, info, nil
+}
+
+type s3Reader struct {
+  storage *S3Storage
+  info ObjectInfo
+  // the object must not change between the requests of one reader.
+  etag string
+  body io.ReadCloser
+  // offset of the reader and of the open response.
+  offset int64
+  bodyOffset int64
+}
+
+func (reader *s3Reader) Read(p []byte) (int, error) {
+  if nil != reader.body && reader.bodyOffset != reader.offset {
+    reader.body.Close()
+    reader.body = nil
+  }
+  if reader.info.Size <= reader.offset {
+    return 0, io.EOF
+  }
+  if nil == reader.body {
+    header := http.Header{}
+    header.Set("Range", fmt.Sprintf("bytes=%d-", reader.offset))
+    if "" != reader.etag {
+      header.Set("If-Match", reader.etag)
+    }
+    resp, err := reader.storage.do("GET", reader.info.Name, nil, header, nil, 0, emptyPayloadHash)
+    if err != nil {
+      return 0, err
+    }
+    if http.StatusPartialContent != resp.StatusCode {
+      resp.Body.Close()
+      return 0, fmt.Errorf("s3: %s: range not supported", reader.info.Name)
+    }
+    reader.body = resp.Body
+    reader.bodyOffset = reader.offset
+  }
+  n, err := reader.body.Read(p)
+  reader.offset += int64(n)
+  reader.bodyOffset = reader.offset
+  return n, err
+}
+
+func (reader *s3Reader) Seek(offset int64, whence int) (int64, error) {
+  switch whence {
+    case io.SeekCurrent:
+      offset += reader.offset
+    case io.SeekEnd:
+      offset += reader.info.Size
+  }
+  if offset < 0 {
+    return 0, errors.New("s3: negative offset")
+  }
+  reader.offset = offset
+  return offset, nil
+}
+
+func (reader *s3Reader) Close() error {
+  if nil == reader.body {
+    return nil
+  }
+  err := reader.body.Close()
+  reader.body = nil
+  return err
+}
+
+// Put spools the content to a temporary file for its length and hash, then uploads it
+// in one request. S3 makes the object visible only when it is complete.
+func (storage *S3Storage) Put(name string, content io.Reader) error {
+  temp, err := ioutil.TempFile("", "xhub-s3-")
+  if err != nil {
+    return err
+  }
+  defer os.Remove(temp.Name())
+  defer temp.Close()
+  hash := sha256.New()
+  size, err := io.Copy(io.MultiWriter(temp, hash), content)
+  if err != nil {
+    return err
+  }
+  if _, err = temp.Seek(0, io.SeekStart); err != nil {
+    return err
+  }
+  header := http.Header{}
+  header.Set("Content-Type", "application/octet-stream")
+  resp, err := storage.do("PUT", name, nil, header, temp, size, hex.EncodeToString(hash.Sum(nil)))
+  if err != nil {
+    return err
+  }
+  resp.Body.Close()
+  return nil
+}
+
+// Rename copies the object and deletes the original, as S3 cannot move objects.
+func (storage *S3Storage) Rename(from string, to string) error {
+  header := http.Header{}
+  header.Set("X-Amz-Copy-Source", "/" + storage.Config.Bucket + "/" + s3Escape(storage.Config.Prefix + from, false))
+  resp, err := storage.do("PUT", to, nil, header, nil, 0, emptyPayloadHash)
+  if err != nil {
+    if os.IsNotExist(err) {
+      return &os.PathError { Op: "rename", Path: from, Err: os.ErrNotExist }
+    }
+    return err
+  }
+  // a copy may fail after the status line was sent.
+  blob, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64 * 1024))
+  resp.Body.Close()
+  if strings.Contains(string(blob), "<Error>") {
+    s3Err := &S3Error { StatusCode: resp.StatusCode }
+    xml.Unmarshal(blob, s3Err)
+    return s3Err
+  }
+  return storage.Delete(from)
+}
+
+func (storage *S3Storage) Delete(name string) error {
+  resp, err := storage.do("DELETE", name, nil, nil, nil, 0, emptyPayloadHash)
+  if err != nil {
+    if os.IsNotExist(err) {
+      return nil
+    }
+    return err
+  }
+  resp.Body.Close()
+  return nil
+}
+
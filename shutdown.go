@@ -0,0 +1,38 @@
+package main
+
+import (
+  "time"
+)
+
+// tells the nodes that the hub stops. nodes keep their servers running, older nodes
+// ignore it like every message they do not know.
+const shutdownMessage = "H>"
+
+// repeat calls fn every interval until stop is closed. a panic in fn is logged and
+// the next interval runs as usual.
+func repeat(where string, interval time.Duration, stop chan struct{}, fn func()) {
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+  for {
+    select {
+      case <- ticker.C:
+        func() {
+          defer recoverPanic(where)
+          fn()
+        }()
+      case <- stop:
+        return
+    }
+  }
+}
+
+// notifyShutdown sends the shutdown message to the nodes that are not stopped.
+func notifyShutdown(state *StateStore) {
+  state.View(func(info *HubInfo) {
+    for _, node := range info.Nodes {
+      if 0 != node.Status {
+        node.SendMessage(shutdownMessage)
+      }
+    }
+  })
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+  "gopkg.in/gin-gonic/gin.v1"
+  "net/http"
+  "io"
+  "crypto/ed25519"
+  "encoding/base64"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "strings"
+  "sync"
+)
+
+const signatureSuffix = ".sig"
+
+// trusted public keys. module signing is disabled while this is empty.
+var trustedKeys []ed25519.PublicKey
+
+// loadTrustedKeys reads base64 (or hex) encoded Ed25519 public keys, one per line.
+// blank lines and lines starting with '#' are ignored.
+func loadTrustedKeys(filePath string) ([]ed25519.PublicKey, error) {
+  keys := make([]ed25519.PublicKey, 0)
+  blob, err := ioutil.ReadFile(filePath)
+  if os.IsNotExist(err) {
+    return keys, nil
+  } else if err != nil {
+    return nil, err
+  }
+  for number, line := range strings.Split(string(blob), "\n") {
+    line = strings.TrimSpace(line)
+    if "" == line || strings.HasPrefix(line, "#") {
+      continue
+    }
+    // "<key> [comment]"
+    key, err := decodeBinary(strings.Fields(line)[0])
+    if err != nil || ed25519.PublicKeySize != len(key) {
+      return nil, fmt.Errorf("%s:%d: invalid ed25519 public key", filePath, number + 1)
+    }
+    keys = append(keys, ed25519.PublicKey(key))
+  }
+  return keys, nil
+}
+
+func currentTrustedKeys() []ed25519.PublicKey {
+  reloadable.RLock()
+  defer reloadable.RUnlock()
+  return trustedKeys
+}
+
+func signingEnabled() bool {
+  return 0 < len(currentTrustedKeys())
+}
+
+// decodeBinary accepts base64 (standard or url) or hex text.
+func decodeBinary(text string) ([]byte, error) {
+  text = strings.TrimSpace(text)
+  if blob, err := base64.StdEncoding.DecodeString(text); err == nil {
+    return blob, nil
+  }
+  if blob, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(text, "=")); err == nil {
+    return blob, nil
+  }
+  return hex.DecodeString(text)
+}
+
+// decodeSignature accepts the textual forms of decodeBinary or a raw 64 byte signature.
+func decodeSignature(blob []byte) ([]byte, error) {
+  if ed25519.SignatureSize == len(blob) {
+    return blob, nil
+  }
+  signature, err := decodeBinary(string(blob))
+  if err != nil || ed25519.SignatureSize != len(signature) {
+    return nil, errors.New("invalid ed25519 signature")
+  }
+  return signature, nil
+}
+
+func verifySignature(message []byte, signature []byte) bool {
+  for _, key := range currentTrustedKeys() {
+    if ed25519.Verify(key, message, signature) {
+      return true
+    }
+  }
+  return false
+}
+
+func signatureName(fileName string) string {
+  return fileName + signatureSuffix
+}
+
+func isSignatureFile(fileName string) bool {
+  return strings.HasSuffix(fileName, signatureSuffix)
+}
+
+func hasSignature(fileName string) bool {
+  return modules.HasSignature(fileName)
+}
+
+func readSignature(fileName string) ([]byte, error) {
+  blob, err := modules.ReadSignature(fileName)
+  if err != nil {
+    return nil, err
+  }
+  return decodeSignature(blob)
+}
+
+func writeSignature(fileName string, signature []byte) error {
+  text := base64.StdEncoding.EncodeToString(signature) + "\n"
+  return modules.WriteSignature(fileName, []byte(text))
+}
+
+// trustEntry is the verification of one version of a module, known by the sha256
+// in its metadata.
+type trustEntry struct {
+  Sum string
+  Trusted bool
+}
+
+// verified modules by name. uploads verify before they store, verifyTrusted verifies the
+// stored modules at startup and for new keys. heartbeats and pushes only look up.
+// the cache is replaced when the trusted keys change.
+var (
+  trustLock sync.Mutex
+  trustCache = map[string]trustEntry{}
+)
+
+// moduleTrusted reports whether the module may be pushed to nodes. every module is
+// trusted while signing is disabled. it is called with the state locked, so it never
+// reads the module: a module that is not verified yet, or has no sha256, is not trusted.
+func moduleTrusted(info *HubInfo, fileName string) bool {
+  if !signingEnabled() {
+    return true
+  }
+  sum := moduleMeta(info, fileName).SHA256
+  if "" == sum {
+    return false
+  }
+  trustLock.Lock()
+  defer trustLock.Unlock()
+  entry, has := trustCache[fileName]
+  return has && sum == entry.Sum && entry.Trusted
+}
+
+// verifyTrusted verifies the stored modules without the state lock, as they may have to
+// be read from a remote storage. modules are not pushed until they are verified.
+func verifyTrusted(state *StateStore) {
+  if !signingEnabled() {
+    return
+  }
+  sums := map[string]string{}
+  state.View(func(info *HubInfo) {
+    for name, meta := range info.Metadata {
+      if "" != meta.SHA256 {
+        sums[name] = meta.SHA256
+      }
+    }
+  })
+  trustLock.Lock()
+  cache := trustCache
+  trustLock.Unlock()
+  trusted := 0
+  for name, sum := range sums {
+    result := verifyModule(name)
+    trustLock.Lock()
+    // an upload since has verified a newer version. a result of replaced keys goes
+    // with the old cache.
+    if _, has := cache[name]; !has {
+      cache[name] = trustEntry { Sum: sum, Trusted: result }
+    }
+    trustLock.Unlock()
+    if result {
+      trusted++
+    }
+  }
+  fmt.Printf("Verified %d modules, %d trusted\n", len(sums), trusted)
+}
+
+func verifyModule(fileName string) bool {
+  signature, err := readSignature(fileName)
+  if err != nil {
+    return false
+  }
+  blob, err := modules.ReadFile(fileName)
+  if err != nil {
+    return false
+  }
+  return verifySignature(blob, signature)
+}
+
+// verifyStaged checks an upload written by ModuleStore.Stage. ed25519 signs the whole
+// message, so the content is read at once, from the storage rather than the request.
+func verifyStaged(temp string, signature []byte) (bool, error) {
+  blob, err := modules.ReadStaged(temp)
+  if err != nil {
+    return false, err
+  }
+  return verifySignature(blob, signature), nil
+}
+
+// setTrusted records the verification of an upload, sum is the sha256 of its metadata.
+func setTrusted(fileName string, sum string, trusted bool) {
+  trustLock.Lock()
+  defer trustLock.Unlock()
+  trustCache[fileName] = trustEntry { Sum: sum, Trusted: trusted }
+}
+
+// moveTrusted follows a rename of the module.
+func moveTrusted(from string, to string) {
+  trustLock.Lock()
+  defer trustLock.Unlock()
+  if entry, has := trustCache[from]; has {
+    trustCache[to] = entry
+    delete(trustCache, from)
+  }
+}
+
+func forgetTrusted(fileName string) {
+  trustLock.Lock()
+  defer trustLock.Unlock()
+  delete(trustCache, fileName)
+}
+
+// resetTrusted drops every verification, for new trusted keys.
+func resetTrusted() {
+  trustLock.Lock()
+  defer trustLock.Unlock()
+  trustCache = map[string]trustEntry{}
+}
+
+// uploadedSignature takes the signature from the "signature" form value or file.
+// it returns nil without error when no signature was sent.
+func uploadedSignature(c *gin.Context) ([]byte, error) {
+  text := c.Request.FormValue("signature")
+  if "" != text {
+    return decodeSignature([]byte(text))
+  }
+  file, _, err := c.Request.FormFile("signature")
+  if err != nil {
+    return nil, nil
+  }
+  defer file.Close()
+  blob, err := ioutil.ReadAll(io.LimitReader(file, 1024))
+  if err != nil {
+    return nil, err
+  }
+  return decodeSignature(blob)
+}
+
+func downloadSignature(c *gin.Context) {
+  fileName := c.Param("file")
+  signature, err := readSignature(fileName)
+  if err != nil {
+    fmt.Printf("Error: %s\n", err)
+    c.Status(http.StatusNotFound)
+    return
+  }
+  c.Header("Content-Disposition", "attachment; filename=" + signatureName(fileName))
+  c.Data(http.StatusOK, "text/plain", []byte(base64.StdEncoding.EncodeToString(signature) + "\n"))
+}
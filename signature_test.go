@@ -0,0 +1,61 @@
+package main
+
+import (
+  "crypto/ed25519"
+  "os"
+  "testing"
+)
+
+// useTrustedKey enables signing with a new key and returns its private key.
+func useTrustedKey(t *testing.T) ed25519.PrivateKey {
+  public, private, err := ed25519.GenerateKey(nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  reloadable.Lock()
+  previous := trustedKeys
+  trustedKeys = []ed25519.PublicKey { public }
+  reloadable.Unlock()
+  resetTrusted()
+  t.Cleanup(func() {
+    reloadable.Lock()
+    trustedKeys = previous
+    reloadable.Unlock()
+    resetTrusted()
+  })
+  return private
+}
+
+func TestModuleTrusted(t *testing.T) {
+  info, _ := newTestServer(t)
+  private := useTrustedKey(t)
+  if err := writeSignature("a.zip", ed25519.Sign(private, []byte("a.zip"))); err != nil {
+    t.Fatal(err)
+  }
+  info.Metadata["a.zip"] = &ModuleMeta { SHA256: "a" }
+  info.Metadata["b.zip"] = &ModuleMeta { SHA256: "b" }
+  state := newStateStore(info, newPersister(os.DevNull))
+
+  // nothing is read on a lookup, modules are untrusted until verified.
+  if moduleTrusted(info, "a.zip") {
+    t.Error("a.zip trusted before the verification")
+  }
+  verifyTrusted(state)
+  if !moduleTrusted(info, "a.zip") {
+    t.Error("signed a.zip not trusted")
+  }
+  if moduleTrusted(info, "b.zip") {
+    t.Error("unsigned b.zip trusted")
+  }
+
+  // another version, or one without sha256, is not the verified one.
+  info.Metadata["a.zip"] = &ModuleMeta { SHA256: "c" }
+  if moduleTrusted(info, "a.zip") {
+    t.Error("replaced a.zip trusted")
+  }
+  info.Metadata["a.zip"] = &ModuleMeta{}
+  setTrusted("a.zip", "", true)
+  if moduleTrusted(info, "a.zip") {
+    t.Error("a.zip without sha256 trusted")
+  }
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+  "sync"
+  "time"
+)
+
+// StateStore guards the hub state. changes run in Update with the state locked for
+// writing, readers share it in View, and pages are rendered from a Snapshot without
+// holding the lock.
+type StateStore struct {
+  lock sync.RWMutex
+  info *HubInfo
+  persister *Persister
+}
+
+func newStateStore(info *HubInfo, persister *Persister) *StateStore {
+  return &StateStore { info: info, persister: persister }
+}
+
+// lockRead and lockWrite record the time waited for the lock.
+func (store *StateStore) lockRead() {
+  start := time.Now()
+  store.lock.RLock()
+  metrics.LockWait(false, time.Since(start))
+}
+
+func (store *StateStore) lockWrite() {
+  start := time.Now()
+  store.lock.Lock()
+  metrics.LockWait(true, time.Since(start))
+}
+
+// View runs fn with the state locked for reading. fn must not change the state.
+func (store *StateStore) View(fn func(*HubInfo)) {
+  store.lockRead()
+  defer store.lock.RUnlock()
+  fn(store.info)
+}
+
+// Update runs fn with the state locked for writing, then publishes the changes and
+// marks the state for the next auto backup. when fn panics the lock is released and the panic goes on
+// to the recovery of the caller. what fn changed before is kept, not rolled back:
+// copying the state on every heartbeat costs more than the changes themselves.
+func (store *StateStore) Update(fn func(*HubInfo)) {
+  store.update(nil, fn)
+}
+
+// UpdateScoped is Update for changes confined to the resources of scope, such as the
+// heartbeats of a node. only those are compared and published.
+func (store *StateStore) UpdateScoped(scope resourceScope, fn func(*HubInfo)) {
+  store.update(scope, fn)
+}
+
+func (store *StateStore) update(scope resourceScope, fn func(*HubInfo)) {
+  store.lockWrite()
+  unlock := store.unlocker()
+  defer unlock()
+  fn(store.info)
+  store.commit(scope, unlock)
+}
+
+// Swap replaces the state with the one fn returns. nil keeps the state.
+func (store *StateStore) Swap(fn func(*HubInfo) *HubInfo) {
+  store.lockWrite()
+  unlock := store.unlocker()
+  defer unlock()
+  if info := fn(store.info); nil != info {
+    store.info = info
+    store.commit(nil, unlock)
+  }
+}
+
+// unlocker returns a function that releases the write lock once, so that the events
+// can be sent after the state is unlocked.
+func (store *StateStore) unlocker() func() {
+  unlocked := false
+  return func() {
+    if !unlocked {
+      unlocked = true
+      store.lock.Unlock()
+    }
+  }
+}
+
+// Snapshot returns a copy of the state, which the caller may read as long as it likes.
+func (store *StateStore) Snapshot() *HubInfo {
+  store.lockRead()
+  defer store.lock.RUnlock()
+  return store.info.Clone()
+}
+
+// commit is called with the state locked for writing. the events unlock it as soon as
+// they have taken the changed resources.
+func (store *StateStore) commit(scope resourceScope, unlock func()) {
+  store.persister.MarkDirty()
+  events.publish(store.info, scope, unlock)
+}
+
+// Clone copies the state deeply. the references between nodes, servers and domains
+// point into the copy. history entries are never changed and are shared.
+func (info *HubInfo) Clone() *HubInfo {
+  clone := &HubInfo {
+    Template: info.Template,
+    Nodes: make(map[string]*Node, len(info.Nodes)),
+    Domains: make(map[string]*Domain, len(info.Domains)),
+    History: append([]*HistoryEntry(nil), info.History...),
+  }
+  servers := map[*ServiceServer]*ServiceServer{}
+  for ip, node := range info.Nodes {
+    nodeClone := *node
+    nodeClone.ServiceServers = make(map[string]*ServiceServer, len(node.ServiceServers))
+    for port, server := range node.ServiceServers {
+      serverClone := *server
+      serverClone.Node = &nodeClone
+      serverClone.History = append([]string(nil), server.History...)
+      serverClone.AssignPriorities = nil
+      nodeClone.ServiceServers[port] = &serverClone
+      servers[server] = &serverClone
+    }
+    clone.Nodes[ip] = &nodeClone
+  }
+  assigns := map[*AssignPriority]*AssignPriority{}
+  for key, domain := range info.Domains {
+    domainClone := *domain
+    domainClone.AssignPriorities = make([]*AssignPriority, 0, len(domain.AssignPriorities))
+    for _, assign := range domain.AssignPriorities {
+      assignClone := &AssignPriority {
+        Priority: assign.Priority,
+        Domain: &domainClone,
+        ServiceServer: servers[assign.ServiceServer],
+      }
+      domainClone.AssignPriorities = append(domainClone.AssignPriorities, assignClone)
+      assigns[assign] = assignClone
+    }
+    clone.Domains[key] = &domainClone
+  }
+  for server, serverClone := range servers {
+    for _, assign := range server.AssignPriorities {
+      if assignClone, has := assigns[assign]; has {
+        serverClone.AssignPriorities = append(serverClone.AssignPriorities, assignClone)
+      }
+    }
+  }
+  if nil != info.Metadata {
+    clone.Metadata = make(map[string]*ModuleMeta, len(info.Metadata))
+    for name, meta := range info.Metadata {
+      metaClone := *meta
+      clone.Metadata[name] = &metaClone
+    }
+  }
+  if nil != info.Rollouts {
+    clone.Rollouts = make([]*Rollout, len(info.Rollouts))
+    for i, rollout := range info.Rollouts {
+      rolloutClone := *rollout
+      rolloutClone.Targets = cloneTargets(rollout.Targets)
+      clone.Rollouts[i] = &rolloutClone
+    }
+  }
+  if nil != info.Canaries {
+    clone.Canaries = make([]*Canary, len(info.Canaries))
+    for i, canary := range info.Canaries {
+      canaryClone := *canary
+      canaryClone.Targets = cloneTargets(canary.Targets)
+      clone.Canaries[i] = &canaryClone
+    }
+  }
+  return clone
+}
+
+func cloneTargets(targets []*RolloutTarget) []*RolloutTarget {
+  if nil == targets {
+    return nil
+  }
+  clones := make([]*RolloutTarget, len(targets))
+  for i, target := range targets {
+    targetClone := *target
+    clones[i] = &targetClone
+  }
+  return clones
+}
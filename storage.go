@@ -0,0 +1,173 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+// ObjectInfo describes one stored object.
+type ObjectInfo struct {
+  Name string
+  Size int64
+  ModTime time.Time
+}
+
+// ObjectReader is the content of an object. seeking is cheap, so that ranges can be served.
+type ObjectReader interface {
+  io.Reader
+  io.Seeker
+  io.Closer
+}
+
+// Storage keeps the objects of the module store: modules, signatures and the descriptions.
+// names are plain file names checked by the module store. missing objects are reported
+// with errors for which os.IsNotExist is true.
+type Storage interface {
+  // Init checks that the storage is usable.
+  Init() error
+  List() ([]ObjectInfo, error)
+  Stat(name string) (ObjectInfo, error)
+  // Get opens the object. the caller closes it.
+  Get(name string) (ObjectReader, ObjectInfo, error)
+  // Put replaces the object. readers of the old object never see a partial one.
+  Put(name string, content io.Reader) error
+  Rename(from string, to string) error
+  // Delete removes the object. missing objects are no error.
+  Delete(name string) error
+}
+
+// StorageConfig selects the storage of the modules. without the file the modules
+// are kept in the files directory of the hub config and downloads are not limited.
+type StorageConfig struct {
+  // local or s3
+  Type string `json:"type"`
+  // directory of local storage.
+  Dir string `json:"dir"`
+  S3 S3Config `json:"s3"`
+  // bytes per second of all module downloads together, 0 is unlimited.
+  DownloadLimit int64 `json:"downloadLimit"`
+  // bytes per second of one download, 0 is unlimited.
+  DownloadLimitPerRequest int64 `json:"downloadLimitPerRequest"`
+}
+
+// loadStorage configures the module store from the file.
+func loadStorage(filePath string) error {
+  var config StorageConfig
+  blob, err := ioutil.ReadFile(filePath)
+  if err == nil {
+    err = json.Unmarshal(blob, &config)
+  } else if os.IsNotExist(err) {
+    err = nil
+  }
+  if err != nil {
+    return fmt.Errorf("%s: %s", filePath, err)
+  }
+  storage, err := newStorage(&config)
+  if err != nil {
+    return fmt.Errorf("%s: %s", filePath, err)
+  }
+  modules = &ModuleStore { Storage: storage }
+  downloadLimiter = newRateLimiter(config.DownloadLimit)
+  downloadLimitPerRequest = config.DownloadLimitPerRequest
+  return nil
+}
+
+func newStorage(config *StorageConfig) (Storage, error) {
+  switch config.Type {
+    case "", "local":
+      dir := config.Dir
+      if "" == dir {
+        dir = currentConfig().Paths.Files
+      }
+      return &LocalStorage { Dir: dir }, nil
+    case "s3":
+      return newS3Storage(&config.S3)
+  }
+  return nil, fmt.Errorf("unknown storage type %s", config.Type)
+}
+
+// LocalStorage keeps the objects as files of a directory.
+type LocalStorage struct {
+  Dir string
+}
+
+func (storage *LocalStorage) Init() error {
+  return os.MkdirAll(storage.Dir, 0755)
+}
+
+// List skips directories and hidden files, such as unfinished uploads.
+func (storage *LocalStorage) List() ([]ObjectInfo, error) {
+  files, err := ioutil.ReadDir(storage.Dir)
+  if err != nil {
+    return nil, err
+  }
+  list := make([]ObjectInfo, 0, len(files))
+  for _, file := range files {
+    if file.Mode().IsRegular() && !strings.HasPrefix(file.Name(), ".") {
+      list = append(list, ObjectInfo { Name: file.Name(), Size: file.Size(), ModTime: file.ModTime() })
+    }
+  }
+  return list, nil
+}
+
+func (storage *LocalStorage) Stat(name string) (ObjectInfo, error) {
+  stat, err := os.Stat(filepath.Join(storage.Dir, name))
+  if err != nil {
+    return ObjectInfo{}, err
+  }
+  if !stat.Mode().IsRegular() {
+    return ObjectInfo{}, &os.PathError { Op: "stat", Path: name, Err: os.ErrNotExist }
+  }
+  return ObjectInfo { Name: name, Size: stat.Size(), ModTime: stat.ModTime() }, nil
+}
+
+func (storage *LocalStorage) Get(name string) (ObjectReader, ObjectInfo, error) {
+  file, err := os.Open(filepath.Join(storage.Dir, name))
+  if err != nil {
+    return nil, ObjectInfo{}, err
+  }
+  stat, err := file.Stat()
+  if err != nil {
+    file.Close()
+    return nil, ObjectInfo{}, err
+  }
+  return file, ObjectInfo { Name: name, Size: stat.Size(), ModTime: stat.ModTime() }, nil
+}
+
+// Put writes through a temporary file, so that a failed upload leaves nothing behind.
+func (storage *LocalStorage) Put(name string, content io.Reader) error {
+  temp, err := ioutil.TempFile(storage.Dir, ".upload-")
+  if err != nil {
+    return err
+  }
+  defer os.Remove(temp.Name())
+  _, err = io.Copy(temp, content)
+  if closeErr := temp.Close(); err == nil {
+    err = closeErr
+  }
+  if err != nil {
+    return err
+  }
+  if err = os.Chmod(temp.Name(), 0644); err != nil {
+    return err
+  }
+  return os.Rename(temp.Name(), filepath.Join(storage.Dir, name))
+}
+
+func (storage *LocalStorage) Rename(from string, to string) error {
+  return os.Rename(filepath.Join(storage.Dir, from), filepath.Join(storage.Dir, to))
+}
+
+func (storage *LocalStorage) Delete(name string) error {
+  err := os.Remove(filepath.Join(storage.Dir, name))
+  if err != nil && !os.IsNotExist(err) {
+    return err
+  }
+  return nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+  "bytes"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "unicode"
+)
+
+const (
+  // maximum length of a module name, as most file systems allow.
+  maxModuleNameLength = 255
+  // staged uploads are hidden, validModuleName rejects names with a leading dot.
+  stagedPrefix = ".staged-"
+)
+
+// ModuleStore keeps the modules, their signatures and the descriptions in a storage.
+// every name is checked by validModuleName first, so nothing outside the store is reached.
+type ModuleStore struct {
+  Storage Storage
+  // serializes the changes of uploads, which are made without the state lock.
+  changes sync.Mutex
+}
+
+var modules = &ModuleStore { Storage: &LocalStorage { Dir: "files" } }
+
+// reservedNames cannot be used for modules. "template" is the template download.
+var reservedNames = map[string]bool {
+  metadataFile: true,
+  descriptionFile: true,
+  "template": true,
+}
+
+// validModuleName rejects empty, reserved and hidden names, names with path separators
+// or control characters, and signature files.
+func validModuleName(name string) error {
+  switch {
+    case "" == name:
+      return invalid("name", "module name is required")
+    case maxModuleNameLength < len(name):
+      return invalid("name", "module name is too long")
+    case strings.ContainsAny(name, "/\\") || filepath.Base(name) != name:
+      return invalid("name", "module name must not contain a path")
+    case strings.HasPrefix(name, "."):
+      return invalid("name", "module name must not start with a dot")
+    case strings.IndexFunc(name, unicode.IsControl) >= 0:
+      return invalid("name", "module name must not contain control characters")
+    case reservedNames[name] || isSignatureFile(name):
+      return invalid("name", "reserved file name")
+  }
+  return nil
+}
+
+func (store *ModuleStore) Init() error {
+  return store.Storage.Init()
+}
+
+func (store *ModuleStore) Exists(name string) bool {
+  if validModuleName(name) != nil {
+    return false
+  }
+  _, err := store.Storage.Stat(name)
+  return err == nil
+}
+
+// List returns the modules without signatures, descriptions and unfinished uploads.
+func (store *ModuleStore) List() ([]ObjectInfo, error) {
+  objects, err := store.Storage.List()
+  if err != nil {
+    return nil, err
+  }
+  list := make([]ObjectInfo, 0, len(objects))
+  for _, object := range objects {
+    if nil == validModuleName(object.Name) {
+      list = append(list, object)
+    }
+  }
+  return list, nil
+}
+
+// Open returns the content of the module. invalid names are not found.
+func (store *ModuleStore) Open(name string) (ObjectReader, ObjectInfo, error) {
+  if validModuleName(name) != nil {
+    return nil, ObjectInfo{}, notFound("module %s not found", name)
+  }
+  content, object, err := store.Storage.Get(name)
+  if os.IsNotExist(err) {
+    return nil, ObjectInfo{}, notFound("module %s not found", name)
+  }
+  return content, object, err
+}
+
+func (store *ModuleStore) ReadFile(name string) ([]byte, error) {
+  content, _, err := store.Open(name)
+  if err != nil {
+    return nil, err
+  }
+  defer content.Close()
+  return ioutil.ReadAll(content)
+}
+
+// Stage writes the content under a hidden temporary name and returns that name, the size
+// and the hex encoded sha256. Commit moves it into place, Discard removes it.
+func (store *ModuleStore) Stage(content io.Reader) (string, int64, string, error) {
+  temp := stagedPrefix + randomHex(8)
+  hash := sha256.New()
+  counter := &countingReader { Reader: io.TeeReader(content, hash) }
+  if err := store.Storage.Put(temp, counter); err != nil {
+    return "", 0, "", err
+  }
+  return temp, counter.Count, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Commit renames the staged content to the module.
+func (store *ModuleStore) Commit(temp string, name string) error {
+  if err := validModuleName(name); err != nil {
+    return err
+  }
+  return store.Storage.Rename(temp, name)
+}
+
+func (store *ModuleStore) ReadStaged(temp string) ([]byte, error) {
+  content, _, err := store.Storage.Get(temp)
+  if err != nil {
+    return nil, err
+  }
+  defer content.Close()
+  return ioutil.ReadAll(content)
+}
+
+func (store *ModuleStore) Discard(temp string) {
+  if err := store.Storage.Delete(temp); err != nil {
+    fmt.Printf("Error: %s\n", err)
+  }
+}
+
+type countingReader struct {
+  io.Reader
+  Count int64
+}
+
+func (reader *countingReader) Read(p []byte) (int, error) {
+  n, err := reader.Reader.Read(p)
+  reader.Count += int64(n)
+  return n, err
+}
+
+// Sum reads the module and returns its hex encoded sha256.
+func (store *ModuleStore) Sum(name string) (string, error) {
+  content, _, err := store.Open(name)
+  if err != nil {
+    return "", err
+  }
+  defer content.Close()
+  hash := sha256.New()
+  if _, err = io.Copy(hash, content); err != nil {
+    return "", err
+  }
+  return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Rename moves the module and its signature.
+func (store *ModuleStore) Rename(from string, to string) error {
+  if err := validModuleName(from); err != nil {
+    return err
+  }
+  if err := validModuleName(to); err != nil {
+    return err
+  }
+  if err := store.Storage.Rename(from, to); err != nil {
+    return err
+  }
+  if store.HasSignature(from) {
+    return store.Storage.Rename(from + signatureSuffix, to + signatureSuffix)
+  }
+  return nil
+}
+
+// Remove deletes the module and its signature.
+func (store *ModuleStore) Remove(name string) error {
+  if err := validModuleName(name); err != nil {
+    return err
+  }
+  if err := store.Storage.Delete(name); err != nil {
+    return err
+  }
+  return store.RemoveSignature(name)
+}
+
+// signatures
+
+func (store *ModuleStore) HasSignature(name string) bool {
+  if validModuleName(name) != nil {
+    return false
+  }
+  _, err := store.Storage.Stat(name + signatureSuffix)
+  return err == nil
+}
+
+func (store *ModuleStore) ReadSignature(name string) ([]byte, error) {
+  if err := validModuleName(name); err != nil {
+    return nil, err
+  }
+  content, _, err := store.Storage.Get(name + signatureSuffix)
+  if err != nil {
+    return nil, err
+  }
+  defer content.Close()
+  return ioutil.ReadAll(content)
+}
+
+func (store *ModuleStore) WriteSignature(name string, blob []byte) error {
+  if err := validModuleName(name); err != nil {
+    return err
+  }
+  return store.Storage.Put(name + signatureSuffix, bytes.NewReader(blob))
+}
+
+func (store *ModuleStore) RemoveSignature(name string) error {
+  if err := validModuleName(name); err != nil {
+    return err
+  }
+  return store.Storage.Delete(name + signatureSuffix)
+}
+
+// metadata
+
+// ReadMetadata returns the metadata by module name. a missing file is reported
+// with os.IsNotExist, so that the descriptions can be migrated.
+func (store *ModuleStore) ReadMetadata() (map[string]*ModuleMeta, error) {
+  content, _, err := store.Storage.Get(metadataFile)
+  if err != nil {
+    return nil, err
+  }
+  defer content.Close()
+  metadata := map[string]*ModuleMeta{}
+  if err = json.NewDecoder(content).Decode(&metadata); err != nil {
+    return nil, fmt.Errorf("%s: %s", metadataFile, err)
+  }
+  if nil == metadata {
+    metadata = map[string]*ModuleMeta{}
+  }
+  return metadata, nil
+}
+
+func (store *ModuleStore) WriteMetadata(metadata map[string]*ModuleMeta) error {
+  blob, err := json.MarshalIndent(metadata, "", "  ")
+  if err != nil {
+    return err
+  }
+  return store.Storage.Put(metadataFile, bytes.NewReader(blob))
+}
+
+// OpenMetadata returns the metadata file for download.
+func (store *ModuleStore) OpenMetadata() (ObjectReader, ObjectInfo, error) {
+  return store.Storage.Get(metadataFile)
+}
+
+// ReadDescriptions returns the descriptions of older versions by module name.
+func (store *ModuleStore) ReadDescriptions() (map[string]string, error) {
+  content, _, err := store.Storage.Get(descriptionFile)
+  if err != nil {
+    return nil, err
+  }
+  defer content.Close()
+  descriptions := map[string]string{}
+  if err = json.NewDecoder(content).Decode(&descriptions); err != nil {
+    return nil, fmt.Errorf("%s: %s", descriptionFile, err)
+  }
+  return descriptions, nil
+}
+
+func (store *ModuleStore) RemoveDescriptions() error {
+  return store.Storage.Delete(descriptionFile)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func TestValidModuleName(t *testing.T) {
+  tests := []struct {
+    name string
+    valid bool
+  }{
+    { "app.zip", true },
+    { "app-1.2.3_final.tar.gz", true },
+    { "20260101_120000_app.zip", true },
+    { strings.Repeat("a", maxModuleNameLength), true },
+    { "", false },
+    { ".", false },
+    { "..", false },
+    { "../app.zip", false },
+    { "..\\app.zip", false },
+    { "dir/app.zip", false },
+    { "/app.zip", false },
+    { "dir\\app.zip", false },
+    { "app\x00.zip", false },
+    { "app\n.zip", false },
+    { ".hidden", false },
+    { stagedPrefix + "0123", false },
+    { strings.Repeat("a", maxModuleNameLength + 1), false },
+    { "app.zip" + signatureSuffix, false },
+    { metadataFile, false },
+    { descriptionFile, false },
+    { "template", false },
+  }
+  for _, test := range tests {
+    err := validModuleName(test.name)
+    if test.valid && nil != err {
+      t.Errorf("validModuleName(%q) = %s, want valid", test.name, err)
+    }
+    if !test.valid && nil == err {
+      t.Errorf("validModuleName(%q) is valid, want an error", test.name)
+    }
+  }
+}
+
+// newTestStore returns a local store in a directory next to a file "secret", which
+// no name may reach.
+func newTestStore(t *testing.T) (*ModuleStore, string) {
+  root := t.TempDir()
+  secret := filepath.Join(root, "secret")
+  if err := ioutil.WriteFile(secret, []byte("secret"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  store := &ModuleStore { Storage: &LocalStorage { Dir: filepath.Join(root, "files") } }
+  if err := store.Init(); err != nil {
+    t.Fatal(err)
+  }
+  return store, secret
+}
+
+var traversalNames = []string {
+  "../secret",
+  "..\\secret",
+  "..",
+  "files/../../secret",
+  "/etc/passwd",
+  "",
+}
+
+func TestModuleStoreRejectsTraversal(t *testing.T) {
+  store, secret := newTestStore(t)
+  for _, name := range traversalNames {
+    if store.Exists(name) {
+      t.Errorf("Exists(%q) is true", name)
+    }
+    if content, _, err := store.Open(name); nil == err {
+      content.Close()
+      t.Errorf("Open(%q) succeeded", name)
+    }
+    temp, _, _, err := store.Stage(strings.NewReader("module"))
+    if err != nil {
+      t.Fatal(err)
+    }
+    if err = store.Commit(temp, name); nil == err {
+      t.Errorf("Commit(%q) succeeded", name)
+    }
+    store.Discard(temp)
+    if err = store.Rename(name, "app.zip"); nil == err {
+      t.Errorf("Rename(%q, app.zip) succeeded", name)
+    }
+    if err = store.Remove(name); nil == err {
+      t.Errorf("Remove(%q) succeeded", name)
+    }
+    if err = store.WriteSignature(name, []byte("signature")); nil == err {
+      t.Errorf("WriteSignature(%q) succeeded", name)
+    }
+    if err = store.RemoveSignature(name); nil == err {
+      t.Errorf("RemoveSignature(%q) succeeded", name)
+    }
+  }
+  blob, err := ioutil.ReadFile(secret)
+  if err != nil || "secret" != string(blob) {
+    t.Fatalf("secret changed: %q, %v", blob, err)
+  }
+  if _, err = os.Stat(filepath.Join(filepath.Dir(secret), "secret" + signatureSuffix)); !os.IsNotExist(err) {
+    t.Errorf("signature written outside the store: %v", err)
+  }
+}
+
+func TestModuleStoreCommit(t *testing.T) {
+  store, _ := newTestStore(t)
+  temp, size, sum, err := store.Stage(strings.NewReader("module"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if 6 != size || "" == sum {
+    t.Fatalf("Stage = %d, %q", size, sum)
+  }
+  if list, _ := store.List(); 0 != len(list) {
+    t.Fatalf("staged content is listed: %v", list)
+  }
+  if err = store.Commit(temp, "app.zip"); err != nil {
+    t.Fatal(err)
+  }
+  blob, err := store.ReadFile("app.zip")
+  if err != nil || "module" != string(blob) {
+    t.Fatalf("ReadFile = %q, %v", blob, err)
+  }
+  if stored, err := store.Sum("app.zip"); err != nil || sum != stored {
+    t.Errorf("Sum = %q, %v, want %q", stored, err, sum)
+  }
+  if err = store.Remove("app.zip"); err != nil {
+    t.Fatal(err)
+  }
+  if store.Exists("app.zip") {
+    t.Error("removed module exists")
+  }
+}
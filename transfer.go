@@ -0,0 +1,151 @@
+package main
+
+import (
+  "gopkg.in/gin-gonic/gin.v1"
+  "net/http"
+  "mime"
+  "path/filepath"
+  "strings"
+  "sync"
+  "time"
+)
+
+// writes are split, so that limited downloads progress evenly.
+const limitedWriteSize = 32 * 1024
+
+// RateLimiter spreads writes to the given bytes per second. it is shared by goroutines.
+type RateLimiter struct {
+  sync.Mutex
+  rate int64
+  // when the bytes reserved so far have been sent.
+  next time.Time
+}
+
+var (
+  // all module downloads together, nil is unlimited.
+  downloadLimiter *RateLimiter
+  downloadLimitPerRequest int64
+)
+
+// newRateLimiter returns nil, no limit, for a rate of 0.
+func newRateLimiter(rate int64) *RateLimiter {
+  if rate <= 0 {
+    return nil
+  }
+  return &RateLimiter { rate: rate }
+}
+
+// Wait blocks until n more bytes may be sent.
+func (limiter *RateLimiter) Wait(n int) {
+  limiter.Lock()
+  now := time.Now()
+  if limiter.next.Before(now) {
+    limiter.next = now
+  }
+  delay := limiter.next.Sub(now)
+  limiter.next = limiter.next.Add(time.Duration(int64(n) * int64(time.Second) / limiter.rate))
+  limiter.Unlock()
+  time.Sleep(delay)
+}
+
+// limitedWriter writes through the limiters. it hides ReadFrom of the response,
+// so that every byte passes Write.
+type limitedWriter struct {
+  http.ResponseWriter
+  limiters []*RateLimiter
+}
+
+func (writer *limitedWriter) Write(p []byte) (int, error) {
+  written := 0
+  for 0 < len(p) {
+    chunk := p
+    if limitedWriteSize < len(chunk) {
+      chunk = chunk[:limitedWriteSize]
+    }
+    for _, limiter := range writer.limiters {
+      limiter.Wait(len(chunk))
+    }
+    n, err := writer.ResponseWriter.Write(chunk)
+    written += n
+    if err != nil {
+      return written, err
+    }
+    p = p[n:]
+  }
+  return written, nil
+}
+
+// downloadWriter returns the response writer limited by the configured rates.
+func downloadWriter(w http.ResponseWriter) http.ResponseWriter {
+  limiters := make([]*RateLimiter, 0, 2)
+  if nil != downloadLimiter {
+    limiters = append(limiters, downloadLimiter)
+  }
+  if limiter := newRateLimiter(downloadLimitPerRequest); nil != limiter {
+    limiters = append(limiters, limiter)
+  }
+  if 0 == len(limiters) {
+    return w
+  }
+  return &limitedWriter { ResponseWriter: w, limiters: limiters }
+}
+
+// types of the usual modules, the system table may not know them.
+var moduleTypes = map[string]string {
+  ".zip": "application/zip",
+  ".jar": "application/java-archive",
+  ".war": "application/java-archive",
+  ".gz": "application/gzip",
+  ".tgz": "application/gzip",
+  ".tar": "application/x-tar",
+  ".txt": "text/plain; charset=utf-8",
+}
+
+// contentType guesses from the extension, unknown types are application/octet-stream.
+func contentType(name string) string {
+  ext := strings.ToLower(filepath.Ext(name))
+  if mimeType, has := moduleTypes[ext]; has {
+    return mimeType
+  }
+  if mimeType := mime.TypeByExtension(ext); "" != mimeType {
+    return mimeType
+  }
+  return "application/octet-stream"
+}
+
+// contentDisposition makes the browser save the file under the name, which is quoted
+// as needed. names that cannot be written are left to the browser.
+func contentDisposition(name string) string {
+  if value := mime.FormatMediaType("attachment", map[string]string { "filename": name }); "" != value {
+    return value
+  }
+  return "attachment"
+}
+
+// openModule opens the module together with the sha256 of its metadata, without holding
+// off uploads. the sum is taken first: uploads replace the content before the metadata,
+// so a module replaced in between goes out with the previous sum, which no longer
+// matches on the next request, rather than the old content with the new sum.
+func openModule(state *StateStore, name string) (ObjectReader, ObjectInfo, string, error) {
+  var sum string
+  state.View(func(info *HubInfo) {
+    sum = moduleMeta(info, name).SHA256
+  })
+  content, object, err := modules.Open(name)
+  if err != nil {
+    return nil, ObjectInfo{}, "", err
+  }
+  return content, object, sum, nil
+}
+
+// serveObject sends the object with range and conditional request support. the ETag
+// is the sha256 of the content, recorded by the upload, so nodes can check what they
+// got. objects without one, such as the metadata file, have no ETag.
+func serveObject(c *gin.Context, content ObjectReader, object ObjectInfo, sum string) {
+  c.Header("Content-Disposition", contentDisposition(object.Name))
+  c.Header("Content-Type", contentType(object.Name))
+  if "" != sum {
+    c.Header("ETag", "\"" + sum + "\"")
+  }
+  http.ServeContent(downloadWriter(c.Writer), c.Request, object.Name, object.ModTime, content)
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+  "mime"
+  "testing"
+)
+
+func TestContentDisposition(t *testing.T) {
+  for _, name := range []string { "app.zip", "my app.zip", `a"b;c.zip`, "モジュール.zip" } {
+    disposition, params, err := mime.ParseMediaType(contentDisposition(name))
+    if err != nil || "attachment" != disposition || name != params["filename"] {
+      t.Errorf("%q: %s %v, %v", name, disposition, params, err)
+    }
+  }
+}
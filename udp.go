@@ -0,0 +1,140 @@
+package main
+
+import (
+  "fmt"
+  "net"
+  "runtime/debug"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// recoverPanic keeps a goroutine of the hub running when one of its steps panics.
+// Update has unlocked the hub state by then.
+func recoverPanic(where string) {
+  if r := recover(); nil != r {
+    fmt.Printf("Error: panic in %s: %v\n%s", where, r, debug.Stack())
+  }
+}
+
+// handleMessage handles one message of a node.
+func handleMessage(conn *net.UDPConn, remote *net.UDPAddr, message string, state *StateStore) {
+  defer recoverPanic("message " + message)
+  if strings.HasPrefix(message, "D") {
+    // D>Domain
+    targets := strings.Split(message, "@")
+    if 1 < len(targets) {
+      target := targets[1]
+      state.View(func(info *HubInfo) {
+        // counted by domain key, or by the target when no domain matches.
+        key := target
+        if domain := matchDomain(info, target); nil != domain {
+          key = domain.Key
+        }
+        server := resolveDomain(info, target)
+        metrics.Resolution(key, nil != server)
+        if nil == server {
+          fmt.Println("E@NotAssignDomain")
+          conn.WriteToUDP([]byte("E@NotAssignDomain"), remote)
+        } else {
+          fmt.Println("D@" + server.Node.IP + server.Port)
+          conn.WriteToUDP([]byte("D@" + server.Node.IP + server.Port), remote)
+        }
+      })
+    } else {
+      metrics.Resolution("", false)
+      conn.WriteToUDP([]byte("E@NotAssignDomain"), remote)
+    }
+  } else if strings.HasPrefix(message, "C") {
+    // C[>PortNo]
+    parts := strings.Split(message, ">")
+    state.UpdateScoped(nodeScope(remote.IP.String()), func(info *HubInfo) {
+      node, has := info.Nodes[remote.IP.String()]
+      if has {
+        if 1 == len(parts) {
+          // node stop
+          node.Status = 0
+          for _, server := range node.ServiceServers {
+            server.Status = 0
+          }
+        } else {
+          port := parts[1] 
+          server, has := node.ServiceServers[port]
+          if has {
+            // server stop
+            server.Status = 0
+          }
+        }
+      }
+    })
+  } else if strings.HasPrefix(message, "N") {
+    // N[>PortNo][>Module][>Sessions]
+    parts := strings.Split(message, ">")
+    metrics.Heartbeat()
+    state.UpdateScoped(nodeScope(remote.IP.String()), func(info *HubInfo) {
+      node, has := info.Nodes[remote.IP.String()]
+      if !has {
+        node = &(Node {
+          IP: remote.IP.String(),
+          Status: 1,
+          ServiceServers: map[string]*ServiceServer{},
+        })
+        info.Nodes[node.IP] = node
+      }
+      node.Status = 1
+      node.LastModifiedAt = time.Now()
+      if 1 < len(parts) {
+        port := parts[1] 
+        server, has := node.ServiceServers[port]
+        if !has {
+          moduleName := ""
+          if 2 < len(parts) {
+            if modules.Exists(parts[2]) {
+              moduleName = parts[2]
+            }
+          }
+          server = &(ServiceServer {
+            Port: port,
+            Status: 1,
+            Module: moduleName,
+            Node: node,
+          })
+          node.ServiceServers[server.Port] = server
+        }
+        server.Status = 1
+        server.LastModifiedAt = time.Now()
+        server.SessionsAt = time.Time{}
+        if 3 < len(parts) {
+          sessions, err := strconv.Atoi(parts[3])
+          if err == nil {
+            server.Sessions = sessions
+            server.SessionsAt = time.Now()
+          }
+        }
+        if "" != server.Module && moduleTrusted(info, server.Module) {
+          if 2 < len(parts) {
+            if server.Module != parts[2] {
+              server.Status = 2
+              node.SendMessage("S>" + server.Port + ">" + server.Module)
+            }
+          } else {
+            server.Status = 2
+            node.SendMessage("S>" + server.Port + ">" + server.Module)
+          }
+        } else if "" == server.Module && 2 < len(parts) {
+          server.Module = parts[2]
+        }
+      }
+    })
+  } else if strings.HasPrefix(message, "E") {
+    // E@Message
+    parts := strings.Split(message, "@")
+    if 1 < len(parts) {
+      fmt.Printf("  %s\n", parts[1])
+    }
+    state.UpdateScoped(canaryScope, func(info *HubInfo) {
+      recordCanaryError(info, remote.IP.String())
+    })
+  }
+  // ignore othres.
+}
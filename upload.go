@@ -0,0 +1,435 @@
+package main
+
+import (
+  "github.com/pantaroid/test/api"
+  "gopkg.in/gin-gonic/gin.v1"
+  "net/http"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  maxChunkSize = 64 * 1024 * 1024
+)
+
+// Upload is a resumable upload of a module. the received bytes are kept in the part
+// file, Offset is its length.
+type Upload struct {
+  ID string `json:"id"`
+  Name string `json:"name"`
+  Size int64 `json:"size"`
+  Description string `json:"description"`
+  Version string `json:"version"`
+  Changelog string `json:"changelog"`
+  Tags []string `json:"tags"`
+  NodeLabels []string `json:"nodeLabels"`
+  Backup bool `json:"backup"`
+  Signature []byte `json:"signature"`
+  User string `json:"user"`
+  CreatedAt time.Time `json:"createdAt"`
+  // UpdatedAt, Offset and busy are guarded by the manager. the request that marked the
+  // upload busy may read Offset without the lock, no one else changes it then.
+  UpdatedAt time.Time `json:"-"`
+  Offset int64 `json:"-"`
+  // a chunk is being written or the upload is being finished.
+  busy bool
+}
+
+func (upload *Upload) edit() ModuleEdit {
+  return ModuleEdit {
+    Description: &upload.Description,
+    Version: &upload.Version,
+    Changelog: &upload.Changelog,
+    Tags: upload.Tags,
+    NodeLabels: upload.NodeLabels,
+  }
+}
+
+func (upload *Upload) ExpiresAt() time.Time {
+  return upload.UpdatedAt.Add(currentConfig().Timing.UploadTimeout)
+}
+
+// UploadManager keeps the unfinished uploads, one .json and one .part file per upload in
+// Dir. the part files survive restarts of the hub.
+type UploadManager struct {
+  sync.Mutex
+  Dir string
+  uploads map[string]*Upload
+}
+
+var uploads = &UploadManager {
+  Dir: "uploads",
+  uploads: map[string]*Upload{},
+}
+
+func (manager *UploadManager) path(id string, ext string) string {
+  return filepath.Join(manager.Dir, id + ext)
+}
+
+// Init loads the uploads left by the last run. broken ones are removed.
+func (manager *UploadManager) Init() error {
+  if err := os.MkdirAll(manager.Dir, 0700); err != nil {
+    return err
+  }
+  files, err := ioutil.ReadDir(manager.Dir)
+  if err != nil {
+    return err
+  }
+  manager.Lock()
+  defer manager.Unlock()
+  for _, file := range files {
+    if ".json" != filepath.Ext(file.Name()) {
+      continue
+    }
+    id := strings.TrimSuffix(file.Name(), ".json")
+    var upload Upload
+    blob, err := ioutil.ReadFile(manager.path(id, ".json"))
+    if err == nil {
+      err = json.Unmarshal(blob, &upload)
+    }
+    var part os.FileInfo
+    if err == nil {
+      part, err = os.Stat(manager.path(id, ".part"))
+    }
+    if err != nil || id != upload.ID || upload.Size < part.Size() {
+      fmt.Printf("Error: upload %s removed\n", id)
+      manager.remove(id)
+      continue
+    }
+    upload.Offset = part.Size()
+    upload.UpdatedAt = part.ModTime()
+    manager.uploads[id] = &upload
+  }
+  return nil
+}
+
+// Create starts an upload of the module.
+func (manager *UploadManager) Create(user string, request api.UploadRequest) (api.UploadResource, error) {
+  if err := validModuleName(request.Name); err != nil {
+    return api.UploadResource{}, err
+  }
+  if request.Size < 0 {
+    return api.UploadResource{}, invalid("size", "size must not be negative")
+  }
+  if limit := int64(currentConfig().MaxUploadSize); limit < request.Size {
+    return api.UploadResource{}, invalid("size", fmt.Sprintf("size exceeds the limit of %d bytes", limit))
+  }
+  // the metadata is checked before any chunk is sent.
+  if err := (&ModuleEdit { Version: &request.Version, Tags: request.Tags, NodeLabels: request.NodeLabels }).apply(&ModuleMeta{}); err != nil {
+    return api.UploadResource{}, err
+  }
+  upload := &Upload {
+    ID: randomHex(16),
+    Name: request.Name,
+    Size: request.Size,
+    Description: request.Description,
+    Version: request.Version,
+    Changelog: request.Changelog,
+    Tags: request.Tags,
+    NodeLabels: request.NodeLabels,
+    Backup: request.Backup,
+    User: user,
+    CreatedAt: time.Now(),
+    UpdatedAt: time.Now(),
+  }
+  if "" != request.Signature {
+    signature, err := decodeSignature([]byte(request.Signature))
+    if err != nil {
+      return api.UploadResource{}, invalid("signature", err.Error())
+    }
+    upload.Signature = signature
+  } else if signingEnabled() {
+    return api.UploadResource{}, invalid("signature", "module signature is required")
+  }
+  blob, err := json.Marshal(upload)
+  if err != nil {
+    return api.UploadResource{}, err
+  }
+  if err = ioutil.WriteFile(manager.path(upload.ID, ".part"), nil, 0600); err != nil {
+    return api.UploadResource{}, err
+  }
+  if err = ioutil.WriteFile(manager.path(upload.ID, ".json"), blob, 0600); err != nil {
+    os.Remove(manager.path(upload.ID, ".part"))
+    return api.UploadResource{}, err
+  }
+  manager.Lock()
+  defer manager.Unlock()
+  manager.uploads[upload.ID] = upload
+  return newUploadResource(upload), nil
+}
+
+// get is called with the manager locked.
+func (manager *UploadManager) get(user *User, id string) (*Upload, error) {
+  upload, has := manager.uploads[id]
+  if !has || (user.Name != upload.User && !user.Can(roleAdmin)) {
+    return nil, notFound("upload %s not found", id)
+  }
+  return upload, nil
+}
+
+// Get returns the upload of the user. admins see every upload.
+func (manager *UploadManager) Get(user *User, id string) (api.UploadResource, error) {
+  manager.Lock()
+  defer manager.Unlock()
+  upload, err := manager.get(user, id)
+  if err != nil {
+    return api.UploadResource{}, err
+  }
+  return newUploadResource(upload), nil
+}
+
+// List returns the uploads of the user, oldest first. admins see every upload.
+func (manager *UploadManager) List(user *User) []api.UploadResource {
+  manager.Lock()
+  defer manager.Unlock()
+  list := make([]*Upload, 0, len(manager.uploads))
+  for _, upload := range manager.uploads {
+    if user.Name == upload.User || user.Can(roleAdmin) {
+      list = append(list, upload)
+    }
+  }
+  sort.Slice(list, func(i, j int) bool {
+    return list[i].CreatedAt.Before(list[j].CreatedAt)
+  })
+  resources := make([]api.UploadResource, 0, len(list))
+  for _, upload := range list {
+    resources = append(resources, newUploadResource(upload))
+  }
+  return resources
+}
+
+// acquire marks the upload busy, so that only one request works on it.
+func (manager *UploadManager) acquire(user *User, id string) (*Upload, error) {
+  manager.Lock()
+  defer manager.Unlock()
+  upload, err := manager.get(user, id)
+  if err != nil {
+    return nil, err
+  }
+  if upload.busy {
+    return nil, conflict("upload %s is busy", id)
+  }
+  upload.busy = true
+  return upload, nil
+}
+
+func (manager *UploadManager) release(upload *Upload) {
+  manager.Lock()
+  defer manager.Unlock()
+  upload.busy = false
+  upload.UpdatedAt = time.Now()
+}
+
+// WriteChunk appends the chunk at offset, which must be the number of bytes received
+// so far. a failed chunk is cut off again, so that it can be sent once more.
+func (manager *UploadManager) WriteChunk(user *User, id string, offset int64, chunk io.Reader) (api.UploadResource, error) {
+  upload, err := manager.acquire(user, id)
+  if err != nil {
+    return api.UploadResource{}, err
+  }
+  defer manager.release(upload)
+  if offset != upload.Offset {
+    return api.UploadResource{}, conflict("upload %s expects offset %d", id, upload.Offset)
+  }
+  file, err := os.OpenFile(manager.path(id, ".part"), os.O_WRONLY, 0600)
+  if err != nil {
+    return api.UploadResource{}, err
+  }
+  defer file.Close()
+  if _, err = file.Seek(offset, io.SeekStart); err != nil {
+    return api.UploadResource{}, err
+  }
+  remaining := upload.Size - offset
+  if maxChunkSize < remaining {
+    remaining = maxChunkSize
+  }
+  n, err := io.Copy(file, io.LimitReader(chunk, remaining + 1))
+  if err == nil && remaining < n {
+    err = invalid("chunk", fmt.Sprintf("chunk is larger than %d bytes", remaining))
+  }
+  if err != nil {
+    file.Truncate(offset)
+    return api.UploadResource{}, err
+  }
+  manager.Lock()
+  defer manager.Unlock()
+  upload.Offset += n
+  return newUploadResource(upload), nil
+}
+
+// Finish checks the size and hash of the upload and passes the part file to store.
+// the upload is removed when store succeeds.
+func (manager *UploadManager) Finish(user *User, id string, sum string, store func(*Upload, io.Reader) error) error {
+  upload, err := manager.acquire(user, id)
+  if err != nil {
+    return err
+  }
+  defer manager.release(upload)
+  if upload.Offset != upload.Size {
+    return conflict("upload %s is incomplete, %d of %d bytes received", id, upload.Offset, upload.Size)
+  }
+  file, err := os.Open(manager.path(id, ".part"))
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+  hash := sha256.New()
+  if _, err = io.Copy(hash, file); err != nil {
+    return err
+  }
+  if !strings.EqualFold(sum, hex.EncodeToString(hash.Sum(nil))) {
+    return invalid("sha256", "sha256 does not match the uploaded content")
+  }
+  if _, err = file.Seek(0, io.SeekStart); err != nil {
+    return err
+  }
+  if err = store(upload, file); err != nil {
+    return err
+  }
+  manager.Lock()
+  defer manager.Unlock()
+  manager.remove(id)
+  return nil
+}
+
+// Abort removes the upload unless a request is working on it.
+func (manager *UploadManager) Abort(user *User, id string) error {
+  if _, err := manager.acquire(user, id); err != nil {
+    return err
+  }
+  manager.Lock()
+  defer manager.Unlock()
+  manager.remove(id)
+  return nil
+}
+
+// Expire removes the uploads that have not progressed within the timeout.
+func (manager *UploadManager) Expire(now time.Time) {
+  manager.Lock()
+  defer manager.Unlock()
+  for id, upload := range manager.uploads {
+    if !upload.busy && upload.ExpiresAt().Before(now) {
+      fmt.Printf("Upload %s of %s expired\n", id, upload.Name)
+      manager.remove(id)
+    }
+  }
+}
+
+// remove is called with the manager locked.
+func (manager *UploadManager) remove(id string) {
+  delete(manager.uploads, id)
+  os.Remove(manager.path(id, ".part"))
+  os.Remove(manager.path(id, ".json"))
+}
+
+// API
+
+// newUploadResource is called with the manager locked.
+func newUploadResource(upload *Upload) api.UploadResource {
+  return api.UploadResource {
+    ID: upload.ID,
+    Name: upload.Name,
+    Size: upload.Size,
+    Offset: upload.Offset,
+    User: upload.User,
+    CreatedAt: upload.CreatedAt,
+    ExpiresAt: upload.ExpiresAt(),
+  }
+}
+
+func apiListUploads(c *gin.Context) {
+  c.JSON(http.StatusOK, uploads.List(currentUser(c)))
+}
+
+func apiCreateUpload(c *gin.Context) {
+  var request api.UploadRequest
+  if err := decodeBody(c, &request, false); err != nil {
+    apiError(c, err)
+    return
+  }
+  upload, err := uploads.Create(currentUser(c).Name, request)
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  c.JSON(http.StatusCreated, upload)
+}
+
+func apiGetUpload(c *gin.Context) {
+  upload, err := uploads.Get(currentUser(c), c.Param("id"))
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  c.JSON(http.StatusOK, upload)
+}
+
+// apiUploadChunk appends the body at the offset given in the query.
+func apiUploadChunk(c *gin.Context) {
+  auditSkip(c)
+  offset, err := strconv.ParseInt(c.Query("offset"), 10, 64)
+  if err != nil || offset < 0 {
+    apiError(c, badRequest("offset is required"))
+    return
+  }
+  upload, err := uploads.WriteChunk(currentUser(c), c.Param("id"), offset, c.Request.Body)
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  c.JSON(http.StatusOK, upload)
+}
+
+// apiFinishUpload stores the module. the hub state is only locked to swap in the metadata.
+func apiFinishUpload(c *gin.Context, state *StateStore) {
+  var request api.FinishUploadRequest
+  if err := decodeBody(c, &request, false); err != nil {
+    apiError(c, err)
+    return
+  }
+  name := ""
+  created := false
+  // the upload is gone once the module is stored, whatever follows.
+  err := uploads.Finish(currentUser(c), c.Param("id"), request.SHA256, func(upload *Upload, content io.Reader) error {
+    var err error
+    name = upload.Name
+    created, err = storeModule(state, upload.Name, content, upload.Signature, upload.edit(), upload.User, upload.Backup)
+    return err
+  })
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  var module UploadedFile
+  state.View(func(info *HubInfo) {
+    module, err = findModule(info, name)
+  })
+  if err != nil {
+    apiError(c, err)
+    return
+  }
+  status := http.StatusOK
+  if created {
+    status = http.StatusCreated
+  }
+  c.JSON(status, newModuleResource(module))
+}
+
+func apiAbortUpload(c *gin.Context) {
+  if err := uploads.Abort(currentUser(c), c.Param("id")); err != nil {
+    apiError(c, err)
+    return
+  }
+  c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+  "github.com/pantaroid/test/api"
+  "errors"
+  "io"
+  "strings"
+  "sync"
+  "testing"
+)
+
+// TestUploadChunks reads the upload while chunks are written, for the race detector.
+func TestUploadChunks(t *testing.T) {
+  manager := &UploadManager { Dir: t.TempDir(), uploads: map[string]*Upload{} }
+  if err := manager.Init(); err != nil {
+    t.Fatal(err)
+  }
+  user := &User { Name: "alice", Role: roleOperator }
+  upload, err := manager.Create(user.Name, api.UploadRequest { Name: "app.zip", Size: 100 })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  done := make(chan struct{})
+  var readers sync.WaitGroup
+  readers.Add(1)
+  go func() {
+    defer readers.Done()
+    for {
+      select {
+      case <-done:
+        return
+      default:
+      }
+      if resource, err := manager.Get(user, upload.ID); err != nil || 100 < resource.Offset {
+        t.Errorf("Get = %+v, %v", resource, err)
+        return
+      }
+      manager.List(user)
+    }
+  }()
+  for offset := int64(0); offset < 100; offset += 10 {
+    if upload, err = manager.WriteChunk(user, upload.ID, offset, strings.NewReader(strings.Repeat("x", 10))); err != nil {
+      t.Fatal(err)
+    }
+  }
+  close(done)
+  readers.Wait()
+  if 100 != upload.Offset {
+    t.Errorf("offset %d, want 100", upload.Offset)
+  }
+
+  // chunks at another offset are refused.
+  if _, err = manager.WriteChunk(user, upload.ID, 50, strings.NewReader("x")); nil == err {
+    t.Error("chunk at a received offset was written")
+  }
+  other := &User { Name: "bob", Role: roleOperator }
+  if _, err = manager.Get(other, upload.ID); nil == err {
+    t.Error("upload of another user found")
+  }
+}
+
+func TestUploadFinish(t *testing.T) {
+  manager := &UploadManager { Dir: t.TempDir(), uploads: map[string]*Upload{} }
+  if err := manager.Init(); err != nil {
+    t.Fatal(err)
+  }
+  user := &User { Name: "alice", Role: roleOperator }
+  if _, err := manager.Create(user.Name, api.UploadRequest { Name: "app.zip", Size: int64(currentConfig().MaxUploadSize) + 1 }); nil == err {
+    t.Error("upload above the size limit created")
+  }
+  upload, err := manager.Create(user.Name, api.UploadRequest { Name: "app.zip", Size: 1 })
+  if err == nil {
+    _, err = manager.WriteChunk(user, upload.ID, 0, strings.NewReader("x"))
+  }
+  if err != nil {
+    t.Fatal(err)
+  }
+  sum := "2d711642b726b04401627ca9fbac32f5c8530fb1903cc4db02258717921a4881"
+
+  // a failed store keeps the upload for another try.
+  failed := errors.New("storage unavailable")
+  if err = manager.Finish(user, upload.ID, sum, func(*Upload, io.Reader) error { return failed }); failed != err {
+    t.Fatalf("finish: %v", err)
+  }
+  stored := 0
+  store := func(*Upload, io.Reader) error {
+    stored++
+    return nil
+  }
+  if err = manager.Finish(user, upload.ID, sum, store); err != nil {
+    t.Fatal(err)
+  }
+  // a stored upload is gone, it is not stored again.
+  if err = manager.Finish(user, upload.ID, sum, store); nil == err || 1 != stored {
+    t.Errorf("finished again: %v, stored %d times", err, stored)
+  }
+}
@@ -1,28 +1,26 @@
 package main
 
 import (
-  "github.com/braintree/manners"
   "gopkg.in/gin-gonic/gin.v1"
+  "context"
   "net/http"
+  "flag"
   "net"
   "fmt"
   "os"
   "os/signal"
-  "io"
-  "io/ioutil"
   "syscall"
   "strings"
   "strconv"
+  "sync"
   "time"
-  "encoding/json"
   "math/rand"
-  "path/filepath"
   "bufio"
   "sort"
 )
 
 const (
-  temporaryBackupFile = "xht_autobackup.txt"
+  // replaced by metadataFile, read once to migrate.
   descriptionFile = "xhub_descriptions.json"
   dateTimeSimple = "20060102150405"
   dateTimeLayout = "2006-01-02 15:04:05"
@@ -34,6 +32,15 @@ type UploadedFile struct {
   Time string
   Description string
   TimeInt int
+  Signed bool
+  Size int64
+  ModTime time.Time
+  Meta *ModuleMeta
+}
+
+// SearchText is matched by the search of the modules tab.
+func (file UploadedFile) SearchText() string {
+  return moduleSearchText(file.Name, file.Meta)
 }
 
 type AssignPriority struct {
@@ -66,6 +73,15 @@ type ServiceServer struct {
   Name string
   Node *Node
   AssignPriorities []*AssignPriority
+  // replaced modules, oldest first.
+  History []string
+
+  // active sessions from the last heartbeat, SessionsAt is zero when not reported.
+  Sessions int
+  SessionsAt time.Time
+  Draining bool
+  DrainUntil time.Time
+  Maintenance bool
 }
 
 type Node struct {
@@ -80,13 +96,20 @@ type Node struct {
   LastModifiedAt time.Time
   Name string
   ServiceServers map[string]*ServiceServer
+
+  Draining bool
+  DrainUntil time.Time
+  Maintenance bool
 }
 
 type HubInfo struct {
   Template string
   Nodes map[string]*Node
   Domains map[string]*Domain
-  Descriptions map[string]string
+  Metadata map[string]*ModuleMeta
+  History []*HistoryEntry
+  Rollouts []*Rollout
+  Canaries []*Canary
 }
 
 func Restore(templateName string, filePath string) (info *HubInfo, err error) {
@@ -125,8 +148,7 @@ func Restore(templateName string, filePath string) (info *HubInfo, err error) {
       if has {
         name := ""
         if 3 < len(parts) {
-          _, err := os.Stat(filepath.Join("files", parts[3]))
-          if !os.IsNotExist(err) {
+          if modules.Exists(parts[3]) {
             name = parts[3]
           }
         }
@@ -137,6 +159,46 @@ func Restore(templateName string, filePath string) (info *HubInfo, err error) {
           Node: node,
         })
       }
+    } else if strings.HasPrefix(record, "P") {// previous module
+      // P>127.0.0.1>:12345>module
+      node, has := info.Nodes[parts[1]]
+      if has && 3 < len(parts) {
+        server, has := node.ServiceServers[parts[2]]
+        if has {
+          if modules.Exists(parts[3]) {
+            server.History = append(server.History, parts[3])
+          }
+        }
+      }
+    } else if strings.HasPrefix(record, "M") {// maintenance
+      // M>127.0.0.1[>:12345]
+      node, has := info.Nodes[parts[1]]
+      if has {
+        if 2 < len(parts) {
+          server, has := node.ServiceServers[parts[2]]
+          if has {
+            server.Maintenance = true
+          }
+        } else {
+          node.Maintenance = true
+        }
+      }
+    } else if strings.HasPrefix(record, "R") {// drain
+      // R>127.0.0.1[>:12345]>end in unix seconds
+      node, has := info.Nodes[parts[1]]
+      until, err := strconv.ParseInt(parts[len(parts) - 1], 10, 64)
+      if has && err == nil {
+        if 3 < len(parts) {
+          server, has := node.ServiceServers[parts[2]]
+          if has {
+            server.Draining = true
+            server.DrainUntil = time.Unix(until, 0)
+          }
+        } else if 2 < len(parts) {
+          node.Draining = true
+          node.DrainUntil = time.Unix(until, 0)
+        }
+      }
     } else if strings.HasPrefix(record, "D") {// domain
       info.Domains[parts[1]] = &(Domain {
         Key: parts[1],
@@ -187,6 +249,12 @@ func Backup(info *HubInfo) []byte {
   }
   for _, node := range info.Nodes {
     buf = append(buf, ("N>" + node.IP + "\n")...)
+    if node.Maintenance {
+      buf = append(buf, ("M>" + node.IP + "\n")...)
+    }
+    if node.Draining {
+      buf = append(buf, ("R>" + node.IP + ">" + strconv.FormatInt(node.DrainUntil.Unix(), 10) + "\n")...)
+    }
     for _, server := range node.ServiceServers {
       line := "S>" + node.IP + ">" + server.Port
       if "" != server.Module {
@@ -194,6 +262,15 @@ func Backup(info *HubInfo) []byte {
       }
       line = line + "\n"
       buf = append(buf, line...)
+      for _, previous := range server.History {
+        buf = append(buf, ("P>" + node.IP + ">" + server.Port + ">" + previous + "\n")...)
+      }
+      if server.Maintenance {
+        buf = append(buf, ("M>" + node.IP + ">" + server.Port + "\n")...)
+      }
+      if server.Draining {
+        buf = append(buf, ("R>" + node.IP + ">" + server.Port + ">" + strconv.FormatInt(server.DrainUntil.Unix(), 10) + "\n")...)
+      }
       for index := range server.AssignPriorities {
         assign := server.AssignPriorities[index]
         priority := strconv.Itoa(assign.Priority)
@@ -209,292 +286,278 @@ func Backup(info *HubInfo) []byte {
   return buf
 }
 
+func (info *HubInfo) Server(ip string, port string) *ServiceServer {
+  node, has := info.Nodes[ip]
+  if !has {
+    return nil
+  }
+  return node.ServiceServers[port]
+}
+
 func (node Node) SendUDP(port string, message string) {
+  var err error
+  defer func() {
+    metrics.CommandSent(err)
+  }()
   remote, err := net.ResolveUDPAddr("udp", node.IP + port)
   if err != nil { return }
   conn, err := net.DialUDP("udp", nil, remote)
   if err != nil { return }
   conn.SetDeadline(time.Now().Add(3 * time.Second))
   defer conn.Close()
-  conn.Write([]byte(message))
+  _, err = conn.Write([]byte(message))
 }
 func (node Node) SendMessage(message string) {
-  node.SendUDP(":51710", message)
+  node.SendUDP(":" + strconv.Itoa(currentConfig().NodePort), message)
 }
 
-func index(c *gin.Context, info *HubInfo) {
-  files, _ := ioutil.ReadDir("files")
-  size := len(files)
-  lists := make([]UploadedFile, size - 1)
-  for i := 0; i < size; i++ {
-    if descriptionFile != files[i].Name() {
-      val, _ := strconv.Atoi(files[i].ModTime().Format(dateTimeSimple))
-      lists[i] = UploadedFile{
-        Name: files[i].Name(),
-        Time: files[i].ModTime().Format(dateTimeLayout),
-        Description: info.Descriptions[files[i].Name()],
-        TimeInt: val,
-      }
-    }
+// setAlert shows the message once on the next rendered page.
+func setAlert(c *gin.Context, message string) {
+  setCookie(c, "alert", message, 10, "/")
+}
+
+// listModules returns the uploaded modules, newest first.
+func listModules(info *HubInfo) []UploadedFile {
+  files, _ := modules.List()
+  lists := make([]UploadedFile, 0, len(files))
+  for _, file := range files {
+    val, _ := strconv.Atoi(file.ModTime.Format(dateTimeSimple))
+    meta := moduleMeta(info, file.Name)
+    lists = append(lists, UploadedFile{
+      Name: file.Name,
+      Time: file.ModTime.Format(dateTimeLayout),
+      Description: meta.Description,
+      TimeInt: val,
+      Signed: hasSignature(file.Name),
+      Size: file.Size,
+      ModTime: file.ModTime,
+      Meta: meta,
+    })
   }
   sort.Slice(lists, func(i, j int) bool {
     return lists[i].TimeInt > lists[j].TimeInt
   })
-  rval, err := c.Cookie("reload")
-  if err == nil && "" != rval {
-    c.SetCookie("reload", "", 10, "/", "", false, true)
-  } else {
-    for _, node := range info.Nodes {
-      for _, server := range node.ServiceServers {
-        if server.Status == 2 {
-          rval = "3000"
-          break
-        }
-      }
-      if "" != rval { break }
-    }
-  }
-  c.HTML(http.StatusOK, "index.tmpl", gin.H {
-    "files": lists,
+  return lists
+}
+
+// pageData is rendered by the page and by the panels that are refreshed in place.
+func pageData(c *gin.Context, info *HubInfo) gin.H {
+  return gin.H {
+    "files": listModules(info),
+    "tags": moduleTags(info),
     "template": info.Template,
     "nodes": info.Nodes,
     "domains": info.Domains,
-    "reload": rval,
-  })
+    "history": recentHistory(info),
+    "rollouts": info.Rollouts,
+    "canaries": info.Canaries,
+    "signing": signingEnabled(),
+    "user": currentUser(c),
+    "admin": currentUser(c).Can(roleAdmin),
+    "csrf": csrfToken(c),
+  }
+}
+
+func index(c *gin.Context, info *HubInfo) {
+  data := pageData(c, info)
+  alert, err := c.Cookie("alert")
+  if err == nil && "" != alert {
+    setCookie(c, "alert", "", -1, "/")
+  }
+  data["alert"] = alert
+  // the audit tab is shown to admins only.
+  if currentUser(c).Can(roleAdmin) {
+    audit, err := readAudit(AuditFilter { Limit: auditPageSize })
+    if err != nil {
+      fmt.Printf("Error: %s\n", err)
+    }
+    data["audit"] = audit
+  }
+  c.HTML(http.StatusOK, "index.tmpl", data)
 }
 
-func execute(c *gin.Context, info *HubInfo) {
-  var json map[string]interface{}
-  err := c.BindJSON(&json)
+// panels lists the parts of the page that are refreshed when the state changes.
+var panels = map[string]bool {
+  "servers": true,
+  "domains": true,
+}
+
+// panel renders one tab of the page (templates/panels.tmpl).
+func panel(c *gin.Context, info *HubInfo) {
+  name := c.Param("name")
+  if !panels[name] {
+    c.Status(http.StatusNotFound)
+    return
+  }
+  c.HTML(http.StatusOK, name, pageData(c, info))
+}
+
+// execute runs an action of the page and renders the page again. the page is rendered
+// from a snapshot after the state is unlocked.
+func execute(c *gin.Context, state *StateStore) {
+  request, err := decodeExecuteRequest(c.Request)
   if err != nil {
     fmt.Printf("Error: %s\n", err)
-    c.Status(http.StatusNotFound)
+    auditError(c, err)
+    c.String(http.StatusBadRequest, err.Error())
     return
   }
-  fmt.Printf("%#v\n", json)
+  if err = authorize(currentUser(c), executeRole(request.Key)); err == nil {
+    state.Update(func(info *HubInfo) {
+      before := Backup(info)
+      if err = executeAction(info, request); err == nil {
+        auditState(c, before, Backup(info))
+      }
+    })
+  }
+  if err != nil {
+    fmt.Printf("Error: %s\n", err)
+    auditError(c, err)
+    setAlert(c, err.Error())
+  }
+  index(c, state.Snapshot())
+  //c.Redirect(http.StatusMovedPermanently, "/")
+}
 
-  switch json["key"] {
+// executeAction changes the state for the request of the page.
+func executeAction(info *HubInfo, request *ExecuteRequest) error {
+  var err error
+  switch request.Key {
     case "removeFile":
-      fileName := json["name"].(string)
-      os.Remove(filepath.Join("files", fileName))
-      delete(info.Descriptions, fileName)
-      saveDescriptions(info)
+      err = removeModule(info, request.Name)
     case "stopNode":
-      ip := json["ip"].(string)
-      node, has := info.Nodes[ip]
-      if has {
-        node.SendMessage("C>")
-      }
+      err = stopNode(info, request.IP)
     case "addServer":
-      ip := json["ip"].(string)
-      node, has := info.Nodes[ip]
-      if has {
-        node.SendMessage("S>")
-      }
+      err = addServer(info, request.IP)
     case "renameServer":
-      ip := json["ip"].(string)
-      port := json["port"].(string)
-      name := json["name"].(string)
-      node, has := info.Nodes[ip]
-      if has {
-        server, has := node.ServiceServers[port]
-        if has {
-          server.Name = name
-        }
-      }
+      err = renameServer(info, request.IP, request.Port, request.Name)
     case "startServer":
-      ip := json["ip"].(string)
-      port := json["port"].(string)
-      node, has := info.Nodes[ip]
-      if has {
-        server, has := node.ServiceServers[port]
-        if has && 0 == server.Status {
-          server.Status = 2
-          server.LastModifiedAt = time.Now()
-          node.SendMessage("S>" + port)
-        }
-      }
+      err = startServer(info, request.IP, request.Port)
     case "stopServer":
-      ip := json["ip"].(string)
-      port := json["port"].(string)
-      node, has := info.Nodes[ip]
-      if has {
-        server, has := node.ServiceServers[port]
-        if has && 1 == server.Status {
-          server.Status = 2
-          node.SendMessage("C>" + port)
-        }
-      }
+      err = stopServer(info, request.IP, request.Port)
     case "syncServer":
-      ip := json["ip"].(string)
-      port := json["port"].(string)
-      node, has := info.Nodes[ip]
-      if has {
-        server, has := node.ServiceServers[port]
-        if has && (1 == server.Status || 8 == server.Status) && "" != server.Module {
-          _, err := os.Stat(filepath.Join("files", server.Module))
-          if !os.IsNotExist(err) {
-            server.Status = 2
-            node.SendMessage("S>" + port + "><" + server.Module)
-          }
-        }
-      }
+      err = syncServer(info, request.IP, request.Port)
     case "setModule":
-      name := json["name"].(string)
-      _, err := os.Stat(filepath.Join("files", name))
-      if !os.IsNotExist(err) {
-        ip := json["ip"].(string)
-        port := json["port"].(string)
-        node, has := info.Nodes[ip]
-        if has {
-          server, has := node.ServiceServers[port]
-          if has && 1 == server.Status && server.Module != name {
-            server.Module = name
-            server.Status = 2
-            node.SendMessage("S>" + port + ">" + server.Module)
-          }
-        }
+      err = setModule(info, request.IP, request.Port, request.Name)
+    case "rollbackServer":
+      var server *ServiceServer
+      if server, err = findServer(info, request.IP, request.Port); err == nil && !rollbackServer(info, server) {
+        err = noRollback(server)
       }
-    case "addDomain":
-      newDomain := json["name"].(string)
-      info.Domains[newDomain] = &(Domain {
-        Key: newDomain,
-        Class: "d" + time.Now().Format(dateTimeTemplateLayout),
-      })
-    case "delDomain":
-      delDomain := json["name"].(string)
-      domain, has := info.Domains[delDomain]
-      if has {
-        for index := range domain.AssignPriorities {
-          assign := domain.AssignPriorities[index]
-          if nil != assign.ServiceServer {
-            priorities := make([]*AssignPriority, 0)
-            for i := range assign.ServiceServer.AssignPriorities {
-              a := assign.ServiceServer.AssignPriorities[i]
-              if a != assign {
-                priorities = append(priorities, a)
-              }
-            }
-            assign.ServiceServer.AssignPriorities = priorities
-          }
-        }
-        delete(info.Domains, delDomain)
+    case "rollbackDomain":
+      var domain *Domain
+      if domain, err = findDomain(info, request.Domain); err == nil && 0 == rollbackDomain(info, domain) {
+        err = conflict("no server of domain %s has a module to roll back to", domain.Key)
       }
-    case "assign":
-      ip := json["ip"].(string)
-      port := json["port"].(string)
-      domainKey := json["domain"].(string)
-      priority, err := strconv.Atoi(json["priority"].(string))
-      node, has := info.Nodes[ip]
-      if has && nil == err {
-        server, has := node.ServiceServers[port]
-        if has {
-          unique := true
-          for i := range server.AssignPriorities {
-            if domainKey == server.AssignPriorities[i].Domain.Key {
-              server.AssignPriorities[i].Priority = priority
-              unique = false
-              break
-            }
-          }
-          if unique {
-            domain, has := info.Domains[domainKey]
-            if has {
-              assign := AssignPriority {
-                Priority: priority,
-                Domain: domain,
-                ServiceServer: server,
-              }
-              server.AssignPriorities = append(server.AssignPriorities, &assign)
-              domain.AssignPriorities = append(domain.AssignPriorities, &assign)
-            }
-          }
-        }
+    case "rollbackModule":
+      if 0 == rollbackModule(info, request.Name) {
+        err = conflict("no server of module %s has a module to roll back to", request.Name)
       }
-    case "exclude":
-      ip := json["ip"].(string)
-      port := json["port"].(string)
-      domainKey := json["domain"].(string)
-      node, has := info.Nodes[ip]
-      if has {
-        server, has := node.ServiceServers[port]
-        if has {
-          assigns := make([]*AssignPriority, 0)
-          for index := range server.AssignPriorities {
-            assign := server.AssignPriorities[index]
-            if domainKey != assign.Domain.Key {
-              assigns = append(assigns, assign)
-            }
-          }
-          server.AssignPriorities = assigns
-        }
+    case "startRollout":
+      _, err = startRollout(info, request.Domain, request.Name, int(request.Batch), time.Duration(request.Timeout) * time.Second, request.Failure)
+    case "pauseRollout":
+      rollout := findRollout(info, request.ID)
+      if nil != rollout {
+        pauseRollout(rollout)
+      }
+    case "resumeRollout":
+      rollout := findRollout(info, request.ID)
+      if nil != rollout {
+        resumeRollout(rollout)
       }
-      domain, has := info.Domains[domainKey]
+    case "abortRollout":
+      rollout := findRollout(info, request.ID)
+      if nil != rollout {
+        abortRollout(info, rollout, "aborted by operator")
+      }
+    case "drainServer":
+      server := info.Server(request.IP, request.Port)
+      if nil != server {
+        drainServer(server, time.Duration(request.Seconds) * time.Second)
+      }
+    case "drainNode":
+      node, has := info.Nodes[request.IP]
       if has {
-        assigns := make([]*AssignPriority, 0)
-        for index := range domain.AssignPriorities {
-          assign := domain.AssignPriorities[index]
-          if port != assign.ServiceServer.Port {
-            assigns = append(assigns, assign)
-          }
+        drainNode(node, time.Duration(request.Seconds) * time.Second)
+      }
+    case "cancelDrain":
+      // an unknown port must not cancel the drain of the whole node.
+      if "" == request.Port {
+        var node *Node
+        if node, err = findNode(info, request.IP); nil == err {
+          cancelDrain(node, nil)
         }
-        domain.AssignPriorities = assigns
+      } else {
+        var server *ServiceServer
+        if server, err = findServer(info, request.IP, request.Port); nil == err {
+          cancelDrain(server.Node, server)
+        }
+      }
+    case "maintenance":
+      err = setMaintenance(info, request.IP, request.Port, "on" == request.Enabled)
+    case "startCanary":
+      _, err = startCanary(info, request.Domain, request.Name, request.Servers, int(request.Weight), time.Duration(request.Window) * time.Second, int(request.Errors), time.Duration(request.Timeout) * time.Second)
+    case "promoteCanary":
+      canary := findCanary(info, request.ID)
+      if nil != canary {
+        err = promoteCanary(info, canary)
       }
+    case "abortCanary":
+      canary := findCanary(info, request.ID)
+      if nil != canary {
+        abortCanary(info, canary, "aborted by operator")
+      }
+    case "addDomain":
+      _, err = addDomain(info, request.Name)
+    case "delDomain":
+      err = deleteDomain(info, request.Name)
+    case "assign":
+      _, err = assignServer(info, request.IP, request.Port, request.Domain, int(request.Priority))
+    case "exclude":
+      excludeServer(info, request.IP, request.Port, request.Domain)
     default:
   }
-  index(c, info)
-  //c.Redirect(http.StatusMovedPermanently, "/")
+  return err
 }
-func saveDescriptions(info *HubInfo) {
-  bytes, err := json.Marshal(info.Descriptions)
-  if err == nil {
-    ioutil.WriteFile(filepath.Join("files", descriptionFile), bytes, 0644)
-  } 
+
+// moduleAvailable reports whether the module exists and may be pushed to nodes.
+func moduleAvailable(info *HubInfo, name string) bool {
+  if !modules.Exists(name) {
+    return false
+  }
+  if !moduleTrusted(info, name) {
+    fmt.Printf("Error: %s is not signed by a trusted key\n", name)
+    return false
+  }
+  return true
 }
-func upload(c *gin.Context, caller chan *HubInfo) {
+
+func upload(c *gin.Context, state *StateStore) {
   file, header, err := c.Request.FormFile("file")
   if err == nil {
-    info := <- caller
-
-    // get filename
-    fileName := header.Filename
-    filePath := filepath.Join("files", fileName)
-    description := c.Request.FormValue("description")
-    descSave := "" != description
-    if "on" == c.Request.FormValue("backup") {
-      _, err := os.Stat(filePath)
-      if !os.IsNotExist(err) {
-        backupName := time.Now().Format(dateTimeTemplateLayout)  + "_" + fileName
-        os.Rename(filePath, filepath.Join("files", backupName))
-        info.Descriptions[backupName] = info.Descriptions[fileName]
-        descSave = true
-      }
-    }
-    if descSave {
-      info.Descriptions[fileName] = description
-      saveDescriptions(info)
-    }
-    // create file
-    out, err := os.Create(filePath)
-    if err == nil {
-      defer out.Close()
-      // copy from temporary
-      _, err = io.Copy(out, file)
-      if err == nil && "template" ==  c.Request.FormValue("key") {
-        newInfo, err := Restore(fileName, filePath)
-        if err == nil {
-          newInfo.Descriptions = info.Descriptions
-          os.Remove(filePath)
-          c.SetCookie("reload", "3000", 10, "/", "", false, true)
-          unlock(caller, newInfo)
-        } else {
-          unlock(caller, info)
-        }
-      } else {
-        unlock(caller, info)
+    defer file.Close()
+    if "template" == c.Request.FormValue("key") {
+      auditAction(c, "uploadTemplate")
+      err = authorize(currentUser(c), roleAdmin)
+      if err == nil {
+        var before, after []byte
+        before, after, err = replaceTemplate(state, header.Filename, file)
+        auditState(c, before, after)
       }
     } else {
-      unlock(caller, info)
+      auditAction(c, "uploadModule")
+      var signature []byte
+      err = authorize(currentUser(c), roleOperator)
+      if err == nil {
+        signature, err = uploadedSignature(c)
+      }
+      if err == nil {
+        _, err = storeModule(state, header.Filename, file, signature, formModuleEdit(c), currentUser(c).Name, "on" == c.Request.FormValue("backup"))
+      }
+    }
+    if err != nil {
+      auditError(c, err)
+      setAlert(c, header.Filename + ": " + err.Error())
     }
   }
   if err != nil {
@@ -503,316 +566,366 @@ func upload(c *gin.Context, caller chan *HubInfo) {
   c.Redirect(http.StatusMovedPermanently, "/")
 }
 
-func download(c *gin.Context, info *HubInfo) {
+// formModuleEdit reads the metadata fields of the upload form.
+func formModuleEdit(c *gin.Context) ModuleEdit {
+  description := c.Request.FormValue("description")
+  version := c.Request.FormValue("version")
+  changelog := c.Request.FormValue("changelog")
+  return ModuleEdit {
+    Description: &description,
+    Version: &version,
+    Changelog: &changelog,
+    Tags: splitLabels(c.Request.FormValue("tags")),
+    NodeLabels: splitLabels(c.Request.FormValue("nodeLabels")),
+  }
+}
+
+// download serves the module from the storage, with the sha256 of its metadata.
+func download(c *gin.Context, state *StateStore) {
   fileName := c.Param("file")
 
-  var bytes []byte
   if fileName == "template" {
-    bytes = Backup(info)
+    var bytes []byte
+    state.View(func(info *HubInfo) {
+      bytes = Backup(info)
+    })
     fileName = "xht_" + time.Now().Format(dateTimeTemplateLayout) + ".txt"
-  } else {
-    file, err := os.Open("./files/" + fileName)
-    if err != nil {
-      fmt.Printf("Error: %s\n", err)
-      c.Status(http.StatusNotFound)
-      return
-    }
-    defer file.Close()
-
-    bytes, err = ioutil.ReadAll(file)
-    if err != nil {
-      fmt.Printf("Error: %s\n", err)
-      c.Status(http.StatusNotFound)
-      return
-    }
+    c.Header("Content-Disposition", contentDisposition(fileName))
+    c.Data(http.StatusOK, contentType(fileName), bytes)
+    return
   }
 
-  c.Header("Content-Disposition", "attachment; filename=" + fileName )
-  c.Data(http.StatusOK, "application/zip", bytes)
-}
-
-func exchange(caller chan *HubInfo, info *HubInfo) {
-fmt.Println(1)
-  <- caller
-fmt.Println(2)
-  caller <- info
-}
-
-func unlock(caller chan *HubInfo, info *HubInfo) {
-  caller <- info
+  var content ObjectReader
+  var object ObjectInfo
+  var sum string
+  var err error
+  if metadataFile == fileName {
+    content, object, err = modules.OpenMetadata()
+  } else {
+    content, object, sum, err = openModule(state, fileName)
+  }
+  if err != nil {
+    fmt.Printf("Error: %s\n", err)
+    c.Status(http.StatusNotFound)
+    return
+  }
+  defer content.Close()
+  serveObject(c, content, object, sum)
 }
 
-func lock(caller chan *HubInfo, fn func(*HubInfo)) {
-  info := <- caller
-  defer unlock(caller, info)
+// stepStatus moves nodes and servers without a heartbeat to warning and then to danger,
+// after 15 and 30 seconds unless configured. it is called by the scheduler.
+func stepStatus(info *HubInfo) {
+  timing := currentConfig().Timing
+  warning := timing.HeartbeatWarning
+  danger := timing.HeartbeatDanger
   for _, node := range info.Nodes {
-    if 0 != node.Status && 9 != node.Status {
-      seconds := int(time.Since(node.LastModifiedAt).Seconds())
-      if 30 < seconds {
+    // nodes under maintenance are not escalated to warning or danger.
+    if 0 != node.Status && 9 != node.Status && !node.Maintenance {
+      elapsed := time.Since(node.LastModifiedAt)
+      if danger < elapsed {
         node.Status = 9
-      } else if 15 < seconds {
+      } else if warning < elapsed {
         node.Status = 8
       }
     }
     for _, server := range node.ServiceServers {
-      if 0 != server.Status && 9 != server.Status {
-        seconds := int(time.Since(server.LastModifiedAt).Seconds())
-        if 30 < seconds {
+      if 0 != server.Status && 9 != server.Status && !server.UnderMaintenance() {
+        elapsed := time.Since(server.LastModifiedAt)
+        if danger < elapsed {
           server.Status = 9
-        } else if 15 < seconds {
+        } else if warning < elapsed {
           server.Status = 8
         }
       }
     }
   }
-  fn(info)
-  ioutil.WriteFile(temporaryBackupFile, Backup(info), 0644)
 }
 
-func loadDescriptions() map[string]string {
-  filePath := filepath.Join("files", descriptionFile)
-  _, err := os.Stat(filePath)
-  if os.IsNotExist(err) {
-    os.Create(filePath)
+// matchDomain returns the domain of the target, or the one with the longest key the
+// target starts with. nil when none matches.
+func matchDomain(info *HubInfo, target string) *Domain {
+  domain, has := info.Domains[target]
+  if !has {
+    length := 0
+    for key, dom := range info.Domains {
+      if 0 == strings.Index(target, key) {
+        if length < len(key) {
+          domain = dom
+          length = len(key)
+        }
+      }
+    }
+  }
+  return domain
+}
+
+// resolveDomain picks an active server for the domain of the target. primaries are
+// preferred over secondaries. it only reads the state, the canary resolutions are counted
+// apart.
+func resolveDomain(info *HubInfo, target string) *ServiceServer {
+  domain := matchDomain(info, target)
+  if nil == domain {
+    return nil
+  }
+  canary := domainCanary(info, domain.Key)
+  primaries := make([]*ServiceServer, 0)
+  secondaries := make([]*ServiceServer, 0)
+  canaries := make([]*ServiceServer, 0)
+  for index := range domain.AssignPriorities {
+    assign := domain.AssignPriorities[index]
+    if 1 == assign.ServiceServer.Node.Status && 1 == assign.ServiceServer.Status && assign.ServiceServer.Resolvable() {
+      if nil != canary && canary.Includes(assign.ServiceServer) {
+        canaries = append(canaries, assign.ServiceServer)
+      } else if 1 == assign.Priority {
+        primaries = append(primaries, assign.ServiceServer)
+      } else if 2 == assign.Priority {
+        secondaries = append(secondaries, assign.ServiceServer)
+      }
+    }
   }
-  blob, err := ioutil.ReadFile(filePath)
-  var descriptions map[string]string
-  json.Unmarshal(blob, &descriptions)
-  if descriptions == nil {
-    descriptions = map[string]string {}
+  rand.Seed(time.Now().UnixNano())
+  if 0 < len(canaries) && (rand.Intn(100) < canary.Weight || 0 == len(primaries) + len(secondaries)) {
+    canaryResolutions.Add(canary.ID)
+    return canaries[rand.Intn(len(canaries))]
+  } else if 0 < len(primaries) {
+    return primaries[rand.Intn(len(primaries))]
+  } else if 0 < len(secondaries) {
+    return secondaries[rand.Intn(len(secondaries))]
   }
-  return descriptions
+  return nil
 }
 
 func main() {
-  // create files directory.
-  _, err := os.Stat("files")
+  os.Exit(run())
+}
+
+// run starts the hub and returns the exit code once it stopped.
+func run() int {
+  // ports, paths and timing
+  options, err := parseFlags(os.Args[1:])
+  if err == flag.ErrHelp {
+    return 0
+  } else if err != nil {
+    return 2
+  }
+  config, err := loadConfig(options)
+  if err == nil {
+    if options.Print {
+      config.Print()
+    }
+    err = config.validate()
+  }
   if err != nil {
-    os.Mkdir("files", 0755)
+    fmt.Printf("Error: %s\n", err)
+    return 1
   }
+  if options.Print {
+    return 0
+  }
+  hubConfig = config
+  startOptions = options
 
-  // description
-  descriptions := loadDescriptions()
+  // module storage, the files directory unless configured.
+  err = loadStorage(config.Paths.Storage)
+  if err != nil {
+    fmt.Printf("Error: %s\n", err)
+    return 1
+  }
+  err = modules.Init()
+  if err != nil {
+    fmt.Printf("Error: %s\n", err)
+    return 1
+  }
 
-  // resource channel.
-  cInfo := make(chan *HubInfo)
+  // unfinished uploads of the last run
+  uploads.Dir = config.Paths.Uploads
+  if err = uploads.Init(); err != nil {
+    fmt.Printf("Error: %s\n", err)
+    return 1
+  }
 
-  {// ResourceMaster
-    go func() {
-      var info *HubInfo
-      empty := true
-      _, err = os.Stat(temporaryBackupFile)
-      if !os.IsNotExist(err) { 
-        tempInfo, err := Restore("Auto backup", temporaryBackupFile)
-        if err == nil {
-          info = tempInfo
-          empty = false
-        }
-      }
-      if empty {
-        info = &HubInfo {
-          Template: "",
-          Nodes: map[string]*Node{},
-          Domains: map[string]*Domain{},
-        }
-      }
-      info.Descriptions = descriptions
-      for {
-        cInfo <- info
-        info = <- cInfo
-      }
-    }()
+  // retention of module backups
+  retention, err = loadRetention(config.Paths.Retention)
+  if err != nil {
+    fmt.Printf("Error: %s\n", err)
+    return 1
   }
 
-  {// CommunicationServer
-    fmt.Println("UDP START!!")
-    addr, err := net.ResolveUDPAddr("udp", ":51701")
-    if err != nil {
-      fmt.Printf("Error: %s\n", err)
-      return
+  // module metadata
+  metadata, err := loadMetadata()
+  if err != nil {
+    fmt.Printf("Error: %s\n", err)
+    return 1
+  }
+
+  // trusted keys for module signatures
+  trustedKeys, err = loadTrustedKeys(config.Paths.TrustedKeys)
+  if err != nil {
+    fmt.Printf("Error: %s\n", err)
+    return 1
+  }
+  if signingEnabled() {
+    fmt.Printf("Module signing enabled (%d keys)\n", len(trustedKeys))
+  }
+
+  // users and single sign-on
+  accounts.File = config.Paths.Users
+  if err = loadUsers(); err != nil {
+    fmt.Printf("Error: %s\n", err)
+    return 1
+  }
+  if oidc, err = loadOIDC(config.Paths.OIDC); err != nil {
+    fmt.Printf("Error: %s\n", err)
+    return 1
+  }
+
+  // auto backup
+  persister := newPersister(config.Paths.AutoBackup)
+  persister.RolloutsPath = config.Paths.Rollouts
+
+  // hub state
+  var state *StateStore
+  {
+    var info *HubInfo
+    empty := true
+    _, err = os.Stat(config.Paths.AutoBackup)
+    if !os.IsNotExist(err) {
+      tempInfo, err := Restore("Auto backup", config.Paths.AutoBackup)
+      if err == nil {
+        info = tempInfo
+        empty = false
+      }
     }
-    conn, err := net.ListenUDP("udp", addr)
-    if err != nil {
+    if empty {
+      info = &HubInfo {
+        Template: "",
+        Nodes: map[string]*Node{},
+        Domains: map[string]*Domain{},
+      }
+    }
+    info.Metadata = metadata
+    info.History = loadHistory()
+    if info.Rollouts, err = loadRollouts(config.Paths.Rollouts); err != nil {
+      // started without them, like a missing file.
       fmt.Printf("Error: %s\n", err)
-      return
     }
-    defer conn.Close()
+    state = newStateStore(info, persister)
+  }
+
+  // both ports are bound before anything runs, so that a port in use stops the hub
+  // before it touches the nodes or the auto backup.
+  addr, err := net.ResolveUDPAddr("udp", config.Listen.UDP)
+  if err != nil {
+    fmt.Printf("Error: %s\n", err)
+    return 1
+  }
+  conn, err := net.ListenUDP("udp", addr)
+  if err != nil {
+    fmt.Printf("Error: %s\n", err)
+    return 1
+  }
+  listener, err := net.Listen("tcp", config.Listen.HTTP)
+  if err != nil {
+    conn.Close()
+    fmt.Printf("Error: %s\n", err)
+    return 1
+  }
 
+  // background tasks, stopped after the servers.
+  stop := make(chan struct{})
+  var background sync.WaitGroup
+  {// Persister
+    background.Add(1)
     go func() {
-      buf := make([]byte, 1024)
-      for {
-        rlen, remote, err := conn.ReadFromUDP(buf)
-        if err == nil {
-          message := string(buf[:rlen])
-          //rlen, err = conn.WriteToUDP([]byte(s), remote)
-          fmt.Printf("Receive %v:%v -> %v\n", remote.IP, remote.Port, message)
-          if strings.HasPrefix(message, "D") {
-            // D>Domain
-            targets := strings.Split(message, "@")
-            if 1 < len(targets) {
-              target := targets[1]
-              lock(cInfo, func(info *HubInfo) {
-                err := true
-                domain, has := info.Domains[target]
-                if !has {
-                  length := 0
-                  for key, dom := range info.Domains {
-                    if 0 == strings.Index(target, key) {
-                      if length < len(key) {
-                        domain = dom
-                        length = len(key)
-                        err = false
-                      }
-                    }
-                  }
-                } else {
-                  err = false
-                }
-                var server *ServiceServer
-                if !err {
-                  primaries := make([]*ServiceServer, 0)
-                  secondaries := make([]*ServiceServer, 0)
-                  for index := range domain.AssignPriorities {
-                    assign := domain.AssignPriorities[index]
-                    if 1 == assign.ServiceServer.Node.Status && 1 == assign.ServiceServer.Status {
-                      if 1 == assign.Priority {
-                        primaries = append(primaries, assign.ServiceServer)
-                      } else if 2 == assign.Priority {
-                        secondaries = append(secondaries, assign.ServiceServer)
-                      }
-                    }
-                  }
-                  rand.Seed(time.Now().UnixNano())
-                  if 0 < len(primaries) {
-                    server = primaries[rand.Intn(len(primaries))]
-                  } else if 0 < len(secondaries) {
-                    server = secondaries[rand.Intn(len(secondaries))]
-                  } else {
-                    err = true
-                  }
-                }
-                if err {
-                  fmt.Printf("%v\n", err)
-                  conn.WriteToUDP([]byte("E@NotAssignDomain"), remote)
-                } else {
-                  fmt.Println("D@" + server.Node.IP + server.Port)
-                  conn.WriteToUDP([]byte("D@" + server.Node.IP + server.Port), remote)
-                }
-              })
-            } else {
-              conn.WriteToUDP([]byte("E@NotAssignDomain"), remote)
-            }
-          } else if strings.HasPrefix(message, "C") {
-            // C[>PortNo]
-            parts := strings.Split(message, ">")
-            lock(cInfo, func(info *HubInfo) {
-              node, has := info.Nodes[remote.IP.String()]
-              if has {
-                if 1 == len(parts) {
-                  // node stop
-                  node.Status = 0
-                  for _, server := range node.ServiceServers {
-                    server.Status = 0
-                  }
-                } else {
-                  port := parts[1] 
-                  server, has := node.ServiceServers[port]
-                  if has {
-                    // server stop
-                    server.Status = 0
-                  }
-                }
-              }
-            })
-          } else if strings.HasPrefix(message, "N") {
-            // N[>PortNo][>Module]
-            parts := strings.Split(message, ">")
-            lock(cInfo, func(info *HubInfo) {
-              node, has := info.Nodes[remote.IP.String()]
-              if !has {
-                node = &(Node {
-                  IP: remote.IP.String(),
-                  Status: 1,
-                  ServiceServers: map[string]*ServiceServer{},
-                })
-                info.Nodes[node.IP] = node
-              }
-              node.Status = 1
-              node.LastModifiedAt = time.Now()
-              if 1 < len(parts) {
-                port := parts[1] 
-                server, has := node.ServiceServers[port]
-                if !has {
-                  moduleName := ""
-                  if 2 < len(parts) {
-                    _, err := os.Stat(filepath.Join("files", parts[2]))
-                    if !os.IsNotExist(err) {
-                      moduleName = parts[2]
-                    }
-                  }
-                  server = &(ServiceServer {
-                    Port: port,
-                    Status: 1,
-                    Module: moduleName,
-                    Node: node,
-                  })
-                  node.ServiceServers[server.Port] = server
-                }
-                server.Status = 1
-                server.LastModifiedAt = time.Now()
-                if "" != server.Module {
-                  if 2 < len(parts) {
-                    if server.Module != parts[2] {
-                      server.Status = 2
-                      node.SendMessage("S>" + server.Port + ">" + server.Module)
-                    }
-                  } else {
-                    server.Status = 2
-                    node.SendMessage("S>" + server.Port + ">" + server.Module)
-                  }
-                } else if 2 < len(parts) {
-                  server.Module = parts[2]
-                }
-              }
-            })
-          } else if strings.HasPrefix(message, "E") {
-            // E@Message
-            parts := strings.Split(message, "@")
-            fmt.Printf("  %s\n", parts[1])
-          }
-          // ignore othres.
-        }
-      }
+      defer background.Done()
+      persister.Run(state, stop)
+    }()
+  }
+
+  {// Module signatures, verified once so that heartbeats only look them up.
+    go verifyTrusted(state)
+  }
+
+  {// Scheduler
+    background.Add(1)
+    go func() {
+      defer background.Done()
+      repeat("scheduler", time.Second, stop, func() {
+        state.Update(func(info *HubInfo) {
+          stepStatus(info)
+          stepRollouts(info)
+          stepCanaries(info)
+          stepDrains(info)
+        })
+        // deletes backups without the state lock.
+        stepRetention(state)
+        expireSessions(time.Now())
+      })
+    }()
+  }
+
+  {// Upload GC
+    background.Add(1)
+    go func() {
+      defer background.Done()
+      repeat("upload gc", time.Minute, stop, func() {
+        uploads.Expire(time.Now())
+      })
     }()
   }
 
+  {// CommunicationServer
+    fmt.Println("UDP START!!")
+    udpPipeline = newMessagePipeline(conn, state)
+    udpPipeline.Start()
+  }
+
+  var server *http.Server
+  served := make(chan error, 1)
+
   {// WebServer
     // initailize
     router := gin.Default()
     // load templates
     router.LoadHTMLGlob("./templates/*")
+    // authentication, audit trail and CSRF protection
+    router.Use(authenticate, auditRequest, checkCSRF)
+    viewer := requireRole(roleViewer)
+    router.GET("/login", loginPage)
+    router.POST("/login", login)
+    router.POST("/logout", logout)
+    router.GET("/login/oidc", oidcLogin)
+    router.GET("/login/oidc/callback", oidcCallback)
     // root
     //router.GET("/", index)
-    router.GET("/", func(c *gin.Context) {
-      lock(cInfo, func(info *HubInfo) {
-        index(c, info)
-      })
+    // pages are rendered from a snapshot, the modules are listed without the lock.
+    router.GET("/", viewer, func(c *gin.Context) {
+      index(c, state.Snapshot())
     })
     // loaders
-    router.POST("/upload", func(c *gin.Context) {
-      upload(c, cInfo)
+    // upload and execute check the role of the action themselves to show an alert.
+    router.POST("/upload", viewer, func(c *gin.Context) {
+      upload(c, state)
     })
-    router.GET("/download/:file", func(c *gin.Context) {
-      lock(cInfo, func(info *HubInfo) {
-        download(c, info)
-      })
+    // nodes download the modules pushed to them without credentials.
+    router.GET("/download/:file", requireViewerOrNode(state), func(c *gin.Context) {
+      download(c, state)
+    })
+    router.GET("/signature/:file", requireViewerOrNode(state), downloadSignature)
+    // prometheus, scraped with an API token.
+    router.GET("/metrics", viewer, func(c *gin.Context) {
+      serveMetrics(c, state)
+    })
+    router.GET("/panels/:name", viewer, func(c *gin.Context) {
+      panel(c, state.Snapshot())
     })
     // execute
-    router.POST("/execute", func(c *gin.Context) {
-      lock(cInfo, func(info *HubInfo) {
-        execute(c, info)
-      })
+    router.POST("/execute", viewer, func(c *gin.Context) {
+      execute(c, state)
     })
+    // json api
+    registerAPI(router, state)
     // resources
     router.StaticFile("/fonts/glyphicons-halflings-regular.woff2", "./resources/glyphicons-halflings-regular.woff2")
     router.StaticFile("/fonts/glyphicons-halflings-regular.woff", "./resources/glyphicons-halflings-regular.woff")
@@ -829,19 +942,67 @@ func main() {
     router.StaticFile("/script.js", "./resources/script.js")
 
     // listen
-    manners.ListenAndServe(":51700",  router)
+    server = &http.Server { Handler: router }
+    // event streams never end by themselves.
+    server.RegisterOnShutdown(events.Close)
+    go func() {
+      if "" != config.TLS.Cert {
+        served <- server.ServeTLS(listener, config.TLS.Cert, config.TLS.Key)
+      } else {
+        served <- server.Serve(listener)
+      }
+    }()
     //router.Run(":51700")
   }
 
-  signal_chan := make(chan os.Signal)
-  signal.Notify(signal_chan, syscall.SIGTERM)
+  // reload on SIGHUP.
+  hangups := make(chan os.Signal, 1)
+  signal.Notify(hangups, syscall.SIGHUP)
   go func() {
-      for {
-          s := <-signal_chan
-          if s == syscall.SIGTERM {
-              manners.Close()
-          }
-      }
+    for range hangups {
+      reloadOnSignal(state)
+    }
   }()
+
+  // stop on SIGTERM or SIGINT. a second signal exits at once.
+  signals := make(chan os.Signal, 2)
+  signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+  code := 0
+  select {
+    case sig := <- signals:
+      fmt.Printf("Stopping on %s\n", sig)
+      go func() {
+        <-signals
+        fmt.Println("Stopped without flushing")
+        os.Exit(1)
+      }()
+    case err := <- served:
+      fmt.Printf("Error: %s\n", err)
+      code = 1
+  }
+
+  // no new requests, those in progress get the configured time.
+  ctx, cancel := context.WithTimeout(context.Background(), currentConfig().Timing.ShutdownTimeout)
+  defer cancel()
+  if err := server.Shutdown(ctx); err != nil {
+    fmt.Printf("Error: %s\n", err)
+    server.Close()
+    code = 1
+  }
+  // no new datagrams, the queued ones are handled.
+  udpPipeline.Stop()
+  close(stop)
+  background.Wait()
+  if currentConfig().NotifyNodes {
+    notifyShutdown(state)
+  }
+
+  // the changes since the last flush are written before exiting.
+  if err := persister.Flush(state); err != nil {
+    fmt.Printf("Error: %s\n", err)
+    code = 1
+  }
+  fmt.Println("Stopped")
+  return code
 }
 